@@ -0,0 +1,42 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import "encoding/json"
+
+// NodeHostsAnnotation keeps different node hosts of Horreum and Keycloak set in v1beta1,
+// which has one per component. The value is JSON object with keys `app` and `keycloak`.
+const NodeHostsAnnotation = "hyperfoil.io/node-hosts"
+
+// NodeHosts are node hosts used for NodePort services of Horreum and Keycloak
+type NodeHosts struct {
+	App      string `json:"app"`
+	Keycloak string `json:"keycloak"`
+}
+
+// Hub marks this version as the one other versions are converted to and from
+func (*Horreum) Hub() {}
+
+// GetNodeHosts returns node hosts of Horreum and Keycloak, which differ only when set through v1beta1
+func (h *Horreum) GetNodeHosts() NodeHosts {
+	hosts := NodeHosts{App: h.Spec.NodeHost, Keycloak: h.Spec.NodeHost}
+	if value, ok := h.Annotations[NodeHostsAnnotation]; ok {
+		// Invalid value is ignored, falling back to spec.nodeHost
+		_ = json.Unmarshal([]byte(value), &hosts)
+	}
+	return hosts
+}
@@ -22,28 +22,43 @@ import (
 )
 
 // DatabaseSpec defines access info for a database
+// +kubebuilder:validation:XValidation:rule="has(self.name) == has(oldSelf.name) && (!has(self.name) || self.name == oldSelf.name)",message="database name cannot be changed"
 type DatabaseSpec struct {
 	// Hostname for the database
 	Host string `json:"host,omitempty"`
 	// Database port; defaults to 5432
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
 	Port int32 `json:"port,omitempty"`
-	// Name of the database
+	// Name of the database; cannot be changed after creation
+	// +kubebuilder:validation:MaxLength=63
 	Name string `json:"name,omitempty"`
 	// Name of secret resource with data `username` and `password`. Created if does not exist.
 	Secret string `json:"secret,omitempty"`
+	// SSL mode for the connection: 'disable', 'allow', 'prefer', 'require', 'verify-ca' or 'verify-full'.
+	// Defaults to 'verify-full' for the database deployed by this operator; for external
+	// databases the driver default is used unless this is set.
+	// +kubebuilder:validation:Enum=disable;allow;prefer;require;verify-ca;verify-full
+	SSLMode string `json:"sslMode,omitempty"`
+	// Name of secret with key `ca.crt` holding the CA certificate used to verify an external database server.
+	CASecret string `json:"caSecret,omitempty"`
 }
 
 // RouteSpec defines the route for external access.
+// +kubebuilder:validation:XValidation:rule="!has(self.type) || self.type != 'passthrough' || has(self.tls)",message="passthrough route requires tls"
+// +kubebuilder:validation:XValidation:rule="!has(self.type) || self.type != 'http' || !has(self.tls)",message="http route cannot use tls"
 type RouteSpec struct {
 	// Host for the route leading to Controller REST endpoint. Example: horreum.apps.mycloud.example.com
 	Host string `json:"host,omitempty"`
-	// Either 'http' (for plain-text routes - not recommended), 'edge', 'reencrypt' or 'passthrough'
+	// Either 'http' (for plain-text routes - not recommended), 'edge', 'reencrypt' (default) or 'passthrough'
+	// +kubebuilder:validation:Enum=http;edge;reencrypt;passthrough
 	Type string `json:"type,omitempty"`
 	// Optional for edge and reencrypt routes, required for passthrough; Name of the secret hosting `tls.crt`, `tls.key` and optionally `ca.crt`
 	TLS string `json:"tls,omitempty"`
 }
 
 // ExternalSpec defines endpoints for provided component (not deployed by this operator)
+// +kubebuilder:validation:XValidation:rule="!has(self.internalUri) || has(self.publicUri)",message="external Keycloak requires publicUri"
 type ExternalSpec struct {
 	// Public facing URI - Horreum will send this URI to the clients.
 	PublicUri string `json:"publicUri,omitempty"`
@@ -52,6 +67,9 @@ type ExternalSpec struct {
 }
 
 // KeycloakSpec defines Keycloak setup
+// +kubebuilder:validation:XValidation:rule="!has(self.databaseMode) || self.databaseMode == 'shared' || !has(self.database) || !has(self.database.host)",message="database.host can be set only with shared databaseMode"
+// +kubebuilder:validation:XValidation:rule="!has(self.databaseMode) || self.databaseMode != 'embedded' || !has(self.replicas) || self.replicas == 1",message="embedded database cannot be used with multiple replicas"
+// +kubebuilder:validation:XValidation:rule="!has(self.postgres) || !has(self.postgres.readReplicas)",message="read replicas are supported only in spec.postgres"
 type KeycloakSpec struct {
 	// When this is set Keycloak instance will not be deployed and Horreum will use this external instance.
 	External ExternalSpec `json:"external,omitempty"`
@@ -60,15 +78,49 @@ type KeycloakSpec struct {
 	// Route for external access to the Keycloak instance.
 	Route RouteSpec `json:"route,omitempty"`
 	// Alternative service type when routes are not available (e.g. on vanilla K8s)
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
 	ServiceType corev1.ServiceType `json:"serviceType,omitempty"`
 	// Secret used for admin access to the deployed Keycloak instance. Created if does not exist.
 	// Must contain keys `username` and `password`.
 	AdminSecret string `json:"adminSecret,omitempty"`
 	// Database coordinates Keycloak should use
 	Database DatabaseSpec `json:"database,omitempty"`
+	// Number of Keycloak instances; defaults to 1. Instances share sessions through a clustered cache
+	// and with more than one instance a PodDisruptionBudget keeps at least one of them running.
+	// +kubebuilder:validation:Minimum=1
+	Replicas *int32 `json:"replicas,omitempty"`
+	// Where Keycloak stores its data: 'shared' (default) uses `database`, by default on the PostgreSQL
+	// deployed for Horreum, 'dedicated' deploys another PostgreSQL configured in `postgres` and 'embedded'
+	// uses a development database inside the Keycloak container that is lost on restart.
+	DatabaseMode KeycloakDatabaseMode `json:"databaseMode,omitempty"`
+	// PostgreSQL deployed for Keycloak when `databaseMode` is 'dedicated'. Property `enabled` is ignored.
+	Postgres PostgresSpec `json:"postgres,omitempty"`
 }
 
+// KeycloakDatabaseMode selects the database used by Keycloak
+// +kubebuilder:validation:Enum=shared;dedicated;embedded
+type KeycloakDatabaseMode string
+
+const (
+	KeycloakDatabaseShared    KeycloakDatabaseMode = "shared"
+	KeycloakDatabaseDedicated KeycloakDatabaseMode = "dedicated"
+	KeycloakDatabaseEmbedded  KeycloakDatabaseMode = "embedded"
+)
+
+// PostgresPreset selects PostgreSQL settings derived from the memory limit of the container
+// +kubebuilder:validation:Enum=oltp;analytics
+type PostgresPreset string
+
+const (
+	// Many short transactions from concurrent clients
+	PostgresPresetOLTP PostgresPreset = "oltp"
+	// Fewer connections running large queries, e.g. over JSONB documents
+	PostgresPresetAnalytics PostgresPreset = "analytics"
+)
+
 // PostgresSpec defines PostgreSQL database setup
+// +kubebuilder:validation:XValidation:rule="!has(self.preset) || (has(self.resources) && has(self.resources.limits) && 'memory' in self.resources.limits)",message="preset requires resources.limits.memory"
+// +kubebuilder:validation:XValidation:rule="!has(self.backup) || !has(self.backup.enabled) || !self.backup.enabled || has(self.persistentVolumeClaim)",message="backup requires persistentVolumeClaim"
 type PostgresSpec struct {
 	// True (or omitted) to deploy PostgreSQL database
 	Enabled *bool `json:"enabled,omitempty"`
@@ -80,10 +132,257 @@ type PostgresSpec struct {
 	// Name of PVC where the database will store the data. If empty, ephemeral storage will be used.
 	PersistentVolumeClaim string `json:"persistentVolumeClaim,omitempty"`
 	// Id of the user the container should run as
+	// +kubebuilder:validation:Minimum=0
+	User *int64 `json:"user,omitempty"`
+	// Compute resources of the PostgreSQL container
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Settings such as `shared_buffers`, `work_mem`, `max_connections` or `effective_cache_size` sized
+	// from `resources.limits.memory`. Values in `parameters` take precedence.
+	Preset PostgresPreset `json:"preset,omitempty"`
+	// Settings added to postgresql.conf, e.g. `work_mem: 64MB`. SSL settings are managed by the operator.
+	// Changes restart the database.
+	// +kubebuilder:validation:XValidation:rule="self.all(k, k.matches('^[a-zA-Z_][a-zA-Z0-9_.]*$'))",message="parameter names can contain only letters, digits, underscores and dots"
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// Continuous archiving of WAL and periodic base backups, which allow point-in-time recovery
+	// +kubebuilder:validation:XValidation:rule="!has(self.enabled) || !self.enabled || (has(self.storage) && (has(self.storage.persistentVolumeClaim) || has(self.storage.s3)))",message="storage is required when backup is enabled"
+	Backup PostgresBackupSpec `json:"backup,omitempty"`
+	// Initialize the database from backups of another instance. Ignored when the data volume already contains a database.
+	Restore *PostgresRestoreSpec `json:"restore,omitempty"`
+	// Streaming replicas serving read-only queries, e.g. from reporting dashboards
+	ReadReplicas PostgresReadReplicasSpec `json:"readReplicas,omitempty"`
+}
+
+// PostgresReadReplicasSpec deploys streaming replicas of the database behind service `<name>-db-ro`
+type PostgresReadReplicasSpec struct {
+	// Number of replicas; none are deployed by default
+	// +kubebuilder:validation:Minimum=0
+	Replicas int32 `json:"replicas,omitempty"`
+	// Secret with credentials of the read-only role. Created if does not exist. Must contain keys `username`
+	// and `password`. Defaults to `<name>-db-readonly`
+	Secret string `json:"secret,omitempty"`
+	// Compute resources of the replicas; defaults to the resources of the primary
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+}
+
+// S3StorageSpec points to a bucket in S3-compatible object storage
+type S3StorageSpec struct {
+	// Name of the bucket
+	Bucket string `json:"bucket"`
+	// Path within the bucket
+	Prefix string `json:"prefix,omitempty"`
+	// URL of the service for storage other than AWS, e.g. https://minio.example.com:9000
+	Endpoint string `json:"endpoint,omitempty"`
+	// Region of the bucket
+	Region string `json:"region,omitempty"`
+	// Secret with keys `AWS_ACCESS_KEY_ID` and `AWS_SECRET_ACCESS_KEY`
+	CredentialsSecret string `json:"credentialsSecret"`
+}
+
+// BackupStorageSpec defines where WAL segments and base backups are stored
+// +kubebuilder:validation:XValidation:rule="!has(self.persistentVolumeClaim) || !has(self.s3)",message="persistentVolumeClaim and s3 are mutually exclusive"
+type BackupStorageSpec struct {
+	// Name of PVC for the backups, must not be the one with the data
+	PersistentVolumeClaim string `json:"persistentVolumeClaim,omitempty"`
+	// S3-compatible object storage
+	S3 *S3StorageSpec `json:"s3,omitempty"`
+}
+
+// PostgresBackupSpec enables continuous archiving of WAL segments and periodic base backups
+type PostgresBackupSpec struct {
+	// True to archive WAL and take base backups
+	Enabled bool `json:"enabled,omitempty"`
+	// Storage for the backups; each instance uses its own directory
+	Storage BackupStorageSpec `json:"storage,omitempty"`
+	// Cron schedule of the base backups; defaults to '0 2 * * *'
+	Schedule string `json:"schedule,omitempty"`
+	// Number of base backups kept, along with WAL needed to recover after the oldest one; defaults to 7
+	// +kubebuilder:validation:Minimum=1
+	Retention int32 `json:"retention,omitempty"`
+}
+
+// PostgresRestoreSpec initializes an empty database from backups of another instance
+// +kubebuilder:validation:XValidation:rule="has(self.storage.persistentVolumeClaim) || has(self.storage.s3)",message="storage is required"
+type PostgresRestoreSpec struct {
+	// Storage where the other instance archived its backups
+	Storage BackupStorageSpec `json:"storage"`
+	// Name of the Horreum resource that created the backups
+	Source string `json:"source"`
+	// Namespace of the Horreum resource that created the backups; defaults to the namespace of this resource
+	SourceNamespace string `json:"sourceNamespace,omitempty"`
+	// Recover to this moment; the latest archived state is recovered when omitted
+	TargetTime *metav1.Time `json:"targetTime,omitempty"`
+}
+
+// PgBouncerPoolMode defines when PgBouncer returns a server connection to the pool
+// +kubebuilder:validation:Enum=session;transaction;statement
+type PgBouncerPoolMode string
+
+const (
+	// Server connection is assigned to the client until it disconnects
+	PgBouncerPoolModeSession PgBouncerPoolMode = "session"
+	// Server connection is assigned to the client for the duration of a transaction
+	PgBouncerPoolModeTransaction PgBouncerPoolMode = "transaction"
+	// Server connection is returned after each statement; multi-statement transactions are not allowed
+	PgBouncerPoolModeStatement PgBouncerPoolMode = "statement"
+)
+
+// PgBouncerSpec defines connection pooler between Horreum, Keycloak and PostgreSQL
+// +kubebuilder:validation:XValidation:rule="!has(self.minPoolSize) || self.minPoolSize <= (has(self.defaultPoolSize) ? self.defaultPoolSize : 20)",message="minPoolSize must not exceed defaultPoolSize"
+type PgBouncerSpec struct {
+	// True to route database connections of Horreum and Keycloak through PgBouncer
+	Enabled bool `json:"enabled,omitempty"`
+	// PgBouncer image, version 1.21 or newer. Defaults to docker.io/edoburu/pgbouncer:v1.23.1-p2 or the image configured in the operator
+	Image string `json:"image,omitempty"`
+	// Number of PgBouncer instances; defaults to 1
+	// +kubebuilder:validation:Minimum=1
+	Replicas *int32 `json:"replicas,omitempty"`
+	// Id of the user the container should run as; defaults to 70
+	// +kubebuilder:validation:Minimum=1
 	User *int64 `json:"user,omitempty"`
+	// When a server connection returns to the pool; defaults to 'transaction'
+	PoolMode PgBouncerPoolMode `json:"poolMode,omitempty"`
+	// Server connections per database and user in each instance; defaults to 20
+	// +kubebuilder:validation:Minimum=1
+	DefaultPoolSize int32 `json:"defaultPoolSize,omitempty"`
+	// Server connections kept open even when the clients are idle
+	// +kubebuilder:validation:Minimum=0
+	MinPoolSize int32 `json:"minPoolSize,omitempty"`
+	// Additional server connections allowed when clients wait for more than 5 seconds
+	// +kubebuilder:validation:Minimum=0
+	ReservePoolSize int32 `json:"reservePoolSize,omitempty"`
+	// Client connections accepted by each instance; defaults to 1000
+	// +kubebuilder:validation:Minimum=1
+	MaxClientConnections int32 `json:"maxClientConnections,omitempty"`
+	// Compute resources of the PgBouncer container
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+}
+
+// CharacterClass is a set of characters passwords are composed of
+// +kubebuilder:validation:Enum=lowercase;uppercase;digits;symbols
+type CharacterClass string
+
+const (
+	CharacterClassLowercase CharacterClass = "lowercase"
+	CharacterClassUppercase CharacterClass = "uppercase"
+	CharacterClassDigits    CharacterClass = "digits"
+	CharacterClassSymbols   CharacterClass = "symbols"
+)
+
+// PasswordPolicy defines how the operator generates passwords
+type PasswordPolicy struct {
+	// Number of characters; defaults to 32
+	// +kubebuilder:validation:Minimum=8
+	Length int32 `json:"length,omitempty"`
+	// Character classes used in the password, each of them at least once.
+	// Defaults to lowercase, uppercase and digits.
+	CharacterClasses []CharacterClass `json:"characterClasses,omitempty"`
+}
+
+// CredentialSource defines where the secret with credentials comes from
+// +kubebuilder:validation:Enum=generated;externalSecret;csi
+type CredentialSource string
+
+const (
+	// Secret is provided by the user or generated by the operator when it does not exist
+	CredentialSourceGenerated CredentialSource = "generated"
+	// Secret is synced by External Secrets Operator from an ExternalSecret created by this operator
+	CredentialSourceExternalSecret CredentialSource = "externalSecret"
+	// Secret is synced by Secrets Store CSI driver from a SecretProviderClass
+	CredentialSourceCSI CredentialSource = "csi"
+)
+
+// ExternalSecretSpec defines the ExternalSecret the operator creates for a credential
+type ExternalSecretSpec struct {
+	// Name of the SecretStore or ClusterSecretStore
+	StoreName string `json:"storeName"`
+	// Either 'SecretStore' (default) or 'ClusterSecretStore'
+	// +kubebuilder:validation:Enum=SecretStore;ClusterSecretStore
+	StoreKind string `json:"storeKind,omitempty"`
+	// Key of the secret in the external store
+	RemoteKey string `json:"remoteKey"`
+	// Property of the remote secret holding the username; defaults to 'username'
+	UsernameProperty string `json:"usernameProperty,omitempty"`
+	// Property of the remote secret holding the password; defaults to 'password'
+	PasswordProperty string `json:"passwordProperty,omitempty"`
+	// Property of the remote secret holding the `dbsecret` key (only for the app credential); defaults to 'dbsecret'
+	DbSecretProperty string `json:"dbSecretProperty,omitempty"`
+	// How often the secret is refreshed; defaults to 1h
+	RefreshInterval string `json:"refreshInterval,omitempty"`
+}
+
+// CSISecretSpec references a SecretProviderClass that syncs the credential into a secret
+type CSISecretSpec struct {
+	// Name of the SecretProviderClass; its `secretObjects` must create the secret with name
+	// expected by the operator, with keys `username` and `password` (and `dbsecret` for the app credential)
+	SecretProviderClass string `json:"secretProviderClass"`
+}
+
+// CredentialSpec configures a secret generated by the operator
+// +kubebuilder:validation:XValidation:rule="!has(self.source) || self.source != 'externalSecret' || has(self.externalSecret)",message="source externalSecret requires externalSecret"
+// +kubebuilder:validation:XValidation:rule="!has(self.source) || self.source != 'csi' || has(self.csi)",message="source csi requires csi"
+type CredentialSpec struct {
+	// Overrides the default password policy for this secret
+	PasswordPolicy *PasswordPolicy `json:"passwordPolicy,omitempty"`
+	// Where the secret comes from; defaults to 'generated'
+	Source CredentialSource `json:"source,omitempty"`
+	// ExternalSecret used when source is 'externalSecret'
+	ExternalSecret *ExternalSecretSpec `json:"externalSecret,omitempty"`
+	// Secrets Store CSI volume used when source is 'csi'
+	CSI *CSISecretSpec `json:"csi,omitempty"`
+}
+
+// CredentialsSpec configures secrets generated by the operator. Secrets provided by the user are not affected.
+type CredentialsSpec struct {
+	// Default policy for generated passwords
+	PasswordPolicy PasswordPolicy `json:"passwordPolicy,omitempty"`
+	// PostgreSQL admin, see spec.postgres.adminSecret
+	DbAdmin CredentialSpec `json:"dbAdmin,omitempty"`
+	// Horreum database user, see spec.database.secret
+	App CredentialSpec `json:"app,omitempty"`
+	// Keycloak database user, see spec.keycloak.database.secret
+	KeycloakDb CredentialSpec `json:"keycloakDb,omitempty"`
+	// Read-only database user, see spec.postgres.readReplicas.secret
+	DbReadOnly CredentialSpec `json:"dbReadOnly,omitempty"`
+	// Role the read replicas use to stream WAL from the primary; generated secret is <name>-db-replication
+	DbReplication CredentialSpec `json:"dbReplication,omitempty"`
+	// Admin of the PostgreSQL dedicated to Keycloak, see spec.keycloak.postgres.adminSecret
+	KeycloakDbAdmin CredentialSpec `json:"keycloakDbAdmin,omitempty"`
+	// Keycloak admin, see spec.keycloak.adminSecret
+	KeycloakAdmin CredentialSpec `json:"keycloakAdmin,omitempty"`
+	// Horreum admin, see spec.adminSecret
+	HorreumAdmin CredentialSpec `json:"horreumAdmin,omitempty"`
+	// Service account for the pod mounting Secrets Store CSI volumes; defaults to 'default'
+	CSIServiceAccount string `json:"csiServiceAccount,omitempty"`
+}
+
+// NetworkPolicySpec configures NetworkPolicies isolating pods deployed by the operator
+type NetworkPolicySpec struct {
+	// True to create NetworkPolicies for Horreum, Keycloak and PostgreSQL pods
+	// When neither `ingressNamespaceSelector`, `allowedNamespaces` nor `allowedCIDRs` is set and routes are not
+	// available, Horreum does not accept any incoming connections.
+	Enabled bool `json:"enabled,omitempty"`
+	// Namespaces allowed to access Horreum and Keycloak, e.g. namespaces where Hyperfoil agents run
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+	// Selector of namespaces hosting ingress controllers. Defaults to OpenShift router namespaces
+	// when routes are available.
+	IngressNamespaceSelector *metav1.LabelSelector `json:"ingressNamespaceSelector,omitempty"`
+	// Address ranges of clients allowed to access Horreum and Keycloak through NodePort or LoadBalancer services
+	AllowedCIDRs []string `json:"allowedCIDRs,omitempty"`
+	// Address ranges of external database servers; any address when not set. Used only when
+	// `spec.database.host` or `spec.keycloak.database.host` is set.
+	DatabaseCIDRs []string `json:"databaseCIDRs,omitempty"`
+	// Address ranges of external Keycloak; any address when not set. Used only when
+	// `spec.keycloak.external.publicUri` is set.
+	KeycloakCIDRs []string `json:"keycloakCIDRs,omitempty"`
+	// Address ranges Horreum may connect to besides Keycloak and the database, e.g. for actions or datastores
+	AppEgressCIDRs []string `json:"appEgressCIDRs,omitempty"`
 }
 
 // HorreumSpec defines the desired state of Horreum
+// +kubebuilder:validation:XValidation:rule="!has(self.cloneFrom) || has(oldSelf.cloneFrom) && self.cloneFrom == oldSelf.cloneFrom",message="cloneFrom can be set only when the resource is created"
+// +kubebuilder:validation:XValidation:rule="!has(self.cloneFrom) || (!has(self.database) || !has(self.database.host)) && (!has(self.postgres) || (!has(self.postgres.enabled) || self.postgres.enabled) && !has(self.postgres.restore))",message="cloneFrom requires PostgreSQL deployed by the operator without restore"
+// +kubebuilder:validation:XValidation:rule="!has(self.cloneFrom) || !has(self.keycloak) || !has(self.keycloak.external) || !has(self.keycloak.external.publicUri)",message="cloneFrom requires Keycloak deployed by the operator"
+// +kubebuilder:validation:XValidation:rule="!has(self.scrubNotifications) || !self.scrubNotifications || has(self.cloneFrom)",message="scrubNotifications requires cloneFrom"
 type HorreumSpec struct {
 	// Name of secret resource with data `username` and `password`. This will be the first user
 	// that get's created in Horreum with the `admin` role, therefore it can create other users and teams.
@@ -92,9 +391,12 @@ type HorreumSpec struct {
 	// Route for external access
 	Route RouteSpec `json:"route,omitempty"`
 	// Alternative service type when routes are not available (e.g. on vanilla K8s)
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
 	ServiceType corev1.ServiceType `json:"serviceType,omitempty"`
-	// Horreum image. Defaults to quay.io/hyperfoil/horreum:latest
+	// Horreum image. Defaults to quay.io/hyperfoil/horreum:latest or the image configured in the operator
 	Image string `json:"image,omitempty"`
+	// Secrets used to pull images of all pods created by the operator, e.g. from a mirror registry
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
 	// Database coordinates for Horreum data. Besides `username` and `password` the secret must
 	// also contain key `dbsecret` that will be used to sign access to the database.
 	Database DatabaseSpec `json:"database,omitempty"`
@@ -102,8 +404,25 @@ type HorreumSpec struct {
 	Keycloak KeycloakSpec `json:"keycloak,omitempty"`
 	// PostgreSQL specification
 	Postgres PostgresSpec `json:"postgres,omitempty"`
+	// Connection pooling between Horreum, Keycloak and the database
+	PgBouncer PgBouncerSpec `json:"pgbouncer,omitempty"`
 	// Host used for NodePort services
 	NodeHost string `json:"nodeHost,omitempty"`
+	// Setting this to a different timestamp (e.g. current time) regenerates passwords in secrets
+	// created by the operator. Database roles, Keycloak admin and Horreum admin are updated
+	// and Horreum and Keycloak are restarted. Secrets provided by the user are not touched.
+	RotateCredentials *metav1.Time `json:"rotateCredentials,omitempty"`
+	// Generation of credentials
+	Credentials CredentialsSpec `json:"credentials,omitempty"`
+	// Network isolation of the deployed pods
+	NetworkPolicy NetworkPolicySpec `json:"networkPolicy,omitempty"`
+	// Name of another Horreum resource in the same namespace. Its Horreum database is copied into the PostgreSQL
+	// deployed for this instance before Horreum starts, e.g. to test an upgrade on production data. Keycloak is
+	// not copied: this instance gets its own realm and clients for its own URLs.
+	CloneFrom string `json:"cloneFrom,omitempty"`
+	// Delete notification settings and actions (webhooks, Slack and GitHub integrations) from the cloned
+	// database, so that the clone does not notify anybody on behalf of the source
+	ScrubNotifications bool `json:"scrubNotifications,omitempty"`
 }
 
 // HorreumStatus defines the observed state of Horreum
@@ -118,11 +437,143 @@ type HorreumStatus struct {
 	PublicUrl string `json:"publicUrl,omitempty"`
 	// Public URL of Keycloak
 	KeycloakUrl string `json:"keycloakUrl,omitempty"`
+	// Source of each credential
+	Credentials []CredentialStatus `json:"credentials,omitempty"`
+	// Secrets created by the operator with passwords that do not match current password policy
+	// or were generated by older versions of the operator; rotate credentials to replace them.
+	WeakSecrets []string `json:"weakSecrets,omitempty"`
+	// Last completed rotation of credentials.
+	CredentialsRotation *CredentialsRotationStatus `json:"credentialsRotation,omitempty"`
+	// Data directory of the PostgreSQL deployed by the operator.
+	Postgres *PostgresStatus `json:"postgres,omitempty"`
+	// Data directory of the PostgreSQL dedicated to Keycloak.
+	KeycloakPostgres *PostgresStatus `json:"keycloakPostgres,omitempty"`
+	// Progress of copying the database from spec.cloneFrom
+	Clone *CloneStatus `json:"clone,omitempty"`
+	// Detailed conditions of the deployment.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// CredentialStatus reports where a credential comes from
+type CredentialStatus struct {
+	// Credential name as in spec.credentials
+	Name string `json:"name"`
+	// Name of the secret
+	Secret string `json:"secret"`
+	// Either 'generated', 'provided' (secret created by the user), 'externalSecret' or 'csi'
+	Source string `json:"source"`
+	// True when the secret exists and contains all required keys
+	Ready bool `json:"ready"`
+}
+
+// CredentialsRotationStatus records the last rotation of generated credentials
+type CredentialsRotationStatus struct {
+	// Value of spec.rotateCredentials that triggered the rotation
+	Requested metav1.Time `json:"requested"`
+	// Time when the rotation completed
+	Completed metav1.Time `json:"completed"`
+	// Secrets that got new passwords
+	Secrets []string `json:"secrets,omitempty"`
 }
 
+// PostgresStatus tracks the major version of the data directory and volumes used by major version upgrades
+type PostgresStatus struct {
+	// Major version of PostgreSQL the data directory belongs to
+	Version string `json:"version,omitempty"`
+	// Image the server last ran with; used to dump the data when upgrading to another major version
+	Image string `json:"image,omitempty"`
+	// Claim holding the data directory when an upgrade moved the data out of `requestedPersistentVolumeClaim`
+	PersistentVolumeClaim string `json:"persistentVolumeClaim,omitempty"`
+	// Value of `persistentVolumeClaim` in spec at the time of the upgrade; when the spec changes
+	// the claim from spec is used again
+	RequestedPersistentVolumeClaim string `json:"requestedPersistentVolumeClaim,omitempty"`
+	// Major version before the last upgrade
+	PreviousVersion string `json:"previousVersion,omitempty"`
+	// Claim with the data directory of the previous major version, kept for rollback
+	PreviousPersistentVolumeClaim string `json:"previousPersistentVolumeClaim,omitempty"`
+	// Progress of the last major version upgrade
+	Upgrade *PostgresUpgradeStatus `json:"upgrade,omitempty"`
+	// Replication state of the read replicas
+	ReadReplicas []PostgresReplicaStatus `json:"readReplicas,omitempty"`
+}
+
+// PostgresReplicaStatus reports how far a read replica is behind the primary
+type PostgresReplicaStatus struct {
+	// Name of the replica pod
+	Name string `json:"name"`
+	// State of the replication as reported by the primary, e.g. 'streaming'; empty when the replica is not connected
+	State string `json:"state,omitempty"`
+	// Amount of WAL generated by the primary and not replayed by the replica yet
+	LagBytes int64 `json:"lagBytes"`
+	// Time between committing a transaction on the primary and replaying it on the replica; empty when the primary is idle
+	ReplayLag *metav1.Duration `json:"replayLag,omitempty"`
+}
+
+// PostgresUpgradeStatus reports progress of a major version upgrade
+type PostgresUpgradeStatus struct {
+	// Dumping, Restoring, Succeeded or Failed
+	Phase string `json:"phase"`
+	// Major version the data is upgraded from
+	From string `json:"from"`
+	// Major version the data is upgraded to
+	To string `json:"to"`
+	// Claim receiving the upgraded data
+	PersistentVolumeClaim string `json:"persistentVolumeClaim"`
+	// Details of the current phase or the failure
+	Message string `json:"message,omitempty"`
+	// Time when the upgrade started
+	Started metav1.Time `json:"started"`
+	// Time when the upgrade succeeded or failed
+	Completed *metav1.Time `json:"completed,omitempty"`
+}
+
+// CloneStatus reports progress of copying the database of another instance
+type CloneStatus struct {
+	// Name of the source Horreum resource
+	Source string `json:"source"`
+	// Waiting, Copying, Succeeded or Failed
+	Phase string `json:"phase"`
+	// Details of the current phase or the failure
+	Message string `json:"message,omitempty"`
+	// Time when the clone was requested
+	Started metav1.Time `json:"started"`
+	// Time when the copy succeeded or failed
+	Completed *metav1.Time `json:"completed,omitempty"`
+}
+
+// Phases of cloning
+const (
+	// The source instance or its database is not ready yet
+	CloneWaiting = "Waiting"
+	// A job copies the database; Horreum does not start until it completes
+	CloneCopying   = "Copying"
+	CloneSucceeded = "Succeeded"
+	CloneFailed    = "Failed"
+)
+
+const (
+	// ConditionDatabaseProvisioned is true when databases, roles and extensions required
+	// by Horreum and Keycloak are present.
+	ConditionDatabaseProvisioned = "DatabaseProvisioned"
+)
+
+// Phases of PostgreSQL major version upgrade
+const (
+	// The previous server is stopped and a job dumps its data into the new volume
+	PostgresUpgradeDumping = "Dumping"
+	// The new server loads the dump on its first start
+	PostgresUpgradeRestoring = "Restoring"
+	PostgresUpgradeSucceeded = "Succeeded"
+	PostgresUpgradeFailed    = "Failed"
+)
+
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 // Horreum is the object configuring Horreum performance results repository
+// +kubebuilder:storageversion
 // +kubebuilder:subresource:status
 // +kubebuilder:resource:path=horreums,scope=Namespaced
 // +kubebuilder:categories=all,hyperfoil
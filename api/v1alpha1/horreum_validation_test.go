@@ -0,0 +1,187 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/validation"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+)
+
+// crdValidator checks objects against the generated CRD the same way the API server does
+type crdValidator struct {
+	validation *apiextensions.CustomResourceValidation
+	structural *schema.Structural
+}
+
+func loadCRDValidator(t *testing.T, version string) *crdValidator {
+	data, err := os.ReadFile("../../config/crd/bases/hyperfoil.io_horreums.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	if err := yaml.Unmarshal(data, crd); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range crd.Spec.Versions {
+		if v.Name != version {
+			continue
+		}
+		props := &apiextensions.JSONSchemaProps{}
+		if err := apiextensionsv1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(v.Schema.OpenAPIV3Schema, props, nil); err != nil {
+			t.Fatal(err)
+		}
+		structural, err := schema.NewStructural(props)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &crdValidator{
+			validation: &apiextensions.CustomResourceValidation{OpenAPIV3Schema: props},
+			structural: structural,
+		}
+	}
+	t.Fatalf("CRD does not define version %s", version)
+	return nil
+}
+
+func (v *crdValidator) validate(t *testing.T, spec string, oldSpec string) field.ErrorList {
+	obj := parseObject(t, spec)
+	schemaValidator, _, err := validation.NewSchemaValidator(v.validation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := validation.ValidateCustomResource(nil, obj, schemaValidator)
+	var oldObj interface{}
+	if oldSpec != "" {
+		oldObj = parseObject(t, oldSpec)
+	}
+	celErrs, _ := cel.NewValidator(v.structural, true, cel.PerCallLimit).
+		Validate(context.Background(), nil, v.structural, obj, oldObj, cel.RuntimeCELCostBudget)
+	return append(errs, celErrs...)
+}
+
+// parseObject decodes integers as int64 like the API server does, CEL rules would not compare them with floats
+func parseObject(t *testing.T, spec string) map[string]interface{} {
+	data, err := yaml.YAMLToJSON([]byte(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := map[string]interface{}{}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	return map[string]interface{}{"spec": parsed}
+}
+
+type validationCase struct {
+	name    string
+	spec    string
+	oldSpec string
+	valid   bool
+}
+
+func runValidationCases(t *testing.T, version string, cases []validationCase) {
+	v := loadCRDValidator(t, version)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			errs := v.validate(t, c.spec, c.oldSpec)
+			if c.valid && len(errs) > 0 {
+				t.Errorf("unexpected errors: %v", errs)
+			} else if !c.valid && len(errs) == 0 {
+				t.Error("expected validation error")
+			}
+		})
+	}
+}
+
+var commonValidationCases = []validationCase{
+	{name: "empty", spec: "{}", valid: true},
+	{name: "port", spec: "database: {port: 5432}", valid: true},
+	{name: "port out of range", spec: "database: {port: 70000}", valid: false},
+	{name: "ssl mode", spec: "database: {sslMode: verify-ca}", valid: true},
+	{name: "invalid ssl mode", spec: "database: {sslMode: strict}", valid: false},
+	{name: "long database name", spec: "database: {name: " + strings.Repeat("a", 64) + "}", valid: false},
+	{name: "external keycloak", spec: "keycloak: {external: {publicUri: 'https://kc', internalUri: 'http://kc'}}", valid: true},
+	{name: "external keycloak without public uri", spec: "keycloak: {external: {internalUri: 'http://kc'}}", valid: false},
+	{name: "csi", spec: "credentials: {app: {source: csi, csi: {secretProviderClass: vault}}}", valid: true},
+	{name: "csi without class", spec: "credentials: {app: {source: csi}}", valid: false},
+	{name: "external secret without store", spec: "credentials: {keycloakDb: {source: externalSecret}}", valid: false},
+	{name: "negative user", spec: "postgres: {user: -1}", valid: false},
+	{name: "postgres parameters", spec: "postgres: {parameters: {work_mem: 64MB, max_connections: '300'}}", valid: true},
+	{name: "invalid parameter name", spec: "postgres: {parameters: {'work_mem = 1': 64MB}}", valid: false},
+	{name: "preset", spec: "postgres: {preset: oltp, resources: {limits: {memory: 4Gi}}}", valid: true},
+	{name: "preset without memory limit", spec: "postgres: {preset: analytics, resources: {requests: {memory: 4Gi}}}", valid: false},
+	{name: "dedicated keycloak database", spec: "keycloak: {databaseMode: dedicated, postgres: {persistentVolumeClaim: keycloak-db}}", valid: true},
+	{name: "invalid keycloak database mode", spec: "keycloak: {databaseMode: h2}", valid: false},
+	{name: "dedicated keycloak database with host", spec: "keycloak: {databaseMode: dedicated, database: {host: db}}", valid: false},
+	{name: "embedded keycloak database with replicas", spec: "keycloak: {databaseMode: embedded, replicas: 2}", valid: false},
+	{name: "pgbouncer", spec: "pgbouncer: {enabled: true, poolMode: session, defaultPoolSize: 30, minPoolSize: 10}", valid: true},
+	{name: "invalid pool mode", spec: "pgbouncer: {enabled: true, poolMode: statements}", valid: false},
+	{name: "min pool size above default", spec: "pgbouncer: {minPoolSize: 25}", valid: false},
+	{name: "backup", spec: "postgres: {persistentVolumeClaim: db, backup: {enabled: true, storage: {s3: {bucket: b, credentialsSecret: s3}}, retention: 3}}", valid: true},
+	{name: "backup without storage", spec: "postgres: {persistentVolumeClaim: db, backup: {enabled: true}}", valid: false},
+	{name: "backup without data volume", spec: "postgres: {backup: {enabled: true, storage: {persistentVolumeClaim: backup}}}", valid: false},
+	{name: "backup to two storages", spec: "postgres: {persistentVolumeClaim: db, backup: {enabled: true, storage: {persistentVolumeClaim: backup, s3: {bucket: b, credentialsSecret: s3}}}}", valid: false},
+	{name: "disabled backup", spec: "postgres: {backup: {schedule: '0 3 * * *'}}", valid: true},
+	{name: "restore", spec: "postgres: {restore: {source: horreum, storage: {persistentVolumeClaim: backup}, targetTime: '2024-05-01T10:00:00Z'}}", valid: true},
+	{name: "restore without storage", spec: "postgres: {restore: {source: horreum, storage: {}}}", valid: false},
+	{name: "read replicas", spec: "postgres: {readReplicas: {replicas: 2, secret: reporting}}", valid: true},
+	{name: "negative read replicas", spec: "postgres: {readReplicas: {replicas: -1}}", valid: false},
+	{name: "clone", spec: "cloneFrom: prod\nscrubNotifications: true", valid: true},
+	{name: "clone with external database", spec: "cloneFrom: prod\ndatabase: {host: db}", valid: false},
+	{name: "clone with restore", spec: "cloneFrom: prod\npostgres: {restore: {source: horreum, storage: {persistentVolumeClaim: backup}}}", valid: false},
+	{name: "clone with external keycloak", spec: "cloneFrom: prod\nkeycloak: {external: {publicUri: 'https://kc'}}", valid: false},
+	{name: "scrub without clone", spec: "scrubNotifications: true", valid: false},
+	{name: "added clone", spec: "cloneFrom: prod", oldSpec: "{}", valid: false},
+	{name: "removed clone", spec: "{}", oldSpec: "cloneFrom: prod", valid: true},
+	{name: "keycloak read replicas", spec: "keycloak: {databaseMode: dedicated, postgres: {readReplicas: {replicas: 1}}}", valid: false},
+	{name: "same database name", spec: "database: {name: horreum, port: 5433}", oldSpec: "database: {name: horreum}", valid: true},
+	{name: "changed database name", spec: "database: {name: other}", oldSpec: "database: {name: horreum}", valid: false},
+	{name: "added database name", spec: "keycloak: {database: {name: other}}", oldSpec: "keycloak: {database: {host: db}}", valid: false},
+	{name: "removed database name", spec: "database: {}", oldSpec: "database: {name: horreum}", valid: false},
+}
+
+func TestCRDValidation(t *testing.T) {
+	runValidationCases(t, "v1alpha1", append(commonValidationCases, []validationCase{
+		{name: "route", spec: "route: {type: edge, host: horreum.example.com}", valid: true},
+		{name: "invalid route type", spec: "route: {type: secure}", valid: false},
+		{name: "passthrough", spec: "keycloak: {route: {type: passthrough, tls: keycloak-tls}}", valid: true},
+		{name: "passthrough without tls", spec: "keycloak: {route: {type: passthrough}}", valid: false},
+		{name: "http with tls", spec: "route: {type: http, tls: horreum-tls}", valid: false},
+		{name: "service type", spec: "serviceType: NodePort", valid: true},
+		{name: "invalid service type", spec: "keycloak: {serviceType: ExternalName}", valid: false},
+	}...))
+}
+
+func TestCRDValidationV1beta1(t *testing.T) {
+	runValidationCases(t, "v1beta1", append(commonValidationCases, []validationCase{
+		{name: "exposure", spec: "exposure: {type: ClusterIP, termination: edge}", valid: true},
+		{name: "invalid exposure type", spec: "exposure: {type: ExternalName}", valid: false},
+		{name: "passthrough without tls", spec: "keycloak: {exposure: {termination: passthrough}}", valid: false},
+		{name: "http with tls", spec: "exposure: {termination: http, tlsSecret: horreum-tls}", valid: false},
+	}...))
+}
@@ -0,0 +1,409 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+)
+
+// ConvertTo converts this Horreum to the hub version (v1alpha1)
+func (src *Horreum) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1alpha1.Horreum)
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	spec := &src.Spec
+	dst.Spec = v1alpha1.HorreumSpec{
+		AdminSecret:      spec.AdminSecret,
+		Route:            routeToHub(spec.Exposure),
+		ServiceType:      serviceTypeToHub(spec.Exposure),
+		Image:            spec.Image,
+		ImagePullSecrets: spec.ImagePullSecrets,
+		Database:         databaseToHub(spec.Database),
+		Keycloak: v1alpha1.KeycloakSpec{
+			External:     v1alpha1.ExternalSpec(spec.Keycloak.External),
+			Image:        spec.Keycloak.Image,
+			Route:        routeToHub(spec.Keycloak.Exposure),
+			ServiceType:  serviceTypeToHub(spec.Keycloak.Exposure),
+			AdminSecret:  spec.Keycloak.AdminSecret,
+			Database:     databaseToHub(spec.Keycloak.Database),
+			Replicas:     spec.Keycloak.Replicas,
+			DatabaseMode: v1alpha1.KeycloakDatabaseMode(spec.Keycloak.DatabaseMode),
+			Postgres:     postgresToHub(spec.Keycloak.Postgres),
+		},
+		Postgres:           postgresToHub(spec.Postgres),
+		PgBouncer:          pgBouncerToHub(spec.PgBouncer),
+		NodeHost:           spec.Exposure.NodeHost,
+		RotateCredentials:  spec.RotateCredentials,
+		Credentials:        credentialsToHub(spec.Credentials),
+		NetworkPolicy:      v1alpha1.NetworkPolicySpec(spec.NetworkPolicy),
+		CloneFrom:          spec.CloneFrom,
+		ScrubNotifications: spec.ScrubNotifications,
+	}
+	// v1alpha1 has single node host; the app one is preferred as the Keycloak one used to be the same
+	if dst.Spec.NodeHost == "" {
+		dst.Spec.NodeHost = spec.Keycloak.Exposure.NodeHost
+	}
+	if spec.Exposure.NodeHost != spec.Keycloak.Exposure.NodeHost {
+		value, err := json.Marshal(v1alpha1.NodeHosts{App: spec.Exposure.NodeHost, Keycloak: spec.Keycloak.Exposure.NodeHost})
+		if err != nil {
+			return err
+		}
+		if dst.Annotations == nil {
+			dst.Annotations = map[string]string{}
+		}
+		dst.Annotations[v1alpha1.NodeHostsAnnotation] = string(value)
+	} else {
+		delete(dst.Annotations, v1alpha1.NodeHostsAnnotation)
+	}
+
+	status := &src.Status
+	dst.Status = v1alpha1.HorreumStatus{
+		Status:              string(status.Status),
+		LastUpdate:          status.LastUpdate,
+		Reason:              status.Reason,
+		PublicUrl:           status.PublicUrl,
+		KeycloakUrl:         status.KeycloakUrl,
+		WeakSecrets:         status.WeakSecrets,
+		CredentialsRotation: (*v1alpha1.CredentialsRotationStatus)(status.CredentialsRotation),
+		Postgres:            postgresStatusToHub(status.Postgres),
+		KeycloakPostgres:    postgresStatusToHub(status.KeycloakPostgres),
+		Clone:               (*v1alpha1.CloneStatus)(status.Clone),
+		Conditions:          status.Conditions,
+	}
+	for _, c := range status.Credentials {
+		dst.Status.Credentials = append(dst.Status.Credentials, v1alpha1.CredentialStatus(c))
+	}
+	return nil
+}
+
+// ConvertFrom converts from the hub version (v1alpha1) to this version
+func (dst *Horreum) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1alpha1.Horreum)
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	delete(dst.Annotations, v1alpha1.NodeHostsAnnotation)
+	nodeHosts := src.GetNodeHosts()
+	spec := &src.Spec
+	dst.Spec = HorreumSpec{
+		AdminSecret:      spec.AdminSecret,
+		Exposure:         exposureFromHub(spec.Route, spec.ServiceType, nodeHosts.App),
+		Image:            spec.Image,
+		ImagePullSecrets: spec.ImagePullSecrets,
+		Database:         databaseFromHub(spec.Database),
+		Keycloak: KeycloakSpec{
+			External:     ExternalSpec(spec.Keycloak.External),
+			Image:        spec.Keycloak.Image,
+			Exposure:     exposureFromHub(spec.Keycloak.Route, spec.Keycloak.ServiceType, nodeHosts.Keycloak),
+			AdminSecret:  spec.Keycloak.AdminSecret,
+			Database:     databaseFromHub(spec.Keycloak.Database),
+			Replicas:     spec.Keycloak.Replicas,
+			DatabaseMode: KeycloakDatabaseMode(spec.Keycloak.DatabaseMode),
+			Postgres:     postgresFromHub(spec.Keycloak.Postgres),
+		},
+		Postgres:           postgresFromHub(spec.Postgres),
+		PgBouncer:          pgBouncerFromHub(spec.PgBouncer),
+		RotateCredentials:  spec.RotateCredentials,
+		Credentials:        credentialsFromHub(spec.Credentials),
+		NetworkPolicy:      NetworkPolicySpec(spec.NetworkPolicy),
+		CloneFrom:          spec.CloneFrom,
+		ScrubNotifications: spec.ScrubNotifications,
+	}
+
+	status := &src.Status
+	dst.Status = HorreumStatus{
+		Status:              Phase(status.Status),
+		LastUpdate:          status.LastUpdate,
+		Reason:              status.Reason,
+		PublicUrl:           status.PublicUrl,
+		KeycloakUrl:         status.KeycloakUrl,
+		WeakSecrets:         status.WeakSecrets,
+		CredentialsRotation: (*CredentialsRotationStatus)(status.CredentialsRotation),
+		Postgres:            postgresStatusFromHub(status.Postgres),
+		KeycloakPostgres:    postgresStatusFromHub(status.KeycloakPostgres),
+		Clone:               (*CloneStatus)(status.Clone),
+		Conditions:          status.Conditions,
+	}
+	for _, c := range status.Credentials {
+		dst.Status.Credentials = append(dst.Status.Credentials, CredentialStatus(c))
+	}
+	return nil
+}
+
+func routeToHub(exposure ExposureSpec) v1alpha1.RouteSpec {
+	return v1alpha1.RouteSpec{
+		Host: exposure.Host,
+		Type: string(exposure.Termination),
+		TLS:  exposure.TLSSecret,
+	}
+}
+
+func serviceTypeToHub(exposure ExposureSpec) corev1.ServiceType {
+	return corev1.ServiceType(exposure.Type)
+}
+
+func exposureFromHub(route v1alpha1.RouteSpec, serviceType corev1.ServiceType, nodeHost string) ExposureSpec {
+	return ExposureSpec{
+		Type:        ExposureType(serviceType),
+		Host:        route.Host,
+		Termination: RouteTermination(route.Type),
+		TLSSecret:   route.TLS,
+		NodeHost:    nodeHost,
+	}
+}
+
+func databaseToHub(db DatabaseSpec) v1alpha1.DatabaseSpec {
+	return v1alpha1.DatabaseSpec{
+		Host:     db.Host,
+		Port:     db.Port,
+		Name:     db.Name,
+		Secret:   db.Secret,
+		SSLMode:  string(db.SSLMode),
+		CASecret: db.CASecret,
+	}
+}
+
+func databaseFromHub(db v1alpha1.DatabaseSpec) DatabaseSpec {
+	return DatabaseSpec{
+		Host:     db.Host,
+		Port:     db.Port,
+		Name:     db.Name,
+		Secret:   db.Secret,
+		SSLMode:  SSLMode(db.SSLMode),
+		CASecret: db.CASecret,
+	}
+}
+
+func postgresToHub(p PostgresSpec) v1alpha1.PostgresSpec {
+	return v1alpha1.PostgresSpec{
+		Enabled:               p.Enabled,
+		Image:                 p.Image,
+		AdminSecret:           p.AdminSecret,
+		PersistentVolumeClaim: p.PersistentVolumeClaim,
+		User:                  p.User,
+		Resources:             p.Resources,
+		Preset:                v1alpha1.PostgresPreset(p.Preset),
+		Parameters:            p.Parameters,
+		Backup: v1alpha1.PostgresBackupSpec{
+			Enabled:   p.Backup.Enabled,
+			Storage:   backupStorageToHub(p.Backup.Storage),
+			Schedule:  p.Backup.Schedule,
+			Retention: p.Backup.Retention,
+		},
+		Restore:      postgresRestoreToHub(p.Restore),
+		ReadReplicas: v1alpha1.PostgresReadReplicasSpec(p.ReadReplicas),
+	}
+}
+
+func postgresFromHub(p v1alpha1.PostgresSpec) PostgresSpec {
+	return PostgresSpec{
+		Enabled:               p.Enabled,
+		Image:                 p.Image,
+		AdminSecret:           p.AdminSecret,
+		PersistentVolumeClaim: p.PersistentVolumeClaim,
+		User:                  p.User,
+		Resources:             p.Resources,
+		Preset:                PostgresPreset(p.Preset),
+		Parameters:            p.Parameters,
+		Backup: PostgresBackupSpec{
+			Enabled:   p.Backup.Enabled,
+			Storage:   backupStorageFromHub(p.Backup.Storage),
+			Schedule:  p.Backup.Schedule,
+			Retention: p.Backup.Retention,
+		},
+		Restore:      postgresRestoreFromHub(p.Restore),
+		ReadReplicas: PostgresReadReplicasSpec(p.ReadReplicas),
+	}
+}
+
+func postgresRestoreToHub(r *PostgresRestoreSpec) *v1alpha1.PostgresRestoreSpec {
+	if r == nil {
+		return nil
+	}
+	return &v1alpha1.PostgresRestoreSpec{
+		Storage:         backupStorageToHub(r.Storage),
+		Source:          r.Source,
+		SourceNamespace: r.SourceNamespace,
+		TargetTime:      r.TargetTime,
+	}
+}
+
+func postgresRestoreFromHub(r *v1alpha1.PostgresRestoreSpec) *PostgresRestoreSpec {
+	if r == nil {
+		return nil
+	}
+	return &PostgresRestoreSpec{
+		Storage:         backupStorageFromHub(r.Storage),
+		Source:          r.Source,
+		SourceNamespace: r.SourceNamespace,
+		TargetTime:      r.TargetTime,
+	}
+}
+
+func backupStorageToHub(s BackupStorageSpec) v1alpha1.BackupStorageSpec {
+	return v1alpha1.BackupStorageSpec{
+		PersistentVolumeClaim: s.PersistentVolumeClaim,
+		S3:                    (*v1alpha1.S3StorageSpec)(s.S3),
+	}
+}
+
+func backupStorageFromHub(s v1alpha1.BackupStorageSpec) BackupStorageSpec {
+	return BackupStorageSpec{
+		PersistentVolumeClaim: s.PersistentVolumeClaim,
+		S3:                    (*S3StorageSpec)(s.S3),
+	}
+}
+
+func pgBouncerToHub(p PgBouncerSpec) v1alpha1.PgBouncerSpec {
+	return v1alpha1.PgBouncerSpec{
+		Enabled:              p.Enabled,
+		Image:                p.Image,
+		Replicas:             p.Replicas,
+		User:                 p.User,
+		PoolMode:             v1alpha1.PgBouncerPoolMode(p.PoolMode),
+		DefaultPoolSize:      p.DefaultPoolSize,
+		MinPoolSize:          p.MinPoolSize,
+		ReservePoolSize:      p.ReservePoolSize,
+		MaxClientConnections: p.MaxClientConnections,
+		Resources:            p.Resources,
+	}
+}
+
+func pgBouncerFromHub(p v1alpha1.PgBouncerSpec) PgBouncerSpec {
+	return PgBouncerSpec{
+		Enabled:              p.Enabled,
+		Image:                p.Image,
+		Replicas:             p.Replicas,
+		User:                 p.User,
+		PoolMode:             PgBouncerPoolMode(p.PoolMode),
+		DefaultPoolSize:      p.DefaultPoolSize,
+		MinPoolSize:          p.MinPoolSize,
+		ReservePoolSize:      p.ReservePoolSize,
+		MaxClientConnections: p.MaxClientConnections,
+		Resources:            p.Resources,
+	}
+}
+
+func postgresStatusToHub(s *PostgresStatus) *v1alpha1.PostgresStatus {
+	if s == nil {
+		return nil
+	}
+	status := &v1alpha1.PostgresStatus{
+		Version:                        s.Version,
+		Image:                          s.Image,
+		PersistentVolumeClaim:          s.PersistentVolumeClaim,
+		RequestedPersistentVolumeClaim: s.RequestedPersistentVolumeClaim,
+		PreviousVersion:                s.PreviousVersion,
+		PreviousPersistentVolumeClaim:  s.PreviousPersistentVolumeClaim,
+		Upgrade:                        (*v1alpha1.PostgresUpgradeStatus)(s.Upgrade),
+	}
+	for _, r := range s.ReadReplicas {
+		status.ReadReplicas = append(status.ReadReplicas, v1alpha1.PostgresReplicaStatus(r))
+	}
+	return status
+}
+
+func postgresStatusFromHub(s *v1alpha1.PostgresStatus) *PostgresStatus {
+	if s == nil {
+		return nil
+	}
+	status := &PostgresStatus{
+		Version:                        s.Version,
+		Image:                          s.Image,
+		PersistentVolumeClaim:          s.PersistentVolumeClaim,
+		RequestedPersistentVolumeClaim: s.RequestedPersistentVolumeClaim,
+		PreviousVersion:                s.PreviousVersion,
+		PreviousPersistentVolumeClaim:  s.PreviousPersistentVolumeClaim,
+		Upgrade:                        (*PostgresUpgradeStatus)(s.Upgrade),
+	}
+	for _, r := range s.ReadReplicas {
+		status.ReadReplicas = append(status.ReadReplicas, PostgresReplicaStatus(r))
+	}
+	return status
+}
+
+func credentialToHub(c CredentialSpec) v1alpha1.CredentialSpec {
+	return v1alpha1.CredentialSpec{
+		PasswordPolicy: passwordPolicyToHub(c.PasswordPolicy),
+		Source:         v1alpha1.CredentialSource(c.Source),
+		ExternalSecret: (*v1alpha1.ExternalSecretSpec)(c.ExternalSecret),
+		CSI:            (*v1alpha1.CSISecretSpec)(c.CSI),
+	}
+}
+
+func credentialFromHub(c v1alpha1.CredentialSpec) CredentialSpec {
+	return CredentialSpec{
+		PasswordPolicy: passwordPolicyFromHub(c.PasswordPolicy),
+		Source:         CredentialSource(c.Source),
+		ExternalSecret: (*ExternalSecretSpec)(c.ExternalSecret),
+		CSI:            (*CSISecretSpec)(c.CSI),
+	}
+}
+
+func passwordPolicyToHub(p *PasswordPolicy) *v1alpha1.PasswordPolicy {
+	if p == nil {
+		return nil
+	}
+	dst := &v1alpha1.PasswordPolicy{Length: p.Length}
+	for _, c := range p.CharacterClasses {
+		dst.CharacterClasses = append(dst.CharacterClasses, v1alpha1.CharacterClass(c))
+	}
+	return dst
+}
+
+func passwordPolicyFromHub(p *v1alpha1.PasswordPolicy) *PasswordPolicy {
+	if p == nil {
+		return nil
+	}
+	dst := &PasswordPolicy{Length: p.Length}
+	for _, c := range p.CharacterClasses {
+		dst.CharacterClasses = append(dst.CharacterClasses, CharacterClass(c))
+	}
+	return dst
+}
+
+func credentialsToHub(c CredentialsSpec) v1alpha1.CredentialsSpec {
+	return v1alpha1.CredentialsSpec{
+		PasswordPolicy:    *passwordPolicyToHub(&c.PasswordPolicy),
+		DbAdmin:           credentialToHub(c.DbAdmin),
+		App:               credentialToHub(c.App),
+		DbReadOnly:        credentialToHub(c.DbReadOnly),
+		DbReplication:     credentialToHub(c.DbReplication),
+		KeycloakDb:        credentialToHub(c.KeycloakDb),
+		KeycloakDbAdmin:   credentialToHub(c.KeycloakDbAdmin),
+		KeycloakAdmin:     credentialToHub(c.KeycloakAdmin),
+		HorreumAdmin:      credentialToHub(c.HorreumAdmin),
+		CSIServiceAccount: c.CSIServiceAccount,
+	}
+}
+
+func credentialsFromHub(c v1alpha1.CredentialsSpec) CredentialsSpec {
+	return CredentialsSpec{
+		PasswordPolicy:    *passwordPolicyFromHub(&c.PasswordPolicy),
+		DbAdmin:           credentialFromHub(c.DbAdmin),
+		App:               credentialFromHub(c.App),
+		DbReadOnly:        credentialFromHub(c.DbReadOnly),
+		DbReplication:     credentialFromHub(c.DbReplication),
+		KeycloakDb:        credentialFromHub(c.KeycloakDb),
+		KeycloakDbAdmin:   credentialFromHub(c.KeycloakDbAdmin),
+		KeycloakAdmin:     credentialFromHub(c.KeycloakAdmin),
+		HorreumAdmin:      credentialFromHub(c.HorreumAdmin),
+		CSIServiceAccount: c.CSIServiceAccount,
+	}
+}
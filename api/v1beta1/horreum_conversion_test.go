@@ -0,0 +1,95 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	fuzz "github.com/google/gofuzz"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+)
+
+func newFuzzer(seed int64) *fuzz.Fuzzer {
+	return fuzz.NewWithSeed(seed).NilChance(0.2).NumElements(0, 3).Funcs(
+		// Conversion does not set type meta; the API server does
+		func(tm *metav1.TypeMeta, c fuzz.Continue) {},
+	)
+}
+
+func TestHubRoundTrip(t *testing.T) {
+	for seed := int64(0); seed < 1000; seed++ {
+		f := newFuzzer(seed)
+		original := &v1alpha1.Horreum{}
+		f.Fuzz(original)
+		delete(original.Annotations, v1alpha1.NodeHostsAnnotation)
+
+		spoke := &Horreum{}
+		if err := spoke.ConvertFrom(original.DeepCopy()); err != nil {
+			t.Fatal(err)
+		}
+		hub := &v1alpha1.Horreum{}
+		if err := spoke.ConvertTo(hub); err != nil {
+			t.Fatal(err)
+		}
+		if !equality.Semantic.DeepEqual(original, hub) {
+			t.Fatalf("seed %d: v1alpha1 -> v1beta1 -> v1alpha1 differs (-want,+got):\n%s", seed, cmp.Diff(original, hub))
+		}
+	}
+}
+
+func TestSpokeRoundTrip(t *testing.T) {
+	for seed := int64(0); seed < 1000; seed++ {
+		f := newFuzzer(seed)
+		original := &Horreum{}
+		f.Fuzz(original)
+		// Different node hosts for Horreum and Keycloak must survive in the annotation
+		if seed%2 == 0 {
+			original.Spec.Keycloak.Exposure.NodeHost = original.Spec.Exposure.NodeHost
+		}
+
+		hub := &v1alpha1.Horreum{}
+		if err := original.DeepCopy().ConvertTo(hub); err != nil {
+			t.Fatal(err)
+		}
+		spoke := &Horreum{}
+		if err := spoke.ConvertFrom(hub); err != nil {
+			t.Fatal(err)
+		}
+		if !equality.Semantic.DeepEqual(original, spoke) {
+			t.Fatalf("seed %d: v1beta1 -> v1alpha1 -> v1beta1 differs (-want,+got):\n%s", seed, cmp.Diff(original, spoke))
+		}
+	}
+}
+
+func TestNodeHosts(t *testing.T) {
+	src := &Horreum{}
+	src.Spec.Keycloak.Exposure.NodeHost = "keycloak.example.com"
+	hub := &v1alpha1.Horreum{}
+	if err := src.ConvertTo(hub); err != nil {
+		t.Fatal(err)
+	}
+	if hub.Spec.NodeHost != "keycloak.example.com" {
+		t.Errorf("unexpected spec.nodeHost %s", hub.Spec.NodeHost)
+	}
+	if hosts := hub.GetNodeHosts(); hosts.App != "" || hosts.Keycloak != "keycloak.example.com" {
+		t.Errorf("unexpected node hosts %v", hosts)
+	}
+}
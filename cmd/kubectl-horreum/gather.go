@@ -0,0 +1,411 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/yaml"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	routev1 "github.com/openshift/api/route/v1"
+)
+
+// Keys of secrets that hold public certificates and are therefore not redacted
+var publicSecretKeys = map[string]bool{
+	corev1.TLSCertKey: true,
+	"ca.crt":          true,
+	"service-ca.crt":  true,
+}
+
+// gatherer writes collected files into a tarball; problems are recorded rather than aborting the collection
+type gatherer struct {
+	tw     *tar.Writer
+	root   string
+	errors []string
+}
+
+func (g *gatherer) add(path string, data []byte) error {
+	if err := g.tw.WriteHeader(&tar.Header{
+		Name:    g.root + "/" + path,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err := g.tw.Write(data)
+	return err
+}
+
+func (g *gatherer) failed(format string, args ...interface{}) {
+	g.errors = append(g.errors, fmt.Sprintf(format, args...))
+}
+
+func (g *gatherer) addObject(path string, obj client.Object) error {
+	if obj.GetObjectKind().GroupVersionKind().Empty() {
+		if gvk, err := apiutil.GVKForObject(obj, scheme); err == nil {
+			obj.GetObjectKind().SetGroupVersionKind(gvk)
+		}
+	}
+	obj.SetManagedFields(nil)
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return g.add(path, data)
+}
+
+// redactSecret replaces all values except public certificates with their length; the placeholders
+// are kept in stringData to be readable without decoding
+func redactSecret(secret *corev1.Secret) *corev1.Secret {
+	redacted := secret.DeepCopy()
+	redacted.Data = map[string][]byte{}
+	redacted.StringData = map[string]string{}
+	for key, value := range secret.Data {
+		if publicSecretKeys[key] {
+			redacted.Data[key] = value
+		} else {
+			redacted.StringData[key] = fmt.Sprintf("<redacted %d bytes>", len(value))
+		}
+	}
+	delete(redacted.Annotations, corev1.LastAppliedConfigAnnotation)
+	return redacted
+}
+
+// summarizeCertificates describes validity of PEM certificates in the data
+func summarizeCertificates(data []byte, now time.Time) string {
+	sb := &strings.Builder{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			fmt.Fprintf(sb, "  cannot parse certificate: %s\n", err)
+			continue
+		}
+		validity := "valid"
+		if now.After(cert.NotAfter) {
+			validity = "EXPIRED"
+		} else if now.Before(cert.NotBefore) {
+			validity = "NOT YET VALID"
+		} else if cert.NotAfter.Sub(now) < 30*24*time.Hour {
+			validity = "expires in less than 30 days"
+		}
+		fmt.Fprintf(sb, "  subject: %s\n  issuer: %s\n  DNS names: %s\n  not before: %s\n  not after: %s\n  status: %s\n\n",
+			cert.Subject, cert.Issuer, strings.Join(cert.DNSNames, ", "),
+			cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339), validity)
+	}
+	return sb.String()
+}
+
+func mustGather(ctx context.Context, args []string) error {
+	fs, conn := newFlagSet("must-gather", "[name] [-o file.tar.gz] [--operator-namespace namespace]")
+	output := fs.String("o", "", "Output file; defaults to must-gather-<name>-<timestamp>.tar.gz.")
+	operatorNamespace := fs.String("operator-namespace", "", "Namespace of the operator; by default operator pods are searched in all namespaces.")
+	args = parse(fs, args)
+	c, err := conn.connect()
+	if err != nil {
+		return err
+	}
+	cr, err := c.horreum(ctx, args)
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Format("20060102-150405")
+	if *output == "" {
+		*output = fmt.Sprintf("must-gather-%s-%s.tar.gz", cr.Name, timestamp)
+	}
+	file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	g := &gatherer{tw: tar.NewWriter(gz), root: "must-gather-" + cr.Name + "-" + timestamp}
+
+	if err := c.gather(ctx, g, cr, *operatorNamespace); err != nil {
+		os.Remove(*output)
+		return err
+	}
+	if len(g.errors) > 0 {
+		if err := g.add("errors.txt", []byte(strings.Join(g.errors, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+	if err := g.tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Diagnostics written to %s", *output)
+	if len(g.errors) > 0 {
+		fmt.Fprintf(os.Stderr, "; %d items could not be collected, see errors.txt", len(g.errors))
+	}
+	fmt.Fprintln(os.Stderr)
+	return nil
+}
+
+func (c *cluster) gather(ctx context.Context, g *gatherer, cr *hyperfoilv1alpha1.Horreum, operatorNamespace string) error {
+	if err := g.addObject("horreum.yaml", cr); err != nil {
+		return err
+	}
+	inNamespace := client.InNamespace(cr.Namespace)
+	names := map[string]bool{cr.Name: true}
+
+	// Jobs with base backups belong to a CronJob owned by the resource
+	cronJobs := map[types.UID]bool{}
+	cronJobList := &batchv1.CronJobList{}
+	if err := c.client.List(ctx, cronJobList, inNamespace); err != nil {
+		g.failed("cannot list cronjobs: %s", err)
+	}
+	for i := range cronJobList.Items {
+		if metav1.IsControlledBy(&cronJobList.Items[i], cr) {
+			cronJobs[cronJobList.Items[i].UID] = true
+		}
+	}
+	owned := func(obj metav1.Object) bool {
+		if metav1.IsControlledBy(obj, cr) {
+			return true
+		}
+		ref := metav1.GetControllerOf(obj)
+		return ref != nil && cronJobs[ref.UID]
+	}
+
+	// Keycloak pods belong to a ReplicaSet of a Deployment owned by the resource
+	deployments := map[types.UID]bool{}
+	deploymentList := &appsv1.DeploymentList{}
+	if err := c.client.List(ctx, deploymentList, inNamespace); err != nil {
+		g.failed("cannot list deployments: %s", err)
+	}
+	for i := range deploymentList.Items {
+		if owned(&deploymentList.Items[i]) {
+			deployments[deploymentList.Items[i].UID] = true
+		}
+	}
+	podOwners := map[types.UID]bool{}
+	replicaSetList := &appsv1.ReplicaSetList{}
+	if err := c.client.List(ctx, replicaSetList, inNamespace); err != nil {
+		g.failed("cannot list replicasets: %s", err)
+	}
+	for _, rs := range replicaSetList.Items {
+		if ref := metav1.GetControllerOf(&rs); ref != nil && deployments[ref.UID] {
+			podOwners[rs.UID] = true
+		}
+	}
+
+	// Pods of the PostgreSQL upgrade and base backups belong to a Job
+	jobList := &batchv1.JobList{}
+	if err := c.client.List(ctx, jobList, inNamespace); err != nil {
+		g.failed("cannot list jobs: %s", err)
+	}
+	for i := range jobList.Items {
+		if owned(&jobList.Items[i]) {
+			podOwners[jobList.Items[i].UID] = true
+		}
+	}
+
+	pods := &corev1.PodList{}
+	if err := c.client.List(ctx, pods, inNamespace); err != nil {
+		g.failed("cannot list pods: %s", err)
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if ref := metav1.GetControllerOf(pod); !owned(pod) && (ref == nil || !podOwners[ref.UID]) {
+			continue
+		}
+		names[pod.Name] = true
+		if err := g.addObject("pods/"+pod.Name+".yaml", pod); err != nil {
+			return err
+		}
+		for _, container := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+			if err := c.gatherLogs(ctx, g, "logs/"+pod.Name+"-"+container.Name, pod, container.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	lists := []struct {
+		dir  string
+		list client.ObjectList
+	}{
+		{"deployments", &appsv1.DeploymentList{}},
+		{"poddisruptionbudgets", &policyv1.PodDisruptionBudgetList{}},
+		{"jobs", &batchv1.JobList{}},
+		{"cronjobs", &batchv1.CronJobList{}},
+		{"services", &corev1.ServiceList{}},
+		{"configmaps", &corev1.ConfigMapList{}},
+		{"secrets", &corev1.SecretList{}},
+		{"networkpolicies", &networkingv1.NetworkPolicyList{}},
+		{"routes", &routev1.RouteList{}},
+		{"externalsecrets", externalSecretList()},
+	}
+	certificates := &strings.Builder{}
+	for _, l := range lists {
+		if err := c.client.List(ctx, l.list, inNamespace); meta.IsNoMatchError(err) {
+			continue
+		} else if err != nil {
+			g.failed("cannot list %s: %s", l.dir, err)
+			continue
+		}
+		items, err := meta.ExtractList(l.list)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			obj := item.(client.Object)
+			if !owned(obj) {
+				continue
+			}
+			names[obj.GetName()] = true
+			if secret, ok := obj.(*corev1.Secret); ok {
+				for _, key := range []string{corev1.TLSCertKey, "ca.crt"} {
+					if summary := summarizeCertificates(secret.Data[key], time.Now()); summary != "" {
+						fmt.Fprintf(certificates, "%s/%s:\n%s", secret.Name, key, summary)
+					}
+				}
+				obj = redactSecret(secret)
+			}
+			if err := g.addObject(l.dir+"/"+obj.GetName()+".yaml", obj); err != nil {
+				return err
+			}
+		}
+	}
+	// Route certificates are provided by the user and not owned by the resource
+	for _, route := range []hyperfoilv1alpha1.RouteSpec{cr.Spec.Route, cr.Spec.Keycloak.Route} {
+		if route.TLS == "" {
+			continue
+		}
+		secret := &corev1.Secret{}
+		if err := c.client.Get(ctx, client.ObjectKey{Namespace: cr.Namespace, Name: route.TLS}, secret); err != nil {
+			g.failed("cannot read route certificate %s: %s", route.TLS, err)
+			continue
+		}
+		fmt.Fprintf(certificates, "%s/%s:\n%s", secret.Name, corev1.TLSCertKey, summarizeCertificates(secret.Data[corev1.TLSCertKey], time.Now()))
+	}
+	if err := g.add("certificates.txt", []byte(certificates.String())); err != nil {
+		return err
+	}
+
+	events := &corev1.EventList{}
+	if err := c.client.List(ctx, events, inNamespace); err != nil {
+		g.failed("cannot list events: %s", err)
+	}
+	related := &corev1.EventList{}
+	for _, event := range events.Items {
+		if names[event.InvolvedObject.Name] {
+			event.ManagedFields = nil
+			related.Items = append(related.Items, event)
+		}
+	}
+	if data, err := yaml.Marshal(related); err != nil {
+		return err
+	} else if err := g.add("events.yaml", data); err != nil {
+		return err
+	}
+
+	return c.gatherOperator(ctx, g, operatorNamespace)
+}
+
+func (c *cluster) gatherLogs(ctx context.Context, g *gatherer, path string, pod *corev1.Pod, container string) error {
+	for _, previous := range []bool{false, true} {
+		stream, err := c.clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+			Container: container,
+			Previous:  previous,
+		}).Stream(ctx)
+		if err != nil {
+			// Previous logs are present only after a restart
+			if !previous {
+				g.failed("cannot get logs of %s/%s: %s", pod.Name, container, err)
+			}
+			continue
+		}
+		buf := &bytes.Buffer{}
+		_, err = io.Copy(buf, stream)
+		stream.Close()
+		if err != nil {
+			g.failed("cannot read logs of %s/%s: %s", pod.Name, container, err)
+		}
+		if err := g.add(path+map[bool]string{false: ".log", true: ".previous.log"}[previous], buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cluster) gatherOperator(ctx context.Context, g *gatherer, namespace string) error {
+	pods := &corev1.PodList{}
+	opts := []client.ListOption{client.MatchingLabels{"control-plane": "controller-manager"}}
+	if namespace != "" {
+		opts = append(opts, client.InNamespace(namespace))
+	}
+	if err := c.client.List(ctx, pods, opts...); err != nil {
+		g.failed("cannot list operator pods (use --operator-namespace without cluster-wide access): %s", err)
+		return nil
+	}
+	found := false
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !isOperatorPod(pod) {
+			continue
+		}
+		found = true
+		if err := g.addObject("operator/"+pod.Name+".yaml", pod); err != nil {
+			return err
+		}
+		for _, container := range pod.Spec.Containers {
+			if err := c.gatherLogs(ctx, g, "operator/"+pod.Name+"-"+container.Name, pod, container.Name); err != nil {
+				return err
+			}
+		}
+	}
+	if !found {
+		g.failed("operator pod was not found")
+	}
+	return nil
+}
+
+func isOperatorPod(pod *corev1.Pod) bool {
+	if strings.Contains(pod.Name, "horreum-operator") {
+		return true
+	}
+	for _, container := range pod.Spec.Containers {
+		if strings.Contains(container.Image, "horreum-operator") {
+			return true
+		}
+	}
+	return false
+}
+
+func externalSecretList() *unstructured.UnstructuredList {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(schema.GroupVersionKind{Group: "external-secrets.io", Version: "v1beta1", Kind: "ExternalSecretList"})
+	return list
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRedactSecret(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "horreum-admin",
+			Annotations: map[string]string{corev1.LastAppliedConfigAnnotation: `{"stringData":{"password":"secret"}}`},
+		},
+		Data: map[string][]byte{
+			corev1.BasicAuthPasswordKey: []byte("secret"),
+			corev1.TLSPrivateKeyKey:     []byte("private key"),
+			corev1.TLSCertKey:           []byte("certificate"),
+		},
+	}
+	redacted := redactSecret(secret)
+	if string(secret.Data[corev1.BasicAuthPasswordKey]) != "secret" {
+		t.Error("original secret was modified")
+	}
+	if _, ok := redacted.Annotations[corev1.LastAppliedConfigAnnotation]; ok {
+		t.Error("last applied configuration was not removed")
+	}
+	for _, key := range []string{corev1.BasicAuthPasswordKey, corev1.TLSPrivateKeyKey} {
+		if _, ok := redacted.Data[key]; ok {
+			t.Errorf("%s was not redacted", key)
+		}
+		if !strings.HasPrefix(redacted.StringData[key], "<redacted") {
+			t.Errorf("%s is missing the placeholder", key)
+		}
+	}
+	if string(redacted.Data[corev1.TLSCertKey]) != "certificate" {
+		t.Error("certificate should be kept")
+	}
+}
+
+func TestSummarizeCertificates(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "horreum-db"},
+		DNSNames:     []string{"horreum-db.test.svc"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	summary := summarizeCertificates(data, now)
+	if !strings.Contains(summary, "CN=horreum-db") || !strings.Contains(summary, "horreum-db.test.svc") || !strings.Contains(summary, "status: valid") {
+		t.Errorf("unexpected summary:\n%s", summary)
+	}
+	if summary := summarizeCertificates(data, now.Add(2*365*24*time.Hour)); !strings.Contains(summary, "status: EXPIRED") {
+		t.Errorf("expected expired certificate:\n%s", summary)
+	}
+	if summary := summarizeCertificates([]byte("not a certificate"), now); summary != "" {
+		t.Errorf("expected empty summary, got %s", summary)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+)
+
+func credentials(ctx context.Context, args []string) error {
+	fs, conn := newFlagSet("credentials", "[name] [--all]")
+	all := fs.Bool("all", false, "Print also credentials used by Horreum and Keycloak to access the database.")
+	args = parse(fs, args)
+	c, err := conn.connect()
+	if err != nil {
+		return err
+	}
+	return c.printCredentials(ctx, os.Stdout, args, *all)
+}
+
+func (c *cluster) printCredentials(ctx context.Context, out io.Writer, args []string, all bool) error {
+	cr, err := c.horreum(ctx, args)
+	if err != nil {
+		return err
+	}
+	if len(cr.Status.Credentials) == 0 {
+		return fmt.Errorf("status of %s does not list credentials yet; is the operator running?", cr.Name)
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CREDENTIAL\tSECRET\tUSER\tPASSWORD")
+	for _, status := range cr.Status.Credentials {
+		if !all && status.Name != "horreumAdmin" && status.Name != "keycloakAdmin" {
+			continue
+		}
+		if status.Name == "keycloakAdmin" && cr.Spec.Keycloak.External.PublicUri != "" {
+			continue
+		}
+		secret := &corev1.Secret{}
+		if err := c.client.Get(ctx, client.ObjectKey{Namespace: cr.Namespace, Name: status.Secret}, secret); err != nil {
+			if errors.IsNotFound(err) {
+				fmt.Fprintf(w, "%s\t%s\t<missing>\t\n", status.Name, status.Secret)
+				continue
+			}
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", status.Name, status.Secret,
+			secret.Data[corev1.BasicAuthUsernameKey], secret.Data[corev1.BasicAuthPasswordKey])
+	}
+	return w.Flush()
+}
+
+func urls(ctx context.Context, args []string) error {
+	fs, conn := newFlagSet("urls", "[name]")
+	args = parse(fs, args)
+	c, err := conn.connect()
+	if err != nil {
+		return err
+	}
+	return c.printUrls(ctx, os.Stdout, args)
+}
+
+func (c *cluster) printUrls(ctx context.Context, out io.Writer, args []string) error {
+	cr, err := c.horreum(ctx, args)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Horreum:  %s\n", withPending(cr.Status.PublicUrl))
+	fmt.Fprintf(out, "Keycloak: %s\n", withPending(cr.Status.KeycloakUrl))
+	if cr.Status.KeycloakUrl != "" && cr.Spec.Keycloak.External.PublicUri == "" {
+		fmt.Fprintf(out, "Keycloak administration: %s/admin/master/console/\n", strings.TrimSuffix(cr.Status.KeycloakUrl, "/"))
+	}
+	fmt.Fprintf(out, `
+To upload Hyperfoil results to Horreum create a secret with credentials of a user in the uploading team:
+
+  kubectl create secret generic %[1]s-hyperfoil -n <hyperfoil-namespace> \
+      --from-literal=HORREUM_USER=<user> --from-literal=HORREUM_PASSWORD=<password> \
+      --from-literal=HORREUM_GROUP=<team>-team
+
+and set it in the Hyperfoil resource together with the post hook from config map %[1]s-hyperfoil-upload
+(copy the config map to the Hyperfoil namespace if it differs from %[2]s):
+
+  spec:
+    postHooks: %[1]s-hyperfoil-upload
+    secretEnvVars:
+    - %[1]s-hyperfoil
+`, cr.Name, cr.Namespace)
+	return nil
+}
+
+func withPending(url string) string {
+	if url == "" {
+		return "<pending>"
+	}
+	return url
+}
+
+// component is a set of pods managed by the operator for a Horreum resource, labeled with its name
+type component struct {
+	name     string
+	external bool
+}
+
+func components(cr *hyperfoilv1alpha1.Horreum) []component {
+	comps := []component{
+		{"db", cr.Spec.Postgres.Enabled != nil && !*cr.Spec.Postgres.Enabled},
+		{"keycloak", cr.Spec.Keycloak.External.PublicUri != ""},
+	}
+	if cr.Spec.Keycloak.DatabaseMode == hyperfoilv1alpha1.KeycloakDatabaseDedicated {
+		comps = append(comps, component{"keycloak-db", cr.Spec.Keycloak.External.PublicUri != ""})
+	}
+	if cr.Spec.PgBouncer.Enabled {
+		comps = append(comps, component{"pgbouncer", false})
+	}
+	return append(comps, component{"app", false})
+}
+
+// pods of the component sorted by name; Keycloak may run several instances
+func (c *cluster) pods(ctx context.Context, cr *hyperfoilv1alpha1.Horreum, comp component) ([]corev1.Pod, error) {
+	list := &corev1.PodList{}
+	if err := c.client.List(ctx, list, client.InNamespace(cr.Namespace),
+		client.MatchingLabels{"app": cr.Name, "service": comp.name}); err != nil {
+		return nil, err
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+	return list.Items, nil
+}
+
+// pod selects a pod of the component by name, or the first one when the name is empty
+func (c *cluster) pod(ctx context.Context, cr *hyperfoilv1alpha1.Horreum, comp component, name string) (string, error) {
+	pods, err := c.pods(ctx, cr, comp)
+	if err != nil {
+		return "", err
+	}
+	names := []string{}
+	for _, pod := range pods {
+		if name == "" || pod.Name == name {
+			return pod.Name, nil
+		}
+		names = append(names, pod.Name)
+	}
+	if name == "" {
+		return "", fmt.Errorf("component %s has no pods", comp.name)
+	}
+	return "", fmt.Errorf("pod %s does not belong to component %s, use one of: %s", name, comp.name, strings.Join(names, ", "))
+}
+
+func findComponent(cr *hyperfoilv1alpha1.Horreum, name string) (component, error) {
+	names := []string{}
+	for _, comp := range components(cr) {
+		if comp.name == name {
+			if comp.external {
+				return comp, fmt.Errorf("component %s is not deployed by the operator", name)
+			}
+			return comp, nil
+		}
+		names = append(names, comp.name)
+	}
+	return component{}, fmt.Errorf("unknown component %s, use one of: %s", name, strings.Join(names, ", "))
+}
+
+func status(ctx context.Context, args []string) error {
+	fs, conn := newFlagSet("status", "[name]")
+	args = parse(fs, args)
+	c, err := conn.connect()
+	if err != nil {
+		return err
+	}
+	return c.printStatus(ctx, os.Stdout, args)
+}
+
+func (c *cluster) printStatus(ctx context.Context, out io.Writer, args []string) error {
+	cr, err := c.horreum(ctx, args)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s/%s: %s", cr.Namespace, cr.Name, withPending(cr.Status.Status))
+	if cr.Status.Reason != "" {
+		fmt.Fprintf(out, " (%s)", cr.Status.Reason)
+	}
+	fmt.Fprintln(out)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "\nCOMPONENT\tPOD\tREADY\tSTATUS\tRESTARTS\tAGE")
+	for _, comp := range components(cr) {
+		if comp.external {
+			fmt.Fprintf(w, "%s\t-\t-\texternal\t-\t-\n", comp.name)
+			continue
+		}
+		pods, err := c.pods(ctx, cr, comp)
+		if err != nil {
+			return err
+		}
+		if len(pods) == 0 {
+			fmt.Fprintf(w, "%s\t-\t-\tmissing\t-\t-\n", comp.name)
+			continue
+		}
+		for _, pod := range pods {
+			ready, restarts := 0, int32(0)
+			state := string(pod.Status.Phase)
+			for _, cs := range pod.Status.ContainerStatuses {
+				if cs.Ready {
+					ready++
+				}
+				restarts += cs.RestartCount
+				if cs.State.Waiting != nil && cs.State.Waiting.Reason != "" {
+					state = cs.State.Waiting.Reason
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d/%d\t%s\t%d\t%s\n", comp.name, pod.Name, ready, len(pod.Spec.Containers), state, restarts,
+				duration.HumanDuration(time.Since(pod.CreationTimestamp.Time)))
+		}
+	}
+	if len(cr.Status.Conditions) > 0 {
+		fmt.Fprintln(w, "\nCONDITION\tSTATUS\tREASON\tMESSAGE")
+		for _, cond := range cr.Status.Conditions {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", cond.Type, cond.Status, cond.Reason, cond.Message)
+		}
+	}
+	if len(cr.Status.Credentials) > 0 {
+		fmt.Fprintln(w, "\nCREDENTIAL\tSECRET\tSOURCE\tREADY")
+		for _, cred := range cr.Status.Credentials {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\n", cred.Name, cred.Secret, cred.Source, cred.Ready)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if pg := cr.Status.Postgres; pg != nil && pg.Upgrade != nil {
+		fmt.Fprintf(out, "\nPostgreSQL upgrade from %s to %s: %s (%s)\n", pg.Upgrade.From, pg.Upgrade.To, pg.Upgrade.Phase, pg.Upgrade.Message)
+	}
+	if pg := cr.Status.KeycloakPostgres; pg != nil && pg.Upgrade != nil {
+		fmt.Fprintf(out, "\nKeycloak PostgreSQL upgrade from %s to %s: %s (%s)\n", pg.Upgrade.From, pg.Upgrade.To, pg.Upgrade.Phase, pg.Upgrade.Message)
+	}
+	if len(cr.Status.WeakSecrets) > 0 {
+		fmt.Fprintf(out, "\nWARNING: secrets %s have weak passwords; set spec.rotateCredentials to replace them\n", strings.Join(cr.Status.WeakSecrets, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+)
+
+func fakeCluster(objects ...client.Object) *cluster {
+	return &cluster{
+		client:    fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+		namespace: "test",
+	}
+}
+
+func basicAuthSecret(name, username, password string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test"},
+		Data: map[string][]byte{
+			corev1.BasicAuthUsernameKey: []byte(username),
+			corev1.BasicAuthPasswordKey: []byte(password),
+		},
+	}
+}
+
+func testHorreum(name string) *hyperfoilv1alpha1.Horreum {
+	cr := &hyperfoilv1alpha1.Horreum{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test"}}
+	cr.Status.Status = "Ready"
+	cr.Status.PublicUrl = "https://horreum.example.com"
+	cr.Status.KeycloakUrl = "https://keycloak.example.com/"
+	cr.Status.Credentials = []hyperfoilv1alpha1.CredentialStatus{
+		{Name: "horreumAdmin", Secret: name + "-admin", Source: "generated", Ready: true},
+		{Name: "keycloakAdmin", Secret: name + "-keycloak-admin", Source: "generated", Ready: true},
+		{Name: "appDb", Secret: name + "-app", Source: "generated", Ready: true},
+	}
+	return cr
+}
+
+func TestSelectHorreum(t *testing.T) {
+	ctx := context.TODO()
+	if _, err := fakeCluster().horreum(ctx, nil); err == nil || !strings.Contains(err.Error(), "no Horreum resource") {
+		t.Errorf("expected no resource, got %v", err)
+	}
+	c := fakeCluster(testHorreum("horreum"))
+	if cr, err := c.horreum(ctx, nil); err != nil || cr.Name != "horreum" {
+		t.Errorf("expected the only resource, got %v", err)
+	}
+	if _, err := c.horreum(ctx, []string{"horreum", "extra"}); err == nil {
+		t.Error("extra arguments must be rejected")
+	}
+	c = fakeCluster(testHorreum("horreum"), testHorreum("staging"))
+	if _, err := c.horreum(ctx, nil); err == nil || !strings.Contains(err.Error(), "horreum, staging") {
+		t.Errorf("expected a list of resources to select from, got %v", err)
+	}
+	if cr, err := c.horreum(ctx, []string{"staging"}); err != nil || cr.Name != "staging" {
+		t.Errorf("expected staging, got %v", err)
+	}
+}
+
+func TestPrintCredentials(t *testing.T) {
+	c := fakeCluster(testHorreum("horreum"),
+		basicAuthSecret("horreum-admin", "admin", "secret"),
+		basicAuthSecret("horreum-app", "appuser", "apppass"))
+	out := &bytes.Buffer{}
+	if err := c.printCredentials(context.TODO(), out, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected header and two credentials, got:\n%s", out)
+	}
+	if fields := strings.Fields(lines[1]); strings.Join(fields, " ") != "horreumAdmin horreum-admin admin secret" {
+		t.Errorf("unexpected line %s", lines[1])
+	}
+	if fields := strings.Fields(lines[2]); strings.Join(fields, " ") != "keycloakAdmin horreum-keycloak-admin <missing>" {
+		t.Errorf("unexpected line %s", lines[2])
+	}
+
+	out.Reset()
+	if err := c.printCredentials(context.TODO(), out, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "apppass") {
+		t.Errorf("--all must print database credentials:\n%s", out)
+	}
+
+	cr := testHorreum("external")
+	cr.Spec.Keycloak.External.PublicUri = "https://sso.example.com"
+	out.Reset()
+	if err := fakeCluster(cr).printCredentials(context.TODO(), out, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "keycloakAdmin") {
+		t.Errorf("external Keycloak has no administrator managed by the operator:\n%s", out)
+	}
+
+	cr = testHorreum("new")
+	cr.Status.Credentials = nil
+	if err := fakeCluster(cr).printCredentials(context.TODO(), out, nil, false); err == nil {
+		t.Error("expected error when status does not list credentials")
+	}
+}
+
+func TestPrintUrls(t *testing.T) {
+	out := &bytes.Buffer{}
+	if err := fakeCluster(testHorreum("horreum")).printUrls(context.TODO(), out, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"Horreum:  https://horreum.example.com\n",
+		"Keycloak administration: https://keycloak.example.com/admin/master/console/\n",
+		"postHooks: horreum-hyperfoil-upload\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+
+	cr := testHorreum("horreum")
+	cr.Status.PublicUrl = ""
+	cr.Spec.Keycloak.External.PublicUri = "https://sso.example.com"
+	out.Reset()
+	if err := fakeCluster(cr).printUrls(context.TODO(), out, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Horreum:  <pending>\n") || strings.Contains(out.String(), "administration") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestPrintStatus(t *testing.T) {
+	cr := testHorreum("horreum")
+	cr.Spec.PgBouncer.Enabled = true
+	cr.Spec.Keycloak.External.PublicUri = "https://sso.example.com"
+	cr.Status.WeakSecrets = []string{"horreum-admin"}
+	cr.Status.KeycloakPostgres = &hyperfoilv1alpha1.PostgresStatus{Upgrade: &hyperfoilv1alpha1.PostgresUpgradeStatus{
+		Phase: hyperfoilv1alpha1.PostgresUpgradeDumping, From: "14", To: "16", Message: "Dumping data from version 14"}}
+	pod := func(name, service string, ready bool, waiting string) *corev1.Pod {
+		p := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test", Labels: map[string]string{"app": "horreum", "service": service}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: service}}},
+			Status: corev1.PodStatus{
+				Phase:             corev1.PodRunning,
+				ContainerStatuses: []corev1.ContainerStatus{{Ready: ready, RestartCount: 3}},
+			},
+		}
+		if waiting != "" {
+			p.Status.ContainerStatuses[0].State.Waiting = &corev1.ContainerStateWaiting{Reason: waiting}
+		}
+		return p
+	}
+	c := fakeCluster(cr, pod("horreum-db", "db", true, ""), pod("horreum-app", "app", false, "CrashLoopBackOff"))
+	out := &bytes.Buffer{}
+	if err := c.printStatus(context.TODO(), out, nil); err != nil {
+		t.Fatal(err)
+	}
+	lines := map[string]string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) == 6 {
+			lines[fields[0]] = strings.Join(fields[1:5], " ")
+		}
+	}
+	for comp, expected := range map[string]string{
+		"db":        "horreum-db 1/1 Running 3",
+		"keycloak":  "- - external -",
+		"pgbouncer": "- - missing -",
+		"app":       "horreum-app 0/1 CrashLoopBackOff 3",
+	} {
+		if lines[comp] != expected {
+			t.Errorf("%s: expected %q, got %q", comp, expected, lines[comp])
+		}
+	}
+	if !strings.HasPrefix(out.String(), "test/horreum: Ready\n") || !strings.Contains(out.String(), "WARNING: secrets horreum-admin") ||
+		!strings.Contains(out.String(), "Keycloak PostgreSQL upgrade from 14 to 16: Dumping (Dumping data from version 14)\n") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestSelectPod(t *testing.T) {
+	cr := testHorreum("horreum")
+	cr.Spec.Keycloak.DatabaseMode = hyperfoilv1alpha1.KeycloakDatabaseDedicated
+	keycloakPod := func(name string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test",
+			Labels: map[string]string{"app": "horreum", "service": "keycloak"}}}
+	}
+	c := fakeCluster(cr, keycloakPod("horreum-keycloak-b"), keycloakPod("horreum-keycloak-a"))
+	ctx := context.TODO()
+	comp, err := findComponent(cr, "keycloak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, err := c.pod(ctx, cr, comp, ""); err != nil || name != "horreum-keycloak-a" {
+		t.Errorf("expected first pod, got %s %v", name, err)
+	}
+	if name, err := c.pod(ctx, cr, comp, "horreum-keycloak-b"); err != nil || name != "horreum-keycloak-b" {
+		t.Errorf("expected selected pod, got %s %v", name, err)
+	}
+	if _, err := c.pod(ctx, cr, comp, "horreum-app"); err == nil || !strings.Contains(err.Error(), "horreum-keycloak-a, horreum-keycloak-b") {
+		t.Errorf("expected list of pods, got %v", err)
+	}
+	if comp, err = findComponent(cr, "keycloak-db"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.pod(ctx, cr, comp, ""); err == nil {
+		t.Error("expected error for component without pods")
+	}
+	if _, err := findComponent(cr, "pgbouncer"); err == nil || !strings.Contains(err.Error(), "db, keycloak, keycloak-db, app") {
+		t.Errorf("expected unknown component, got %v", err)
+	}
+	cr.Spec.Keycloak.External.PublicUri = "https://sso.example.com"
+	if _, err := findComponent(cr, "keycloak"); err == nil {
+		t.Error("external Keycloak must be rejected")
+	}
+}
@@ -0,0 +1,194 @@
+// kubectl-horreum is a kubectl plugin for day-2 operations on Horreum instances managed by the operator.
+// Install the binary on PATH and invoke it as 'kubectl horreum <command>'.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	routev1 "github.com/openshift/api/route/v1"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(hyperfoilv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(routev1.AddToScheme(scheme))
+}
+
+type command struct {
+	description string
+	run         func(ctx context.Context, args []string) error
+}
+
+var commands = map[string]command{
+	"credentials": {"Print credentials of the Horreum and Keycloak administrators", credentials},
+	"urls":        {"Print public URLs and Hyperfoil upload configuration", urls},
+	"status":      {"Show health of the Horreum components", status},
+	"logs":        {"Print logs of a Horreum component", logs},
+	"backup":      {"Dump the database deployed by the operator to a local file", backup},
+	"create-team": {"Create a team role in Keycloak and optionally a user in the team", createTeam},
+	"must-gather": {"Collect diagnostics with redacted secrets into a tarball", mustGather},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: kubectl horreum <command> [name] [flags]")
+	fmt.Fprintln(os.Stderr, "\nThe name of the Horreum resource can be omitted when there is only one in the namespace.\n\nCommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, commands[name].description)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun 'kubectl horreum <command> -h' for flags of the command.")
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "--help" || os.Args[1] == "help" {
+		usage()
+		return
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if err := cmd.run(ctx, os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+// cluster holds connection to the cluster and the namespace selected through flags or kubeconfig
+type cluster struct {
+	client    client.Client
+	clientset kubernetes.Interface
+	config    *rest.Config
+	namespace string
+}
+
+type connectionFlags struct {
+	kubeconfig string
+	context    string
+	namespace  string
+}
+
+// newFlagSet creates flags for a command, including the common kubeconfig flags
+func newFlagSet(name string, args string) (*flag.FlagSet, *connectionFlags) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	conn := &connectionFlags{}
+	fs.StringVar(&conn.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file.")
+	fs.StringVar(&conn.context, "context", "", "The kubeconfig context to use.")
+	fs.StringVar(&conn.namespace, "namespace", "", "Namespace of the Horreum resource.")
+	fs.StringVar(&conn.namespace, "n", "", "Shorthand for --namespace.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kubectl horreum %s %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs, conn
+}
+
+// parse parses flags allowing them both before and after the positional arguments
+func parse(fs *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func (f *connectionFlags) connect() (*cluster, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = f.kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{
+		CurrentContext: f.context,
+		Context:        clientcmdapi.Context{Namespace: f.namespace},
+	})
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &cluster{client: c, clientset: clientset, config: config, namespace: namespace}, nil
+}
+
+// horreum finds the resource by name, or the only one in the namespace when the name is not given
+func (c *cluster) horreum(ctx context.Context, args []string) (*hyperfoilv1alpha1.Horreum, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(args[1:], " "))
+	}
+	if len(args) == 1 {
+		cr := &hyperfoilv1alpha1.Horreum{}
+		err := c.client.Get(ctx, client.ObjectKey{Namespace: c.namespace, Name: args[0]}, cr)
+		return cr, err
+	}
+	list := &hyperfoilv1alpha1.HorreumList{}
+	if err := c.client.List(ctx, list, client.InNamespace(c.namespace)); err != nil {
+		return nil, err
+	}
+	switch len(list.Items) {
+	case 0:
+		return nil, fmt.Errorf("no Horreum resource found in namespace %s", c.namespace)
+	case 1:
+		return &list.Items[0], nil
+	default:
+		names := []string{}
+		for _, item := range list.Items {
+			names = append(names, item.Name)
+		}
+		return nil, fmt.Errorf("there are multiple Horreum resources in namespace %s, select one of: %s", c.namespace, strings.Join(names, ", "))
+	}
+}
+
+// credentialSecret reads the secret holding given credential as listed in the status of the resource
+func (c *cluster) credentialSecret(ctx context.Context, cr *hyperfoilv1alpha1.Horreum, credential string) (*corev1.Secret, error) {
+	for _, status := range cr.Status.Credentials {
+		if status.Name == credential {
+			secret := &corev1.Secret{}
+			err := c.client.Get(ctx, client.ObjectKey{Namespace: cr.Namespace, Name: status.Secret}, secret)
+			return secret, err
+		}
+	}
+	return nil, fmt.Errorf("status of %s does not list credential %s; is the operator running?", cr.Name, credential)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func logs(ctx context.Context, args []string) error {
+	fs, conn := newFlagSet("logs", "[name] [-c app|keycloak|db|keycloak-db|pgbouncer] [--pod pod] [-f]")
+	comp := fs.String("c", "app", "Component: app, keycloak, db, keycloak-db (PostgreSQL dedicated to Keycloak) or pgbouncer.")
+	podName := fs.String("pod", "", "Pod of the component, when it runs several instances; defaults to the first one.")
+	follow := fs.Bool("f", false, "Stream the logs.")
+	previous := fs.Bool("previous", false, "Print logs of the previous container instance.")
+	tail := fs.Int64("tail", -1, "Number of recent lines to print; all lines by default.")
+	since := fs.Duration("since", 0, "Print only logs newer than this duration, e.g. 1h.")
+	args = parse(fs, args)
+	c, err := conn.connect()
+	if err != nil {
+		return err
+	}
+	cr, err := c.horreum(ctx, args)
+	if err != nil {
+		return err
+	}
+	target, err := findComponent(cr, *comp)
+	if err != nil {
+		return err
+	}
+	pod, err := c.pod(ctx, cr, target, *podName)
+	if err != nil {
+		return err
+	}
+	opts := &corev1.PodLogOptions{Follow: *follow, Previous: *previous}
+	if *tail >= 0 {
+		opts.TailLines = tail
+	}
+	if *since > 0 {
+		seconds := int64(since.Seconds())
+		opts.SinceSeconds = &seconds
+	}
+	stream, err := c.clientset.CoreV1().Pods(cr.Namespace).GetLogs(pod, opts).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	_, err = io.Copy(os.Stdout, stream)
+	return err
+}
+
+// exec runs command in the first container of the pod, copying its output to stdout
+func (c *cluster) exec(namespace, pod string, command []string, stdout io.Writer) error {
+	req := c.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").Namespace(namespace).Name(pod).SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Command: command,
+			Stdout:  true,
+			Stderr:  true,
+		}, clientgoscheme.ParameterCodec)
+	executor, err := remotecommand.NewSPDYExecutor(c.config, "POST", req.URL())
+	if err != nil {
+		return err
+	}
+	return executor.Stream(remotecommand.StreamOptions{Stdout: stdout, Stderr: os.Stderr})
+}
+
+func backup(ctx context.Context, args []string) error {
+	fs, conn := newFlagSet("backup", "[name] [-d horreum|keycloak] [-o file]")
+	database := fs.String("d", "", "Database to dump; defaults to the Horreum database.")
+	output := fs.String("o", "", "Output file; defaults to <name>-<database>-<timestamp>.dump, '-' writes to standard output.")
+	args = parse(fs, args)
+	c, err := conn.connect()
+	if err != nil {
+		return err
+	}
+	cr, err := c.horreum(ctx, args)
+	if err != nil {
+		return err
+	}
+	if *database == "" {
+		*database = cr.Spec.Database.Name
+		if *database == "" {
+			*database = "horreum"
+		}
+	}
+	server := "db"
+	keycloakDatabase := cr.Spec.Keycloak.Database.Name
+	if keycloakDatabase == "" {
+		keycloakDatabase = "keycloak"
+	}
+	if *database == keycloakDatabase && cr.Spec.Keycloak.DatabaseMode == hyperfoilv1alpha1.KeycloakDatabaseDedicated {
+		server = "keycloak-db"
+	}
+	target, err := findComponent(cr, server)
+	if err != nil {
+		return fmt.Errorf("%w; use pg_dump against the external database directly", err)
+	}
+	pod, err := c.pod(ctx, cr, target, "")
+	if err != nil {
+		return err
+	}
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		if *output == "" {
+			*output = fmt.Sprintf("%s-%s-%s.dump", cr.Name, *database, time.Now().Format("20060102-150405"))
+		}
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	// pg_dump connects through the local socket, which does not require password in both supported images
+	if err := c.exec(cr.Namespace, pod, []string{"pg_dump", "--format=custom", "--dbname=" + *database}, out); err != nil {
+		if *output != "-" {
+			os.Remove(*output)
+		}
+		return fmt.Errorf("pg_dump failed: %w", err)
+	}
+	if *output != "-" {
+		fmt.Fprintf(os.Stderr, "Database %s was dumped to %s; restore it using pg_restore --clean --dbname=%s\n", *database, *output, *database)
+	}
+	return nil
+}
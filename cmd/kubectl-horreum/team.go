@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/Hyperfoil/horreum-operator/pkg/keycloak"
+)
+
+// Roles Horreum defines in its realm; team members usually get some of these along with the team role
+var predefinedRoles = []string{"viewer", "tester", "uploader", "manager", "admin"}
+
+// teamOptions are the flags of create-team
+type teamOptions struct {
+	team     string
+	username string
+	email    string
+	roles    string
+	caCert   []byte
+}
+
+func createTeam(ctx context.Context, args []string) error {
+	fs, conn := newFlagSet("create-team", "[name] --team <team> [--user <user> [--email <email>] [--roles viewer,tester,uploader]]")
+	team := fs.String("team", "", "Name of the team; the '-team' suffix is added to the role when missing.")
+	username := fs.String("user", "", "Create user with this name and add it to the team.")
+	email := fs.String("email", "", "E-mail of the created user.")
+	roles := fs.String("roles", "viewer,tester,uploader", "Comma-separated predefined roles ("+strings.Join(predefinedRoles, ", ")+") for the created user.")
+	caFile := fs.String("ca-file", "", "CA certificate for Keycloak URL; the system trust store is used by default.")
+	args = parse(fs, args)
+	if *team == "" {
+		fs.Usage()
+		return errors.New("--team must be set")
+	}
+	opts := teamOptions{team: *team, username: *username, email: *email, roles: *roles}
+	if *caFile != "" {
+		var err error
+		if opts.caCert, err = os.ReadFile(*caFile); err != nil {
+			return err
+		}
+	}
+	c, err := conn.connect()
+	if err != nil {
+		return err
+	}
+	return c.createTeam(ctx, os.Stdout, args, opts)
+}
+
+func (c *cluster) createTeam(ctx context.Context, out io.Writer, args []string, opts teamOptions) error {
+	teamRole := strings.TrimSuffix(opts.team, "-team") + "-team"
+	cr, err := c.horreum(ctx, args)
+	if err != nil {
+		return err
+	}
+	if cr.Status.KeycloakUrl == "" {
+		return fmt.Errorf("Keycloak URL of %s is not known yet", cr.Name)
+	}
+	adminSecret, err := c.credentialSecret(ctx, cr, "keycloakAdmin")
+	if err != nil {
+		return err
+	}
+	kc, err := keycloak.NewClient(cr.Status.KeycloakUrl, opts.caCert)
+	if err != nil {
+		return err
+	}
+	if err := kc.Login(ctx, "master", string(adminSecret.Data[corev1.BasicAuthUsernameKey]),
+		string(adminSecret.Data[corev1.BasicAuthPasswordKey])); err != nil {
+		return err
+	}
+
+	if err := kc.CreateRole(ctx, "horreum", keycloak.Role{Name: teamRole}); errors.Is(err, keycloak.ErrExists) {
+		fmt.Fprintf(out, "Role %s already exists\n", teamRole)
+	} else if err != nil {
+		return err
+	} else {
+		fmt.Fprintf(out, "Created role %s\n", teamRole)
+	}
+	if opts.username == "" {
+		return nil
+	}
+
+	assigned := []keycloak.Role{}
+	for _, name := range append([]string{teamRole}, strings.Split(opts.roles, ",")...) {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		role, err := kc.GetRole(ctx, "horreum", name)
+		if err != nil {
+			return err
+		}
+		assigned = append(assigned, role)
+	}
+	password, err := temporaryPassword()
+	if err != nil {
+		return err
+	}
+	userID, err := kc.CreateUser(ctx, "horreum", keycloak.User{
+		Username: opts.username,
+		Email:    opts.email,
+		Enabled:  true,
+		Credentials: []keycloak.Credential{{
+			Type:      "password",
+			Value:     password,
+			Temporary: true,
+		}},
+	})
+	if errors.Is(err, keycloak.ErrExists) {
+		// Adding existing user to the team
+		if userID, err = kc.FindUser(ctx, "horreum", opts.username); err != nil {
+			return err
+		}
+		password = ""
+	} else if err != nil {
+		return err
+	}
+	if err := kc.AddRealmRoles(ctx, "horreum", userID, assigned); err != nil {
+		return err
+	}
+	names := []string{}
+	for _, role := range assigned {
+		names = append(names, role.Name)
+	}
+	if password == "" {
+		fmt.Fprintf(out, "Assigned roles %s to existing user %s\n", strings.Join(names, ", "), opts.username)
+	} else {
+		fmt.Fprintf(out, "Created user %s with roles %s and temporary password %s\n", opts.username, strings.Join(names, ", "), password)
+	}
+	return nil
+}
+
+func temporaryPassword() (string, error) {
+	bytes := make([]byte, 12)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Hyperfoil/horreum-operator/pkg/keycloak"
+)
+
+// fakeKeycloak serves the part of the admin API used by create-team for the horreum realm
+type fakeKeycloak struct {
+	mu       sync.Mutex
+	roles    map[string]bool
+	users    map[string]keycloak.User
+	mappings map[string][]string
+}
+
+func (kc *fakeKeycloak) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	const realm = "/admin/realms/horreum"
+	switch {
+	case req.Method == http.MethodPost && req.URL.Path == "/realms/master/protocol/openid-connect/token":
+		if req.FormValue("username") != "admin" || req.FormValue("password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "token"})
+	case req.Header.Get("Authorization") != "Bearer token":
+		w.WriteHeader(http.StatusUnauthorized)
+	case req.Method == http.MethodPost && req.URL.Path == realm+"/roles":
+		role := keycloak.Role{}
+		json.NewDecoder(req.Body).Decode(&role)
+		if kc.roles[role.Name] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		kc.roles[role.Name] = true
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, realm+"/roles/"):
+		name := strings.TrimPrefix(req.URL.Path, realm+"/roles/")
+		if !kc.roles[name] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(keycloak.Role{ID: "id-" + name, Name: name})
+	case req.Method == http.MethodPost && req.URL.Path == realm+"/users":
+		user := keycloak.User{}
+		json.NewDecoder(req.Body).Decode(&user)
+		if _, ok := kc.users[user.Username]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		user.ID = "id-" + user.Username
+		kc.users[user.Username] = user
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodGet && req.URL.Path == realm+"/users":
+		users := []keycloak.User{}
+		if user, ok := kc.users[req.URL.Query().Get("username")]; ok {
+			users = append(users, user)
+		}
+		json.NewEncoder(w).Encode(users)
+	case req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/role-mappings/realm"):
+		userID := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, realm+"/users/"), "/role-mappings/realm")
+		roles := []keycloak.Role{}
+		json.NewDecoder(req.Body).Decode(&roles)
+		for _, role := range roles {
+			kc.mappings[userID] = append(kc.mappings[userID], role.Name)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestCreateTeam(t *testing.T) {
+	kc := &fakeKeycloak{
+		roles:    map[string]bool{"viewer": true, "tester": true, "uploader": true, "manager": true, "admin": true},
+		users:    map[string]keycloak.User{},
+		mappings: map[string][]string{},
+	}
+	server := httptest.NewServer(kc)
+	defer server.Close()
+	cr := testHorreum("horreum")
+	cr.Status.KeycloakUrl = server.URL
+	c := fakeCluster(cr, basicAuthSecret("horreum-keycloak-admin", "admin", "secret"))
+	ctx := context.TODO()
+	out := &bytes.Buffer{}
+
+	if err := c.createTeam(ctx, out, nil, teamOptions{team: "perf"}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Created role perf-team\n" || !kc.roles["perf-team"] {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	out.Reset()
+	opts := teamOptions{team: "perf-team", username: "alice", email: "alice@example.com", roles: "viewer, uploader,"}
+	if err := c.createTeam(ctx, out, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "Role perf-team already exists\nCreated user alice with roles perf-team, viewer, uploader and temporary password ") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	user := kc.users["alice"]
+	if user.Email != "alice@example.com" || !user.Enabled || len(user.Credentials) != 1 || !user.Credentials[0].Temporary ||
+		!strings.HasSuffix(strings.TrimSpace(out.String()), user.Credentials[0].Value) {
+		t.Errorf("unexpected user %v", user)
+	}
+	if roles := strings.Join(kc.mappings["id-alice"], ","); roles != "perf-team,viewer,uploader" {
+		t.Errorf("unexpected roles %s", roles)
+	}
+
+	// Existing users keep their password
+	out.Reset()
+	if err := c.createTeam(ctx, out, nil, teamOptions{team: "dev", username: "alice", roles: "manager"}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Created role dev-team\nAssigned roles dev-team, manager to existing user alice\n" {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	if roles := strings.Join(kc.mappings["id-alice"], ","); roles != "perf-team,viewer,uploader,dev-team,manager" {
+		t.Errorf("unexpected roles %s", roles)
+	}
+
+	if err := c.createTeam(ctx, out, nil, teamOptions{team: "perf", username: "bob", roles: "superuser"}); err == nil {
+		t.Error("unknown roles must be rejected")
+	} else if _, ok := kc.users["bob"]; ok {
+		t.Error("user must not be created when roles are invalid")
+	}
+
+	cr.Status.KeycloakUrl = ""
+	if err := fakeCluster(cr).createTeam(ctx, out, nil, teamOptions{team: "perf"}); err == nil {
+		t.Error("expected error when Keycloak URL is not known")
+	}
+}
@@ -7,16 +7,17 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func appPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl, appPublicUrl string) *corev1.Pod {
+func appPod(cr *hyperfoilv1alpha1.Horreum, p Platform, keycloakPublicUrl, appPublicUrl string) *corev1.Pod {
 	keycloakInternalURL := keycloakInternalURL(cr)
 
 	horreumEnv := []corev1.EnvVar{
 		{
 			Name:  "QUARKUS_DATASOURCE_JDBC_URL",
-			Value: dbURL(cr, &cr.Spec.Database, "horreum"),
+			Value: appDbURL(cr),
 		},
 		secretEnv("QUARKUS_DATASOURCE_USERNAME", appUserSecret(cr), corev1.BasicAuthUsernameKey),
 		secretEnv("QUARKUS_DATASOURCE_PASSWORD", appUserSecret(cr), corev1.BasicAuthPasswordKey),
+		// Schema migration holds session-level locks, it connects to the database directly
 		{
 			Name:  "QUARKUS_DATASOURCE_MIGRATION_JDBC_URL",
 			Value: dbURL(cr, &cr.Spec.Database, "horreum"),
@@ -69,7 +70,7 @@ func appPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl, appPublicUrl strin
 			VolumeSource: corev1.VolumeSource{
 				ConfigMap: &corev1.ConfigMapVolumeSource{
 					LocalObjectReference: corev1.LocalObjectReference{
-						Name: "service-ca.crt",
+						Name: serviceCaConfigMapName(cr),
 					},
 				},
 			},
@@ -80,7 +81,15 @@ func appPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl, appPublicUrl strin
 			Name:      "imports",
 			MountPath: "/etc/horreum/imports",
 		},
+		{
+			Name:      "service-ca",
+			MountPath: "/etc/ssl/certs/service-ca.crt",
+			SubPath:   "service-ca.crt",
+		},
 	}
+	dbCAVolumes, dbCAMounts := dbCAVolume(&cr.Spec.Database)
+	volumes = append(volumes, dbCAVolumes...)
+	mounts = append(mounts, dbCAMounts...)
 	routeType := cr.Spec.Route.Type
 	if routeType == "passthrough" || routeType == "reencrypt" || routeType == "" {
 		secretName := cr.Name + "-app-certs"
@@ -98,10 +107,6 @@ func appPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl, appPublicUrl strin
 		mounts = append(mounts, corev1.VolumeMount{
 			Name:      "certs",
 			MountPath: "/opt/certs",
-		}, corev1.VolumeMount{
-			Name:      "service-ca",
-			MountPath: "/etc/ssl/certs/service-ca.crt",
-			SubPath:   "service-ca.crt",
 		})
 		horreumEnv = append(horreumEnv, corev1.EnvVar{
 			Name:  "QUARKUS_HTTP_SSL_CERTIFICATE_FILE",
@@ -125,15 +130,18 @@ func appPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl, appPublicUrl strin
 			},
 		},
 		Spec: corev1.PodSpec{
+			ImagePullSecrets:              cr.Spec.ImagePullSecrets,
 			TerminationGracePeriodSeconds: &[]int64{0}[0],
+			SecurityContext:               restrictedPodSecurityContext(),
 			InitContainers: []corev1.Container{
 				{
 					Name:            "init",
-					Image:           appImage(cr),
-					ImagePullPolicy: corev1.PullAlways,
+					Image:           appImage(cr, p),
+					ImagePullPolicy: p.PullPolicy,
 					Command: []string{
 						"sh", "-x", "-c", "/deployments/k8s-setup.sh",
 					},
+					SecurityContext: restrictedSecurityContext(false),
 					Env: []corev1.EnvVar{
 						secretEnv("KEYCLOAK_USER", keycloakAdminSecret(cr), corev1.BasicAuthUsernameKey),
 						secretEnv("KEYCLOAK_PASSWORD", keycloakAdminSecret(cr), corev1.BasicAuthPasswordKey),
@@ -167,8 +175,9 @@ func appPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl, appPublicUrl strin
 			},
 			Containers: []corev1.Container{
 				{
-					Name:  "horreum",
-					Image: appImage(cr),
+					Name:            "horreum",
+					Image:           appImage(cr, p),
+					ImagePullPolicy: p.PullPolicy,
 					Command: []string{
 						"sh", "-c", `
 							keytool -noprompt -import -alias service-ca -file /etc/ssl/certs/service-ca.crt -cacerts -storepass changeit
@@ -178,6 +187,8 @@ func appPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl, appPublicUrl strin
 					},
 					Env:          horreumEnv,
 					VolumeMounts: mounts,
+					// The service CA is imported into JDK cacerts on start
+					SecurityContext: restrictedSecurityContext(false),
 				},
 			},
 			Volumes: volumes,
@@ -185,7 +196,7 @@ func appPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl, appPublicUrl strin
 	}
 }
 
-func appService(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev1.Service {
+func appService(cr *hyperfoilv1alpha1.Horreum, p Platform) *corev1.Service {
 	return &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name,
@@ -195,7 +206,7 @@ func appService(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev1.Ser
 			},
 		},
 		Spec: corev1.ServiceSpec{
-			Type: serviceType(cr.Spec.ServiceType, r),
+			Type: serviceType(cr.Spec.ServiceType, p),
 			Ports: []corev1.ServicePort{
 				servicePort(cr.Spec.Route, 8080, 8443),
 			},
@@ -207,6 +218,6 @@ func appService(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev1.Ser
 	}
 }
 
-func appRoute(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) (*routev1.Route, error) {
-	return route(cr.Spec.Route, "", cr, r)
+func appRoute(cr *hyperfoilv1alpha1.Horreum, p Platform, tlsSecret *corev1.Secret) (*routev1.Route, error) {
+	return route(cr.Spec.Route, "", cr, p, tlsSecret)
 }
@@ -0,0 +1,378 @@
+package horreum
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// WAL-G is copied here from its image so that the server can archive WAL
+	walGPath           = "/opt/wal-g"
+	backupStoragePath  = "/backup"
+	restoreStoragePath = "/restore"
+	// Variables configuring WAL-G for the storage of the restored backups carry this prefix,
+	// because the server archives its own WAL into a different location
+	restoreEnvPrefix = "RESTORE_"
+	// Wrapper running WAL-G with the storage of the restored backups
+	restoreWalGScript = dbConfigPath + "/restore-wal-g.bash"
+	// Sourced before the server starts, see postgresRestoreScript
+	restoreBackupScript = dbConfigPath + "/restore-backup.bash"
+)
+
+const restoreWalG = `
+unset WALG_FILE_PREFIX WALG_S3_PREFIX AWS_ENDPOINT AWS_REGION AWS_S3_FORCE_PATH_STYLE AWS_ACCESS_KEY_ID AWS_SECRET_ACCESS_KEY
+for var in $(compgen -e | grep '^` + restoreEnvPrefix + `'); do
+	export "${var#` + restoreEnvPrefix + `}=${!var}"
+done
+exec ` + walGPath + `/wal-g "$@"
+`
+
+func isBackupEnabled(spec *hyperfoilv1alpha1.PostgresSpec) bool {
+	return spec.Backup.Enabled
+}
+
+// usesWalG is true when the server pod needs WAL-G for archiving or restoring WAL
+func usesWalG(spec *hyperfoilv1alpha1.PostgresSpec) bool {
+	return isBackupEnabled(spec) || spec.Restore != nil
+}
+
+// backupPath separates backups of instances sharing the storage. Servers of different major versions
+// cannot use each other's backups and WAL of a new cluster would overwrite the old one, so the version
+// is part of the path, too.
+func backupPath(namespace string, name string, db postgresInstance, image string) string {
+	path := namespace + "/" + name + "/" + db.component
+	if version := postgresMajorVersion(image); version != "" {
+		path += "/" + version
+	}
+	return path
+}
+
+// walGStorage configures WAL-G through environment variables
+func walGStorage(storage hyperfoilv1alpha1.BackupStorageSpec, path string, volume string, mountPath string, envPrefix string) ([]corev1.EnvVar, []corev1.Volume, []corev1.VolumeMount) {
+	if storage.S3 == nil {
+		return []corev1.EnvVar{{
+			Name:  envPrefix + "WALG_FILE_PREFIX",
+			Value: mountPath + "/" + path,
+		}}, []corev1.Volume{{
+			Name: volume,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: storage.PersistentVolumeClaim,
+				},
+			},
+		}}, []corev1.VolumeMount{{
+			Name:      volume,
+			MountPath: mountPath,
+		}}
+	}
+	s3 := storage.S3
+	prefix := "s3://" + s3.Bucket + "/"
+	if s3.Prefix != "" {
+		prefix += strings.Trim(s3.Prefix, "/") + "/"
+	}
+	env := []corev1.EnvVar{
+		{
+			Name:  envPrefix + "WALG_S3_PREFIX",
+			Value: prefix + path,
+		},
+		secretEnv(envPrefix+"AWS_ACCESS_KEY_ID", s3.CredentialsSecret, "AWS_ACCESS_KEY_ID"),
+		secretEnv(envPrefix+"AWS_SECRET_ACCESS_KEY", s3.CredentialsSecret, "AWS_SECRET_ACCESS_KEY"),
+	}
+	if s3.Endpoint != "" {
+		// Storage other than AWS rarely supports virtual-hosted buckets
+		env = append(env, corev1.EnvVar{
+			Name:  envPrefix + "AWS_ENDPOINT",
+			Value: s3.Endpoint,
+		}, corev1.EnvVar{
+			Name:  envPrefix + "AWS_S3_FORCE_PATH_STYLE",
+			Value: "true",
+		})
+	}
+	if s3.Region != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  envPrefix + "AWS_REGION",
+			Value: s3.Region,
+		})
+	}
+	return env, nil, nil
+}
+
+// postgresBackupStorage is the storage where the server archives its WAL
+func postgresBackupStorage(cr *hyperfoilv1alpha1.Horreum, db postgresInstance, image string) ([]corev1.EnvVar, []corev1.Volume, []corev1.VolumeMount) {
+	return walGStorage(db.spec.Backup.Storage, backupPath(cr.Namespace, cr.Name, db, image), "backup-storage", backupStoragePath, "")
+}
+
+// postgresRestoreStorage is the storage with backups of the source instance
+func postgresRestoreStorage(cr *hyperfoilv1alpha1.Horreum, db postgresInstance, image string) ([]corev1.EnvVar, []corev1.Volume, []corev1.VolumeMount) {
+	restore := db.spec.Restore
+	path := backupPath(withDefault(restore.SourceNamespace, cr.Namespace), restore.Source, db, image)
+	return walGStorage(restore.Storage, path, "restore-storage", restoreStoragePath, restoreEnvPrefix)
+}
+
+// postgresArchiveParameters make the server push completed WAL segments into the backup storage
+func postgresArchiveParameters(spec *hyperfoilv1alpha1.PostgresSpec) map[string]string {
+	if !isBackupEnabled(spec) {
+		return map[string]string{}
+	}
+	return map[string]string{
+		"archive_mode":    "on",
+		"archive_command": walGPath + "/wal-g wal-push %p",
+		// Limits the data lost when the volume is lost on a quiet server
+		"archive_timeout": "5min",
+	}
+}
+
+// recoveryTargetTime formats the target in UTC, as both PostgreSQL and listing of WAL-G backups understand it
+func recoveryTargetTime(restore *hyperfoilv1alpha1.PostgresRestoreSpec) (string, string) {
+	if restore.TargetTime == nil {
+		return "", ""
+	}
+	target := restore.TargetTime.UTC()
+	return target.Format("2006-01-02 15:04:05+00"), target.Format(time.RFC3339)
+}
+
+// postgresRestoreScript fetches the latest base backup taken before the target when the data directory
+// is empty, and replays archived WAL up to the target. Recovery runs on a local socket only, with
+// the settings passed on the command line, so that the server accepts connections once it is promoted.
+func postgresRestoreScript(db postgresInstance) string {
+	restore := db.spec.Restore
+	target, listTarget := recoveryTargetTime(restore)
+	// The instance archives its own WAL only after the restore
+	settings := "-c listen_addresses='' -c unix_socket_directories=/tmp -c ssl=off -c archive_mode=off" +
+		" -c restore_command='bash " + restoreWalGScript + " wal-fetch %f %p'" +
+		" -c recovery_target_action=promote"
+	if target != "" {
+		settings += " -c recovery_target_time='" + target + "'"
+	}
+	return `
+if [ ! -f "$PGDATA/PG_VERSION" ]; then
+	echo "Restoring backup of ` + restore.Source + `"
+	backup=$(bash ` + restoreWalGScript + ` backup-list | awk -v target="` + listTarget + `" \
+		'NR > 1 && (target == "" || $2 < target) && $2 > modified { modified = $2; name = $1 } END { print name }')
+	if [ -z "$backup" ]; then
+		echo "No base backup to restore"
+		exit 1
+	fi
+	bash ` + restoreWalGScript + ` backup-fetch "$PGDATA" "$backup" || exit 1
+	chmod 700 "$PGDATA"
+	touch "$PGDATA/recovery.signal"
+	# Red Hat image includes configuration generated on start
+	touch /var/lib/pgsql/openshift-custom-postgresql.conf 2> /dev/null || true
+	pg_ctl start -w -t 3600 -o "` + settings + `" || exit 1
+	until [ "$(psql -X -h /tmp --username "${POSTGRES_USER:-postgres}" --dbname postgres -Atc 'select pg_is_in_recovery()')" = f ]; do
+		sleep 5
+	done
+	pg_ctl stop -w -m fast || exit 1
+	echo "Backup of ` + restore.Source + ` restored"
+fi
+`
+}
+
+// walGInitContainer copies WAL-G binary into the server pod
+func walGInitContainer(p Platform, userId int64) corev1.Container {
+	securityContext := restrictedSecurityContext(true)
+	securityContext.RunAsUser = &userId
+	return corev1.Container{
+		Name:            "wal-g",
+		Image:           walGImage(p),
+		ImagePullPolicy: p.PullPolicy,
+		Command:         []string{"cp", "/usr/local/bin/wal-g", walGPath + "/wal-g"},
+		SecurityContext: securityContext,
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "wal-g",
+				MountPath: walGPath,
+			},
+		},
+	}
+}
+
+func postgresBackupLabels(cr *hyperfoilv1alpha1.Horreum, db postgresInstance) map[string]string {
+	return map[string]string{
+		"app":     cr.Name,
+		"service": db.component + "-backup",
+	}
+}
+
+// postgresSuperuserEnv lets libpq clients connect to the server as superuser, verifying its certificate
+func postgresSuperuserEnv(cr *hyperfoilv1alpha1.Horreum, db postgresInstance, image string) []corev1.EnvVar {
+	env := []corev1.EnvVar{
+		{
+			Name:  "PGHOST",
+			Value: db.host(cr),
+		},
+		{
+			Name:  "PGPORT",
+			Value: "5432",
+		},
+		{
+			Name:  "PGDATABASE",
+			Value: "postgres",
+		},
+		// Superuser of the community image is the admin; Red Hat image uses 'postgres'
+		secretEnv("PGPASSWORD", db.adminSecret, corev1.BasicAuthPasswordKey),
+		{
+			Name:  "PGSSLMODE",
+			Value: "verify-full",
+		},
+		{
+			Name:  "PGSSLROOTCERT",
+			Value: serviceCaPath,
+		},
+	}
+	if isDockerDbImage(image) {
+		env = append(env, secretEnv("PGUSER", db.adminSecret, corev1.BasicAuthUsernameKey))
+	} else {
+		env = append(env, corev1.EnvVar{
+			Name:  "PGUSER",
+			Value: "postgres",
+		})
+	}
+	return env
+}
+
+// postgresBackupCronJob takes base backups of the running server. Files of the data directory are read
+// from the volume, therefore the pod must run on the same node as the server.
+func postgresBackupCronJob(cr *hyperfoilv1alpha1.Horreum, db postgresInstance, p Platform) *batchv1.CronJob {
+	backup := &db.spec.Backup
+	image := postgresImage(db.spec, p)
+	userId := postgresUserId(db.spec, image)
+	env := postgresSuperuserEnv(cr, db, image)
+	storageEnv, volumes, volumeMounts := postgresBackupStorage(cr, db, image)
+	env = append(env, storageEnv...)
+	volumes = append(volumes, corev1.Volume{
+		Name: "db-volume",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: db.claim,
+				ReadOnly:  true,
+			},
+		},
+	}, corev1.Volume{
+		Name: "service-ca",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: serviceCaConfigMapName(cr),
+				},
+			},
+		},
+	})
+	volumeMounts = append(volumeMounts, corev1.VolumeMount{
+		Name:      "db-volume",
+		MountPath: dbDataPath,
+		ReadOnly:  true,
+	}, corev1.VolumeMount{
+		Name:      "service-ca",
+		MountPath: serviceCaPath,
+		SubPath:   "service-ca.crt",
+	})
+
+	retention := backup.Retention
+	if retention <= 0 {
+		retention = 7
+	}
+	podSecurityContext := restrictedPodSecurityContext()
+	podSecurityContext.FSGroup = &[]int64{userId}[0]
+	podSecurityContext.FSGroupChangePolicy = &[]corev1.PodFSGroupChangePolicy{corev1.FSGroupChangeOnRootMismatch}[0]
+	securityContext := restrictedSecurityContext(true)
+	securityContext.RunAsUser = &userId
+	backoffLimit := int32(2)
+	labels := postgresBackupLabels(cr, db)
+	return &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      db.name + "-backup",
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule:          withDefault(backup.Schedule, "0 2 * * *"),
+			ConcurrencyPolicy: batchv1.ForbidConcurrent,
+			JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{
+					BackoffLimit: &backoffLimit,
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: labels,
+						},
+						Spec: corev1.PodSpec{
+							RestartPolicy:    corev1.RestartPolicyNever,
+							ImagePullSecrets: cr.Spec.ImagePullSecrets,
+							SecurityContext:  podSecurityContext,
+							Affinity: &corev1.Affinity{
+								PodAffinity: &corev1.PodAffinity{
+									RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+										{
+											LabelSelector: &metav1.LabelSelector{
+												MatchLabels: map[string]string{
+													"app":     cr.Name,
+													"service": db.component,
+												},
+											},
+											TopologyKey: "kubernetes.io/hostname",
+										},
+									},
+								},
+							},
+							Containers: []corev1.Container{
+								{
+									Name:            "backup",
+									Image:           walGImage(p),
+									ImagePullPolicy: p.PullPolicy,
+									Env:             env,
+									Command: []string{"bash", "-c", `
+										set -e
+										for dir in ` + dbDataPath + `/pgdata ` + dbDataPath + `/userdata ` + dbDataPath + `; do
+											if [ -f "$dir/PG_VERSION" ]; then
+												export PGDATA="$dir"
+												break
+											fi
+										done
+										wal-g backup-push "$PGDATA"
+										wal-g delete retain FULL ` + strconv.Itoa(int(retention)) + ` --confirm
+									`},
+									SecurityContext: securityContext,
+									VolumeMounts:    volumeMounts,
+								},
+							},
+							Volumes: volumes,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func compareCronJob(i1, i2 interface{}, logger logr.Logger) bool {
+	c1, ok1 := i1.(*batchv1.CronJob)
+	c2, ok2 := i2.(*batchv1.CronJob)
+	if !ok1 || !ok2 {
+		logger.Info("Cannot cast to CronJobs: " + fmt.Sprintf("%T | %T", i1, i2))
+		return false
+	}
+	if equality.Semantic.DeepDerivative(c1.Spec, c2.Spec) {
+		return true
+	}
+	logger.Info("CronJob " + c1.Name + " does not match")
+	return false
+}
+
+// ensurePostgresBackup schedules base backups when archiving is enabled, or deletes the schedule.
+// Backups already stored are kept.
+func ensurePostgresBackup(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger, db postgresInstance) error {
+	cronJob := postgresBackupCronJob(cr, db, r.Platform)
+	if !isBackupEnabled(db.spec) {
+		return ensureDeleted(r, cr, cronJob, &batchv1.CronJob{})
+	}
+	return ensureSame(r, cr, logger, cronJob, &batchv1.CronJob{}, compareCronJob, nocheck)
+}
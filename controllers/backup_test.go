@@ -0,0 +1,162 @@
+package horreum
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func envValue(env []corev1.EnvVar, name string) string {
+	for _, e := range env {
+		if e.Name == name {
+			return e.Value
+		}
+	}
+	return ""
+}
+
+func TestPostgresBackup(t *testing.T) {
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			Postgres: hyperfoilv1alpha1.PostgresSpec{
+				Image:                 "docker.io/library/postgres:16.2",
+				PersistentVolumeClaim: "horreum-db",
+				Backup: hyperfoilv1alpha1.PostgresBackupSpec{
+					Enabled: true,
+					Storage: hyperfoilv1alpha1.BackupStorageSpec{
+						S3: &hyperfoilv1alpha1.S3StorageSpec{
+							Bucket:            "backups",
+							Prefix:            "/horreum/",
+							Endpoint:          "https://minio.example.com",
+							CredentialsSecret: "s3",
+						},
+					},
+					Retention: 3,
+				},
+				Parameters: map[string]string{"archive_timeout": "1min"},
+			},
+		},
+	}
+	db := horreumPostgres(cr)
+	conf := postgresqlConf(db.spec)
+	for _, line := range []string{
+		"archive_mode = 'on'",
+		"archive_command = '" + walGPath + "/wal-g wal-push %p'",
+		"archive_timeout = '1min'",
+	} {
+		if !strings.Contains(conf, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, conf)
+		}
+	}
+
+	platform := Platform{Images: Images{WalG: "quay.io/example/wal-g:v3.0.3"}}
+	pod := postgresPod(cr, db, platform)
+	if len(pod.Spec.InitContainers) != 1 {
+		t.Fatalf("WAL-G must be copied into the pod")
+	}
+	if image := pod.Spec.InitContainers[0].Image; image != "quay.io/example/wal-g:v3.0.3" {
+		t.Errorf("unexpected WAL-G image %s", image)
+	}
+	env := pod.Spec.Containers[0].Env
+	if prefix := envValue(env, "WALG_S3_PREFIX"); prefix != "s3://backups/horreum/test/horreum/db/16" {
+		t.Errorf("unexpected prefix %s", prefix)
+	}
+	if envValue(env, "AWS_S3_FORCE_PATH_STYLE") != "true" {
+		t.Error("path style must be used with custom endpoint")
+	}
+
+	cronJob := postgresBackupCronJob(cr, db, platform)
+	container := cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers[0]
+	if !strings.Contains(container.Command[2], "wal-g delete retain FULL 3 --confirm") {
+		t.Errorf("unexpected command %s", container.Command[2])
+	}
+	if envValue(container.Env, "PGHOST") != "horreum-db.test.svc" {
+		t.Errorf("unexpected host %s", envValue(container.Env, "PGHOST"))
+	}
+}
+
+func TestPostgresRestore(t *testing.T) {
+	target := metav1.NewTime(time.Date(2024, 5, 1, 12, 30, 0, 0, time.FixedZone("CEST", 2*60*60)))
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "restored", Namespace: "test"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			Postgres: hyperfoilv1alpha1.PostgresSpec{
+				Image: "registry.redhat.io/rhel9/postgresql-15:latest",
+				Restore: &hyperfoilv1alpha1.PostgresRestoreSpec{
+					Storage:         hyperfoilv1alpha1.BackupStorageSpec{PersistentVolumeClaim: "backups"},
+					Source:          "horreum",
+					SourceNamespace: "prod",
+					TargetTime:      &target,
+				},
+			},
+		},
+	}
+	db := horreumPostgres(cr)
+	script := postgresRestoreScript(db)
+	for _, part := range []string{
+		`awk -v target="2024-05-01T10:30:00Z"`,
+		"-c recovery_target_time='2024-05-01 10:30:00+00'",
+		"-c restore_command='bash " + restoreWalGScript + " wal-fetch %f %p'",
+	} {
+		if !strings.Contains(script, part) {
+			t.Errorf("missing %q in:\n%s", part, script)
+		}
+	}
+	if strings.Contains(postgresqlConf(db.spec), "archive_mode") {
+		t.Error("restored instance must not archive without backup")
+	}
+
+	pod := postgresPod(cr, db, Platform{})
+	container := pod.Spec.Containers[0]
+	if prefix := envValue(container.Env, restoreEnvPrefix+"WALG_FILE_PREFIX"); prefix != restoreStoragePath+"/prod/horreum/db/15" {
+		t.Errorf("unexpected prefix %s", prefix)
+	}
+	if envValue(container.Env, "WALG_FILE_PREFIX") != "" {
+		t.Error("storage of the restored instance must not be used for archiving")
+	}
+	if len(container.Command) != 3 || !strings.HasSuffix(container.Command[2], "source "+restoreBackupScript+"\nexec run-postgresql") {
+		t.Errorf("backup must be restored before the server starts: %v", container.Command)
+	}
+	if cm := postgresConfigMap(cr, db, Platform{}); cm.Data["restore-backup.bash"] == "" || cm.Data["restore-wal-g.bash"] == "" {
+		t.Error("restore scripts are missing")
+	}
+}
+
+func TestBackupRequiresWalGImage(t *testing.T) {
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			NodeHost: "horreum.example.com",
+			Postgres: hyperfoilv1alpha1.PostgresSpec{
+				PersistentVolumeClaim: "horreum-db",
+				Backup: hyperfoilv1alpha1.PostgresBackupSpec{
+					Enabled: true,
+					Storage: hyperfoilv1alpha1.BackupStorageSpec{PersistentVolumeClaim: "horreum-backup"},
+				},
+			},
+		},
+	}
+	if _, err := Render(cr, Platform{}, "", "", nil); err == nil {
+		t.Error("rendering backups without WAL-G image must fail")
+	}
+
+	r := fakeReconciler(t, cr)
+	if _, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(cr)}); err == nil {
+		t.Fatal("backups without WAL-G image must be rejected")
+	}
+	updated := &hyperfoilv1alpha1.Horreum{}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(cr), updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.Status.Status != "Error" || !strings.Contains(updated.Status.Reason, "WAL-G") {
+		t.Errorf("unexpected status %s: %s", updated.Status.Status, updated.Status.Reason)
+	}
+}
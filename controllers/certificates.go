@@ -84,9 +84,11 @@ func createCA(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler, logger logr.L
 
 		logger.Info("Creating a new CA secret " + caSecret.GetName())
 		if err = r.Create(context.TODO(), caSecret); err != nil {
+			recordEvent(r, cr, corev1.EventTypeWarning, "FailedCreate", "Cannot create CA secret "+caSecret.GetName()+": "+err.Error())
 			updateStatus(r, cr, "Error", "Cannot create CA private key secret")
 			return
 		}
+		recordEvent(r, cr, corev1.EventTypeNormal, "CertificateIssued", "Issued CA certificate in secret "+caSecret.GetName())
 	} else if err != nil {
 		logger.Error(err, "Cannot fetch current CA certificates")
 		return
@@ -116,11 +118,11 @@ func createCA(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler, logger logr.L
 	}
 
 	serviceCaConfigMap := &corev1.ConfigMap{}
-	err = r.Get(context.TODO(), types.NamespacedName{Name: "service-ca.crt", Namespace: cr.Namespace}, serviceCaConfigMap)
+	err = r.Get(context.TODO(), types.NamespacedName{Name: serviceCaConfigMapName(cr), Namespace: cr.Namespace}, serviceCaConfigMap)
 	if err != nil && errors.IsNotFound(err) {
 		serviceCaConfigMap.ObjectMeta = metav1.ObjectMeta{
 			Namespace: cr.Namespace,
-			Name:      "service-ca.crt",
+			Name:      serviceCaConfigMapName(cr),
 		}
 		serviceCaConfigMap.BinaryData = map[string][]byte{
 			"service-ca.crt": caPEMBytes,
@@ -128,12 +130,13 @@ func createCA(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler, logger logr.L
 		if err = controllerutil.SetControllerReference(cr, serviceCaConfigMap, r.Scheme); err != nil {
 			return
 		}
-		logger.Info("Creating config map service-ca.crt with CA certificate")
+		logger.Info("Creating config map " + serviceCaConfigMap.Name + " with CA certificate")
 		err = r.Create(context.TODO(), serviceCaConfigMap)
 		if err != nil {
 			logger.Error(err, "Cannot create/update config map with CA")
 			return
 		}
+		recordEvent(r, cr, corev1.EventTypeNormal, "Created", "Created ConfigMap "+serviceCaConfigMap.Name)
 	} else if err != nil {
 		logger.Error(err, "Cannot fetch current CA config map")
 		return
@@ -159,8 +162,10 @@ func createServiceCert(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler, logg
 			"*." + serviceName + "." + cr.Namespace + ".svc",
 			"*." + serviceName + "." + cr.Namespace + ".svc.cluster.local",
 		}
-		if cr.Spec.NodeHost != "" {
-			sans = append(sans, cr.Spec.NodeHost)
+		for _, host := range []string{appNodeHost(cr), keycloakNodeHost(cr)} {
+			if host != "" && (len(sans) == 4 || sans[len(sans)-1] != host) {
+				sans = append(sans, host)
+			}
 		}
 		cert := &x509.Certificate{
 			SerialNumber: big.NewInt(serial),
@@ -219,8 +224,11 @@ func createServiceCert(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler, logg
 		err = r.Create(context.TODO(), certSecret)
 		if err != nil {
 			logger.Error(err, "Cannot create secret with service certificate")
+			recordEvent(r, cr, corev1.EventTypeWarning, "FailedCreate", "Cannot create certificate secret "+certSecret.Name+": "+err.Error())
+			return err
 		}
-		return err
+		recordEvent(r, cr, corev1.EventTypeNormal, "CertificateIssued", "Issued certificate for service "+serviceName+" in secret "+certSecret.Name)
+		return nil
 	} else if err == nil {
 		logger.Info("Certificate " + resourceName + " is present, not doing anything")
 		return nil
@@ -0,0 +1,279 @@
+package horreum
+
+import (
+	"context"
+	"strconv"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	cloneWorkPath = "/clone"
+	// Connection to the source server is passed in PG* variables with this prefix
+	cloneEnvPrefix = "SOURCE_"
+	// The database of the source instance accepts connections from pods with this label
+	cloneSourceLabel = "hyperfoil.io/clone-source"
+	// Each instance may have its own CA, the certificate of the source server is verified against the source one
+	cloneSourceCaPath = "/etc/ssl/certs/source-service-ca.crt"
+)
+
+func cloneJobName(cr *hyperfoilv1alpha1.Horreum) string {
+	return cr.Name + "-clone"
+}
+
+// cloneScript copies the data and schema without owners and privileges: the roles of the clone have different names.
+// Extensions are created by the operator, and the owner, who runs Horreum migrations, cannot create them. The passphrase
+// Horreum uses to sign the roles of the user is replaced, otherwise the clone would not see any data.
+const cloneScript = `
+	set -e -o pipefail
+	PGHOST="$SOURCE_PGHOST" PGPORT="$SOURCE_PGPORT" PGUSER="$SOURCE_PGUSER" PGPASSWORD="$SOURCE_PGPASSWORD" \
+		PGSSLMODE="$SOURCE_PGSSLMODE" PGSSLROOTCERT="$SOURCE_PGSSLROOTCERT" \
+		pg_dump --format=custom --no-owner --no-privileges --dbname="$SOURCE_DATABASE" --file=` + cloneWorkPath + `/horreum.dump
+	pg_restore --list ` + cloneWorkPath + `/horreum.dump | grep -v -e ' EXTENSION ' -e ' SCHEMA - public ' > ` + cloneWorkPath + `/restore.list
+	pg_restore --no-owner --no-privileges --role="$OWNER" --single-transaction --use-list=` + cloneWorkPath + `/restore.list \
+		--dbname="$TARGET_DATABASE" ` + cloneWorkPath + `/horreum.dump
+	psql -X -v ON_ERROR_STOP=1 --dbname="$TARGET_DATABASE" \
+		-v owner="$OWNER" -v app_user="$APP_USER" -v db_secret="$DB_SECRET" -v scrub="$SCRUB_NOTIFICATIONS" <<-'SQL'
+	BEGIN;
+	SET ROLE :"owner";
+	GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO :"app_user";
+	GRANT USAGE, SELECT, UPDATE ON ALL SEQUENCES IN SCHEMA public TO :"app_user";
+	SELECT to_regclass('public.dbsecret') IS NOT NULL AS has_dbsecret,
+		to_regclass('public.notificationsettings') IS NOT NULL AS has_notifications,
+		to_regclass('public.action') IS NOT NULL AS has_actions \gset
+	RESET ROLE;
+	\if :has_dbsecret
+	UPDATE dbsecret SET passphrase = :'db_secret';
+	\endif
+	\if :scrub
+	\if :has_notifications
+	DELETE FROM notificationsettings;
+	\endif
+	\if :has_actions
+	DELETE FROM action;
+	\endif
+	\endif
+	COMMIT;
+	SQL
+`
+
+// cloneJob copies the Horreum database of the source instance into the server deployed for this instance
+func cloneJob(cr *hyperfoilv1alpha1.Horreum, source *hyperfoilv1alpha1.Horreum, p Platform) *batchv1.Job {
+	db := horreumPostgres(cr)
+	sourceDb := horreumPostgres(source)
+	image := postgresImage(db.spec, p)
+	userId := postgresUserId(db.spec, image)
+	env := postgresSuperuserEnv(cr, db, image)
+	for _, e := range postgresSuperuserEnv(source, sourceDb, postgresImage(sourceDb.spec, p)) {
+		if e.Name == "PGSSLROOTCERT" {
+			e.Value = cloneSourceCaPath
+		}
+		e.Name = cloneEnvPrefix + e.Name
+		env = append(env, e)
+	}
+	env = append(env,
+		corev1.EnvVar{
+			Name:  "SOURCE_DATABASE",
+			Value: sourceDb.database,
+		},
+		corev1.EnvVar{
+			Name:  "TARGET_DATABASE",
+			Value: db.database,
+		},
+		secretEnv("OWNER", db.adminSecret, corev1.BasicAuthUsernameKey),
+		secretEnv("APP_USER", appUserSecret(cr), corev1.BasicAuthUsernameKey),
+		secretEnv("DB_SECRET", appUserSecret(cr), "dbsecret"),
+		corev1.EnvVar{
+			Name:  "SCRUB_NOTIFICATIONS",
+			Value: strconv.FormatBool(cr.Spec.ScrubNotifications),
+		},
+	)
+	labels := map[string]string{
+		"app":            cr.Name,
+		"service":        "clone",
+		cloneSourceLabel: source.Name,
+	}
+	securityContext := restrictedSecurityContext(true)
+	securityContext.RunAsUser = &userId
+	backoffLimit := int32(2)
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cloneJobName(cr),
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy:    corev1.RestartPolicyNever,
+					ImagePullSecrets: cr.Spec.ImagePullSecrets,
+					SecurityContext:  restrictedPodSecurityContext(),
+					Containers: []corev1.Container{
+						{
+							Name:            "clone",
+							Image:           image,
+							ImagePullPolicy: p.PullPolicy,
+							Env:             env,
+							Command:         []string{"bash", "-c", cloneScript},
+							SecurityContext: securityContext,
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "clone",
+									MountPath: cloneWorkPath,
+								},
+								{
+									Name:      "service-ca",
+									MountPath: serviceCaPath,
+									SubPath:   "service-ca.crt",
+								},
+								{
+									Name:      "source-service-ca",
+									MountPath: cloneSourceCaPath,
+									SubPath:   "service-ca.crt",
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "clone",
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+						{
+							Name: "service-ca",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{
+										Name: serviceCaConfigMapName(cr),
+									},
+								},
+							},
+						},
+						{
+							Name: "source-service-ca",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{
+										Name: serviceCaConfigMapName(source),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// cloneDatabase copies the database of the instance in spec.cloneFrom once the server of this instance is provisioned.
+// Returns false until the copy succeeds; Horreum must not start on an empty database as it would create the schema.
+func cloneDatabase(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) (bool, error) {
+	name := cr.Spec.CloneFrom
+	if name == "" {
+		return true, nil
+	}
+	status := cr.Status.Clone
+	if status == nil || status.Source != name {
+		status = &hyperfoilv1alpha1.CloneStatus{
+			Source:  name,
+			Phase:   hyperfoilv1alpha1.CloneWaiting,
+			Started: metav1.Now(),
+		}
+		cr.Status.Clone = status
+		recordEvent(r, cr, corev1.EventTypeNormal, "CloneStarted", "Cloning database of Horreum "+name)
+	}
+	switch status.Phase {
+	case hyperfoilv1alpha1.CloneSucceeded:
+		return true, nil
+	case hyperfoilv1alpha1.CloneFailed:
+		updateStatus(r, cr, "Error", "Cloning database of Horreum "+name+" failed: "+status.Message)
+		return false, nil
+	}
+
+	source := &hyperfoilv1alpha1.Horreum{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, source); errors.IsNotFound(err) {
+		return false, waitForCloneSource(r, cr, "Horreum "+name+" does not exist")
+	} else if err != nil {
+		return false, err
+	}
+	if name == cr.Name {
+		return false, failClone(r, cr, "Horreum cannot be cloned from itself")
+	} else if source.Spec.Postgres.Enabled != nil && !*source.Spec.Postgres.Enabled || source.Spec.Database.Host != "" {
+		return false, failClone(r, cr, "Horreum "+name+" does not use PostgreSQL deployed by the operator")
+	}
+	from := postgresMajorVersion(dbImage(source, r.Platform))
+	to := postgresMajorVersion(dbImage(cr, r.Platform))
+	fromVersion, _ := strconv.ParseFloat(from, 64)
+	toVersion, _ := strconv.ParseFloat(to, 64)
+	if fromVersion > 0 && toVersion > 0 && toVersion < fromVersion {
+		return false, failClone(r, cr, "Cannot copy database of PostgreSQL version "+from+" into version "+to)
+	}
+	sourceDb := horreumPostgres(source)
+	if ready, err := isPodReady(r, postgresPod(source, sourceDb, r.Platform)); err != nil {
+		return false, err
+	} else if !ready {
+		return false, waitForCloneSource(r, cr, "Waiting for PostgreSQL of Horreum "+name)
+	}
+
+	job := cloneJob(cr, source, r.Platform)
+	if err := ensureSame(r, cr, logger, job, &batchv1.Job{}, nocompare, nocheck); err != nil {
+		return false, err
+	}
+	found := &batchv1.Job{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, found); err != nil {
+		return false, err
+	}
+	for _, c := range found.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			// The job is kept to let the user inspect its logs
+			return false, failClone(r, cr, "Copying the database failed ("+c.Message+"), see logs of job "+found.Name)
+		}
+	}
+	if found.Status.Succeeded == 0 {
+		status.Phase = hyperfoilv1alpha1.CloneCopying
+		status.Message = "Copying database of Horreum " + name
+		setStatus(r, cr, "Pending", "Cloning database of Horreum "+name)
+		return false, r.Status().Update(context.TODO(), cr)
+	}
+	if err := deleteJob(r, cr, found); err != nil {
+		return false, err
+	}
+	status.Phase = hyperfoilv1alpha1.CloneSucceeded
+	status.Message = "Copied database of Horreum " + name
+	if cr.Spec.ScrubNotifications {
+		status.Message += " without notification settings and actions"
+	}
+	status.Completed = &[]metav1.Time{metav1.Now()}[0]
+	recordEvent(r, cr, corev1.EventTypeNormal, "Cloned", status.Message)
+	return true, r.Status().Update(context.TODO(), cr)
+}
+
+func waitForCloneSource(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, message string) error {
+	cr.Status.Clone.Phase = hyperfoilv1alpha1.CloneWaiting
+	cr.Status.Clone.Message = message
+	setStatus(r, cr, "Pending", message)
+	return r.Status().Update(context.TODO(), cr)
+}
+
+func failClone(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, message string) error {
+	clone := cr.Status.Clone
+	clone.Phase = hyperfoilv1alpha1.CloneFailed
+	clone.Message = message
+	clone.Completed = &[]metav1.Time{metav1.Now()}[0]
+	recordEvent(r, cr, corev1.EventTypeWarning, "CloneFailed", message)
+	setStatus(r, cr, "Error", "Cloning database of Horreum "+clone.Source+" failed: "+message)
+	return r.Status().Update(context.TODO(), cr)
+}
@@ -0,0 +1,246 @@
+package horreum
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestCloneJob(t *testing.T) {
+	source := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "prod", Namespace: "test"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			Database: hyperfoilv1alpha1.DatabaseSpec{Name: "perf"},
+			Postgres: hyperfoilv1alpha1.PostgresSpec{Image: "registry.redhat.io/rhel9/postgresql-15:latest"},
+		},
+	}
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "staging", Namespace: "test"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			Postgres:           hyperfoilv1alpha1.PostgresSpec{Image: "docker.io/library/postgres:16.2"},
+			CloneFrom:          "prod",
+			ScrubNotifications: true,
+		},
+	}
+	job := cloneJob(cr, source, Platform{})
+	pod := job.Spec.Template
+	if pod.Labels[cloneSourceLabel] != "prod" || pod.Labels["app"] != "staging" {
+		t.Errorf("unexpected labels %v", pod.Labels)
+	}
+	env := pod.Spec.Containers[0].Env
+	for name, value := range map[string]string{
+		"PGHOST":              "staging-db.test.svc",
+		"SOURCE_PGHOST":       "prod-db.test.svc",
+		"SOURCE_PGUSER":       "postgres",
+		"SOURCE_DATABASE":     "perf",
+		"TARGET_DATABASE":     "horreum",
+		"SCRUB_NOTIFICATIONS": "true",
+	} {
+		if actual := envValue(env, name); actual != value {
+			t.Errorf("%s: expected %q, got %q", name, value, actual)
+		}
+	}
+	for _, e := range env {
+		if e.Name == "SOURCE_PGPASSWORD" && e.ValueFrom.SecretKeyRef.Name != "prod-db-admin" {
+			t.Errorf("source password must come from the source admin secret: %v", e.ValueFrom)
+		}
+	}
+
+	np := dbNetworkPolicy(source, Platform{})
+	found := false
+	for _, peer := range np.Spec.Ingress[0].From {
+		found = found || peer.PodSelector != nil && peer.PodSelector.MatchLabels[cloneSourceLabel] == "prod"
+	}
+	if !found {
+		t.Error("clones must be allowed to connect to the source database")
+	}
+	if !strings.Contains(cloneScript, "UPDATE dbsecret SET passphrase") {
+		t.Error("clone must use its own passphrase")
+	}
+}
+
+func TestCloneSourceCa(t *testing.T) {
+	source := &hyperfoilv1alpha1.Horreum{ObjectMeta: metav1.ObjectMeta{Name: "prod", Namespace: "test"}}
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "staging", Namespace: "test"},
+		Spec:       hyperfoilv1alpha1.HorreumSpec{CloneFrom: "prod"},
+	}
+	spec := cloneJob(cr, source, Platform{}).Spec.Template.Spec
+	env := spec.Containers[0].Env
+	if envValue(env, "PGSSLROOTCERT") != serviceCaPath || envValue(env, "SOURCE_PGSSLROOTCERT") != cloneSourceCaPath {
+		t.Errorf("unexpected root certificates %q, %q", envValue(env, "PGSSLROOTCERT"), envValue(env, "SOURCE_PGSSLROOTCERT"))
+	}
+	if envValue(env, "SOURCE_PGSSLMODE") != "verify-full" || !strings.Contains(cloneScript, `PGSSLROOTCERT="$SOURCE_PGSSLROOTCERT"`) {
+		t.Error("source server must be verified against its CA")
+	}
+	mounts := map[string]string{}
+	for _, m := range spec.Containers[0].VolumeMounts {
+		mounts[m.MountPath] = m.Name
+	}
+	configMaps := map[string]string{}
+	for _, v := range spec.Volumes {
+		if v.ConfigMap != nil {
+			configMaps[v.Name] = v.ConfigMap.Name
+		}
+	}
+	if configMaps[mounts[serviceCaPath]] != "staging-service-ca" {
+		t.Errorf("target CA must come from the clone: %v", configMaps)
+	}
+	if configMaps[mounts[cloneSourceCaPath]] != "prod-service-ca" {
+		t.Errorf("source CA must come from the source: %v", configMaps)
+	}
+}
+
+func cloneResources(sourceImage string, image string) (*hyperfoilv1alpha1.Horreum, *hyperfoilv1alpha1.Horreum) {
+	source := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "prod", Namespace: "test"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			Postgres: hyperfoilv1alpha1.PostgresSpec{Image: sourceImage},
+		},
+	}
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "staging", Namespace: "test"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			Postgres:  hyperfoilv1alpha1.PostgresSpec{Image: image},
+			CloneFrom: "prod",
+		},
+	}
+	return source, cr
+}
+
+func readyPod(pod *corev1.Pod) *corev1.Pod {
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	return pod
+}
+
+func getCloneJob(t *testing.T, r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) *batchv1.Job {
+	job := &batchv1.Job{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: cloneJobName(cr), Namespace: cr.Namespace}, job); errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestCloneWaitsForSource(t *testing.T) {
+	source, cr := cloneResources("docker.io/library/postgres:16.2", "docker.io/library/postgres:16.2")
+	r := fakeReconciler(t, cr)
+	if done, err := cloneDatabase(r, cr, r.Log); done || err != nil {
+		t.Fatalf("clone must wait for the source: %v, %v", done, err)
+	}
+	if cr.Status.Clone.Phase != hyperfoilv1alpha1.CloneWaiting || !strings.Contains(cr.Status.Clone.Message, "does not exist") {
+		t.Errorf("unexpected status %v", cr.Status.Clone)
+	}
+
+	// Source database is not ready
+	if err := r.Create(context.TODO(), source); err != nil {
+		t.Fatal(err)
+	}
+	if done, err := cloneDatabase(r, cr, r.Log); done || err != nil {
+		t.Fatalf("clone must wait for the source database: %v, %v", done, err)
+	}
+	if cr.Status.Clone.Phase != hyperfoilv1alpha1.CloneWaiting || getCloneJob(t, r, cr) != nil {
+		t.Errorf("job must not start before the source database is ready: %v", cr.Status.Clone)
+	}
+}
+
+func TestCloneFromItself(t *testing.T) {
+	_, cr := cloneResources("", "docker.io/library/postgres:16.2")
+	cr.Spec.CloneFrom = cr.Name
+	r := fakeReconciler(t, cr)
+	if done, err := cloneDatabase(r, cr, r.Log); done || err != nil {
+		t.Fatalf("unexpected result %v, %v", done, err)
+	}
+	if cr.Status.Clone.Phase != hyperfoilv1alpha1.CloneFailed || cr.Status.Clone.Completed == nil || cr.Status.Status != "Error" {
+		t.Errorf("unexpected status %v", cr.Status.Clone)
+	}
+}
+
+func TestCloneRejectsDowngrade(t *testing.T) {
+	source, cr := cloneResources("docker.io/library/postgres:16.2", "docker.io/library/postgres:15.6")
+	r := fakeReconciler(t, cr, source, readyPod(postgresPod(source, horreumPostgres(source), Platform{})))
+	if done, err := cloneDatabase(r, cr, r.Log); done || err != nil {
+		t.Fatalf("unexpected result %v, %v", done, err)
+	}
+	if cr.Status.Clone.Phase != hyperfoilv1alpha1.CloneFailed || !strings.Contains(cr.Status.Clone.Message, "version 16 into version 15") {
+		t.Errorf("unexpected status %v", cr.Status.Clone)
+	}
+	if getCloneJob(t, r, cr) != nil {
+		t.Error("job must not be created")
+	}
+
+	// Failure is terminal, fixing the version does not restart the copy
+	cr.Spec.Postgres.Image = "docker.io/library/postgres:16.2"
+	if done, err := cloneDatabase(r, cr, r.Log); done || err != nil {
+		t.Fatalf("unexpected result %v, %v", done, err)
+	}
+	if cr.Status.Clone.Phase != hyperfoilv1alpha1.CloneFailed || getCloneJob(t, r, cr) != nil {
+		t.Errorf("failed clone must not be retried: %v", cr.Status.Clone)
+	}
+}
+
+func TestCloneCopies(t *testing.T) {
+	source, cr := cloneResources("docker.io/library/postgres:15.6", "docker.io/library/postgres:16.2")
+	r := fakeReconciler(t, cr, source, readyPod(postgresPod(source, horreumPostgres(source), Platform{})))
+	if done, err := cloneDatabase(r, cr, r.Log); done || err != nil {
+		t.Fatalf("unexpected result %v, %v", done, err)
+	}
+	job := getCloneJob(t, r, cr)
+	if job == nil || cr.Status.Clone.Phase != hyperfoilv1alpha1.CloneCopying || cr.Status.Clone.Completed != nil {
+		t.Fatalf("copy must start: %v", cr.Status.Clone)
+	}
+
+	job.Status.Succeeded = 1
+	if err := r.Status().Update(context.TODO(), job); err != nil {
+		t.Fatal(err)
+	}
+	if done, err := cloneDatabase(r, cr, r.Log); !done || err != nil {
+		t.Fatalf("unexpected result %v, %v", done, err)
+	}
+	if cr.Status.Clone.Phase != hyperfoilv1alpha1.CloneSucceeded || cr.Status.Clone.Completed == nil {
+		t.Errorf("unexpected status %v", cr.Status.Clone)
+	}
+	if getCloneJob(t, r, cr) != nil {
+		t.Error("completed job must be deleted")
+	}
+	stored := &hyperfoilv1alpha1.Horreum{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: cr.Name, Namespace: cr.Namespace}, stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status.Clone == nil || stored.Status.Clone.Phase != hyperfoilv1alpha1.CloneSucceeded {
+		t.Errorf("status must be persisted: %v", stored.Status.Clone)
+	}
+	if done, err := cloneDatabase(r, cr, r.Log); !done || err != nil || getCloneJob(t, r, cr) != nil {
+		t.Errorf("database must be copied only once: %v, %v", done, err)
+	}
+}
+
+func TestCloneJobFailure(t *testing.T) {
+	source, cr := cloneResources("docker.io/library/postgres:16.2", "docker.io/library/postgres:16.2")
+	r := fakeReconciler(t, cr, source, readyPod(postgresPod(source, horreumPostgres(source), Platform{})))
+	if _, err := cloneDatabase(r, cr, r.Log); err != nil {
+		t.Fatal(err)
+	}
+	job := getCloneJob(t, r, cr)
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Message: "BackoffLimitExceeded"}}
+	if err := r.Status().Update(context.TODO(), job); err != nil {
+		t.Fatal(err)
+	}
+	if done, err := cloneDatabase(r, cr, r.Log); done || err != nil {
+		t.Fatalf("unexpected result %v, %v", done, err)
+	}
+	if cr.Status.Clone.Phase != hyperfoilv1alpha1.CloneFailed || !strings.Contains(cr.Status.Clone.Message, "BackoffLimitExceeded") {
+		t.Errorf("unexpected status %v", cr.Status.Clone)
+	}
+	if getCloneJob(t, r, cr) == nil {
+		t.Error("failed job must be kept for its logs")
+	}
+}
@@ -0,0 +1,321 @@
+package horreum
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// Secrets generated by older versions of the operator used predictable passwords and lack this annotation
+	passwordGeneratorAnnotation = "hyperfoil.io/password-generator"
+	passwordGenerator           = "crypto-rand"
+	// Size of the key Horreum uses to sign database access, in bytes
+	dbSecretKeySize = 32
+)
+
+// credentialSecret is a secret with credentials used by Horreum, Keycloak or PostgreSQL
+type credentialSecret struct {
+	// Name of the credential in spec.credentials
+	credential string
+	name       string
+	spec       hyperfoilv1alpha1.CredentialSpec
+	policy     hyperfoilv1alpha1.PasswordPolicy
+	// Additional random keys besides the password
+	keys []string
+}
+
+func passwordPolicy(cr *hyperfoilv1alpha1.Horreum, credential hyperfoilv1alpha1.CredentialSpec) hyperfoilv1alpha1.PasswordPolicy {
+	policy := cr.Spec.Credentials.PasswordPolicy
+	if credential.PasswordPolicy != nil {
+		if credential.PasswordPolicy.Length != 0 {
+			policy.Length = credential.PasswordPolicy.Length
+		}
+		if len(credential.PasswordPolicy.CharacterClasses) > 0 {
+			policy.CharacterClasses = credential.PasswordPolicy.CharacterClasses
+		}
+	}
+	if policy.Length == 0 {
+		policy.Length = 32
+	}
+	if len(policy.CharacterClasses) == 0 {
+		policy.CharacterClasses = []hyperfoilv1alpha1.CharacterClass{
+			hyperfoilv1alpha1.CharacterClassLowercase,
+			hyperfoilv1alpha1.CharacterClassUppercase,
+			hyperfoilv1alpha1.CharacterClassDigits,
+		}
+	}
+	return policy
+}
+
+func credentialSecrets(cr *hyperfoilv1alpha1.Horreum) []credentialSecret {
+	credentials := cr.Spec.Credentials
+	secret := func(credential string, name string, spec hyperfoilv1alpha1.CredentialSpec, keys ...string) credentialSecret {
+		return credentialSecret{credential: credential, name: name, spec: spec, policy: passwordPolicy(cr, spec), keys: keys}
+	}
+	secrets := []credentialSecret{
+		secret("dbAdmin", dbAdminSecret(cr), credentials.DbAdmin),
+		secret("app", appUserSecret(cr), credentials.App, "dbsecret"),
+		secret("keycloakAdmin", keycloakAdminSecret(cr), credentials.KeycloakAdmin),
+	}
+	// Keycloak with embedded database needs no database credentials
+	if keycloakDatabaseMode(cr) != hyperfoilv1alpha1.KeycloakDatabaseEmbedded {
+		secrets = append(secrets, secret("keycloakDb", keycloakDbSecret(cr), credentials.KeycloakDb))
+	}
+	if hasReadReplicas(cr) {
+		secrets = append(secrets, secret("dbReadOnly", dbReadOnlySecret(cr), credentials.DbReadOnly))
+		secrets = append(secrets, secret("dbReplication", dbReplicationSecret(cr), credentials.DbReplication))
+	}
+	if isKeycloakDbDeployed(cr) {
+		secrets = append(secrets, secret("keycloakDbAdmin", keycloakDbAdminSecret(cr), credentials.KeycloakDbAdmin))
+	}
+	return append(secrets, secret("horreumAdmin", horreumAdminSecret(cr), credentials.HorreumAdmin))
+}
+
+func newGeneratedSecret(cr *hyperfoilv1alpha1.Horreum, c credentialSecret) (*corev1.Secret, error) {
+	secret, err := newSecret(cr, c.name, c.policy)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range c.keys {
+		if secret.StringData[key], err = generateKey(dbSecretKeySize); err != nil {
+			return nil, err
+		}
+	}
+	return secret, nil
+}
+
+func newExternalSecret() *unstructured.Unstructured {
+	es := &unstructured.Unstructured{}
+	es.SetGroupVersionKind(schema.GroupVersionKind{Group: "external-secrets.io", Version: "v1beta1", Kind: "ExternalSecret"})
+	return es
+}
+
+// externalSecret is the ExternalSecret that External Secrets Operator syncs into the credential secret
+func externalSecret(cr *hyperfoilv1alpha1.Horreum, c credentialSecret) (*unstructured.Unstructured, error) {
+	spec := c.spec.ExternalSecret
+	if spec == nil {
+		return nil, fmt.Errorf("spec.credentials.%s.externalSecret must be set for source externalSecret", c.credential)
+	}
+	remoteRef := func(secretKey string, property string) interface{} {
+		return map[string]interface{}{
+			"secretKey": secretKey,
+			"remoteRef": map[string]interface{}{
+				"key":      spec.RemoteKey,
+				"property": property,
+			},
+		}
+	}
+	data := []interface{}{
+		remoteRef(corev1.BasicAuthUsernameKey, withDefault(spec.UsernameProperty, corev1.BasicAuthUsernameKey)),
+		remoteRef(corev1.BasicAuthPasswordKey, withDefault(spec.PasswordProperty, corev1.BasicAuthPasswordKey)),
+	}
+	for _, key := range c.keys {
+		data = append(data, remoteRef(key, withDefault(spec.DbSecretProperty, key)))
+	}
+	es := newExternalSecret()
+	es.SetName(c.name)
+	es.SetNamespace(cr.Namespace)
+	es.SetLabels(map[string]string{"app": cr.Name})
+	es.Object["spec"] = map[string]interface{}{
+		"refreshInterval": withDefault(spec.RefreshInterval, "1h"),
+		"secretStoreRef": map[string]interface{}{
+			"name": spec.StoreName,
+			"kind": withDefault(spec.StoreKind, "SecretStore"),
+		},
+		"target": map[string]interface{}{
+			"name":           c.name,
+			"creationPolicy": "Owner",
+			"template": map[string]interface{}{
+				"type": string(corev1.SecretTypeBasicAuth),
+			},
+		},
+		"data": data,
+	}
+	return es, nil
+}
+
+func compareExternalSecret(i1, i2 interface{}, logger logr.Logger) bool {
+	es1, ok1 := i1.(*unstructured.Unstructured)
+	es2, ok2 := i2.(*unstructured.Unstructured)
+	if !ok1 || !ok2 {
+		logger.Info("Cannot cast to Unstructured: " + fmt.Sprintf("%v | %v", i1, i2))
+		return false
+	}
+	// The server fills in defaults so we check only what we set
+	return equality.Semantic.DeepDerivative(es1.Object["spec"], es2.Object["spec"])
+}
+
+// secretsSyncPod mounts Secrets Store CSI volumes; the driver syncs secrets only while a pod uses the volume
+func secretsSyncPod(cr *hyperfoilv1alpha1.Horreum, p Platform) *corev1.Pod {
+	volumes := []corev1.Volume{}
+	volumeMounts := []corev1.VolumeMount{}
+	for _, c := range credentialSecrets(cr) {
+		if c.spec.Source != hyperfoilv1alpha1.CredentialSourceCSI || c.spec.CSI == nil {
+			continue
+		}
+		volumes = append(volumes, corev1.Volume{
+			Name: "csi-" + strings.ToLower(c.credential),
+			VolumeSource: corev1.VolumeSource{
+				CSI: &corev1.CSIVolumeSource{
+					Driver:   "secrets-store.csi.k8s.io",
+					ReadOnly: &[]bool{true}[0],
+					VolumeAttributes: map[string]string{
+						"secretProviderClass": c.spec.CSI.SecretProviderClass,
+					},
+				},
+			},
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      "csi-" + strings.ToLower(c.credential),
+			MountPath: "/mnt/secrets-store/" + c.credential,
+			ReadOnly:  true,
+		})
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-secrets-sync",
+			Namespace: cr.Namespace,
+			Labels: map[string]string{
+				"app":     cr.Name,
+				"service": "secrets-sync",
+			},
+		},
+		Spec: corev1.PodSpec{
+			ImagePullSecrets:   cr.Spec.ImagePullSecrets,
+			ServiceAccountName: cr.Spec.Credentials.CSIServiceAccount,
+			SecurityContext:    restrictedPodSecurityContext(),
+			Containers: []corev1.Container{
+				{
+					Name:            "pause",
+					Image:           secretsSyncImage(p),
+					ImagePullPolicy: p.PullPolicy,
+					VolumeMounts:    volumeMounts,
+					SecurityContext: restrictedSecurityContext(true),
+				},
+			},
+			Volumes: volumes,
+		},
+	}
+}
+
+func isSecretReady(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, c credentialSecret) (bool, error) {
+	secret := &corev1.Secret{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: c.name, Namespace: cr.Namespace}, secret); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, key := range append([]string{corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey}, c.keys...) {
+		if len(secret.Data[key]) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ensureCredentials generates missing secrets or sets up their sync from an external secret store.
+// Returns false when some of the secrets are not synced yet.
+func ensureCredentials(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) (bool, error) {
+	allReady := true
+	statuses := []hyperfoilv1alpha1.CredentialStatus{}
+	useCSI := false
+	for _, c := range credentialSecrets(cr) {
+		status := hyperfoilv1alpha1.CredentialStatus{
+			Name:   c.credential,
+			Secret: c.name,
+			Source: string(c.spec.Source),
+		}
+		switch c.spec.Source {
+		case "", hyperfoilv1alpha1.CredentialSourceGenerated:
+			secret, err := newGeneratedSecret(cr, c)
+			if err != nil {
+				return false, err
+			}
+			keys := append([]string{corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey}, c.keys...)
+			found := &corev1.Secret{}
+			if err := ensureSame(r, cr, logger, secret, found, nocompare, checkSecret(keys...)); err != nil {
+				return false, err
+			}
+			status.Source = ifThenElse(found.UID == "" || metav1.IsControlledBy(found, cr), "generated", "provided")
+			// Freshly created secret might not be in the cache yet
+			status.Ready = true
+			statuses = append(statuses, status)
+			continue
+		case hyperfoilv1alpha1.CredentialSourceExternalSecret:
+			es, err := externalSecret(cr, c)
+			if err != nil {
+				return false, err
+			}
+			if err := ensureSame(r, cr, logger, es, newExternalSecret(), compareExternalSecret, nocheck); err != nil {
+				return false, err
+			}
+		case hyperfoilv1alpha1.CredentialSourceCSI:
+			if c.spec.CSI == nil {
+				return false, fmt.Errorf("spec.credentials.%s.csi must be set for source csi", c.credential)
+			}
+			useCSI = true
+		}
+		ready, err := isSecretReady(r, cr, c)
+		if err != nil {
+			return false, err
+		}
+		status.Ready = ready
+		allReady = allReady && ready
+		statuses = append(statuses, status)
+	}
+	syncPod := secretsSyncPod(cr, r.Platform)
+	if useCSI {
+		if err := ensureSame(r, cr, logger, syncPod, &corev1.Pod{}, comparePods, nocheck); err != nil {
+			return false, err
+		}
+	} else if err := ensureDeleted(r, cr, syncPod, &corev1.Pod{}); err != nil {
+		return false, err
+	}
+	cr.Status.Credentials = statuses
+	return allReady, nil
+}
+
+// weakSecrets lists secrets created by the operator that should be rotated
+func weakSecrets(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) ([]string, error) {
+	weak := []string{}
+	for _, s := range credentialSecrets(cr) {
+		if s.spec.Source != "" && s.spec.Source != hyperfoilv1alpha1.CredentialSourceGenerated {
+			continue
+		}
+		secret := &corev1.Secret{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: s.name, Namespace: cr.Namespace}, secret); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if !metav1.IsControlledBy(secret, cr) {
+			continue
+		}
+		if secret.Annotations[passwordGeneratorAnnotation] != passwordGenerator ||
+			len(secret.Data[corev1.BasicAuthPasswordKey]) < int(s.policy.Length) {
+			weak = append(weak, s.name)
+			continue
+		}
+		for _, key := range s.keys {
+			// Base64-encoded key is longer than its size in bytes
+			if len(secret.Data[key]) < dbSecretKeySize {
+				weak = append(weak, s.name)
+				break
+			}
+		}
+	}
+	return weak, nil
+}
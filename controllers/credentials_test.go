@@ -0,0 +1,212 @@
+package horreum
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func findCredential(cr *hyperfoilv1alpha1.Horreum, credential string) credentialSecret {
+	for _, c := range credentialSecrets(cr) {
+		if c.credential == credential {
+			return c
+		}
+	}
+	return credentialSecret{}
+}
+
+func TestExternalSecret(t *testing.T) {
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			Credentials: hyperfoilv1alpha1.CredentialsSpec{
+				App: hyperfoilv1alpha1.CredentialSpec{
+					Source: hyperfoilv1alpha1.CredentialSourceExternalSecret,
+					ExternalSecret: &hyperfoilv1alpha1.ExternalSecretSpec{
+						StoreName:        "vault",
+						StoreKind:        "ClusterSecretStore",
+						RemoteKey:        "horreum/app",
+						PasswordProperty: "pw",
+						DbSecretProperty: "passphrase",
+						RefreshInterval:  "5m",
+					},
+				},
+				DbAdmin: hyperfoilv1alpha1.CredentialSpec{
+					Source:         hyperfoilv1alpha1.CredentialSourceExternalSecret,
+					ExternalSecret: &hyperfoilv1alpha1.ExternalSecretSpec{StoreName: "vault", RemoteKey: "horreum/admin"},
+				},
+				KeycloakAdmin: hyperfoilv1alpha1.CredentialSpec{Source: hyperfoilv1alpha1.CredentialSourceExternalSecret},
+			},
+		},
+	}
+	es, err := externalSecret(cr, findCredential(cr, "app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if es.GetKind() != "ExternalSecret" || es.GetAPIVersion() != "external-secrets.io/v1beta1" ||
+		es.GetName() != appUserSecret(cr) || es.GetNamespace() != "test" {
+		t.Errorf("unexpected object %s %s/%s", es.GetAPIVersion(), es.GetNamespace(), es.GetName())
+	}
+	for path, expected := range map[string]string{
+		"refreshInterval":       "5m",
+		"secretStoreRef.name":   "vault",
+		"secretStoreRef.kind":   "ClusterSecretStore",
+		"target.name":           appUserSecret(cr),
+		"target.creationPolicy": "Owner",
+		"target.template.type":  string(corev1.SecretTypeBasicAuth),
+	} {
+		fields := append([]string{"spec"}, strings.Split(path, ".")...)
+		if actual, _, _ := unstructured.NestedString(es.Object, fields...); actual != expected {
+			t.Errorf("spec.%s: expected %q, got %q", path, expected, actual)
+		}
+	}
+	data, _, _ := unstructured.NestedSlice(es.Object, "spec", "data")
+	properties := map[string]string{}
+	for _, d := range data {
+		entry := d.(map[string]interface{})
+		ref := entry["remoteRef"].(map[string]interface{})
+		if ref["key"] != "horreum/app" {
+			t.Errorf("unexpected remote key %v", ref["key"])
+		}
+		properties[entry["secretKey"].(string)] = ref["property"].(string)
+	}
+	if len(properties) != 3 || properties["username"] != "username" || properties["password"] != "pw" || properties["dbsecret"] != "passphrase" {
+		t.Errorf("unexpected data %v", properties)
+	}
+
+	es, err = externalSecret(cr, findCredential(cr, "dbAdmin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind, _, _ := unstructured.NestedString(es.Object, "spec", "secretStoreRef", "kind"); kind != "SecretStore" {
+		t.Errorf("unexpected default store kind %s", kind)
+	}
+	if interval, _, _ := unstructured.NestedString(es.Object, "spec", "refreshInterval"); interval != "1h" {
+		t.Errorf("unexpected default refresh interval %s", interval)
+	}
+	if data, _, _ := unstructured.NestedSlice(es.Object, "spec", "data"); len(data) != 2 {
+		t.Errorf("admin secret has no dbsecret: %v", data)
+	}
+	if _, err := externalSecret(cr, findCredential(cr, "keycloakAdmin")); err == nil {
+		t.Error("missing externalSecret must be rejected")
+	}
+}
+
+func TestEnsureCredentialsWaitsForExternalSecret(t *testing.T) {
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test", UID: "1234"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			Credentials: hyperfoilv1alpha1.CredentialsSpec{
+				App: hyperfoilv1alpha1.CredentialSpec{
+					Source:         hyperfoilv1alpha1.CredentialSourceExternalSecret,
+					ExternalSecret: &hyperfoilv1alpha1.ExternalSecretSpec{StoreName: "vault", RemoteKey: "horreum/app"},
+				},
+			},
+		},
+	}
+	r := fakeReconciler(t, cr)
+	appStatus := func() hyperfoilv1alpha1.CredentialStatus {
+		for _, s := range cr.Status.Credentials {
+			if s.Name == "app" {
+				return s
+			}
+		}
+		t.Fatal("missing status of app credential")
+		return hyperfoilv1alpha1.CredentialStatus{}
+	}
+
+	if ready, err := ensureCredentials(r, cr, r.Log); err != nil || ready {
+		t.Fatalf("credentials must wait for the synced secret: %v, %v", ready, err)
+	}
+	if s := appStatus(); s.Ready || s.Source != "externalSecret" || s.Secret != appUserSecret(cr) {
+		t.Errorf("unexpected status %+v", s)
+	}
+	es := newExternalSecret()
+	if err := r.Get(context.TODO(), client.ObjectKey{Name: appUserSecret(cr), Namespace: "test"}, es); err != nil {
+		t.Fatalf("ExternalSecret was not created: %v", err)
+	}
+	generated := &corev1.Secret{}
+	if err := r.Get(context.TODO(), client.ObjectKey{Name: dbAdminSecret(cr), Namespace: "test"}, generated); err != nil {
+		t.Errorf("other credentials must be generated: %v", err)
+	}
+
+	// External Secrets Operator creates the secret; it is ready once all keys are synced
+	synced := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: appUserSecret(cr), Namespace: "test"},
+		Data: map[string][]byte{
+			corev1.BasicAuthUsernameKey: []byte("horreum"),
+			corev1.BasicAuthPasswordKey: []byte("secret"),
+		},
+	}
+	if err := r.Create(context.TODO(), synced); err != nil {
+		t.Fatal(err)
+	}
+	if ready, err := ensureCredentials(r, cr, r.Log); err != nil || ready {
+		t.Fatalf("secret without dbsecret is not ready: %v, %v", ready, err)
+	}
+	synced.Data["dbsecret"] = []byte("passphrase")
+	if err := r.Update(context.TODO(), synced); err != nil {
+		t.Fatal(err)
+	}
+	if ready, err := ensureCredentials(r, cr, r.Log); err != nil || !ready {
+		t.Fatalf("synced secret must be ready: %v, %v", ready, err)
+	}
+	if !appStatus().Ready {
+		t.Error("status must report the synced secret")
+	}
+}
+
+func TestSecretsSyncPod(t *testing.T) {
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test", UID: "1234"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			Credentials: hyperfoilv1alpha1.CredentialsSpec{
+				KeycloakAdmin: hyperfoilv1alpha1.CredentialSpec{
+					Source: hyperfoilv1alpha1.CredentialSourceCSI,
+					CSI:    &hyperfoilv1alpha1.CSISecretSpec{SecretProviderClass: "horreum-keycloak"},
+				},
+				CSIServiceAccount: "vault-reader",
+			},
+		},
+	}
+	pod := secretsSyncPod(cr, Platform{})
+	if pod.Spec.ServiceAccountName != "vault-reader" || len(pod.Spec.Volumes) != 1 {
+		t.Fatalf("unexpected pod %v", pod.Spec)
+	}
+	csi := pod.Spec.Volumes[0].CSI
+	if csi == nil || csi.Driver != "secrets-store.csi.k8s.io" || !*csi.ReadOnly ||
+		csi.VolumeAttributes["secretProviderClass"] != "horreum-keycloak" {
+		t.Errorf("unexpected volume %v", pod.Spec.Volumes[0])
+	}
+	if !hasMount(pod.Spec.Containers[0].VolumeMounts, "csi-keycloakadmin", "/mnt/secrets-store/keycloakAdmin") {
+		t.Errorf("unexpected mounts %v", pod.Spec.Containers[0].VolumeMounts)
+	}
+
+	r := fakeReconciler(t, cr)
+	if ready, err := ensureCredentials(r, cr, r.Log); err != nil || ready {
+		t.Fatalf("credentials must wait for the CSI driver: %v, %v", ready, err)
+	}
+	if err := r.Get(context.TODO(), client.ObjectKeyFromObject(pod), &corev1.Pod{}); err != nil {
+		t.Fatalf("sync pod was not created: %v", err)
+	}
+	// The pod is removed when no credential uses CSI
+	cr.Spec.Credentials.KeycloakAdmin = hyperfoilv1alpha1.CredentialSpec{}
+	if _, err := ensureCredentials(r, cr, r.Log); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(context.TODO(), client.ObjectKeyFromObject(pod), &corev1.Pod{}); !errors.IsNotFound(err) {
+		t.Errorf("sync pod must be deleted: %v", err)
+	}
+
+	cr.Spec.Credentials.KeycloakAdmin = hyperfoilv1alpha1.CredentialSpec{Source: hyperfoilv1alpha1.CredentialSourceCSI}
+	if _, err := ensureCredentials(r, cr, r.Log); err == nil {
+		t.Error("missing csi must be rejected")
+	}
+}
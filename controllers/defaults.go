@@ -1,6 +1,8 @@
 package horreum
 
 import (
+	"strings"
+
 	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
 )
 
@@ -10,13 +12,108 @@ func dbDefaultHost(cr *hyperfoilv1alpha1.Horreum) string {
 
 func dbURL(cr *hyperfoilv1alpha1.Horreum, db *hyperfoilv1alpha1.DatabaseSpec, defName string) string {
 	return "jdbc:postgresql://" + withDefault(db.Host, dbDefaultHost(cr)) +
-		":" + withDefaultInt(db.Port, 5432) + "/" + withDefault(db.Name, defName)
+		":" + withDefaultInt(db.Port, 5432) + "/" + withDefault(db.Name, defName) + dbURLProperties(db)
+}
+
+// appDbURL is used by Horreum at runtime, through PgBouncer when it is enabled
+func appDbURL(cr *hyperfoilv1alpha1.Horreum) string {
+	if cr.Spec.PgBouncer.Enabled {
+		return pgBouncerURL(cr, withDefault(cr.Spec.Database.Name, "horreum"))
+	}
+	return dbURL(cr, &cr.Spec.Database, "horreum")
+}
+
+const (
+	// Path where the CA certificate for an external database is mounted.
+	dbCAMountPath = "/etc/horreum/db-ca"
+	// Path where the service CA bundle is mounted.
+	serviceCaPath = "/etc/ssl/certs/service-ca.crt"
+)
+
+func dbSSLMode(db *hyperfoilv1alpha1.DatabaseSpec) string {
+	if db.SSLMode != "" {
+		return db.SSLMode
+	}
+	if db.Host == "" {
+		return "verify-full"
+	}
+	return ""
+}
+
+func dbSSLRootCert(db *hyperfoilv1alpha1.DatabaseSpec) string {
+	if db.CASecret != "" {
+		return dbCAMountPath + "/ca.crt"
+	}
+	if db.Host == "" {
+		// The database deployed by the operator uses certificate signed by the service CA
+		return serviceCaPath
+	}
+	return ""
+}
+
+// dbURLProperties returns JDBC URL query (including the leading '?') or empty string
+func dbURLProperties(db *hyperfoilv1alpha1.DatabaseSpec) string {
+	props := []string{}
+	sslMode := dbSSLMode(db)
+	if sslMode != "" {
+		props = append(props, "sslmode="+sslMode)
+	}
+	if rootCert := dbSSLRootCert(db); rootCert != "" && sslMode != "disable" {
+		props = append(props, "sslrootcert="+rootCert)
+	}
+	if len(props) == 0 {
+		return ""
+	}
+	return "?" + strings.Join(props, "&")
+}
+
+func dbCertsSecret(cr *hyperfoilv1alpha1.Horreum) string {
+	return cr.Name + "-postgres"
 }
 
 func dbAdminSecret(cr *hyperfoilv1alpha1.Horreum) string {
 	return withDefault(cr.Spec.Postgres.AdminSecret, cr.Name+"-db-admin")
 }
 
+// Streaming replicas are deployed only for the Horreum database
+func hasReadReplicas(cr *hyperfoilv1alpha1.Horreum) bool {
+	return (cr.Spec.Postgres.Enabled == nil || *cr.Spec.Postgres.Enabled) && cr.Spec.Database.Host == "" &&
+		cr.Spec.Postgres.ReadReplicas.Replicas > 0
+}
+
+func dbReadOnlySecret(cr *hyperfoilv1alpha1.Horreum) string {
+	return withDefault(cr.Spec.Postgres.ReadReplicas.Secret, cr.Name+"-db-readonly")
+}
+
+// Read replicas stream WAL from the primary as this role, so that they do not need superuser credentials
+func dbReplicationSecret(cr *hyperfoilv1alpha1.Horreum) string {
+	return cr.Name + "-db-replication"
+}
+
+func keycloakDbAdminSecret(cr *hyperfoilv1alpha1.Horreum) string {
+	return withDefault(cr.Spec.Keycloak.Postgres.AdminSecret, cr.Name+"-keycloak-db-admin")
+}
+
+func keycloakDatabaseMode(cr *hyperfoilv1alpha1.Horreum) hyperfoilv1alpha1.KeycloakDatabaseMode {
+	if cr.Spec.Keycloak.DatabaseMode == "" {
+		return hyperfoilv1alpha1.KeycloakDatabaseShared
+	}
+	return cr.Spec.Keycloak.DatabaseMode
+}
+
+// isKeycloakDbDeployed tells whether the operator runs a PostgreSQL dedicated to Keycloak
+func isKeycloakDbDeployed(cr *hyperfoilv1alpha1.Horreum) bool {
+	return cr.Spec.Keycloak.External.PublicUri == "" && keycloakDatabaseMode(cr) == hyperfoilv1alpha1.KeycloakDatabaseDedicated
+}
+
+// keycloakDbDefaultHost is the database host used by Keycloak when spec.keycloak.database.host is not set
+func keycloakDbDefaultHost(cr *hyperfoilv1alpha1.Horreum) string {
+	if keycloakDatabaseMode(cr) == hyperfoilv1alpha1.KeycloakDatabaseDedicated {
+		return keycloakPostgres(cr).host(cr)
+	}
+	return dbDefaultHost(cr)
+}
+
 func appUserSecret(cr *hyperfoilv1alpha1.Horreum) string {
 	return withDefault(cr.Spec.Database.Secret, cr.Name+"-app")
 }
@@ -33,13 +130,68 @@ func horreumAdminSecret(cr *hyperfoilv1alpha1.Horreum) string {
 	return withDefault(cr.Spec.AdminSecret, cr.Name+"-admin")
 }
 
-func dbImage(cr *hyperfoilv1alpha1.Horreum, useRedHatImage bool) string {
-	return withDefault(cr.Spec.Postgres.Image,
-		ifThenElse(useRedHatImage, "registry.redhat.io/rhel8/postgresql-12:latest", "docker.io/library/postgres:14.4"))
+// Each Horreum instance gets its own config map with the CA bundle (under key `service-ca.crt`)
+// so that several instances in one namespace don't fight over a shared one.
+func serviceCaConfigMapName(cr *hyperfoilv1alpha1.Horreum) string {
+	return cr.Name + "-service-ca"
+}
+
+// The community image uses different environment variables and directory layout than the Red Hat one
+func isDockerDbImage(image string) bool {
+	name := image
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.IndexAny(name, ":@"); i >= 0 {
+		name = name[:i]
+	}
+	return name == "postgres"
+}
+
+func dbImage(cr *hyperfoilv1alpha1.Horreum, p Platform) string {
+	return postgresImage(&cr.Spec.Postgres, p)
+}
+
+func postgresImage(spec *hyperfoilv1alpha1.PostgresSpec, p Platform) string {
+	if spec.Image != "" {
+		return spec.Image
+	} else if p.UseRedHatImages {
+		return p.mirrored(withDefault(p.Images.PostgresRedHat, DefaultPostgresRedHatImage))
+	}
+	return p.mirrored(withDefault(p.Images.Postgres, DefaultPostgresImage))
+}
+
+func appImage(cr *hyperfoilv1alpha1.Horreum, p Platform) string {
+	return withDefault(cr.Spec.Image, p.mirrored(withDefault(p.Images.App, DefaultAppImage)))
+}
+
+func keycloakImage(cr *hyperfoilv1alpha1.Horreum, p Platform) string {
+	return withDefault(cr.Spec.Keycloak.Image, p.mirrored(withDefault(p.Images.Keycloak, DefaultKeycloakImage)))
+}
+
+func pgBouncerImage(cr *hyperfoilv1alpha1.Horreum, p Platform) string {
+	return withDefault(cr.Spec.PgBouncer.Image, p.mirrored(withDefault(p.Images.PgBouncer, DefaultPgBouncerImage)))
+}
+
+// walGImage returns an empty string when the operator has not been configured with a WAL-G image
+func walGImage(p Platform) string {
+	if p.Images.WalG == "" {
+		return ""
+	}
+	return p.mirrored(p.Images.WalG)
+}
+
+func secretsSyncImage(p Platform) string {
+	return p.mirrored(withDefault(p.Images.SecretsSync, DefaultSecretsSyncImage))
+}
+
+// Node hosts of Horreum and Keycloak differ only when set through v1beta1 API
+func appNodeHost(cr *hyperfoilv1alpha1.Horreum) string {
+	return withDefault(cr.GetNodeHosts().App, cr.Spec.NodeHost)
 }
 
-func appImage(cr *hyperfoilv1alpha1.Horreum) string {
-	return withDefault(cr.Spec.Image, "quay.io/hyperfoil/horreum:latest")
+func keycloakNodeHost(cr *hyperfoilv1alpha1.Horreum) string {
+	return withDefault(cr.GetNodeHosts().Keycloak, cr.Spec.NodeHost)
 }
 
 func keycloakInternalURL(cr *hyperfoilv1alpha1.Horreum) string {
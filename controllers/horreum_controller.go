@@ -21,6 +21,8 @@ import (
 	stdErrors "errors"
 	"fmt"
 	"reflect"
+	"strings"
+	"time"
 
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -33,23 +35,35 @@ import (
 	logr "github.com/go-logr/logr"
 
 	routev1 "github.com/openshift/api/route/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 )
 
 // HorreumReconciler reconciles a Horreum object
 type HorreumReconciler struct {
 	client.Client
-	Log             logr.Logger
-	Scheme          *runtime.Scheme
-	RoutesAvailable bool
-	UseRedHatImages bool
+	Platform
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
 }
 
+// Changing this annotation of a pod template restarts the pods
+const restartedAtAnnotation = "hyperfoil.io/restarted-at"
+
+// Pods with different value of this annotation are recreated, e.g. when the configuration they read changes
+const configHashAnnotation = "hyperfoil.io/config-hash"
+
 type compareFunc func(interface{}, interface{}, logr.Logger) bool
 type checkFunc func(interface{}) (bool, string, string)
 
@@ -64,8 +78,13 @@ var nocheck = func(interface{}) (bool, string, string) {
 //+kubebuilder:rbac:groups=hyperfoil.io,resources=horreums/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=hyperfoil.io,resources=horreums/finalizers,verbs=update
 //+kubebuilder:rbac:groups=core,resources=pods;services;services/finalizers;endpoints;persistentvolumeclaims;events;configmaps;secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=external-secrets.io,resources=externalsecrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors,verbs=get;create
 //+kubebuilder:rbac:groups=apps,resourceNames=horreum-operator,resources=deployments/finalizers,verbs=update
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=batch,resources=jobs;cronjobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=route.openshift.io,resources=routes;routes/custom-host,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=security.openshift.io,resources=securitycontextconstraints,resourceNames=nonroot,verbs=use
 
@@ -87,14 +106,23 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 	err := r.Get(ctx, request.NamespacedName, cr)
 	if err != nil {
 		if errors.IsNotFound(err) {
+			// Owned objects are garbage-collected, only the metrics have to be removed
+			setReplicaLag(request.NamespacedName, nil)
 			return reconcile.Result{}, nil
 		}
 		return reconcile.Result{}, err
 	}
 
-	if cr.Spec.NodeHost == "" &&
-		(isNodePort(r, cr.Spec.ServiceType) || isNodePort(r, cr.Spec.Keycloak.ServiceType)) {
+	if appNodeHost(cr) == "" && isNodePort(r.Platform, cr.Spec.ServiceType) ||
+		keycloakNodeHost(cr) == "" && isNodePort(r.Platform, cr.Spec.Keycloak.ServiceType) {
 		msg := "service of type NodePort is used but spec.nodeHost is not defined"
+		recordEvent(r, cr, corev1.EventTypeWarning, "InvalidSpec", msg)
+		updateStatus(r, cr, "Error", msg)
+		return reconcile.Result{}, stdErrors.New(msg)
+	}
+	if walGImage(r.Platform) == "" && (usesWalG(&cr.Spec.Postgres) || isKeycloakDbDeployed(cr) && usesWalG(&cr.Spec.Keycloak.Postgres)) {
+		msg := "backup or restore of PostgreSQL is configured but the operator has no WAL-G image; set --wal-g-image"
+		recordEvent(r, cr, corev1.EventTypeWarning, "InvalidSpec", msg)
 		updateStatus(r, cr, "Error", msg)
 		return reconcile.Result{}, stdErrors.New(msg)
 	}
@@ -119,72 +147,170 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 		if err != nil {
 			return reconcile.Result{}, err
 		}
-	} else {
-		serviceCaConfigMap := &corev1.ConfigMap{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      "service-ca.crt",
-				Namespace: cr.Namespace,
-				Annotations: map[string]string{
-					"service.beta.openshift.io/inject-cabundle": "true",
-				},
-			},
+		if cr.Spec.Postgres.Enabled == nil || *cr.Spec.Postgres.Enabled {
+			err = createServiceCert(cr, r, logger, ca, caPrivateKey, dbCertsSecret(cr), cr.GetName()+"-db", 3000)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
 		}
-		if err := ensureSame(r, cr, logger, serviceCaConfigMap, &corev1.ConfigMap{}, nocompare, nocheck); err != nil {
+		if keycloakDb := keycloakPostgres(cr); isKeycloakDbDeployed(cr) {
+			err = createServiceCert(cr, r, logger, ca, caPrivateKey, keycloakDb.certsSecret, keycloakDb.name, 4000)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+		if cr.Spec.PgBouncer.Enabled {
+			err = createServiceCert(cr, r, logger, ca, caPrivateKey, pgBouncerCertsSecret(cr), pgBouncerName(cr), 5000)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+		if hasReadReplicas(cr) {
+			err = createServiceCert(cr, r, logger, ca, caPrivateKey, dbReadOnlyCertsSecret(cr), dbReadOnlyService(cr), 6000)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+	} else {
+		if err := ensureSame(r, cr, logger, serviceCaConfigMap(cr), &corev1.ConfigMap{}, nocompare, nocheck); err != nil {
 			return reconcile.Result{}, err
 		}
 	}
-
-	dbAdminSecret := newSecret(cr, dbAdminSecret(cr))
-	if err := ensureSame(r, cr, logger, dbAdminSecret, &corev1.Secret{}, nocompare,
-		checkSecret(corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey)); err != nil {
-		return reconcile.Result{}, err
-	}
-	appSecret := newSecret(cr, appUserSecret(cr))
-	appSecret.StringData["dbsecret"] = generatePassword()
-	if err := ensureSame(r, cr, logger, appSecret, &corev1.Secret{}, nocompare,
-		checkSecret(corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey, "dbsecret")); err != nil {
+	if err := deleteLegacyServiceCa(r, cr); err != nil {
 		return reconcile.Result{}, err
 	}
-	keycloakAdminSecret := newSecret(cr, keycloakAdminSecret(cr))
-	if err := ensureSame(r, cr, logger, keycloakAdminSecret, &corev1.Secret{}, nocompare,
-		checkSecret(corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey)); err != nil {
+
+	if ready, err := ensureCredentials(r, cr, logger); err != nil {
+		recordEvent(r, cr, corev1.EventTypeWarning, "CredentialsError", err.Error())
+		updateStatus(r, cr, "Error", "Cannot set up credentials: "+err.Error())
 		return reconcile.Result{}, err
+	} else if !ready {
+		updateStatus(r, cr, "Pending", "Waiting for secrets synced from external secret store")
+		logger.Info("Waiting for secrets synced from external secret store")
+		return reconcile.Result{RequeueAfter: 10 * time.Second}, nil
 	}
-	keycloakDbSecret := newSecret(cr, keycloakDbSecret(cr))
-	if err := ensureSame(r, cr, logger, keycloakDbSecret, &corev1.Secret{}, nocompare,
-		checkSecret(corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey)); err != nil {
+	if err := ensureNetworkPolicies(r, cr, logger); err != nil {
 		return reconcile.Result{}, err
 	}
-	horreumAdminSecret := newSecret(cr, horreumAdminSecret(cr))
-	if err := ensureSame(r, cr, logger, horreumAdminSecret, &corev1.Secret{}, nocompare,
-		checkSecret(corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey)); err != nil {
+	if weak, err := weakSecrets(r, cr); err != nil {
 		return reconcile.Result{}, err
+	} else {
+		if len(weak) > 0 && !reflect.DeepEqual(weak, cr.Status.WeakSecrets) {
+			recordEvent(r, cr, corev1.EventTypeWarning, "WeakSecrets",
+				"Secrets "+strings.Join(weak, ", ")+" have weak passwords; set spec.rotateCredentials to replace them")
+		}
+		cr.Status.WeakSecrets = weak
 	}
 
-	postgresConfigMap := postgresConfigMap(cr)
-	postgresPod := postgresPod(cr, r)
-	postgresService := postgresService(cr)
+	horreumDb := horreumPostgres(cr)
 	if cr.Spec.Postgres.Enabled != nil && !*cr.Spec.Postgres.Enabled {
-		if err := ensureDeleted(r, cr, postgresPod, &corev1.Pod{}); err != nil {
+		if err := ensureDeleted(r, cr, postgresPod(cr, horreumDb, r.Platform), &corev1.Pod{}); err != nil {
 			return reconcile.Result{}, err
 		}
-		if err := ensureDeleted(r, cr, postgresService, &corev1.Service{}); err != nil {
+		if err := ensureDeleted(r, cr, postgresService(cr, horreumDb), &corev1.Service{}); err != nil {
 			return reconcile.Result{}, err
 		}
+		if problems, err := provisionExternalDatabase(r, cr, logger); err != nil {
+			setCondition(cr, hyperfoilv1alpha1.ConditionDatabaseProvisioned, metav1.ConditionFalse, "ProvisioningFailed", err.Error())
+			recordEvent(r, cr, corev1.EventTypeWarning, "ProvisioningFailed", err.Error())
+			updateStatus(r, cr, "Error", "Cannot provision external database")
+			return reconcile.Result{}, err
+		} else if len(problems) > 0 {
+			msg := strings.Join(problems, "; ")
+			setCondition(cr, hyperfoilv1alpha1.ConditionDatabaseProvisioned, metav1.ConditionFalse, "MissingDatabaseObjects", msg)
+			recordEvent(r, cr, corev1.EventTypeWarning, "MissingDatabaseObjects", msg)
+			updateStatus(r, cr, "Error", "External database is not ready: "+msg)
+			return reconcile.Result{RequeueAfter: time.Minute}, nil
+		}
 	} else {
-		if err := ensureSame(r, cr, logger, postgresConfigMap, &corev1.ConfigMap{}, compareConfigMap, nocheck); err != nil {
+		if proceed, err := upgradePostgres(r, cr, horreumDb, logger); err != nil {
+			return reconcile.Result{}, err
+		} else if !proceed {
+			setCondition(cr, hyperfoilv1alpha1.ConditionDatabaseProvisioned, metav1.ConditionFalse, "UpgradingDatabase", cr.Status.Reason)
+			r.Status().Update(ctx, cr)
+			return reconcile.Result{RequeueAfter: 10 * time.Second}, nil
+		}
+		// Upgrade may have moved the data to another volume
+		horreumDb = horreumPostgres(cr)
+		if ready, err := ensurePostgres(r, cr, logger, horreumDb); err != nil {
+			return reconcile.Result{}, err
+		} else if !ready {
+			setCondition(cr, hyperfoilv1alpha1.ConditionDatabaseProvisioned, metav1.ConditionFalse, "WaitingForDatabase", "Waiting for PostgreSQL to become ready")
+			r.Status().Update(ctx, cr)
+			logger.Info("Waiting for PostgreSQL to become ready")
+			return reconcile.Result{RequeueAfter: 5 * time.Second}, nil
+		}
+		if err := provisionManagedDatabase(r, cr, logger); err != nil {
+			setCondition(cr, hyperfoilv1alpha1.ConditionDatabaseProvisioned, metav1.ConditionFalse, "ProvisioningFailed", err.Error())
+			recordEvent(r, cr, corev1.EventTypeWarning, "ProvisioningFailed", err.Error())
+			updateStatus(r, cr, "Error", "Cannot provision database")
+			return reconcile.Result{}, err
+		}
+		if err := completePostgresUpgrade(r, cr, horreumDb); err != nil {
+			return reconcile.Result{}, err
+		}
+		if done, err := cloneDatabase(r, cr, logger); err != nil {
+			return reconcile.Result{}, err
+		} else if !done {
+			setCondition(cr, hyperfoilv1alpha1.ConditionDatabaseProvisioned, metav1.ConditionFalse, "CloningDatabase", cr.Status.Reason)
+			r.Status().Update(ctx, cr)
+			return reconcile.Result{RequeueAfter: 10 * time.Second}, nil
+		}
+	}
+	if err := ensureDbReplicas(r, cr, logger); err != nil {
+		return reconcile.Result{}, err
+	}
+	updateReplicaStatus(r, cr, logger)
+	keycloakDb := keycloakPostgres(cr)
+	if isKeycloakDbDeployed(cr) {
+		if proceed, err := upgradePostgres(r, cr, keycloakDb, logger); err != nil {
+			return reconcile.Result{}, err
+		} else if !proceed {
+			setCondition(cr, hyperfoilv1alpha1.ConditionDatabaseProvisioned, metav1.ConditionFalse, "UpgradingDatabase", cr.Status.Reason)
+			r.Status().Update(ctx, cr)
+			return reconcile.Result{RequeueAfter: 10 * time.Second}, nil
+		}
+		// Upgrade may have moved the data to another volume
+		keycloakDb = keycloakPostgres(cr)
+		if ready, err := ensurePostgres(r, cr, logger, keycloakDb); err != nil {
+			return reconcile.Result{}, err
+		} else if !ready {
+			setCondition(cr, hyperfoilv1alpha1.ConditionDatabaseProvisioned, metav1.ConditionFalse, "WaitingForDatabase", "Waiting for Keycloak PostgreSQL to become ready")
+			r.Status().Update(ctx, cr)
+			logger.Info("Waiting for Keycloak PostgreSQL to become ready")
+			return reconcile.Result{RequeueAfter: 5 * time.Second}, nil
+		}
+		if err := provisionKeycloakDatabase(r, cr, logger); err != nil {
+			setCondition(cr, hyperfoilv1alpha1.ConditionDatabaseProvisioned, metav1.ConditionFalse, "ProvisioningFailed", err.Error())
+			recordEvent(r, cr, corev1.EventTypeWarning, "ProvisioningFailed", err.Error())
+			updateStatus(r, cr, "Error", "Cannot provision Keycloak database")
 			return reconcile.Result{}, err
 		}
-		if err := ensureSame(r, cr, logger, postgresPod, &corev1.Pod{}, comparePods, checkPod); err != nil {
+		if err := completePostgresUpgrade(r, cr, keycloakDb); err != nil {
+			return reconcile.Result{}, err
+		}
+	} else {
+		if err := ensureDeleted(r, cr, postgresPod(cr, keycloakDb, r.Platform), &corev1.Pod{}); err != nil {
 			return reconcile.Result{}, err
 		}
-		if err := ensureSame(r, cr, logger, postgresService, &corev1.Service{}, compareService, nocheck); err != nil {
+		if err := ensureDeleted(r, cr, postgresService(cr, keycloakDb), &corev1.Service{}); err != nil {
 			return reconcile.Result{}, err
 		}
 	}
+	if !meta.IsStatusConditionTrue(cr.Status.Conditions, hyperfoilv1alpha1.ConditionDatabaseProvisioned) {
+		recordEvent(r, cr, corev1.EventTypeNormal, "DatabaseProvisioned", "Databases, roles and extensions are present")
+	}
+	setCondition(cr, hyperfoilv1alpha1.ConditionDatabaseProvisioned, metav1.ConditionTrue, "Provisioned", "Databases, roles and extensions are present")
+	if err := ensurePgBouncer(r, cr, logger); err != nil {
+		return reconcile.Result{}, err
+	}
 
-	keycloakService := keycloakService(cr, r)
-	keycloakRoute, err := keycloakRoute(cr, r)
+	keycloakService := keycloakService(cr, r.Platform)
+	keycloakTLS, err := routeTLSSecret(r, cr, cr.Spec.Keycloak.Route)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	keycloakRoute, err := keycloakRoute(cr, r.Platform, keycloakTLS)
 	if err != nil {
 		return reconcile.Result{}, err
 	}
@@ -193,7 +319,7 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 		if err := ensureSame(r, cr, logger, keycloakService, &corev1.Service{}, compareService, nocheck); err != nil {
 			return reconcile.Result{}, err
 		}
-		if isNodePort(r, cr.Spec.Keycloak.ServiceType) {
+		if isNodePort(r.Platform, cr.Spec.Keycloak.ServiceType) {
 			nodePort, err := getNodePort(r, keycloakService, logger)
 			if err != nil {
 				return reconcile.Result{}, err
@@ -202,9 +328,9 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 				logger.Info("Waiting for Keycloak service node port to be assigned")
 				return reconcile.Result{Requeue: true}, nil
 			}
-			keycloakPublicUrl = fmt.Sprintf("https://%s:%d", cr.Spec.NodeHost, nodePort)
+			keycloakPublicUrl = fmt.Sprintf("https://%s:%d", keycloakNodeHost(cr), nodePort)
 		} else {
-			if cr.Spec.Keycloak.ServiceType == corev1.ServiceTypeLoadBalancer {
+			if serviceType(cr.Spec.Keycloak.ServiceType, r.Platform) == corev1.ServiceTypeLoadBalancer {
 				keycloakPublicUrl, err = getLoadBalancer(r, keycloakService, logger)
 				if err != nil {
 					return reconcile.Result{}, err
@@ -225,9 +351,21 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 	}
 	cr.Status.KeycloakUrl = keycloakPublicUrl
 
-	keycloakPod := keycloakPod(cr, keycloakPublicUrl)
+	keycloakDeployment := keycloakDeployment(cr, r.Platform, keycloakPublicUrl)
+	keycloakDiscoveryService := keycloakDiscoveryService(cr)
+	keycloakPDB := keycloakPodDisruptionBudget(cr)
+	// Older versions of the operator ran Keycloak in a single pod
+	if err := ensureDeleted(r, cr, &corev1.Pod{ObjectMeta: keycloakDeployment.ObjectMeta}, &corev1.Pod{}); err != nil {
+		return reconcile.Result{}, err
+	}
 	if cr.Spec.Keycloak.External.PublicUri != "" {
-		if err := ensureDeleted(r, cr, keycloakPod, &corev1.Pod{}); err != nil {
+		if err := ensureDeleted(r, cr, keycloakDeployment, &appsv1.Deployment{}); err != nil {
+			return reconcile.Result{}, err
+		}
+		if err := ensureDeleted(r, cr, keycloakPDB, &policyv1.PodDisruptionBudget{}); err != nil {
+			return reconcile.Result{}, err
+		}
+		if err := ensureDeleted(r, cr, keycloakDiscoveryService, &corev1.Service{}); err != nil {
 			return reconcile.Result{}, err
 		}
 		if err := ensureDeleted(r, cr, keycloakService, &corev1.Service{}); err != nil {
@@ -238,12 +376,41 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 				return reconcile.Result{}, err
 			}
 		}
-	} else if err := ensureSame(r, cr, logger, keycloakPod, &corev1.Pod{}, comparePods, checkPod); err != nil {
-		return reconcile.Result{}, err
+	} else {
+		if err := ensureSame(r, cr, logger, keycloakDiscoveryService, &corev1.Service{}, compareService, nocheck); err != nil {
+			return reconcile.Result{}, err
+		}
+		if err := ensureDeployment(r, cr, logger, keycloakDeployment); err != nil {
+			return reconcile.Result{}, err
+		}
+		if keycloakReplicas(cr) > 1 {
+			if err := ensureSame(r, cr, logger, keycloakPDB, &policyv1.PodDisruptionBudget{}, comparePodDisruptionBudget, nocheck); err != nil {
+				return reconcile.Result{}, err
+			}
+		} else if err := ensureDeleted(r, cr, keycloakPDB, &policyv1.PodDisruptionBudget{}); err != nil {
+			return reconcile.Result{}, err
+		}
 	}
 
-	appService := appService(cr, r)
-	appRoute, err := appRoute(cr, r)
+	if rotationRequested(cr) {
+		if done, err := rotateCredentials(r, cr, logger); err != nil {
+			recordEvent(r, cr, corev1.EventTypeWarning, "CredentialsRotationFailed", err.Error())
+			updateStatus(r, cr, "Error", "Cannot rotate credentials")
+			return reconcile.Result{}, err
+		} else if !done {
+			updateStatus(r, cr, "Pending", "Waiting for Keycloak to rotate credentials")
+			return reconcile.Result{RequeueAfter: 5 * time.Second}, nil
+		}
+		updateStatus(r, cr, "Pending", "Restarting after credentials rotation")
+		return reconcile.Result{Requeue: true}, nil
+	}
+
+	appService := appService(cr, r.Platform)
+	appTLS, err := routeTLSSecret(r, cr, cr.Spec.Route)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	appRoute, err := appRoute(cr, r.Platform, appTLS)
 	if err != nil {
 		return reconcile.Result{}, err
 	}
@@ -251,7 +418,7 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 		return reconcile.Result{}, err
 	}
 	var appPublicUrl string
-	if isNodePort(r, cr.Spec.ServiceType) {
+	if isNodePort(r.Platform, cr.Spec.ServiceType) {
 		nodePort, err := getNodePort(r, appService, logger)
 		if err != nil {
 			return reconcile.Result{}, err
@@ -260,9 +427,9 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 			updateStatus(r, cr, "Pending", "Waiting for service node port")
 			return reconcile.Result{Requeue: true}, nil
 		}
-		appPublicUrl = fmt.Sprintf("https://%s:%d", cr.Spec.NodeHost, nodePort)
+		appPublicUrl = fmt.Sprintf("https://%s:%d", appNodeHost(cr), nodePort)
 	} else {
-		if cr.Spec.ServiceType == corev1.ServiceTypeLoadBalancer {
+		if serviceType(cr.Spec.ServiceType, r.Platform) == corev1.ServiceTypeLoadBalancer {
 			appPublicUrl, err = getLoadBalancer(r, appService, logger)
 			if err != nil {
 				return reconcile.Result{}, err
@@ -282,7 +449,7 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 	}
 	cr.Status.PublicUrl = appPublicUrl
 
-	appPod := appPod(cr, keycloakPublicUrl, appPublicUrl)
+	appPod := appPod(cr, r.Platform, keycloakPublicUrl, appPublicUrl)
 	if err := ensureSame(r, cr, logger, appPod, &corev1.Pod{}, comparePods, checkPod); err != nil {
 		return reconcile.Result{}, err
 	}
@@ -294,6 +461,9 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 
 	r.Status().Update(ctx, cr)
 
+	if hasReadReplicas(cr) {
+		return reconcile.Result{RequeueAfter: replicaLagInterval}, nil
+	}
 	return reconcile.Result{}, nil
 }
 
@@ -317,9 +487,11 @@ func ensureSame(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr
 		logger.Info("Creating a new "+kind, kind+".Namespace", object.GetNamespace(), kind+".Name", object.GetName())
 		err = r.Create(context.TODO(), object)
 		if err != nil {
+			recordEvent(r, cr, corev1.EventTypeWarning, "FailedCreate", "Cannot create "+kind+" "+object.GetName()+": "+err.Error())
 			updateStatus(r, cr, "Error", "Cannot create "+kind+" "+object.GetName())
 			return err
 		}
+		recordEvent(r, cr, corev1.EventTypeNormal, "Created", "Created "+kind+" "+object.GetName())
 		setStatus(r, cr, "Pending", "Creating "+kind+" "+object.GetName())
 	} else if err != nil {
 		updateStatus(r, cr, "Error", "Cannot find "+kind+" "+object.GetName())
@@ -327,25 +499,32 @@ func ensureSame(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr
 	} else if compare(object, out, logger) {
 		logger.Info(kind + " " + object.GetName() + " already exists and matches.")
 		if ok, status, reason := check(out); !ok {
+			if status == "Error" {
+				recordEvent(r, cr, corev1.EventTypeWarning, kind+"Error", kind+" "+object.GetName()+" "+reason)
+			}
 			setStatus(r, cr, status, kind+" "+object.GetName()+" "+reason)
 		}
 	} else {
 		logger.Info(kind + " " + object.GetName() + " already exists but does not match. Deleting existing object.")
 		if err = r.Delete(context.TODO(), out); err != nil {
 			logger.Error(err, "Cannot delete "+kind+" "+object.GetName())
+			recordEvent(r, cr, corev1.EventTypeWarning, "FailedDelete", "Cannot delete "+kind+" "+object.GetName()+": "+err.Error())
 			updateStatus(r, cr, "Error", "Cannot delete "+kind+" "+object.GetName())
 			return err
 		}
 		logger.Info("Creating a new " + kind)
 		if err = r.Create(context.TODO(), object); err != nil {
+			recordEvent(r, cr, corev1.EventTypeWarning, "FailedCreate", "Cannot create "+kind+" "+object.GetName()+": "+err.Error())
 			updateStatus(r, cr, "Error", "Cannot create "+kind+" "+object.GetName())
 			return err
 		}
+		recordEvent(r, cr, corev1.EventTypeNormal, "Recreated", kind+" "+object.GetName()+" did not match the desired state and was recreated")
 		setStatus(r, cr, "Pending", "Creating "+kind+" "+object.GetName())
 	}
 	return nil
 }
 
+// ensureDeleted removes the object unless it was created by someone else than this Horreum resource
 func ensureDeleted(r *HorreumReconciler, instance *hyperfoilv1alpha1.Horreum, object resource, out client.Object) error {
 	kind := reflect.TypeOf(object).Elem().Name()
 	err := r.Get(context.TODO(), types.NamespacedName{Name: object.GetName(), Namespace: object.GetNamespace()}, out)
@@ -354,17 +533,112 @@ func ensureDeleted(r *HorreumReconciler, instance *hyperfoilv1alpha1.Horreum, ob
 	} else if err != nil {
 		updateStatus(r, instance, "Error", "Cannot find "+kind+" "+object.GetName())
 		return err
+	} else if !metav1.IsControlledBy(out, instance) {
+		r.Log.Info("Not deleting "+kind+" "+object.GetName()+" as it is not controlled by Horreum "+instance.Name,
+			kind+".Namespace", object.GetNamespace())
+		return nil
 	} else {
 		if err = r.Delete(context.TODO(), out); err != nil {
+			recordEvent(r, instance, corev1.EventTypeWarning, "FailedDelete", "Cannot delete "+kind+" "+object.GetName()+": "+err.Error())
 			updateStatus(r, instance, "Error", "Cannot delete "+kind+" "+object.GetName())
 			return err
 		}
+		recordEvent(r, instance, corev1.EventTypeNormal, "Deleted", "Deleted "+kind+" "+object.GetName())
+	}
+	return nil
+}
+
+// ensureDeployment creates the deployment or updates it in place, so that the pods are replaced
+// in a rolling fashion rather than all at once
+func ensureDeployment(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger, deployment *appsv1.Deployment) error {
+	found := &appsv1.Deployment{}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: deployment.Name, Namespace: deployment.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		return ensureSame(r, cr, logger, deployment, found, compareDeployment, checkDeployment)
+	} else if err != nil {
+		updateStatus(r, cr, "Error", "Cannot find Deployment "+deployment.Name)
+		return err
+	}
+	if !compareDeployment(deployment, found, logger) {
+		logger.Info("Deployment " + deployment.Name + " does not match. Updating existing object.")
+		found.Spec.Replicas = deployment.Spec.Replicas
+		// Keep other annotations of the template, such as the restart marker
+		if hash, ok := deployment.Spec.Template.Annotations[configHashAnnotation]; ok {
+			if found.Spec.Template.Annotations == nil {
+				found.Spec.Template.Annotations = map[string]string{}
+			}
+			found.Spec.Template.Annotations[configHashAnnotation] = hash
+		}
+		found.Spec.Template.Labels = deployment.Spec.Template.Labels
+		found.Spec.Template.Spec = deployment.Spec.Template.Spec
+		if err := r.Update(context.TODO(), found); err != nil {
+			recordEvent(r, cr, corev1.EventTypeWarning, "FailedUpdate", "Cannot update Deployment "+deployment.Name+": "+err.Error())
+			updateStatus(r, cr, "Error", "Cannot update Deployment "+deployment.Name)
+			return err
+		}
+		recordEvent(r, cr, corev1.EventTypeNormal, "Updated", "Deployment "+deployment.Name+" did not match the desired state and was updated")
+		setStatus(r, cr, "Pending", "Updating Deployment "+deployment.Name)
+		return nil
+	}
+	if ok, status, reason := checkDeployment(found); !ok {
+		// Problems of individual pods are reported sooner than by the deployment
+		pods := &corev1.PodList{}
+		if err := r.List(context.TODO(), pods, client.InNamespace(found.Namespace), client.MatchingLabels(found.Spec.Selector.MatchLabels)); err != nil {
+			return err
+		}
+		for i := range pods.Items {
+			if _, podStatus, podReason := checkPod(&pods.Items[i]); podStatus == "Error" {
+				status, reason = podStatus, "has pod "+pods.Items[i].Name+" that "+podReason
+				break
+			}
+		}
+		if status == "Error" {
+			recordEvent(r, cr, corev1.EventTypeWarning, "DeploymentError", "Deployment "+found.Name+" "+reason)
+		}
+		setStatus(r, cr, status, "Deployment "+found.Name+" "+reason)
 	}
 	return nil
 }
 
-func isNodePort(r *HorreumReconciler, serviceType corev1.ServiceType) bool {
-	return serviceType == corev1.ServiceTypeNodePort || serviceType == "" && !r.RoutesAvailable
+// restartDeployment replaces the pods one by one, like `kubectl rollout restart`
+func restartDeployment(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, name string) error {
+	found := &appsv1.Deployment{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, found); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if found.Spec.Template.Annotations == nil {
+		found.Spec.Template.Annotations = map[string]string{}
+	}
+	found.Spec.Template.Annotations[restartedAtAnnotation] = time.Now().Format(time.RFC3339)
+	if err := r.Update(context.TODO(), found); err != nil {
+		return err
+	}
+	recordEvent(r, cr, corev1.EventTypeNormal, "Restarted", "Restarted pods of Deployment "+name)
+	return nil
+}
+
+// Older versions of the operator used a single config map `service-ca.crt` shared by all
+// Horreum instances in the namespace and owned by whichever instance created it first.
+func deleteLegacyServiceCa(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) error {
+	legacy := &corev1.ConfigMap{}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: "service-ca.crt", Namespace: cr.Namespace}, legacy)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !metav1.IsControlledBy(legacy, cr) {
+		return nil
+	}
+	return ensureDeleted(r, cr, legacy, &corev1.ConfigMap{})
+}
+
+func isNodePort(p Platform, svcType corev1.ServiceType) bool {
+	return serviceType(svcType, p) == corev1.ServiceTypeNodePort
 }
 
 func getNodePort(r *HorreumReconciler, service *corev1.Service, logger logr.Logger) (int32, error) {
@@ -439,6 +713,67 @@ func updateStatus(r *HorreumReconciler, instance *hyperfoilv1alpha1.Horreum, sta
 	r.Status().Update(context.TODO(), instance)
 }
 
+func setCondition(instance *hyperfoilv1alpha1.Horreum, conditionType string, status metav1.ConditionStatus, reason string, message string) {
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: instance.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// recordEvent emits a Kubernetes event on the Horreum resource so that the
+// lifecycle can be followed through `kubectl describe horreum`.
+func recordEvent(r *HorreumReconciler, instance *hyperfoilv1alpha1.Horreum, eventType string, reason string, message string) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Event(instance, eventType, reason, message)
+}
+
+// ensurePostgres deploys the database server and reports whether it accepts connections
+func ensurePostgres(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger, db postgresInstance) (bool, error) {
+	if err := ensureSame(r, cr, logger, postgresConfigMap(cr, db, r.Platform), &corev1.ConfigMap{}, compareConfigMap, nocheck); err != nil {
+		return false, err
+	}
+	pod := postgresPod(cr, db, r.Platform)
+	if err := ensureSame(r, cr, logger, pod, &corev1.Pod{}, comparePods, checkPod); err != nil {
+		return false, err
+	}
+	if err := ensureSame(r, cr, logger, postgresService(cr, db), &corev1.Service{}, compareService, nocheck); err != nil {
+		return false, err
+	}
+	if err := ensurePostgresBackup(r, cr, logger, db); err != nil {
+		return false, err
+	}
+	return isPodReady(r, pod)
+}
+
+func isPodReady(r *HorreumReconciler, pod *corev1.Pod) (bool, error) {
+	found := &corev1.Pod{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace}, found); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	ready, _, _ := checkPod(found)
+	return ready, nil
+}
+
+func isDeploymentReady(r *HorreumReconciler, name string, namespace string) (bool, error) {
+	found := &appsv1.Deployment{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, found); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	ready, _, _ := checkDeployment(found)
+	return ready, nil
+}
+
 func comparePods(i1 interface{}, i2 interface{}, logger logr.Logger) bool {
 	p1, ok1 := i1.(*corev1.Pod)
 	p2, ok2 := i2.(*corev1.Pod)
@@ -446,6 +781,10 @@ func comparePods(i1 interface{}, i2 interface{}, logger logr.Logger) bool {
 		logger.Info("Cannot cast to Pods: " + fmt.Sprintf("%v | %v", i1, i2))
 		return false
 	}
+	if p1.Annotations[configHashAnnotation] != p2.Annotations[configHashAnnotation] {
+		logger.Info("Pod " + p1.GetName() + " uses outdated configuration")
+		return false
+	}
 
 	if equality.Semantic.DeepDerivative(p1.Spec, p2.Spec) {
 		return true
@@ -456,6 +795,80 @@ func comparePods(i1 interface{}, i2 interface{}, logger logr.Logger) bool {
 	return false
 }
 
+func compareDeployment(i1 interface{}, i2 interface{}, logger logr.Logger) bool {
+	d1, ok1 := i1.(*appsv1.Deployment)
+	d2, ok2 := i2.(*appsv1.Deployment)
+	if !ok1 || !ok2 {
+		logger.Info("Cannot cast to Deployments: " + fmt.Sprintf("%v | %v", i1, i2))
+		return false
+	}
+	if !equality.Semantic.DeepEqual(d1.Spec.Replicas, d2.Spec.Replicas) {
+		logger.Info("Deployment " + d1.GetName() + " replicas do not match")
+		return false
+	}
+	if d1.Spec.Template.Annotations[configHashAnnotation] != d2.Spec.Template.Annotations[configHashAnnotation] {
+		logger.Info("Deployment " + d1.GetName() + " uses outdated configuration")
+		return false
+	}
+	if equality.Semantic.DeepDerivative(d1.Spec.Template.Spec, d2.Spec.Template.Spec) {
+		return true
+	}
+	diff := cmp.Diff(d1.Spec.Template.Spec, d2.Spec.Template.Spec)
+	logger.Info("Deployment " + d1.GetName() + " diff (-want,+got):\n" + diff)
+	return false
+}
+
+// checkDeployment is ready when all replicas run the current template and are ready
+func checkDeployment(i interface{}) (bool, string, string) {
+	deployment, ok := i.(*appsv1.Deployment)
+	if !ok {
+		return false, "Error", "is not a deployment"
+	}
+	for _, c := range deployment.Status.Conditions {
+		if c.Type == appsv1.DeploymentReplicaFailure && c.Status == corev1.ConditionTrue {
+			return false, "Error", "cannot create pods: " + c.Message
+		} else if c.Type == appsv1.DeploymentProgressing && c.Status == corev1.ConditionFalse {
+			return false, "Error", "is not progressing: " + c.Message
+		}
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+	if status.ObservedGeneration < deployment.Generation || status.UpdatedReplicas < replicas ||
+		status.Replicas > status.UpdatedReplicas {
+		return false, "Pending", fmt.Sprintf("is rolling out, %d/%d replicas updated", status.UpdatedReplicas, replicas)
+	}
+	if status.ReadyReplicas < replicas {
+		return false, "Pending", fmt.Sprintf("has %d/%d replicas ready", status.ReadyReplicas, replicas)
+	}
+	return true, "", ""
+}
+
+func comparePodDisruptionBudget(i1 interface{}, i2 interface{}, logger logr.Logger) bool {
+	pdb1, ok1 := i1.(*policyv1.PodDisruptionBudget)
+	pdb2, ok2 := i2.(*policyv1.PodDisruptionBudget)
+	if !ok1 || !ok2 {
+		logger.Info("Cannot cast to PodDisruptionBudgets: " + fmt.Sprintf("%v | %v", i1, i2))
+		return false
+	}
+	return equality.Semantic.DeepDerivative(pdb1.Spec, pdb2.Spec)
+}
+
+// serviceCaConfigMap gets the OpenShift service CA bundle injected
+func serviceCaConfigMap(cr *hyperfoilv1alpha1.Horreum) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      serviceCaConfigMapName(cr),
+			Namespace: cr.Namespace,
+			Annotations: map[string]string{
+				"service.beta.openshift.io/inject-cabundle": "true",
+			},
+		},
+	}
+}
+
 func uploadConfig(cr *hyperfoilv1alpha1.Horreum) *corev1.ConfigMap {
 	keycloakURL := keycloakInternalURL(cr)
 	horreumURL := innerProtocol(cr.Spec.Route) + cr.Name + "." + cr.Namespace + `.svc`
@@ -484,11 +897,11 @@ func checkSecret(keys ...string) checkFunc {
 	return func(obj interface{}) (bool, string, string) {
 		secret, ok := obj.(*corev1.Secret)
 		if !ok {
-			return false, "Error", " is not a secret"
+			return false, "Error", "is not a secret"
 		}
 		for _, key := range keys {
 			if _, ok := secret.Data[key]; !ok {
-				return false, "Error", " missing data " + key
+				return false, "Error", "missing data " + key
 			}
 		}
 		return true, "", ""
@@ -498,16 +911,16 @@ func checkSecret(keys ...string) checkFunc {
 func checkPod(i interface{}) (bool, string, string) {
 	pod, ok := i.(*corev1.Pod)
 	if !ok {
-		return false, "Error", " is not a pod"
+		return false, "Error", "is not a pod"
 	}
 	for _, cs := range pod.Status.ContainerStatuses {
 		if cs.State.Waiting != nil {
 			reason := cs.State.Waiting.Reason
 			if reason == "ImagePullBackOff" || reason == "ErrImagePull" {
-				return false, "Error", " cannot pull container image"
+				return false, "Error", "cannot pull container image"
 			}
 		} else if cs.State.Terminated != nil {
-			return false, "Pending", " has terminated container"
+			return false, "Pending", "has terminated container"
 		}
 	}
 	for _, c := range pod.Status.Conditions {
@@ -515,7 +928,7 @@ func checkPod(i interface{}) (bool, string, string) {
 			return true, "", ""
 		}
 	}
-	return false, "Pending", " is not ready"
+	return false, "Pending", "is not ready"
 }
 
 func compareService(i1, i2 interface{}, logger logr.Logger) bool {
@@ -566,7 +979,7 @@ func compareRoute(i1, i2 interface{}, logger logr.Logger) bool {
 func checkRoute(i interface{}) (bool, string, string) {
 	route, ok := i.(*routev1.Route)
 	if !ok {
-		return false, "Error", " is not a route"
+		return false, "Error", "is not a route"
 	}
 	for _, ri := range route.Status.Ingress {
 		for _, c := range ri.Conditions {
@@ -574,11 +987,11 @@ func checkRoute(i interface{}) (bool, string, string) {
 				if c.Status == corev1.ConditionTrue {
 					return true, "", ""
 				}
-				return false, "Error", " was not admitted"
+				return false, "Error", "was not admitted"
 			}
 		}
 	}
-	return false, "Pending", " is in unknown state"
+	return false, "Pending", "is in unknown state"
 }
 
 func compareConfigMap(i1, i2 interface{}, logger logr.Logger) bool {
@@ -606,9 +1019,14 @@ func (r *HorreumReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	controller := ctrl.NewControllerManagedBy(mgr).
 		For(&hyperfoilv1alpha1.Horreum{}).
 		Owns(&corev1.Pod{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&policyv1.PodDisruptionBudget{}).
+		Owns(&batchv1.Job{}).
+		Owns(&batchv1.CronJob{}).
 		Owns(&corev1.Service{}).
 		Owns(&corev1.Secret{}).
-		Owns(&corev1.ConfigMap{})
+		Owns(&corev1.ConfigMap{}).
+		Owns(&networkingv1.NetworkPolicy{})
 	if r.RoutesAvailable {
 		controller = controller.Owns(&routev1.Route{})
 	}
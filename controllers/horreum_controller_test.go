@@ -0,0 +1,161 @@
+package horreum
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// fakeReconciler runs the reconciliation steps against an in-memory API server holding the objects
+func fakeReconciler(t *testing.T, objects ...client.Object) *HorreumReconciler {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := hyperfoilv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return &HorreumReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+		Log:      logr.Discard(),
+		Scheme:   scheme,
+		Recorder: record.NewFakeRecorder(100),
+	}
+}
+
+// nextEvent returns the oldest event recorded by fakeReconciler, or an empty string
+func nextEvent(r *HorreumReconciler) string {
+	select {
+	case event := <-r.Recorder.(*record.FakeRecorder).Events:
+		return event
+	default:
+		return ""
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	cr := &hyperfoilv1alpha1.Horreum{ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test", UID: "1234"}}
+	r := fakeReconciler(t, cr)
+	configMap := func(value string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "horreum-config", Namespace: "test"},
+			Data:       map[string]string{"key": value},
+		}
+	}
+
+	if err := ensureSame(r, cr, r.Log, configMap("foo"), &corev1.ConfigMap{}, compareConfigMap, nocheck); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(r); event != "Normal Created Created ConfigMap horreum-config" {
+		t.Errorf("unexpected event %q", event)
+	}
+	if err := ensureSame(r, cr, r.Log, configMap("foo"), &corev1.ConfigMap{}, compareConfigMap, nocheck); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(r); event != "" {
+		t.Errorf("matching object must not emit events: %q", event)
+	}
+	if err := ensureSame(r, cr, r.Log, configMap("bar"), &corev1.ConfigMap{}, compareConfigMap, nocheck); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(r); event != "Normal Recreated ConfigMap horreum-config did not match the desired state and was recreated" {
+		t.Errorf("unexpected event %q", event)
+	}
+
+	replicas := int32(1)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum-app", Namespace: "test"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "horreum"}},
+		},
+	}
+	if err := ensureDeployment(r, cr, r.Log, deployment.DeepCopy()); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(r); event != "Normal Created Created Deployment horreum-app" {
+		t.Errorf("unexpected event %q", event)
+	}
+	replicas = 2
+	if err := ensureDeployment(r, cr, r.Log, deployment.DeepCopy()); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(r); event != "Normal Updated Deployment horreum-app did not match the desired state and was updated" {
+		t.Errorf("unexpected event %q", event)
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum-db", Namespace: "test"},
+		Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+		}}},
+	}
+	if err := r.Create(context.Background(), pod.DeepCopy()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureSame(r, cr, r.Log, pod, &corev1.Pod{}, comparePods, checkPod); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(r); event != "Warning PodError Pod horreum-db cannot pull container image" {
+		t.Errorf("unexpected event %q", event)
+	}
+	if cr.Status.Status != "Error" || cr.Status.Reason != "Pod horreum-db cannot pull container image" {
+		t.Errorf("unexpected status %s: %q", cr.Status.Status, cr.Status.Reason)
+	}
+
+	// The API server rejects objects without name
+	if err := ensureSame(r, cr, r.Log, &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test"}}, &corev1.Service{}, compareService, nocheck); err == nil {
+		t.Fatal("invalid service must not be created")
+	}
+	if event := nextEvent(r); !strings.HasPrefix(event, "Warning FailedCreate Cannot create Service : ") {
+		t.Errorf("unexpected event %q", event)
+	}
+}
+
+func TestServiceCaConfigMapPerInstance(t *testing.T) {
+	first := &hyperfoilv1alpha1.Horreum{ObjectMeta: metav1.ObjectMeta{Name: "first", Namespace: "test", UID: "1"}}
+	second := &hyperfoilv1alpha1.Horreum{ObjectMeta: metav1.ObjectMeta{Name: "second", Namespace: "test", UID: "2"}}
+	legacy := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "service-ca.crt", Namespace: "test"}}
+	r := fakeReconciler(t, first, second)
+	if err := controllerutil.SetControllerReference(first, legacy, r.Scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Create(context.Background(), legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cr := range []*hyperfoilv1alpha1.Horreum{first, second} {
+		if err := ensureSame(r, cr, r.Log, serviceCaConfigMap(cr), &corev1.ConfigMap{}, nocompare, nocheck); err != nil {
+			t.Fatal(err)
+		}
+		if err := deleteLegacyServiceCa(r, cr); err != nil {
+			t.Fatal(err)
+		}
+		cm := &corev1.ConfigMap{}
+		if err := r.Get(context.Background(), client.ObjectKey{Name: cr.Name + "-service-ca", Namespace: "test"}, cm); err != nil {
+			t.Fatal(err)
+		}
+		if cm.Annotations["service.beta.openshift.io/inject-cabundle"] != "true" {
+			t.Errorf("%s: service CA must be injected into %s", cr.Name, cm.Name)
+		}
+		if !metav1.IsControlledBy(cm, cr) {
+			t.Errorf("%s: %s must be owned by the instance", cr.Name, cm.Name)
+		}
+	}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(legacy), &corev1.ConfigMap{}); !errors.IsNotFound(err) {
+		t.Errorf("shared config map must be removed: %v", err)
+	}
+}
@@ -3,15 +3,38 @@ package horreum
 import (
 	"errors"
 	"net/url"
+	"strconv"
 
 	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
 	routev1 "github.com/openshift/api/route/v1"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
-func keycloakPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl string) *corev1.Pod {
+// Ports used by Infinispan/JGroups for communication between Keycloak instances
+const (
+	jgroupsPort   = 7800
+	jgroupsFDPort = 57800
+)
+
+func keycloakLabels(cr *hyperfoilv1alpha1.Horreum) map[string]string {
+	return map[string]string{
+		"app":     cr.Name,
+		"service": "keycloak",
+	}
+}
+
+func keycloakReplicas(cr *hyperfoilv1alpha1.Horreum) int32 {
+	if cr.Spec.Keycloak.Replicas == nil {
+		return 1
+	}
+	return *cr.Spec.Keycloak.Replicas
+}
+
+func keycloakDeployment(cr *hyperfoilv1alpha1.Horreum, p Platform, keycloakPublicUrl string) *appsv1.Deployment {
 	secretName := cr.Name + "-keycloak-certs"
 	if cr.Spec.Keycloak.Route.Type == "passthrough" {
 		secretName = cr.Spec.Keycloak.Route.TLS
@@ -37,83 +60,164 @@ func keycloakPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl string) *corev
 			MountPath: "/etc/x509/https",
 		},
 	}
+	env := []corev1.EnvVar{
+		secretEnv("KEYCLOAK_ADMIN", keycloakAdminSecret(cr), corev1.BasicAuthUsernameKey),
+		secretEnv("KEYCLOAK_ADMIN_PASSWORD", keycloakAdminSecret(cr), corev1.BasicAuthPasswordKey),
+		// For simplicity of development the image has HTTP enabled, which is not suitable for production
+		{
+			Name:  "KC_HTTP_ENABLED",
+			Value: "false",
+		},
+		{
+			Name:  "KC_HTTPS_PORT",
+			Value: "8443",
+		},
+		{
+			Name:  "KC_HTTPS_CERTIFICATE_FILE",
+			Value: "/etc/x509/https/tls.crt",
+		},
+		{
+			Name:  "KC_HTTPS_CERTIFICATE_KEY_FILE",
+			Value: "/etc/x509/https/tls.key",
+		},
+		{
+			Name:  "KC_HOSTNAME",
+			Value: publicUrl.Host,
+		},
+		{
+			Name:  "KC_PROXY",
+			Value: "passthrough", // TODO at least for NodePort?
+		},
+		{
+			Name:  "KEYCLOAK_COMMAND",
+			Value: "start",
+		},
+		// Instances find each other through DNS records of the headless discovery service
+		{
+			Name:  "KC_CACHE",
+			Value: "ispn",
+		},
+		{
+			Name:  "KC_CACHE_STACK",
+			Value: "kubernetes",
+		},
+		{
+			Name:  "JAVA_OPTS_APPEND",
+			Value: "-Djgroups.dns.query=" + keycloakDiscoveryServiceName(cr) + "." + cr.Namespace,
+		},
+	}
+	if keycloakDatabaseMode(cr) == hyperfoilv1alpha1.KeycloakDatabaseEmbedded {
+		// Data is stored in the container and lost on restart
+		env = append(env, corev1.EnvVar{
+			Name:  "KC_DB",
+			Value: "dev-file",
+		})
+	} else {
+		dbAddr := withDefault(cr.Spec.Keycloak.Database.Host, keycloakDbDefaultHost(cr))
+		dbPort := withDefaultInt(cr.Spec.Keycloak.Database.Port, 5432)
+		props := dbURLProperties(&cr.Spec.Keycloak.Database)
+		usePgBouncer := keycloakUsesPgBouncer(cr)
+		if usePgBouncer {
+			dbAddr, dbPort, props = pgBouncerHost(cr), strconv.Itoa(pgBouncerPort), pgBouncerURLProperties()
+		}
+		env = append(env,
+			corev1.EnvVar{
+				Name:  "DB_ADDR",
+				Value: dbAddr,
+			},
+			corev1.EnvVar{
+				Name:  "DB_PORT",
+				Value: dbPort,
+			},
+			corev1.EnvVar{
+				Name:  "DB_DATABASE",
+				Value: withDefault(cr.Spec.Keycloak.Database.Name, "keycloak"),
+			},
+			secretEnv("KC_DB_USERNAME", keycloakDbSecret(cr), corev1.BasicAuthUsernameKey),
+			secretEnv("KC_DB_PASSWORD", keycloakDbSecret(cr), corev1.BasicAuthPasswordKey),
+		)
+		if props != "" {
+			env = append(env, corev1.EnvVar{
+				Name:  "KC_DB_URL_PROPERTIES",
+				Value: props,
+			})
+		}
+		if usePgBouncer || dbSSLRootCert(&cr.Spec.Keycloak.Database) == serviceCaPath {
+			volumes = append(volumes, corev1.Volume{
+				Name: "service-ca",
+				VolumeSource: corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: serviceCaConfigMapName(cr),
+						},
+					},
+				},
+			})
+			volumeMounts = append(volumeMounts, corev1.VolumeMount{
+				Name:      "service-ca",
+				MountPath: serviceCaPath,
+				SubPath:   "service-ca.crt",
+			})
+		}
+		if !usePgBouncer {
+			dbCAVolumes, dbCAMounts := dbCAVolume(&cr.Spec.Keycloak.Database)
+			volumes = append(volumes, dbCAVolumes...)
+			volumeMounts = append(volumeMounts, dbCAMounts...)
+		}
+	}
 
-	return &corev1.Pod{
+	replicas := keycloakReplicas(cr)
+	return &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name + "-keycloak",
 			Namespace: cr.Namespace,
-			Labels: map[string]string{
-				"app":     cr.Name,
-				"service": "keycloak",
-			},
+			Labels:    keycloakLabels(cr),
 		},
-		Spec: corev1.PodSpec{
-			Containers: []corev1.Container{
-				{
-					Name:  "keycloak",
-					Image: withDefault(cr.Spec.Keycloak.Image, "quay.io/hyperfoil/horreum-keycloak:latest"),
-					Env: []corev1.EnvVar{
-						secretEnv("KEYCLOAK_ADMIN", keycloakAdminSecret(cr), corev1.BasicAuthUsernameKey),
-						secretEnv("KEYCLOAK_ADMIN_PASSWORD", keycloakAdminSecret(cr), corev1.BasicAuthPasswordKey),
-						{
-							Name:  "DB_ADDR",
-							Value: withDefault(cr.Spec.Keycloak.Database.Host, dbDefaultHost(cr)),
-						},
-						{
-							Name:  "DB_PORT",
-							Value: withDefaultInt(cr.Spec.Keycloak.Database.Port, 5432),
-						},
-						{
-							Name:  "DB_DATABASE",
-							Value: withDefault(cr.Spec.Keycloak.Database.Name, "keycloak"),
-						},
-						// For simplicity of development the image has HTTP enabled, which is not suitable for production
-						{
-							Name:  "KC_HTTP_ENABLED",
-							Value: "false",
-						},
-						{
-							Name:  "KC_HTTPS_PORT",
-							Value: "8443",
-						},
-						{
-							Name:  "KC_HTTPS_CERTIFICATE_FILE",
-							Value: "/etc/x509/https/tls.crt",
-						},
-						{
-							Name:  "KC_HTTPS_CERTIFICATE_KEY_FILE",
-							Value: "/etc/x509/https/tls.key",
-						},
-						{
-							Name:  "KC_HOSTNAME",
-							Value: publicUrl.Host,
-						},
-						{
-							Name:  "KC_PROXY",
-							Value: "passthrough", // TODO at least for NodePort?
-						},
-						secretEnv("KC_DB_USERNAME", keycloakDbSecret(cr), corev1.BasicAuthUsernameKey),
-						secretEnv("KC_DB_PASSWORD", keycloakDbSecret(cr), corev1.BasicAuthPasswordKey),
-						{
-							Name:  "KEYCLOAK_COMMAND",
-							Value: "start",
-						},
-					},
-					Ports: []corev1.ContainerPort{
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: keycloakLabels(cr),
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: keycloakLabels(cr),
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets: cr.Spec.ImagePullSecrets,
+					SecurityContext:  restrictedPodSecurityContext(),
+					Containers: []corev1.Container{
 						{
-							Name:          "https",
-							ContainerPort: 8443,
+							Name:            "keycloak",
+							Image:           keycloakImage(cr, p),
+							ImagePullPolicy: p.PullPolicy,
+							Env:             env,
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "https",
+									ContainerPort: 8443,
+								},
+								{
+									Name:          "jgroups",
+									ContainerPort: jgroupsPort,
+								},
+								{
+									Name:          "jgroups-fd",
+									ContainerPort: jgroupsFDPort,
+								},
+							},
+							VolumeMounts: volumeMounts,
+							// Keycloak rebuilds its server image into the installation directory on start
+							SecurityContext: restrictedSecurityContext(false),
 						},
 					},
-					VolumeMounts: volumeMounts,
+					Volumes: volumes,
 				},
 			},
-			Volumes: volumes,
 		},
 	}
 }
 
-func keycloakService(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev1.Service {
+func keycloakService(cr *hyperfoilv1alpha1.Horreum, p Platform) *corev1.Service {
 	return &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name + "-keycloak",
@@ -123,7 +227,7 @@ func keycloakService(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev
 			},
 		},
 		Spec: corev1.ServiceSpec{
-			Type: serviceType(cr.Spec.Keycloak.ServiceType, r),
+			Type: serviceType(cr.Spec.Keycloak.ServiceType, p),
 			Ports: []corev1.ServicePort{
 				{
 					Name: "https",
@@ -133,18 +237,61 @@ func keycloakService(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev
 					},
 				},
 			},
-			Selector: map[string]string{
-				"app":     cr.Name,
-				"service": "keycloak",
+			Selector: keycloakLabels(cr),
+		},
+	}
+}
+
+func keycloakDiscoveryServiceName(cr *hyperfoilv1alpha1.Horreum) string {
+	return cr.Name + "-keycloak-discovery"
+}
+
+// keycloakDiscoveryService lists all Keycloak instances, including those that are not ready yet
+func keycloakDiscoveryService(cr *hyperfoilv1alpha1.Horreum) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      keycloakDiscoveryServiceName(cr),
+			Namespace: cr.Namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:                     corev1.ServiceTypeClusterIP,
+			ClusterIP:                corev1.ClusterIPNone,
+			PublishNotReadyAddresses: true,
+			Ports: []corev1.ServicePort{
+				{
+					Name: "jgroups",
+					Port: jgroupsPort,
+					TargetPort: intstr.IntOrString{
+						IntVal: jgroupsPort,
+					},
+				},
+			},
+			Selector: keycloakLabels(cr),
+		},
+	}
+}
+
+// keycloakPodDisruptionBudget is created only with multiple replicas, a single instance cannot stay available anyway
+func keycloakPodDisruptionBudget(cr *hyperfoilv1alpha1.Horreum) *policyv1.PodDisruptionBudget {
+	maxUnavailable := intstr.FromInt(1)
+	return &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-keycloak",
+			Namespace: cr.Namespace,
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			MaxUnavailable: &maxUnavailable,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: keycloakLabels(cr),
 			},
 		},
 	}
 }
 
-func keycloakRoute(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) (*routev1.Route, error) {
+func keycloakRoute(cr *hyperfoilv1alpha1.Horreum, p Platform, tlsSecret *corev1.Secret) (*routev1.Route, error) {
 	routeType := cr.Spec.Keycloak.Route.Type
 	if routeType != "passthrough" && routeType != "reencrypt" && routeType != "" {
 		return nil, errors.New("keycloak supports only TLS-encrypted routes")
 	}
-	return route(cr.Spec.Keycloak.Route, "-keycloak", cr, r)
+	return route(cr.Spec.Keycloak.Route, "-keycloak", cr, p, tlsSecret)
 }
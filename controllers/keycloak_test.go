@@ -0,0 +1,110 @@
+package horreum
+
+import (
+	"strings"
+	"testing"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestKeycloakDeploymentCompare(t *testing.T) {
+	replicas := int32(3)
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			Keycloak: hyperfoilv1alpha1.KeycloakSpec{Replicas: &replicas},
+		},
+	}
+	desired := keycloakDeployment(cr, Platform{}, "https://keycloak.example.com")
+	existing := desired.DeepCopy()
+	// Fields defaulted by the API server must not trigger an update
+	existing.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyAlways
+	existing.Spec.Template.Spec.DNSPolicy = corev1.DNSClusterFirst
+	if !compareDeployment(desired, existing, logr.Discard()) {
+		t.Error("deployment with server defaults must match")
+	}
+
+	scaled := existing.DeepCopy()
+	one := int32(1)
+	scaled.Spec.Replicas = &one
+	if compareDeployment(desired, scaled, logr.Discard()) {
+		t.Error("change of replicas must be detected")
+	}
+	upgraded := existing.DeepCopy()
+	upgraded.Spec.Template.Spec.Containers[0].Image = "quay.io/hyperfoil/horreum-keycloak:old"
+	if compareDeployment(desired, upgraded, logr.Discard()) {
+		t.Error("change of image must be detected")
+	}
+	if compareDeployment(desired, keycloakDiscoveryService(cr), logr.Discard()) {
+		t.Error("service is not a deployment")
+	}
+}
+
+func TestCheckDeployment(t *testing.T) {
+	replicas := int32(2)
+	for _, tc := range []struct {
+		name       string
+		generation int64
+		status     appsv1.DeploymentStatus
+		ready      bool
+		state      string
+		reason     string
+	}{
+		{"ready", 1, appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 2}, true, "", ""},
+		{"not observed", 2, appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 2}, false, "Pending", "rolling out"},
+		{"old replicas", 1, appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 3, UpdatedReplicas: 2, ReadyReplicas: 3}, false, "Pending", "2/2 replicas updated"},
+		{"not ready", 1, appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 1}, false, "Pending", "1/2 replicas ready"},
+		{"replica failure", 1, appsv1.DeploymentStatus{ObservedGeneration: 1, Conditions: []appsv1.DeploymentCondition{
+			{Type: appsv1.DeploymentReplicaFailure, Status: corev1.ConditionTrue, Message: "exceeded quota"},
+		}}, false, "Error", "exceeded quota"},
+		{"stuck", 1, appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 1, Conditions: []appsv1.DeploymentCondition{
+			{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionFalse, Message: "progress deadline exceeded"},
+		}}, false, "Error", "not progressing"},
+	} {
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Generation: tc.generation},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+			Status:     tc.status,
+		}
+		ready, state, reason := checkDeployment(deployment)
+		if ready != tc.ready || state != tc.state || !strings.Contains(reason, tc.reason) {
+			t.Errorf("%s: unexpected %v, %s, %s", tc.name, ready, state, reason)
+		}
+	}
+}
+
+func TestKeycloakDiscoveryServiceAndPodDisruptionBudget(t *testing.T) {
+	cr := &hyperfoilv1alpha1.Horreum{ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test"}}
+	service := keycloakDiscoveryService(cr)
+	if service.Spec.ClusterIP != corev1.ClusterIPNone || !service.Spec.PublishNotReadyAddresses {
+		t.Error("discovery service must be headless and list pods that are not ready")
+	}
+	existing := service.DeepCopy()
+	existing.Spec.SessionAffinity = corev1.ServiceAffinityNone
+	if !compareService(service, existing, logr.Discard()) {
+		t.Error("service with server defaults must match")
+	}
+	existing.Spec.Ports[0].Port = 7600
+	if compareService(service, existing, logr.Discard()) {
+		t.Error("change of port must be detected")
+	}
+
+	pdb := keycloakPodDisruptionBudget(cr)
+	existingPdb := pdb.DeepCopy()
+	if !comparePodDisruptionBudget(pdb, existingPdb, logr.Discard()) {
+		t.Error("same budget must match")
+	}
+	two := intstr.FromInt(2)
+	existingPdb.Spec.MaxUnavailable = &two
+	if comparePodDisruptionBudget(pdb, existingPdb, logr.Discard()) {
+		t.Error("change of max unavailable must be detected")
+	}
+	if comparePodDisruptionBudget(pdb, service, logr.Discard()) {
+		t.Error("service is not a budget")
+	}
+}
@@ -0,0 +1,411 @@
+package horreum
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Namespaces of OpenShift routers carry this label
+const openshiftIngressPolicyGroup = "policy-group.network.openshift.io/ingress"
+
+func instancePeer(cr *hyperfoilv1alpha1.Horreum, services ...string) networkingv1.NetworkPolicyPeer {
+	return networkingv1.NetworkPolicyPeer{
+		PodSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{"app": cr.Name},
+			MatchExpressions: []metav1.LabelSelectorRequirement{
+				{
+					Key:      "service",
+					Operator: metav1.LabelSelectorOpIn,
+					Values:   services,
+				},
+			},
+		},
+	}
+}
+
+func namespacePeer(namespace string) networkingv1.NetworkPolicyPeer {
+	return networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{"kubernetes.io/metadata.name": namespace},
+		},
+	}
+}
+
+// The operator connects to the database to provision it and to Keycloak to rotate credentials
+func operatorPeers(p Platform) []networkingv1.NetworkPolicyPeer {
+	if p.OperatorNamespace == "" {
+		return nil
+	}
+	peer := namespacePeer(p.OperatorNamespace)
+	peer.PodSelector = &metav1.LabelSelector{
+		MatchLabels: map[string]string{"control-plane": "controller-manager"},
+	}
+	return []networkingv1.NetworkPolicyPeer{peer}
+}
+
+// cidrPeers allows any address when no ranges are given
+func cidrPeers(cidrs []string) []networkingv1.NetworkPolicyPeer {
+	if len(cidrs) == 0 {
+		cidrs = []string{"0.0.0.0/0", "::/0"}
+	}
+	peers := []networkingv1.NetworkPolicyPeer{}
+	for _, cidr := range cidrs {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{
+			IPBlock: &networkingv1.IPBlock{CIDR: cidr},
+		})
+	}
+	return peers
+}
+
+func tcpPort(port int32) networkingv1.NetworkPolicyPort {
+	return networkingv1.NetworkPolicyPort{
+		Protocol: &[]corev1.Protocol{corev1.ProtocolTCP}[0],
+		Port:     &intstr.IntOrString{IntVal: port},
+	}
+}
+
+// clientPeers may access Horreum and Keycloak from outside of the instance
+func clientPeers(cr *hyperfoilv1alpha1.Horreum, p Platform) []networkingv1.NetworkPolicyPeer {
+	spec := cr.Spec.NetworkPolicy
+	peers := []networkingv1.NetworkPolicyPeer{}
+	if spec.IngressNamespaceSelector != nil {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{NamespaceSelector: spec.IngressNamespaceSelector})
+	} else if p.RoutesAvailable {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{openshiftIngressPolicyGroup: ""},
+			},
+		})
+	}
+	for _, namespace := range spec.AllowedNamespaces {
+		peers = append(peers, namespacePeer(namespace))
+	}
+	for _, cidr := range spec.AllowedCIDRs {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{
+			IPBlock: &networkingv1.IPBlock{CIDR: cidr},
+		})
+	}
+	return peers
+}
+
+// DNS might be served from the node so we can't restrict the destination
+func dnsEgress() networkingv1.NetworkPolicyEgressRule {
+	udp, tcp := corev1.ProtocolUDP, corev1.ProtocolTCP
+	ports := []networkingv1.NetworkPolicyPort{}
+	// OpenShift DNS pods listen on 5353
+	for _, port := range []int32{53, 5353} {
+		ports = append(ports,
+			networkingv1.NetworkPolicyPort{Protocol: &udp, Port: &intstr.IntOrString{IntVal: port}},
+			networkingv1.NetworkPolicyPort{Protocol: &tcp, Port: &intstr.IntOrString{IntVal: port}})
+	}
+	return networkingv1.NetworkPolicyEgressRule{Ports: ports}
+}
+
+func databaseEgress(cr *hyperfoilv1alpha1.Horreum, db *hyperfoilv1alpha1.DatabaseSpec) networkingv1.NetworkPolicyEgressRule {
+	if db.Host == "" {
+		return networkingv1.NetworkPolicyEgressRule{
+			To:    []networkingv1.NetworkPolicyPeer{instancePeer(cr, "db")},
+			Ports: []networkingv1.NetworkPolicyPort{tcpPort(5432)},
+		}
+	}
+	port := db.Port
+	if port == 0 {
+		port = 5432
+	}
+	return networkingv1.NetworkPolicyEgressRule{
+		To:    cidrPeers(cr.Spec.NetworkPolicy.DatabaseCIDRs),
+		Ports: []networkingv1.NetworkPolicyPort{tcpPort(port)},
+	}
+}
+
+func pgBouncerEgress(cr *hyperfoilv1alpha1.Horreum) networkingv1.NetworkPolicyEgressRule {
+	return networkingv1.NetworkPolicyEgressRule{
+		To:    []networkingv1.NetworkPolicyPeer{instancePeer(cr, "pgbouncer")},
+		Ports: []networkingv1.NetworkPolicyPort{tcpPort(pgBouncerPort)},
+	}
+}
+
+func keycloakEgress(cr *hyperfoilv1alpha1.Horreum) ([]networkingv1.NetworkPolicyEgressRule, error) {
+	if cr.Spec.Keycloak.External.PublicUri == "" {
+		return []networkingv1.NetworkPolicyEgressRule{{
+			To:    []networkingv1.NetworkPolicyPeer{instancePeer(cr, "keycloak")},
+			Ports: []networkingv1.NetworkPolicyPort{tcpPort(8443)},
+		}}, nil
+	}
+	rules := []networkingv1.NetworkPolicyEgressRule{}
+	for _, uri := range []string{cr.Spec.Keycloak.External.PublicUri, cr.Spec.Keycloak.External.InternalUri} {
+		if uri == "" {
+			continue
+		}
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Keycloak URI %s: %w", uri, err)
+		}
+		port := int32(443)
+		if parsed.Port() != "" {
+			p, err := strconv.ParseInt(parsed.Port(), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Keycloak URI %s: %w", uri, err)
+			}
+			port = int32(p)
+		} else if parsed.Scheme == "http" {
+			port = 80
+		}
+		rules = append(rules, networkingv1.NetworkPolicyEgressRule{
+			To:    cidrPeers(cr.Spec.NetworkPolicy.KeycloakCIDRs),
+			Ports: []networkingv1.NetworkPolicyPort{tcpPort(port)},
+		})
+	}
+	return rules, nil
+}
+
+func networkPolicy(cr *hyperfoilv1alpha1.Horreum, service string) *networkingv1.NetworkPolicy {
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-" + service,
+			Namespace: cr.Namespace,
+			Labels: map[string]string{
+				"app": cr.Name,
+			},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app":     cr.Name,
+					"service": service,
+				},
+			},
+		},
+	}
+}
+
+// Only Horreum, Keycloak, PgBouncer, base backups, read replicas, clones and the operator may connect to the database
+func dbNetworkPolicy(cr *hyperfoilv1alpha1.Horreum, p Platform) *networkingv1.NetworkPolicy {
+	np := networkPolicy(cr, "db")
+	np.Spec.PolicyTypes = []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}
+	clients := []string{"app"}
+	// Keycloak connects here only when it shares the database and does not go through PgBouncer
+	if cr.Spec.Keycloak.External.PublicUri == "" && keycloakDatabaseMode(cr) == hyperfoilv1alpha1.KeycloakDatabaseShared &&
+		cr.Spec.Keycloak.Database.Host == "" && !keycloakUsesPgBouncer(cr) {
+		clients = append(clients, "keycloak")
+	}
+	if cr.Spec.PgBouncer.Enabled {
+		clients = append(clients, "pgbouncer")
+	}
+	if isBackupEnabled(&cr.Spec.Postgres) {
+		clients = append(clients, "db-backup")
+	}
+	if hasReadReplicas(cr) {
+		clients = append(clients, "db-replica")
+	}
+	if cr.Spec.CloneFrom != "" {
+		clients = append(clients, "clone")
+	}
+	// Instances cloned from this one copy the database in a job
+	clones := networkingv1.NetworkPolicyPeer{
+		PodSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{cloneSourceLabel: cr.Name},
+		},
+	}
+	np.Spec.Ingress = []networkingv1.NetworkPolicyIngressRule{
+		{
+			From:  append([]networkingv1.NetworkPolicyPeer{instancePeer(cr, clients...), clones}, operatorPeers(p)...),
+			Ports: []networkingv1.NetworkPolicyPort{tcpPort(5432)},
+		},
+	}
+	return np
+}
+
+func appNetworkPolicy(cr *hyperfoilv1alpha1.Horreum, p Platform) (*networkingv1.NetworkPolicy, error) {
+	np := networkPolicy(cr, "app")
+	np.Spec.PolicyTypes = []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress}
+	// Rule without peers would allow traffic from anywhere
+	if peers := clientPeers(cr, p); len(peers) > 0 {
+		np.Spec.Ingress = []networkingv1.NetworkPolicyIngressRule{{From: peers}}
+	}
+	keycloak, err := keycloakEgress(cr)
+	if err != nil {
+		return nil, err
+	}
+	np.Spec.Egress = append([]networkingv1.NetworkPolicyEgressRule{
+		dnsEgress(),
+		databaseEgress(cr, &cr.Spec.Database),
+	}, keycloak...)
+	if cr.Spec.PgBouncer.Enabled {
+		np.Spec.Egress = append(np.Spec.Egress, pgBouncerEgress(cr))
+	}
+	if len(cr.Spec.NetworkPolicy.AppEgressCIDRs) > 0 {
+		np.Spec.Egress = append(np.Spec.Egress, networkingv1.NetworkPolicyEgressRule{
+			To: cidrPeers(cr.Spec.NetworkPolicy.AppEgressCIDRs),
+		})
+	}
+	return np, nil
+}
+
+func keycloakNetworkPolicy(cr *hyperfoilv1alpha1.Horreum, p Platform) *networkingv1.NetworkPolicy {
+	np := networkPolicy(cr, "keycloak")
+	np.Spec.PolicyTypes = []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress}
+	from := append(clientPeers(cr, p), instancePeer(cr, "app"))
+	// Keycloak instances share the cache
+	clusterPorts := []networkingv1.NetworkPolicyPort{tcpPort(jgroupsPort), tcpPort(jgroupsFDPort)}
+	np.Spec.Ingress = []networkingv1.NetworkPolicyIngressRule{
+		{From: append(from, operatorPeers(p)...)},
+		{From: []networkingv1.NetworkPolicyPeer{instancePeer(cr, "keycloak")}, Ports: clusterPorts},
+	}
+	np.Spec.Egress = []networkingv1.NetworkPolicyEgressRule{
+		dnsEgress(),
+		{To: []networkingv1.NetworkPolicyPeer{instancePeer(cr, "keycloak")}, Ports: clusterPorts},
+	}
+	switch {
+	case keycloakUsesPgBouncer(cr):
+		np.Spec.Egress = append(np.Spec.Egress, pgBouncerEgress(cr))
+	case keycloakDatabaseMode(cr) == hyperfoilv1alpha1.KeycloakDatabaseShared:
+		np.Spec.Egress = append(np.Spec.Egress, databaseEgress(cr, &cr.Spec.Keycloak.Database))
+	case keycloakDatabaseMode(cr) == hyperfoilv1alpha1.KeycloakDatabaseDedicated:
+		np.Spec.Egress = append(np.Spec.Egress, networkingv1.NetworkPolicyEgressRule{
+			To:    []networkingv1.NetworkPolicyPeer{instancePeer(cr, "keycloak-db")},
+			Ports: []networkingv1.NetworkPolicyPort{tcpPort(5432)},
+		})
+	}
+	return np
+}
+
+// Only Keycloak (directly or through PgBouncer), base backups and the operator may connect to the database dedicated to Keycloak
+func keycloakDbNetworkPolicy(cr *hyperfoilv1alpha1.Horreum, p Platform) *networkingv1.NetworkPolicy {
+	np := networkPolicy(cr, "keycloak-db")
+	np.Spec.PolicyTypes = []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}
+	clients := []string{ifThenElse(keycloakUsesPgBouncer(cr), "pgbouncer", "keycloak")}
+	if isBackupEnabled(&cr.Spec.Keycloak.Postgres) {
+		clients = append(clients, "keycloak-db-backup")
+	}
+	np.Spec.Ingress = []networkingv1.NetworkPolicyIngressRule{
+		{
+			From:  append([]networkingv1.NetworkPolicyPeer{instancePeer(cr, clients...)}, operatorPeers(p)...),
+			Ports: []networkingv1.NetworkPolicyPort{tcpPort(5432)},
+		},
+	}
+	return np
+}
+
+// Read replicas serve reporting tools, e.g. Grafana running in one of the allowed namespaces
+func dbReplicaNetworkPolicy(cr *hyperfoilv1alpha1.Horreum, p Platform) *networkingv1.NetworkPolicy {
+	np := networkPolicy(cr, "db-replica")
+	np.Spec.PolicyTypes = []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}
+	from := append(clientPeers(cr, p), instancePeer(cr, "app"))
+	np.Spec.Ingress = []networkingv1.NetworkPolicyIngressRule{
+		{
+			From:  append(from, operatorPeers(p)...),
+			Ports: []networkingv1.NetworkPolicyPort{tcpPort(5432)},
+		},
+	}
+	return np
+}
+
+// Only Horreum and Keycloak may connect to PgBouncer, which connects to the databases
+func pgBouncerNetworkPolicy(cr *hyperfoilv1alpha1.Horreum) *networkingv1.NetworkPolicy {
+	np := networkPolicy(cr, "pgbouncer")
+	np.Spec.PolicyTypes = []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress}
+	np.Spec.Ingress = []networkingv1.NetworkPolicyIngressRule{
+		{
+			From:  []networkingv1.NetworkPolicyPeer{instancePeer(cr, "app", "keycloak")},
+			Ports: []networkingv1.NetworkPolicyPort{tcpPort(pgBouncerPort)},
+		},
+	}
+	np.Spec.Egress = []networkingv1.NetworkPolicyEgressRule{
+		dnsEgress(),
+		databaseEgress(cr, &cr.Spec.Database),
+	}
+	if keycloakUsesPgBouncer(cr) {
+		if keycloakDatabaseMode(cr) == hyperfoilv1alpha1.KeycloakDatabaseDedicated {
+			np.Spec.Egress = append(np.Spec.Egress, networkingv1.NetworkPolicyEgressRule{
+				To:    []networkingv1.NetworkPolicyPeer{instancePeer(cr, "keycloak-db")},
+				Ports: []networkingv1.NetworkPolicyPort{tcpPort(5432)},
+			})
+		} else if rule := databaseEgress(cr, &cr.Spec.Keycloak.Database); !equality.Semantic.DeepEqual(rule, np.Spec.Egress[1]) {
+			np.Spec.Egress = append(np.Spec.Egress, rule)
+		}
+	}
+	return np
+}
+
+func compareNetworkPolicy(i1, i2 interface{}, logger logr.Logger) bool {
+	np1, ok1 := i1.(*networkingv1.NetworkPolicy)
+	np2, ok2 := i2.(*networkingv1.NetworkPolicy)
+	if !ok1 || !ok2 {
+		logger.Info("Cannot cast to NetworkPolicies: " + fmt.Sprintf("%v | %v", i1, i2))
+		return false
+	}
+	// Missing rules deny traffic so DeepDerivative would not do
+	if !equality.Semantic.DeepEqual(np1.Spec, np2.Spec) {
+		logger.Info("NetworkPolicy " + np1.Name + " does not match")
+		return false
+	}
+	return true
+}
+
+// networkPolicies returns policies for the components that are deployed and those that are not
+func networkPolicies(cr *hyperfoilv1alpha1.Horreum, p Platform) ([]*networkingv1.NetworkPolicy, []*networkingv1.NetworkPolicy, error) {
+	appPolicy, err := appNetworkPolicy(cr, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	deployed := []*networkingv1.NetworkPolicy{appPolicy}
+	unused := []*networkingv1.NetworkPolicy{}
+	if cr.Spec.Postgres.Enabled == nil || *cr.Spec.Postgres.Enabled {
+		deployed = append(deployed, dbNetworkPolicy(cr, p))
+	} else {
+		unused = append(unused, dbNetworkPolicy(cr, p))
+	}
+	if hasReadReplicas(cr) {
+		deployed = append(deployed, dbReplicaNetworkPolicy(cr, p))
+	} else {
+		unused = append(unused, dbReplicaNetworkPolicy(cr, p))
+	}
+	if cr.Spec.Keycloak.External.PublicUri == "" {
+		deployed = append(deployed, keycloakNetworkPolicy(cr, p))
+	} else {
+		unused = append(unused, keycloakNetworkPolicy(cr, p))
+	}
+	if isKeycloakDbDeployed(cr) {
+		deployed = append(deployed, keycloakDbNetworkPolicy(cr, p))
+	} else {
+		unused = append(unused, keycloakDbNetworkPolicy(cr, p))
+	}
+	if cr.Spec.PgBouncer.Enabled {
+		deployed = append(deployed, pgBouncerNetworkPolicy(cr))
+	} else {
+		unused = append(unused, pgBouncerNetworkPolicy(cr))
+	}
+	if !cr.Spec.NetworkPolicy.Enabled {
+		return nil, append(deployed, unused...), nil
+	}
+	return deployed, unused, nil
+}
+
+// ensureNetworkPolicies creates policies for the deployed components, or deletes them when disabled
+func ensureNetworkPolicies(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) error {
+	policies, unused, err := networkPolicies(cr, r.Platform)
+	if err != nil {
+		return err
+	}
+	for _, policy := range policies {
+		if err := ensureSame(r, cr, logger, policy, &networkingv1.NetworkPolicy{}, compareNetworkPolicy, nocheck); err != nil {
+			return err
+		}
+	}
+	for _, policy := range unused {
+		if err := ensureDeleted(r, cr, policy, &networkingv1.NetworkPolicy{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
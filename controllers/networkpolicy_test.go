@@ -0,0 +1,234 @@
+package horreum
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// peerServices lists the instance services selected by the peers, e.g. "app,keycloak"
+func peerServices(peers []networkingv1.NetworkPolicyPeer) []string {
+	services := []string{}
+	for _, peer := range peers {
+		if peer.PodSelector == nil || peer.NamespaceSelector != nil {
+			continue
+		}
+		for _, expr := range peer.PodSelector.MatchExpressions {
+			if expr.Key == "service" {
+				services = append(services, strings.Join(expr.Values, ","))
+			}
+		}
+	}
+	return services
+}
+
+func egressServices(np *networkingv1.NetworkPolicy) []string {
+	services := []string{}
+	for _, rule := range np.Spec.Egress {
+		services = append(services, peerServices(rule.To)...)
+	}
+	return services
+}
+
+func TestDatabaseClients(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		mode         hyperfoilv1alpha1.KeycloakDatabaseMode
+		pgBouncer    bool
+		keycloakHost string
+		external     bool
+		backup       bool
+		db           string
+		keycloakDb   string
+		pgBouncerOut string
+	}{
+		{name: "shared", db: "app,keycloak"},
+		{name: "shared with PgBouncer", pgBouncer: true, db: "app,pgbouncer", pgBouncerOut: "db"},
+		{name: "shared on external server", keycloakHost: "keycloak-db.example.com", db: "app"},
+		{name: "dedicated", mode: hyperfoilv1alpha1.KeycloakDatabaseDedicated, db: "app", keycloakDb: "keycloak"},
+		{name: "dedicated with backup", mode: hyperfoilv1alpha1.KeycloakDatabaseDedicated, backup: true,
+			db: "app", keycloakDb: "keycloak,keycloak-db-backup"},
+		{name: "dedicated with PgBouncer", mode: hyperfoilv1alpha1.KeycloakDatabaseDedicated, pgBouncer: true,
+			db: "app,pgbouncer", keycloakDb: "pgbouncer", pgBouncerOut: "db keycloak-db"},
+		{name: "embedded", mode: hyperfoilv1alpha1.KeycloakDatabaseEmbedded, db: "app"},
+		{name: "embedded with PgBouncer", mode: hyperfoilv1alpha1.KeycloakDatabaseEmbedded, pgBouncer: true,
+			db: "app,pgbouncer", pgBouncerOut: "db"},
+		{name: "external Keycloak", external: true, db: "app"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cr := &hyperfoilv1alpha1.Horreum{
+				ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test"},
+				Spec: hyperfoilv1alpha1.HorreumSpec{
+					PgBouncer: hyperfoilv1alpha1.PgBouncerSpec{Enabled: test.pgBouncer},
+				},
+			}
+			cr.Spec.Keycloak.DatabaseMode = test.mode
+			cr.Spec.Keycloak.Database.Host = test.keycloakHost
+			cr.Spec.Keycloak.Postgres.Backup.Enabled = test.backup
+			if test.external {
+				cr.Spec.Keycloak.External.PublicUri = "https://keycloak.example.com"
+			}
+
+			if clients := peerServices(dbNetworkPolicy(cr, Platform{}).Spec.Ingress[0].From); strings.Join(clients, " ") != test.db {
+				t.Errorf("expected database clients %s, got %v", test.db, clients)
+			}
+			if isKeycloakDbDeployed(cr) != (test.keycloakDb != "") {
+				t.Fatalf("Keycloak database deployed: %v", isKeycloakDbDeployed(cr))
+			}
+			if test.keycloakDb != "" {
+				if clients := peerServices(keycloakDbNetworkPolicy(cr, Platform{}).Spec.Ingress[0].From); strings.Join(clients, " ") != test.keycloakDb {
+					t.Errorf("expected Keycloak database clients %s, got %v", test.keycloakDb, clients)
+				}
+			}
+			if test.pgBouncer {
+				np := pgBouncerNetworkPolicy(cr)
+				if clients := peerServices(np.Spec.Ingress[0].From); strings.Join(clients, " ") != "app,keycloak" {
+					t.Errorf("expected PgBouncer clients app,keycloak, got %v", clients)
+				}
+				if targets := egressServices(np); strings.Join(targets, " ") != test.pgBouncerOut {
+					t.Errorf("expected PgBouncer to connect to %s, got %v", test.pgBouncerOut, targets)
+				}
+			}
+		})
+	}
+}
+
+func TestKeycloakEgress(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		public   string
+		internal string
+		ports    []int32
+		err      bool
+	}{
+		{name: "deployed", ports: []int32{8443}},
+		{name: "https", public: "https://keycloak.example.com", ports: []int32{443}},
+		{name: "http", public: "http://keycloak.example.com/auth", ports: []int32{80}},
+		{name: "explicit port", public: "https://keycloak.example.com:8443", ports: []int32{8443}},
+		{name: "internal URI", public: "https://keycloak.example.com", internal: "http://keycloak.sso.svc:8080",
+			ports: []int32{443, 8080}},
+		{name: "invalid port", public: "https://keycloak.example.com:https", err: true},
+		{name: "port out of range", public: "https://keycloak.example.com:4294967296", err: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cr := &hyperfoilv1alpha1.Horreum{ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test"}}
+			cr.Spec.Keycloak.External.PublicUri = test.public
+			cr.Spec.Keycloak.External.InternalUri = test.internal
+			cr.Spec.NetworkPolicy.KeycloakCIDRs = []string{"10.0.0.0/8"}
+			rules, err := keycloakEgress(cr)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected error, got %v", rules)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if len(rules) != len(test.ports) {
+				t.Fatalf("expected %d rules, got %v", len(test.ports), rules)
+			}
+			for i, rule := range rules {
+				if port := rule.Ports[0].Port.IntVal; port != test.ports[i] {
+					t.Errorf("expected port %d, got %d", test.ports[i], port)
+				}
+				if test.public == "" {
+					if services := peerServices(rule.To); len(services) != 1 || services[0] != "keycloak" {
+						t.Errorf("expected deployed Keycloak, got %v", rule.To)
+					}
+				} else if len(rule.To) != 1 || rule.To[0].IPBlock == nil || rule.To[0].IPBlock.CIDR != "10.0.0.0/8" {
+					t.Errorf("expected Keycloak CIDR, got %v", rule.To)
+				}
+			}
+		})
+	}
+}
+
+func TestAppIngress(t *testing.T) {
+	cr := &hyperfoilv1alpha1.Horreum{ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test"}}
+	cr.Spec.NetworkPolicy.Enabled = true
+	// No rule rather than a rule without peers, which would admit anyone
+	if np, err := appNetworkPolicy(cr, Platform{}); err != nil {
+		t.Fatal(err)
+	} else if len(np.Spec.Ingress) != 0 {
+		t.Errorf("expected no ingress rules, got %v", np.Spec.Ingress)
+	}
+	np, err := appNetworkPolicy(cr, Platform{RoutesAvailable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(np.Spec.Ingress) != 1 || np.Spec.Ingress[0].From[0].NamespaceSelector.MatchLabels[openshiftIngressPolicyGroup] != "" {
+		t.Errorf("expected OpenShift routers, got %v", np.Spec.Ingress)
+	}
+	cr.Spec.NetworkPolicy.AllowedNamespaces = []string{"agents"}
+	cr.Spec.NetworkPolicy.AllowedCIDRs = []string{"192.168.0.0/16"}
+	np, err = appNetworkPolicy(cr, Platform{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := np.Spec.Ingress[0].From; len(from) != 2 ||
+		from[0].NamespaceSelector.MatchLabels["kubernetes.io/metadata.name"] != "agents" || from[1].IPBlock.CIDR != "192.168.0.0/16" {
+		t.Errorf("unexpected peers %v", from)
+	}
+}
+
+func TestNetworkPoliciesDisabled(t *testing.T) {
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test", UID: "1234"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			PgBouncer:     hyperfoilv1alpha1.PgBouncerSpec{Enabled: true},
+			NetworkPolicy: hyperfoilv1alpha1.NetworkPolicySpec{Enabled: true},
+		},
+	}
+	cr.Spec.Keycloak.DatabaseMode = hyperfoilv1alpha1.KeycloakDatabaseDedicated
+	names := func(policies []*networkingv1.NetworkPolicy) string {
+		list := []string{}
+		for _, np := range policies {
+			list = append(list, np.Name)
+		}
+		sort.Strings(list)
+		return strings.Join(list, " ")
+	}
+	deployed, unused, err := networkPolicies(cr, Platform{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names(deployed) != "horreum-app horreum-db horreum-keycloak horreum-keycloak-db horreum-pgbouncer" {
+		t.Errorf("unexpected deployed policies %s", names(deployed))
+	}
+	if names(unused) != "horreum-db-replica" {
+		t.Errorf("unexpected unused policies %s", names(unused))
+	}
+
+	r := fakeReconciler(t, cr)
+	list := &networkingv1.NetworkPolicyList{}
+	if err := ensureNetworkPolicies(r, cr, r.Log); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.List(context.TODO(), list); err != nil {
+		t.Fatal(err)
+	} else if len(list.Items) != 5 {
+		t.Errorf("expected 5 policies, got %d", len(list.Items))
+	}
+
+	cr.Spec.NetworkPolicy.Enabled = false
+	deployed, unused, err = networkPolicies(cr, Platform{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deployed) != 0 || len(unused) != 6 {
+		t.Errorf("expected all policies unused, got %s | %s", names(deployed), names(unused))
+	}
+	if err := ensureNetworkPolicies(r, cr, r.Log); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.List(context.TODO(), list); err != nil {
+		t.Fatal(err)
+	} else if len(list.Items) != 0 {
+		t.Errorf("expected policies to be deleted, got %d", len(list.Items))
+	}
+}
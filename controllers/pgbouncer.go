@@ -0,0 +1,331 @@
+package horreum
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	pgBouncerPort       = 5432
+	pgBouncerConfigPath = "/etc/pgbouncer"
+	pgBouncerCertsPath  = "/etc/pgbouncer-certs"
+)
+
+func pgBouncerName(cr *hyperfoilv1alpha1.Horreum) string {
+	return cr.Name + "-pgbouncer"
+}
+
+func pgBouncerCertsSecret(cr *hyperfoilv1alpha1.Horreum) string {
+	return cr.Name + "-pgbouncer-certs"
+}
+
+func pgBouncerHost(cr *hyperfoilv1alpha1.Horreum) string {
+	return pgBouncerName(cr) + "." + cr.Namespace + ".svc"
+}
+
+func pgBouncerLabels(cr *hyperfoilv1alpha1.Horreum) map[string]string {
+	return map[string]string{
+		"app":     cr.Name,
+		"service": "pgbouncer",
+	}
+}
+
+// pgBouncerURL is the JDBC URL of a database behind PgBouncer, which uses certificate signed by the service CA
+func pgBouncerURL(cr *hyperfoilv1alpha1.Horreum, database string) string {
+	return "jdbc:postgresql://" + pgBouncerHost(cr) + ":" + strconv.Itoa(pgBouncerPort) + "/" + database + pgBouncerURLProperties()
+}
+
+func pgBouncerURLProperties() string {
+	return "?sslmode=verify-full&sslrootcert=" + serviceCaPath
+}
+
+// keycloakUsesPgBouncer tells whether Keycloak connects through PgBouncer. PgBouncer applies the TLS settings
+// of spec.database to all servers, so Keycloak keeps connecting directly to a database that needs different ones.
+func keycloakUsesPgBouncer(cr *hyperfoilv1alpha1.Horreum) bool {
+	if !cr.Spec.PgBouncer.Enabled || cr.Spec.Keycloak.External.PublicUri != "" ||
+		keycloakDatabaseMode(cr) == hyperfoilv1alpha1.KeycloakDatabaseEmbedded {
+		return false
+	}
+	app, keycloak := &cr.Spec.Database, &cr.Spec.Keycloak.Database
+	return dbSSLMode(keycloak) == dbSSLMode(app) && dbSSLRootCert(keycloak) == dbSSLRootCert(app) &&
+		keycloak.CASecret == app.CASecret && withDefault(keycloak.Name, "keycloak") != withDefault(app.Name, "horreum")
+}
+
+// pgBouncerIni renders the configuration; clients connect to databases of the same name as on the server
+func pgBouncerIni(cr *hyperfoilv1alpha1.Horreum) string {
+	spec := &cr.Spec.PgBouncer
+	database := func(db *hyperfoilv1alpha1.DatabaseSpec, defHost string, defName string) string {
+		name := withDefault(db.Name, defName)
+		return name + " = host=" + withDefault(db.Host, defHost) + " port=" + withDefaultInt(db.Port, 5432) + " dbname=" + name + "\n"
+	}
+	ini := "[databases]\n" + database(&cr.Spec.Database, dbDefaultHost(cr), "horreum")
+	if keycloakUsesPgBouncer(cr) {
+		ini += database(&cr.Spec.Keycloak.Database, keycloakDbDefaultHost(cr), "keycloak")
+	}
+	ini += `
+[pgbouncer]
+listen_addr = *
+listen_port = ` + strconv.Itoa(pgBouncerPort) + `
+unix_socket_dir =
+auth_type = scram-sha-256
+auth_file = ` + pgBouncerConfigPath + `/userlist.txt
+pool_mode = ` + withDefault(string(spec.PoolMode), string(hyperfoilv1alpha1.PgBouncerPoolModeTransaction)) + `
+default_pool_size = ` + withDefaultInt(spec.DefaultPoolSize, 20) + `
+min_pool_size = ` + withDefaultInt(spec.MinPoolSize, 0) + `
+reserve_pool_size = ` + withDefaultInt(spec.ReservePoolSize, 0) + `
+max_client_conn = ` + withDefaultInt(spec.MaxClientConnections, 1000) + `
+; JDBC driver uses named prepared statements, which PgBouncer tracks in transaction mode
+max_prepared_statements = 200
+ignore_startup_parameters = extra_float_digits
+client_tls_sslmode = require
+client_tls_cert_file = ` + pgBouncerCertsPath + `/` + corev1.TLSCertKey + `
+client_tls_key_file = ` + pgBouncerCertsPath + `/` + corev1.TLSPrivateKeyKey + `
+`
+	sslMode := withDefault(dbSSLMode(&cr.Spec.Database), "prefer")
+	ini += "server_tls_sslmode = " + sslMode + "\n"
+	if rootCert := dbSSLRootCert(&cr.Spec.Database); rootCert != "" && sslMode != "disable" {
+		ini += "server_tls_ca_file = " + rootCert + "\n"
+	}
+	return ini
+}
+
+// pgBouncerUserlist lists users allowed to connect with their passwords, which PgBouncer uses for the server, too
+func pgBouncerUserlist(secrets ...*corev1.Secret) string {
+	quote := func(value []byte) string {
+		return `"` + strings.ReplaceAll(string(value), `"`, `""`) + `"`
+	}
+	userlist := ""
+	for _, secret := range secrets {
+		userlist += quote(secret.Data[corev1.BasicAuthUsernameKey]) + " " + quote(secret.Data[corev1.BasicAuthPasswordKey]) + "\n"
+	}
+	return userlist
+}
+
+// pgBouncerSecret holds the configuration and credentials derived from the secrets of Horreum and Keycloak
+func pgBouncerSecret(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) (*corev1.Secret, error) {
+	names := []string{appUserSecret(cr)}
+	if keycloakUsesPgBouncer(cr) {
+		names = append(names, keycloakDbSecret(cr))
+	}
+	secrets := []*corev1.Secret{}
+	for _, name := range names {
+		secret, err := readSecret(r, cr.Namespace, name)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read secret %s: %w", name, err)
+		}
+		secrets = append(secrets, secret)
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pgBouncerName(cr),
+			Namespace: cr.Namespace,
+		},
+		Data: map[string][]byte{
+			"pgbouncer.ini": []byte(pgBouncerIni(cr)),
+			"userlist.txt":  []byte(pgBouncerUserlist(secrets...)),
+		},
+	}, nil
+}
+
+func pgBouncerReplicas(cr *hyperfoilv1alpha1.Horreum) int32 {
+	if cr.Spec.PgBouncer.Replicas == nil {
+		return 1
+	}
+	return *cr.Spec.PgBouncer.Replicas
+}
+
+// pgBouncerDeployment runs the pooler; the instances are replaced when the hash of the configuration changes
+func pgBouncerDeployment(cr *hyperfoilv1alpha1.Horreum, p Platform, configHash string) *appsv1.Deployment {
+	volumes := []corev1.Volume{
+		{
+			Name: "config",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: pgBouncerName(cr),
+				},
+			},
+		},
+		{
+			Name: "certs",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: pgBouncerCertsSecret(cr),
+				},
+			},
+		},
+	}
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      "config",
+			MountPath: pgBouncerConfigPath,
+		},
+		{
+			Name:      "certs",
+			MountPath: pgBouncerCertsPath,
+		},
+	}
+	if dbSSLRootCert(&cr.Spec.Database) == serviceCaPath {
+		volumes = append(volumes, corev1.Volume{
+			Name: "service-ca",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: serviceCaConfigMapName(cr),
+					},
+				},
+			},
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      "service-ca",
+			MountPath: serviceCaPath,
+			SubPath:   "service-ca.crt",
+		})
+	}
+	dbCAVolumes, dbCAMounts := dbCAVolume(&cr.Spec.Database)
+	volumes = append(volumes, dbCAVolumes...)
+	volumeMounts = append(volumeMounts, dbCAMounts...)
+
+	userId := int64(70)
+	if cr.Spec.PgBouncer.User != nil {
+		userId = *cr.Spec.PgBouncer.User
+	}
+	securityContext := restrictedSecurityContext(true)
+	securityContext.RunAsUser = &userId
+	replicas := pgBouncerReplicas(cr)
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pgBouncerName(cr),
+			Namespace: cr.Namespace,
+			Labels:    pgBouncerLabels(cr),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: pgBouncerLabels(cr),
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: pgBouncerLabels(cr),
+					Annotations: map[string]string{
+						configHashAnnotation: configHash,
+					},
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets: cr.Spec.ImagePullSecrets,
+					SecurityContext:  restrictedPodSecurityContext(),
+					Containers: []corev1.Container{
+						{
+							Name:            "pgbouncer",
+							Image:           pgBouncerImage(cr, p),
+							ImagePullPolicy: p.PullPolicy,
+							Command:         []string{"pgbouncer", pgBouncerConfigPath + "/pgbouncer.ini"},
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "postgres",
+									ContainerPort: pgBouncerPort,
+								},
+							},
+							ReadinessProbe: &corev1.Probe{
+								ProbeHandler: corev1.ProbeHandler{
+									TCPSocket: &corev1.TCPSocketAction{
+										Port: intstr.FromInt(pgBouncerPort),
+									},
+								},
+								PeriodSeconds: 5,
+							},
+							Resources:       cr.Spec.PgBouncer.Resources,
+							SecurityContext: securityContext,
+							VolumeMounts:    volumeMounts,
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+}
+
+func pgBouncerService(cr *hyperfoilv1alpha1.Horreum) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pgBouncerName(cr),
+			Namespace: cr.Namespace,
+			Annotations: map[string]string{
+				"service.beta.openshift.io/serving-cert-secret-name": pgBouncerCertsSecret(cr),
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeClusterIP,
+			Ports: []corev1.ServicePort{
+				{
+					Name: "postgres",
+					Port: int32(pgBouncerPort),
+					TargetPort: intstr.IntOrString{
+						IntVal: pgBouncerPort,
+					},
+				},
+			},
+			Selector: pgBouncerLabels(cr),
+		},
+	}
+}
+
+func compareSecretData(i1, i2 interface{}, logger logr.Logger) bool {
+	s1, ok1 := i1.(*corev1.Secret)
+	s2, ok2 := i2.(*corev1.Secret)
+	if !ok1 || !ok2 {
+		logger.Info("Cannot cast to Secrets: " + fmt.Sprintf("%T | %T", i1, i2))
+		return false
+	}
+	// Do not log the values, these contain passwords
+	return equality.Semantic.DeepEqual(s1.Data, s2.Data)
+}
+
+// ensurePgBouncer deploys PgBouncer when enabled, or deletes it. Its configuration is updated in place
+// and the instances are replaced one by one when it changes, e.g. after credentials rotation.
+func ensurePgBouncer(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) error {
+	deployment := pgBouncerDeployment(cr, r.Platform, "")
+	service := pgBouncerService(cr)
+	if !cr.Spec.PgBouncer.Enabled {
+		if err := ensureDeleted(r, cr, deployment, &appsv1.Deployment{}); err != nil {
+			return err
+		}
+		if err := ensureDeleted(r, cr, service, &corev1.Service{}); err != nil {
+			return err
+		}
+		return ensureDeleted(r, cr, &corev1.Secret{ObjectMeta: deployment.ObjectMeta}, &corev1.Secret{})
+	}
+	secret, err := pgBouncerSecret(r, cr)
+	if err != nil {
+		return err
+	}
+	found := &corev1.Secret{}
+	if err := ensureSame(r, cr, logger, secret.DeepCopy(), found, nocompare, nocheck); err != nil {
+		return err
+	}
+	// Freshly created secret is not fetched
+	if found.ResourceVersion != "" && !compareSecretData(secret, found, logger) {
+		logger.Info("Secret " + secret.Name + " does not match. Updating existing object.")
+		found.Data = secret.Data
+		if err := r.Update(context.TODO(), found); err != nil {
+			updateStatus(r, cr, "Error", "Cannot update Secret "+secret.Name)
+			return err
+		}
+	}
+	config := string(secret.Data["pgbouncer.ini"]) + string(secret.Data["userlist.txt"])
+	deployment.Spec.Template.Annotations[configHashAnnotation] = configHash(config)
+	if err := ensureDeployment(r, cr, logger, deployment); err != nil {
+		return err
+	}
+	return ensureSame(r, cr, logger, service, &corev1.Service{}, compareService, nocheck)
+}
@@ -0,0 +1,58 @@
+package horreum
+
+import (
+	"strings"
+	"testing"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPgBouncerIni(t *testing.T) {
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			PgBouncer: hyperfoilv1alpha1.PgBouncerSpec{
+				Enabled:         true,
+				DefaultPoolSize: 50,
+			},
+		},
+	}
+	ini := pgBouncerIni(cr)
+	for _, line := range []string{
+		"horreum = host=horreum-db.test.svc port=5432 dbname=horreum",
+		"keycloak = host=horreum-db.test.svc port=5432 dbname=keycloak",
+		"pool_mode = transaction",
+		"default_pool_size = 50",
+		"max_client_conn = 1000",
+		"server_tls_sslmode = verify-full",
+		"server_tls_ca_file = " + serviceCaPath,
+	} {
+		if !strings.Contains(ini, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, ini)
+		}
+	}
+	if url := appDbURL(cr); url != "jdbc:postgresql://horreum-pgbouncer.test.svc:5432/horreum?sslmode=verify-full&sslrootcert="+serviceCaPath {
+		t.Errorf("unexpected Horreum URL %s", url)
+	}
+
+	// PgBouncer verifies all servers with the CA of spec.database
+	cr.Spec.Database = hyperfoilv1alpha1.DatabaseSpec{Host: "db.example.com", SSLMode: "verify-full", CASecret: "db-ca"}
+	cr.Spec.Keycloak.DatabaseMode = hyperfoilv1alpha1.KeycloakDatabaseDedicated
+	if keycloakUsesPgBouncer(cr) {
+		t.Error("Keycloak database with different CA must be connected directly")
+	}
+	ini = pgBouncerIni(cr)
+	if strings.Contains(ini, "keycloak =") || !strings.Contains(ini, "server_tls_ca_file = "+dbCAMountPath+"/ca.crt\n") {
+		t.Errorf("unexpected configuration:\n%s", ini)
+	}
+
+	userlist := pgBouncerUserlist(&corev1.Secret{Data: map[string][]byte{
+		corev1.BasicAuthUsernameKey: []byte("horreum-app"),
+		corev1.BasicAuthPasswordKey: []byte(`pa"ss`),
+	}})
+	if userlist != `"horreum-app" "pa""ss"`+"\n" {
+		t.Errorf("unexpected userlist %s", userlist)
+	}
+}
@@ -0,0 +1,64 @@
+package horreum
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Images used when the Horreum resource does not set them
+const (
+	DefaultAppImage            = "quay.io/hyperfoil/horreum:latest"
+	DefaultKeycloakImage       = "quay.io/hyperfoil/horreum-keycloak:latest"
+	DefaultPostgresImage       = "docker.io/library/postgres:14.4"
+	DefaultPostgresRedHatImage = "registry.redhat.io/rhel8/postgresql-12:latest"
+	DefaultSecretsSyncImage    = "registry.k8s.io/pause:3.9"
+	DefaultPgBouncerImage      = "docker.io/edoburu/pgbouncer:v1.23.1-p2"
+)
+
+// Images overrides the default images; empty values fall back to the compiled-in defaults
+type Images struct {
+	App            string
+	Keycloak       string
+	Postgres       string
+	PostgresRedHat string
+	// Image of the pod that keeps Secrets Store CSI volumes mounted
+	SecretsSync string
+	PgBouncer   string
+	// Image with WAL-G used for backups of PostgreSQL; there is no default, backups require it
+	WalG string
+}
+
+// Platform describes the cluster the resources are built for and operator-wide defaults
+type Platform struct {
+	// OpenShift routes (and service CA) are available
+	RoutesAvailable bool
+	// Use the Red Hat PostgreSQL image rather than the community one
+	UseRedHatImages bool
+	// Namespace where the operator runs, empty when running outside of the cluster
+	OperatorNamespace string
+	Images            Images
+	// Pull policy of the containers; empty value leaves the choice to Kubernetes
+	PullPolicy corev1.PullPolicy
+	// Replaces registry in the default images, e.g. 'mirror.example.com:5000' or 'mirror.example.com/quay'
+	RegistryMirror string
+	// Type of services when the Horreum resource does not set it; empty value means ClusterIP
+	// when routes are available and NodePort otherwise
+	ServiceType corev1.ServiceType
+}
+
+// mirrored replaces the registry of the image with the mirror, keeping the repository path. Images
+// without registry come from docker.io, where official images live under library/.
+func (p Platform) mirrored(image string) string {
+	if p.RegistryMirror == "" {
+		return image
+	}
+	registry := "docker.io"
+	if parts := strings.SplitN(image, "/", 2); len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		registry, image = parts[0], parts[1]
+	}
+	if registry == "docker.io" && !strings.Contains(image, "/") {
+		image = "library/" + image
+	}
+	return strings.TrimSuffix(p.RegistryMirror, "/") + "/" + image
+}
@@ -0,0 +1,44 @@
+package horreum
+
+import "testing"
+
+func TestMirrored(t *testing.T) {
+	for _, tc := range []struct {
+		mirror   string
+		image    string
+		expected string
+	}{
+		{"", "postgres:14", "postgres:14"},
+		{"mirror.example.com", "quay.io/hyperfoil/horreum:latest", "mirror.example.com/hyperfoil/horreum:latest"},
+		{"mirror.example.com/quay/", "quay.io/hyperfoil/horreum:latest", "mirror.example.com/quay/hyperfoil/horreum:latest"},
+		{"mirror.example.com:5000", "docker.io/library/postgres:14.4", "mirror.example.com:5000/library/postgres:14.4"},
+		{"mirror.example.com:5000", "docker.io/postgres:14.4", "mirror.example.com:5000/library/postgres:14.4"},
+		{"mirror.example.com:5000", "postgres:14.4", "mirror.example.com:5000/library/postgres:14.4"},
+		{"mirror.example.com:5000", "edoburu/pgbouncer:v1.23.1-p2", "mirror.example.com:5000/edoburu/pgbouncer:v1.23.1-p2"},
+		{"mirror.example.com", "registry.example.com:5000/horreum/app:1.0", "mirror.example.com/horreum/app:1.0"},
+		{"mirror.example.com", "localhost/horreum:dev", "mirror.example.com/horreum:dev"},
+		{"mirror.example.com", "quay.io/hyperfoil/horreum@sha256:0123456789abcdef", "mirror.example.com/hyperfoil/horreum@sha256:0123456789abcdef"},
+		{"mirror.example.com", "postgres@sha256:0123456789abcdef", "mirror.example.com/library/postgres@sha256:0123456789abcdef"},
+	} {
+		if actual := (Platform{RegistryMirror: tc.mirror}).mirrored(tc.image); actual != tc.expected {
+			t.Errorf("mirrored(%q) with mirror %q: expected %q, got %q", tc.image, tc.mirror, tc.expected, actual)
+		}
+	}
+}
+
+func TestIsDockerDbImage(t *testing.T) {
+	for image, expected := range map[string]bool{
+		"postgres":                                           true,
+		"postgres:16.2":                                      true,
+		"docker.io/library/postgres:14.4":                    true,
+		"registry.example.com:5000/postgres:15":              true,
+		"docker.io/library/postgres@sha256:0123456789abcdef": true,
+		"registry.redhat.io/rhel8/postgresql-12:latest":      false,
+		"quay.io/example/postgres-custom:14":                 false,
+		"registry.example.com:5000/rhel9/postgresql-15":      false,
+	} {
+		if actual := isDockerDbImage(image); actual != expected {
+			t.Errorf("isDockerDbImage(%q): expected %v, got %v", image, expected, actual)
+		}
+	}
+}
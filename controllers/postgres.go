@@ -1,7 +1,10 @@
 package horreum
 
 import (
-	"fmt"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
 	"strings"
 
 	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
@@ -10,53 +13,213 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
-func postgresConfigMap(cr *hyperfoilv1alpha1.Horreum) *corev1.ConfigMap {
-	keycloakDbName := withDefault(cr.Spec.Keycloak.Database.Name, "keycloak")
-	return &corev1.ConfigMap{
+const (
+	dbCertsPath  = "/etc/pgsql/certs"
+	dbConfigPath = "/etc/horreum/postgresql"
+	dbDataPath   = "/var/lib/pgsql/data"
+	// Dump of the previous major version, loaded by the server on its first start after an upgrade
+	dbUpgradeDump = dbDataPath + "/upgrade.sql"
+	// The dump is renamed when the restore fails, which keeps the server from starting with partial data
+	dbUpgradeFailed = dbDataPath + "/upgrade.failed"
+)
+
+// restoreUpgradeScript is sourced by both images when the server runs only on the local socket
+const restoreUpgradeScript = `
+	if [ -f ` + dbUpgradeFailed + ` ]; then
+		echo "Restoring data from the previous PostgreSQL version failed, see ` + dbDataPath + `/upgrade.log"
+		exit 1
+	fi
+	if [ -f ` + dbUpgradeDump + ` ]; then
+		echo "Restoring data from the previous PostgreSQL version"
+		# Roles and databases created on initialization are in the dump, too
+		if ! psql -X -q --username "${POSTGRES_USER:-postgres}" --dbname postgres -f ` + dbUpgradeDump + ` 2> ` + dbDataPath + `/upgrade.log ||
+			grep ERROR ` + dbDataPath + `/upgrade.log | grep -v "already exists"; then
+			mv ` + dbUpgradeDump + ` ` + dbUpgradeFailed + `
+			echo "Restoring data from the previous PostgreSQL version failed, see ` + dbDataPath + `/upgrade.log"
+			exit 1
+		fi
+		rm ` + dbUpgradeDump + `
+	fi
+`
+
+// postgresqlConf renders settings that are included into the server's postgresql.conf
+func postgresqlConf(spec *hyperfoilv1alpha1.PostgresSpec) string {
+	parameters := postgresPresetParameters(spec)
+	for name, value := range postgresArchiveParameters(spec) {
+		parameters[name] = value
+	}
+	for name, value := range spec.Parameters {
+		parameters[name] = value
+	}
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	conf := "\n"
+	for _, name := range names {
+		conf += name + " = '" + strings.ReplaceAll(parameters[name], "'", "''") + "'\n"
+	}
+	// Later settings win, user cannot switch off TLS
+	return conf + `ssl = on
+ssl_cert_file = '` + dbCertsPath + `/` + corev1.TLSCertKey + `'
+ssl_key_file = '` + dbCertsPath + `/` + corev1.TLSPrivateKeyKey + `'
+`
+}
+
+// postgresConfig is what the server reads only on start
+func postgresConfig(db postgresInstance) string {
+	conf := postgresqlConf(db.spec)
+	if db.replicated {
+		conf += replicationHbaScript
+	}
+	return conf
+}
+
+// configHash identifies the configuration the server was started with, most settings need restart
+func configHash(conf string) string {
+	sum := sha256.Sum256([]byte(conf))
+	return hex.EncodeToString(sum[:8])
+}
+
+// postgresPresetParameters sizes memory settings from the container memory limit, similar to pgtune
+func postgresPresetParameters(spec *hyperfoilv1alpha1.PostgresSpec) map[string]string {
+	parameters := map[string]string{}
+	memory := spec.Resources.Limits.Memory().Value() / 1024
+	if spec.Preset == "" || memory <= 0 {
+		return parameters
+	}
+	maxConnections := int64(200)
+	maintenanceWorkMem := memory / 16
+	workMemDivisor := int64(3)
+	if spec.Preset == hyperfoilv1alpha1.PostgresPresetAnalytics {
+		maxConnections = 50
+		maintenanceWorkMem = memory / 8
+		workMemDivisor = 2
+	}
+	if maintenanceWorkMem > 2*1024*1024 {
+		maintenanceWorkMem = 2 * 1024 * 1024
+	}
+	sharedBuffers := memory / 4
+	workMem := (memory - sharedBuffers) / (maxConnections * workMemDivisor)
+	if workMem < 64 {
+		workMem = 64
+	}
+	kB := func(value int64) string {
+		return strconv.FormatInt(value, 10) + "kB"
+	}
+	parameters["max_connections"] = strconv.FormatInt(maxConnections, 10)
+	parameters["shared_buffers"] = kB(sharedBuffers)
+	parameters["effective_cache_size"] = kB(memory * 3 / 4)
+	parameters["maintenance_work_mem"] = kB(maintenanceWorkMem)
+	parameters["work_mem"] = kB(workMem)
+	return parameters
+}
+
+// postgresInstance describes a PostgreSQL server deployed by the operator. Besides the one used by Horreum
+// (and by default also by Keycloak) there can be another one dedicated to Keycloak.
+type postgresInstance struct {
+	// Name of the pod and service
+	name string
+	// Value of the `service` label
+	component string
+	spec      *hyperfoilv1alpha1.PostgresSpec
+	// Claim mounted as the data volume; ephemeral storage is used when empty
+	claim string
+	// Database created when the server is initialized
+	database    string
+	adminSecret string
+	certsSecret string
+	configMap   string
+	// Streaming replicas connect to the server, see replica.go
+	replicated bool
+	// Major version and volumes of the data directory, see upgrade.go
+	status **hyperfoilv1alpha1.PostgresStatus
+	// Name of the server in messages and path of its spec
+	title    string
+	specPath string
+}
+
+func horreumPostgres(cr *hyperfoilv1alpha1.Horreum) postgresInstance {
+	return postgresInstance{
+		name:        cr.Name + "-db",
+		component:   "db",
+		spec:        &cr.Spec.Postgres,
+		claim:       postgresDataClaim(&cr.Spec.Postgres, cr.Status.Postgres),
+		database:    withDefault(cr.Spec.Database.Name, "horreum"),
+		adminSecret: dbAdminSecret(cr),
+		certsSecret: dbCertsSecret(cr),
+		configMap:   cr.Name + "-postgresql-start",
+		replicated:  hasReadReplicas(cr),
+		status:      &cr.Status.Postgres,
+		title:       "PostgreSQL",
+		specPath:    "spec.postgres",
+	}
+}
+
+func keycloakPostgres(cr *hyperfoilv1alpha1.Horreum) postgresInstance {
+	return postgresInstance{
+		name:        cr.Name + "-keycloak-db",
+		component:   "keycloak-db",
+		spec:        &cr.Spec.Keycloak.Postgres,
+		claim:       postgresDataClaim(&cr.Spec.Keycloak.Postgres, cr.Status.KeycloakPostgres),
+		database:    withDefault(cr.Spec.Keycloak.Database.Name, "keycloak"),
+		adminSecret: keycloakDbAdminSecret(cr),
+		certsSecret: cr.Name + "-keycloak-postgres",
+		configMap:   cr.Name + "-keycloak-postgresql-start",
+		status:      &cr.Status.KeycloakPostgres,
+		title:       "Keycloak PostgreSQL",
+		specPath:    "spec.keycloak.postgres",
+	}
+}
+
+func (db postgresInstance) host(cr *hyperfoilv1alpha1.Horreum) string {
+	return db.name + "." + cr.Namespace + ".svc"
+}
+
+func postgresConfigMap(cr *hyperfoilv1alpha1.Horreum, db postgresInstance, p Platform) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      cr.Name + "-postgresql-start",
+			Name:      db.configMap,
 			Namespace: cr.Namespace,
 			Labels: map[string]string{
 				"app": cr.Name,
 			},
 		},
 		Data: map[string]string{
-			"init_keycloak.sh": `
-				if psql -t -c "SELECT 1 FROM pg_roles WHERE rolname = '$KEYCLOAK_USER';" | grep -q 1; then
-					echo "Database role $KEYCLOAK_USER already exists.";
-				else
-					psql -c "CREATE ROLE \"$KEYCLOAK_USER\" noinherit login password '$KEYCLOAK_PASSWORD';";
-				fi
-				if psql -t -c "SELECT 1 FROM pg_database WHERE datname = '` + keycloakDbName + `';" | grep -q 1; then
-					echo "Database "` + keycloakDbName + `" already exists.";
-				else
-					psql -c "CREATE DATABASE ` + keycloakDbName + ` WITH OWNER = '$KEYCLOAK_USER';";
-				fi
-			`,
-			"init_app.sh": `
-			    # Adding extension pgcrypto requires superuser priviledges
-				psql -c 'ALTER ROLE "'$POSTGRESQL_USER'" WITH SUPERUSER';
-				if psql -t -c "SELECT 1 FROM pg_roles WHERE rolname = '$APP_USER';" | grep -q 1; then
-					echo "Database role $APP_USER already exists.";
-				else
-					psql -c "CREATE ROLE \"$APP_USER\" noinherit login password '$APP_PASSWORD';"
-				fi
-			`,
+			"horreum.conf":       postgresqlConf(db.spec),
+			"restore_upgrade.sh": restoreUpgradeScript,
 		},
 	}
+	if db.spec.Restore != nil {
+		// Not *.sh, these must not run from the init directory
+		cm.Data["restore-wal-g.bash"] = restoreWalG
+		cm.Data["restore-backup.bash"] = postgresRestoreScript(db)
+	}
+	if db.replicated {
+		// Red Hat image sources the script on every start, community image on initialization
+		cm.Data["replication_hba.sh"] = replicationHbaScript
+	}
+	if isDockerDbImage(postgresImage(db.spec, p)) {
+		// Red Hat image includes *.conf files from postgresql-cfg directory, community image needs this
+		cm.Data["include_horreum_conf.sh"] = `
+			echo "include_if_exists = '` + dbConfigPath + `/horreum.conf'" >> "$PGDATA/postgresql.conf"
+		`
+	}
+	return cm
 }
 
-func postgresPod(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev1.Pod {
+func postgresPod(cr *hyperfoilv1alpha1.Horreum, db postgresInstance, p Platform) *corev1.Pod {
 	labels := map[string]string{
 		"app":     cr.Name,
-		"service": "db",
+		"service": db.component,
 	}
 
 	dbVolumeSrc := corev1.VolumeSource{}
-	if cr.Spec.Postgres.PersistentVolumeClaim != "" {
+	if db.claim != "" {
 		dbVolumeSrc = corev1.VolumeSource{
 			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-				ClaimName: cr.Spec.Postgres.PersistentVolumeClaim,
+				ClaimName: db.claim,
 			},
 		}
 	} else {
@@ -64,135 +227,244 @@ func postgresPod(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev1.Po
 			EmptyDir: &corev1.EmptyDirVolumeSource{},
 		}
 	}
-	image := dbImage(cr, r.UseRedHatImages)
-	envs := []corev1.EnvVar{
-		secretEnv("KEYCLOAK_USER", keycloakDbSecret(cr), corev1.BasicAuthUsernameKey),
-		secretEnv("KEYCLOAK_PASSWORD", keycloakDbSecret(cr), corev1.BasicAuthPasswordKey),
-		secretEnv("APP_USER", appUserSecret(cr), corev1.BasicAuthUsernameKey),
-		secretEnv("APP_PASSWORD", appUserSecret(cr), corev1.BasicAuthPasswordKey),
-		secretEnv("APP_DB_SECRET", appUserSecret(cr), "dbsecret"),
-	}
+	image := postgresImage(db.spec, p)
+	// Roles and databases for Horreum and Keycloak are created by the operator, see provision.go
+	envs := []corev1.EnvVar{}
 
-	var userId int64
+	userId := postgresUserId(db.spec, image)
 	var initDir string
-	if strings.HasPrefix(image, "docker.io/library/postgres") || strings.HasPrefix(image, "postgres") {
-		userId = int64(999)
+	var command []string
+	// Red Hat image generates configuration outside of the data directory
+	readOnlyRootFilesystem := false
+	volumes := []corev1.Volume{
+		{
+			Name:         "db-volume",
+			VolumeSource: dbVolumeSrc,
+		},
+		{
+			Name: "postgresql-start",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: db.configMap,
+					},
+				},
+			},
+		},
+		{
+			Name: "certs",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: db.certsSecret,
+					// PostgreSQL refuses to use private key readable by others
+					DefaultMode: &[]int32{0640}[0],
+				},
+			},
+		},
+	}
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      "db-volume",
+			MountPath: dbDataPath,
+		},
+		{
+			Name:      "postgresql-start",
+			MountPath: dbConfigPath,
+		},
+		{
+			Name:      "certs",
+			MountPath: dbCertsPath,
+		},
+	}
+	var initContainers []corev1.Container
+	if usesWalG(db.spec) {
+		initContainers = append(initContainers, walGInitContainer(p, userId))
+		volumes = append(volumes, corev1.Volume{
+			Name: "wal-g",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      "wal-g",
+			MountPath: walGPath,
+		})
+	}
+	if isBackupEnabled(db.spec) {
+		storageEnv, storageVolumes, storageMounts := postgresBackupStorage(cr, db, image)
+		envs = append(envs, storageEnv...)
+		volumes = append(volumes, storageVolumes...)
+		volumeMounts = append(volumeMounts, storageMounts...)
+	}
+	// The backup is restored before the server starts, see postgresRestoreScript
+	restore := ""
+	if db.spec.Restore != nil {
+		storageEnv, storageVolumes, storageMounts := postgresRestoreStorage(cr, db, image)
+		envs = append(envs, storageEnv...)
+		volumes = append(volumes, storageVolumes...)
+		volumeMounts = append(volumeMounts, storageMounts...)
+		restore = "source " + restoreBackupScript + "\n"
+	}
+	// Databases initialized before the replicas were added need to get the entry on start
+	replication := ""
+	if db.replicated {
+		replication = "source " + dbConfigPath + "/replication_hba.sh\n"
+	}
+	if isDockerDbImage(image) {
 		initDir = "/docker-entrypoint-initdb.d/"
 		envs = append(envs,
 			corev1.EnvVar{
 				Name:  "POSTGRES_DB",
-				Value: withDefault(cr.Spec.Database.Name, "horreum"),
+				Value: db.database,
 			},
 			corev1.EnvVar{
 				Name:  "PGDATABASE",
-				Value: withDefault(cr.Spec.Database.Name, "horreum"),
+				Value: db.database,
 			},
-			corev1.EnvVar{
-				Name:  "PGDATA",
-				Value: "/var/lib/pgsql/data",
-			},
-			secretEnv("PGUSER", dbAdminSecret(cr), corev1.BasicAuthUsernameKey),
-			secretEnv("POSTGRES_USER", dbAdminSecret(cr), corev1.BasicAuthUsernameKey),
-			// because of the init script
-			secretEnv("POSTGRESQL_USER", dbAdminSecret(cr), corev1.BasicAuthUsernameKey),
-			secretEnv("POSTGRES_PASSWORD", dbAdminSecret(cr), corev1.BasicAuthPasswordKey),
+			secretEnv("PGUSER", db.adminSecret, corev1.BasicAuthUsernameKey),
+			secretEnv("POSTGRES_USER", db.adminSecret, corev1.BasicAuthUsernameKey),
+			secretEnv("POSTGRES_PASSWORD", db.adminSecret, corev1.BasicAuthPasswordKey),
 		)
+		// Older versions of the operator chowned the volume in a privileged init container and kept
+		// the data in its root. Without that the volume root is only group-writable (through fsGroup)
+		// and the server refuses to use it, so new databases live in a subdirectory.
+		// Databases initialized before the include was added to postgresql.conf need to get it on start.
+		command = []string{"bash", "-c", `
+			if [ -f /var/lib/pgsql/data/PG_VERSION ]; then
+				export PGDATA=/var/lib/pgsql/data
+			else
+				export PGDATA=/var/lib/pgsql/data/pgdata
+			fi
+			if [ -f ` + dbUpgradeFailed + ` ]; then
+				echo "Restoring data from the previous PostgreSQL version failed, see ` + dbDataPath + `/upgrade.log"
+				exit 1
+			fi
+			` + restore + `if [ -f "$PGDATA/postgresql.conf" ] && ! grep -q "` + dbConfigPath + `/horreum.conf" "$PGDATA/postgresql.conf"; then
+				echo "include_if_exists = '` + dbConfigPath + `/horreum.conf'" >> "$PGDATA/postgresql.conf"
+			fi
+			` + replication + `exec docker-entrypoint.sh postgres
+		`}
+		readOnlyRootFilesystem = true
+		for _, dir := range []struct{ name, path string }{{"run", "/var/run/postgresql"}, {"tmp", "/tmp"}} {
+			volumes = append(volumes, corev1.Volume{
+				Name: dir.name,
+				VolumeSource: corev1.VolumeSource{
+					EmptyDir: &corev1.EmptyDirVolumeSource{},
+				},
+			})
+			volumeMounts = append(volumeMounts, corev1.VolumeMount{
+				Name:      dir.name,
+				MountPath: dir.path,
+			})
+		}
 	} else { // Red Hat image
-		userId = int64(26)
 		initDir = "/opt/app-root/src/postgresql-start"
 		envs = append(envs,
 			corev1.EnvVar{
 				Name:  "POSTGRESQL_DATABASE",
-				Value: withDefault(cr.Spec.Database.Name, "horreum"),
+				Value: db.database,
 			},
-			secretEnv("POSTGRESQL_USER", dbAdminSecret(cr), corev1.BasicAuthUsernameKey),
-			secretEnv("POSTGRESQL_PASSWORD", dbAdminSecret(cr), corev1.BasicAuthPasswordKey))
-	}
-
-	if cr.Spec.Postgres.User != nil {
-		userId = *cr.Spec.Postgres.User
-	}
-	initContainers := []corev1.Container{}
-	if !r.UseRedHatImages {
-		initContainers = append(initContainers, corev1.Container{
-			Name:    "init",
-			Image:   image,
-			Command: []string{"chown", fmt.Sprint(userId), "/var/lib/pgsql/data"},
-			SecurityContext: &corev1.SecurityContext{
-				RunAsUser: &[]int64{0}[0],
-			},
-			VolumeMounts: []corev1.VolumeMount{
-				{
-					Name:      "db-volume",
-					MountPath: "/var/lib/pgsql/data",
+			secretEnv("POSTGRESQL_USER", db.adminSecret, corev1.BasicAuthUsernameKey),
+			secretEnv("POSTGRESQL_PASSWORD", db.adminSecret, corev1.BasicAuthPasswordKey),
+			// Password for the 'postgres' superuser the operator uses to create extensions
+			secretEnv("POSTGRESQL_ADMIN_PASSWORD", db.adminSecret, corev1.BasicAuthPasswordKey))
+		volumes = append(volumes, corev1.Volume{
+			Name: "postgresql-cfg",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: db.configMap,
+					},
+					Items: []corev1.KeyToPath{
+						{
+							Key:  "horreum.conf",
+							Path: "horreum.conf",
+						},
+					},
 				},
 			},
 		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      "postgresql-cfg",
+			MountPath: "/opt/app-root/src/postgresql-cfg",
+		})
+		if restore != "" {
+			command = []string{"bash", "-c", "export PGDATA=${PGDATA:-" + dbDataPath + "/userdata}\n" + restore + "exec run-postgresql"}
+		}
 	}
+	volumeMounts = append(volumeMounts, corev1.VolumeMount{
+		Name:      "postgresql-start",
+		MountPath: initDir,
+	})
+
+	// The volume is made writable for the user through fsGroup
+	podSecurityContext := restrictedPodSecurityContext()
+	podSecurityContext.FSGroup = &[]int64{userId}[0]
+	podSecurityContext.FSGroupChangePolicy = &[]corev1.PodFSGroupChangePolicy{corev1.FSGroupChangeOnRootMismatch}[0]
+	securityContext := restrictedSecurityContext(readOnlyRootFilesystem)
+	securityContext.RunAsUser = &[]int64{userId}[0]
 	return &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      cr.Name + "-db",
+			Name:      db.name,
 			Namespace: cr.Namespace,
 			Labels:    labels,
+			Annotations: map[string]string{
+				configHashAnnotation: configHash(postgresConfig(db)),
+			},
 		},
 		Spec: corev1.PodSpec{
-			InitContainers: initContainers,
-			SecurityContext: &corev1.PodSecurityContext{
-				FSGroup: &[]int64{userId}[0],
-			},
+			ImagePullSecrets: cr.Spec.ImagePullSecrets,
+			SecurityContext:  podSecurityContext,
+			InitContainers:   initContainers,
 			Containers: []corev1.Container{
 				{
-					Name:  "postgres",
-					Image: image,
-					Env:   envs,
+					Name:            "postgres",
+					Image:           image,
+					ImagePullPolicy: p.PullPolicy,
+					Command:         command,
+					Env:             envs,
 					Ports: []corev1.ContainerPort{
 						{
 							Name:          "postgres",
 							ContainerPort: 5432,
 						},
 					},
-					SecurityContext: &corev1.SecurityContext{
-						RunAsUser: &[]int64{userId}[0],
-					},
-					VolumeMounts: []corev1.VolumeMount{
-						{
-							Name:      "db-volume",
-							MountPath: "/var/lib/pgsql/data",
-						},
-						{
-							Name:      "postgresql-start",
-							MountPath: initDir,
-						},
-					},
-				},
-			},
-			Volumes: []corev1.Volume{
-				{
-					Name:         "db-volume",
-					VolumeSource: dbVolumeSrc,
-				},
-				{
-					Name: "postgresql-start",
-					VolumeSource: corev1.VolumeSource{
-						ConfigMap: &corev1.ConfigMapVolumeSource{
-							LocalObjectReference: corev1.LocalObjectReference{
-								Name: cr.Name + "-postgresql-start",
+					// The server listens only on local socket while the init scripts run
+					ReadinessProbe: &corev1.Probe{
+						ProbeHandler: corev1.ProbeHandler{
+							Exec: &corev1.ExecAction{
+								Command: []string{"pg_isready", "-h", "127.0.0.1", "-p", "5432"},
 							},
 						},
+						PeriodSeconds: 5,
 					},
+					Resources:       db.spec.Resources,
+					SecurityContext: securityContext,
+					VolumeMounts:    volumeMounts,
 				},
 			},
+			Volumes: volumes,
 		},
 	}
 }
 
-func postgresService(cr *hyperfoilv1alpha1.Horreum) *corev1.Service {
+// postgresUserId is the user running the server, which owns the data directory
+func postgresUserId(spec *hyperfoilv1alpha1.PostgresSpec, image string) int64 {
+	if spec.User != nil {
+		return *spec.User
+	} else if isDockerDbImage(image) {
+		return 999
+	}
+	return 26
+}
+
+func postgresService(cr *hyperfoilv1alpha1.Horreum, db postgresInstance) *corev1.Service {
 	return &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      cr.Name + "-db",
+			Name:      db.name,
 			Namespace: cr.Namespace,
 			Annotations: map[string]string{
-				"service.beta.openshift.io/serving-cert-secret-name": cr.Name + "-postgres",
+				"service.beta.openshift.io/serving-cert-secret-name": db.certsSecret,
 			},
 		},
 		Spec: corev1.ServiceSpec{
@@ -208,7 +480,7 @@ func postgresService(cr *hyperfoilv1alpha1.Horreum) *corev1.Service {
 			},
 			Selector: map[string]string{
 				"app":     cr.Name,
-				"service": "db",
+				"service": db.component,
 			},
 		},
 	}
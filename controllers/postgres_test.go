@@ -0,0 +1,142 @@
+package horreum
+
+import (
+	"strings"
+	"testing"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPostgresqlConf(t *testing.T) {
+	spec := &hyperfoilv1alpha1.PostgresSpec{
+		Preset: hyperfoilv1alpha1.PostgresPresetOLTP,
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{corev1.ResourceMemory: apiresource.MustParse("4Gi")},
+		},
+		Parameters: map[string]string{
+			"work_mem":         "64MB",
+			"search_path":      "'$user', public",
+			"ssl":              "off",
+			"random_page_cost": "1.1",
+		},
+	}
+	conf := postgresqlConf(spec)
+	for _, line := range []string{
+		"max_connections = '200'",
+		"shared_buffers = '1048576kB'",
+		"effective_cache_size = '3145728kB'",
+		"maintenance_work_mem = '262144kB'",
+		"work_mem = '64MB'",
+		"random_page_cost = '1.1'",
+		"search_path = '''$user'', public'",
+	} {
+		if !strings.Contains(conf, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, conf)
+		}
+	}
+	if !strings.HasSuffix(conf[:strings.Index(conf, "ssl_cert_file")], "ssl = on\n") {
+		t.Errorf("TLS settings must come last:\n%s", conf)
+	}
+
+	spec.Preset = hyperfoilv1alpha1.PostgresPresetAnalytics
+	if params := postgresPresetParameters(spec); params["max_connections"] != "50" || params["work_mem"] != "31457kB" {
+		t.Errorf("unexpected analytics preset: %v", params)
+	}
+	spec.Resources.Limits = nil
+	if params := postgresPresetParameters(spec); len(params) != 0 {
+		t.Errorf("preset without memory limit: %v", params)
+	}
+}
+
+func TestPostgresMajorVersion(t *testing.T) {
+	for image, version := range map[string]string{
+		"postgres:14.4":                                      "14",
+		"docker.io/library/postgres:16-alpine":               "16",
+		"postgres:9.6.24":                                    "9.6",
+		"registry.redhat.io/rhel8/postgresql-12:latest":      "12",
+		"registry.redhat.io/rhel9/postgresql-15@sha256:0123": "15",
+		"postgres:latest":                                    "",
+		"postgres@sha256:0123":                               "",
+		"mirror.example.com:5000/postgres:15.2":              "15",
+	} {
+		if actual := postgresMajorVersion(image); actual != version {
+			t.Errorf("%s: expected %q, got %q", image, version, actual)
+		}
+	}
+}
+
+func hasMount(mounts []corev1.VolumeMount, name string, path string) bool {
+	for _, m := range mounts {
+		if m.Name == name && m.MountPath == path {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPostgresTls(t *testing.T) {
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			Postgres: hyperfoilv1alpha1.PostgresSpec{PersistentVolumeClaim: "horreum-db"},
+		},
+	}
+	db := horreumPostgres(cr)
+	conf := postgresqlConf(db.spec)
+	for _, line := range []string{
+		"ssl = on",
+		"ssl_cert_file = '" + dbCertsPath + "/tls.crt'",
+		"ssl_key_file = '" + dbCertsPath + "/tls.key'",
+	} {
+		if !strings.Contains(conf, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, conf)
+		}
+	}
+	pod := postgresPod(cr, db, Platform{})
+	if !hasMount(pod.Spec.Containers[0].VolumeMounts, "certs", dbCertsPath) {
+		t.Error("server certificates are not mounted")
+	}
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == "certs" && (v.Secret == nil || v.Secret.SecretName != "horreum-postgres" || *v.Secret.DefaultMode != 0640) {
+			t.Errorf("unexpected certificates volume %v", v.VolumeSource)
+		}
+	}
+
+	// Both applications verify the server against the service CA
+	serviceCaProps := "?sslmode=verify-full&sslrootcert=" + serviceCaPath
+	app := appPod(cr, Platform{}, "https://keycloak.example.com", "https://horreum.example.com").Spec.Containers[0]
+	if url := envValue(app.Env, "QUARKUS_DATASOURCE_JDBC_URL"); url != "jdbc:postgresql://horreum-db.test.svc:5432/horreum"+serviceCaProps {
+		t.Errorf("unexpected Horreum URL %s", url)
+	}
+	if !hasMount(app.VolumeMounts, "service-ca", serviceCaPath) {
+		t.Error("service CA is not mounted in Horreum")
+	}
+	keycloak := keycloakDeployment(cr, Platform{}, "https://keycloak.example.com").Spec.Template.Spec.Containers[0]
+	if props := envValue(keycloak.Env, "KC_DB_URL_PROPERTIES"); props != serviceCaProps {
+		t.Errorf("unexpected Keycloak URL properties %s", props)
+	}
+	if !hasMount(keycloak.VolumeMounts, "service-ca", serviceCaPath) {
+		t.Error("service CA is not mounted in Keycloak")
+	}
+
+	// External databases use the configured mode and CA
+	cr.Spec.Database = hyperfoilv1alpha1.DatabaseSpec{Host: "db.example.com", SSLMode: "verify-ca", CASecret: "db-ca"}
+	cr.Spec.Keycloak.Database = hyperfoilv1alpha1.DatabaseSpec{Host: "kc.example.com", SSLMode: "disable", CASecret: "kc-ca"}
+	app = appPod(cr, Platform{}, "https://keycloak.example.com", "https://horreum.example.com").Spec.Containers[0]
+	if url := envValue(app.Env, "QUARKUS_DATASOURCE_JDBC_URL"); url != "jdbc:postgresql://db.example.com:5432/horreum?sslmode=verify-ca&sslrootcert="+dbCAMountPath+"/ca.crt" {
+		t.Errorf("unexpected Horreum URL %s", url)
+	}
+	if !hasMount(app.VolumeMounts, "db-ca", dbCAMountPath) {
+		t.Error("database CA is not mounted in Horreum")
+	}
+	keycloak = keycloakDeployment(cr, Platform{}, "https://keycloak.example.com").Spec.Template.Spec.Containers[0]
+	if props := envValue(keycloak.Env, "KC_DB_URL_PROPERTIES"); props != "?sslmode=disable" {
+		t.Errorf("unexpected Keycloak URL properties %s", props)
+	}
+	if hasMount(keycloak.VolumeMounts, "service-ca", serviceCaPath) {
+		t.Error("service CA is not needed for external database")
+	}
+}
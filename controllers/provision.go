@@ -0,0 +1,556 @@
+package horreum
+
+import (
+	"context"
+	"database/sql"
+	stdErrors "errors"
+	"fmt"
+	"strings"
+	"time"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	"github.com/lib/pq"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// dbConnection holds coordinates and credentials the operator uses to connect to PostgreSQL
+type dbConnection struct {
+	host     string
+	port     int32
+	database string
+	user     string
+	password string
+	// 'disable', 'require', 'verify-ca' or 'verify-full'; empty value means 'prefer'
+	sslMode string
+	// PEM-encoded CA certificate used to verify the server
+	caCert string
+}
+
+// dbRole is a login role that should exist on the server
+type dbRole struct {
+	name     string
+	password string
+	// Role used for reporting on read replicas; it sees all rows but cannot modify anything
+	readOnly bool
+	// Role the read replicas use to copy the data and stream WAL; it needs no access to the databases
+	replication bool
+}
+
+// dbDatabase is a database that should exist on the server
+type dbDatabase struct {
+	name  string
+	owner string
+	// Extensions that must be created by a privileged user as the owner cannot do that
+	extensions []string
+	// Roles that connect to the database without owning it
+	users []string
+	// Roles that can select from all tables in the public schema, including those created later by the owner
+	readers []string
+}
+
+// dbProvisioning describes everything Horreum and Keycloak need from the server
+type dbProvisioning struct {
+	roles     []dbRole
+	databases []dbDatabase
+	// Roles that must not be superusers; older versions of the operator granted that to install extensions
+	demote []string
+}
+
+func quoteDsnValue(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+func (c dbConnection) withDatabase(database string) dbConnection {
+	c.database = database
+	return c
+}
+
+func (c dbConnection) dsn(sslMode string) string {
+	params := []string{
+		"host=" + quoteDsnValue(c.host),
+		"port=" + fmt.Sprint(c.port),
+		"dbname=" + quoteDsnValue(c.database),
+		"user=" + quoteDsnValue(c.user),
+		"password=" + quoteDsnValue(c.password),
+		"sslmode=" + sslMode,
+		"connect_timeout=10",
+	}
+	if c.caCert != "" && sslMode != "disable" {
+		params = append(params, "sslinline=true", "sslrootcert="+quoteDsnValue(c.caCert))
+	}
+	return strings.Join(params, " ")
+}
+
+func openDb(ctx context.Context, c dbConnection) (*sql.DB, error) {
+	sslMode := c.sslMode
+	if sslMode == "" || sslMode == "prefer" || sslMode == "allow" {
+		// Driver does not support opportunistic TLS, emulate it
+		db, err := pingDb(ctx, c.dsn("require"))
+		if err == nil || !stdErrors.Is(err, pq.ErrSSLNotSupported) {
+			return db, err
+		}
+		sslMode = "disable"
+	}
+	return pingDb(ctx, c.dsn(sslMode))
+}
+
+func pingDb(ctx context.Context, dsn string) (*sql.DB, error) {
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func exists(ctx context.Context, db *sql.DB, query string, args ...interface{}) (bool, error) {
+	var result bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS ("+query+")", args...).Scan(&result)
+	return result, err
+}
+
+// provisionDatabases creates missing roles, databases and extensions. Existing objects are left intact
+// so this can be invoked repeatedly.
+func provisionDatabases(ctx context.Context, admin dbConnection, p dbProvisioning, logger logr.Logger) error {
+	db, err := openDb(ctx, admin)
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s:%d as %s: %w", admin.host, admin.port, admin.user, err)
+	}
+	defer db.Close()
+
+	for _, role := range p.roles {
+		if found, err := exists(ctx, db, "SELECT 1 FROM pg_roles WHERE rolname = $1", role.name); err != nil {
+			return err
+		} else if found {
+			continue
+		}
+		logger.Info("Creating database role " + role.name)
+		attributes := " WITH LOGIN NOINHERIT NOSUPERUSER NOCREATEDB NOCREATEROLE"
+		if role.readOnly {
+			// Horreum restricts access to rows with row-level security policies
+			attributes += " BYPASSRLS"
+		}
+		if role.replication {
+			attributes += " REPLICATION"
+		}
+		// DDL statements cannot use bind parameters
+		if _, err := db.ExecContext(ctx, "CREATE ROLE "+pq.QuoteIdentifier(role.name)+
+			attributes+" PASSWORD "+pq.QuoteLiteral(role.password)); err != nil {
+			return fmt.Errorf("cannot create role %s: %w", role.name, err)
+		}
+		if role.readOnly {
+			if _, err := db.ExecContext(ctx, "ALTER ROLE "+pq.QuoteIdentifier(role.name)+
+				" SET default_transaction_read_only = on"); err != nil {
+				return fmt.Errorf("cannot make role %s read-only: %w", role.name, err)
+			}
+		}
+	}
+	for _, role := range p.demote {
+		if role == admin.user {
+			continue
+		}
+		if super, err := exists(ctx, db, "SELECT 1 FROM pg_roles WHERE rolname = $1 AND rolsuper", role); err != nil {
+			return err
+		} else if super {
+			logger.Info("Revoking superuser from database role " + role)
+			if _, err := db.ExecContext(ctx, "ALTER ROLE "+pq.QuoteIdentifier(role)+" WITH NOSUPERUSER"); err != nil {
+				return fmt.Errorf("cannot revoke superuser from role %s: %w", role, err)
+			}
+		}
+	}
+	for _, database := range p.databases {
+		if found, err := exists(ctx, db, "SELECT 1 FROM pg_database WHERE datname = $1", database.name); err != nil {
+			return err
+		} else if !found {
+			// Non-superuser (e.g. on managed cloud databases) can assign ownership only to roles it is member of
+			if member, err := exists(ctx, db, "SELECT 1 WHERE pg_has_role(current_user, $1, 'MEMBER')", database.owner); err != nil {
+				return err
+			} else if !member {
+				if _, err := db.ExecContext(ctx, "GRANT "+pq.QuoteIdentifier(database.owner)+" TO CURRENT_USER"); err != nil {
+					return fmt.Errorf("cannot grant role %s to %s: %w", database.owner, admin.user, err)
+				}
+			}
+			logger.Info("Creating database " + database.name)
+			if _, err := db.ExecContext(ctx, "CREATE DATABASE "+pq.QuoteIdentifier(database.name)+
+				" WITH OWNER = "+pq.QuoteIdentifier(database.owner)); err != nil {
+				return fmt.Errorf("cannot create database %s: %w", database.name, err)
+			}
+		}
+		for _, user := range database.users {
+			if _, err := db.ExecContext(ctx, "GRANT CONNECT ON DATABASE "+pq.QuoteIdentifier(database.name)+
+				" TO "+pq.QuoteIdentifier(user)); err != nil {
+				return fmt.Errorf("cannot grant access to database %s to %s: %w", database.name, user, err)
+			}
+		}
+		if len(database.extensions) > 0 {
+			if err := createExtensions(ctx, admin.withDatabase(database.name), database.extensions, logger); err != nil {
+				return err
+			}
+		}
+		if len(database.readers) > 0 {
+			if err := grantReadAccess(ctx, admin.withDatabase(database.name), database.owner, database.readers); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// grantReadAccess lets the readers select from existing tables and from tables the owner creates later
+func grantReadAccess(ctx context.Context, admin dbConnection, owner string, readers []string) error {
+	db, err := openDb(ctx, admin)
+	if err != nil {
+		return fmt.Errorf("cannot connect to database %s as %s: %w", admin.database, admin.user, err)
+	}
+	defer db.Close()
+	for _, reader := range readers {
+		role := pq.QuoteIdentifier(reader)
+		for _, statement := range []string{
+			"GRANT USAGE ON SCHEMA public TO " + role,
+			"GRANT SELECT ON ALL TABLES IN SCHEMA public TO " + role,
+			"ALTER DEFAULT PRIVILEGES FOR ROLE " + pq.QuoteIdentifier(owner) + " IN SCHEMA public GRANT SELECT ON TABLES TO " + role,
+		} {
+			if _, err := db.ExecContext(ctx, statement); err != nil {
+				return fmt.Errorf("cannot grant read access to database %s to %s: %w", admin.database, reader, err)
+			}
+		}
+	}
+	return nil
+}
+
+func createExtensions(ctx context.Context, admin dbConnection, extensions []string, logger logr.Logger) error {
+	db, err := openDb(ctx, admin)
+	if err != nil {
+		return fmt.Errorf("cannot connect to database %s as %s: %w", admin.database, admin.user, err)
+	}
+	defer db.Close()
+	for _, extension := range extensions {
+		if found, err := exists(ctx, db, "SELECT 1 FROM pg_extension WHERE extname = $1", extension); err != nil {
+			return err
+		} else if found {
+			continue
+		}
+		logger.Info("Creating extension " + extension + " in database " + admin.database)
+		if _, err := db.ExecContext(ctx, "CREATE EXTENSION IF NOT EXISTS "+pq.QuoteIdentifier(extension)); err != nil {
+			return fmt.Errorf("cannot create extension %s in database %s: %w", extension, admin.database, err)
+		}
+	}
+	return nil
+}
+
+// verifyDatabase connects as the given user and reports what prevents Horreum or Keycloak from using the database.
+func verifyDatabase(ctx context.Context, conn dbConnection, extensions []string) []string {
+	db, err := openDb(ctx, conn)
+	if err != nil {
+		var pqErr *pq.Error
+		if stdErrors.As(err, &pqErr) {
+			switch pqErr.Code {
+			case "28P01":
+				// The server does not disclose whether the role exists
+				return []string{"password authentication failed for role " + conn.user + " on " + conn.host + " (the role may not exist)"}
+			case "28000":
+				return []string{"role " + conn.user + " does not exist or is not allowed to log in to " + conn.database + " on " + conn.host}
+			case "3D000":
+				return []string{"database " + conn.database + " does not exist on " + conn.host}
+			case "42501":
+				return []string{"role " + conn.user + " does not have permission to connect to " + conn.database + " on " + conn.host}
+			}
+		}
+		return []string{fmt.Sprintf("cannot connect to %s on %s as %s: %v", conn.database, conn.host, conn.user, err)}
+	}
+	defer db.Close()
+	problems := []string{}
+	for _, extension := range extensions {
+		if found, err := exists(ctx, db, "SELECT 1 FROM pg_extension WHERE extname = $1", extension); err != nil {
+			problems = append(problems, "cannot check extension "+extension+" in "+conn.database+": "+err.Error())
+		} else if !found {
+			problems = append(problems, "extension "+extension+" is not installed in database "+conn.database+" on "+conn.host)
+		}
+	}
+	return problems
+}
+
+func readSecret(r *HorreumReconciler, namespace string, name string) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, secret); err != nil {
+		return nil, fmt.Errorf("cannot read secret %s: %w", name, err)
+	}
+	return secret, nil
+}
+
+func readServiceCa(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) (string, error) {
+	cm := &corev1.ConfigMap{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: serviceCaConfigMapName(cr), Namespace: cr.Namespace}, cm); err != nil {
+		return "", fmt.Errorf("cannot read service CA: %w", err)
+	}
+	// OpenShift injects the bundle into data, the operator's own CA is stored as binary data
+	if ca, ok := cm.Data["service-ca.crt"]; ok && ca != "" {
+		return ca, nil
+	} else if ca, ok := cm.BinaryData["service-ca.crt"]; ok && len(ca) > 0 {
+		return string(ca), nil
+	}
+	return "", stdErrors.New("service CA bundle was not injected yet")
+}
+
+// postgresAdminConnection prepares superuser connection to a database server deployed by this operator
+func postgresAdminConnection(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, db postgresInstance) (dbConnection, dbProvisioning, error) {
+	adminSecret, err := readSecret(r, cr.Namespace, db.adminSecret)
+	if err != nil {
+		return dbConnection{}, dbProvisioning{}, err
+	}
+	caCert, err := readServiceCa(r, cr)
+	if err != nil {
+		return dbConnection{}, dbProvisioning{}, err
+	}
+	adminUser := string(adminSecret.Data[corev1.BasicAuthUsernameKey])
+	admin := dbConnection{
+		host:     db.host(cr),
+		port:     5432,
+		database: "postgres",
+		user:     adminUser,
+		password: string(adminSecret.Data[corev1.BasicAuthPasswordKey]),
+		sslMode:  "verify-full",
+		caCert:   caCert,
+	}
+	p := dbProvisioning{}
+	if !isDockerDbImage(postgresImage(db.spec, r.Platform)) {
+		// In the Red Hat image the database owner is not a superuser; the superuser is 'postgres'
+		admin.user = "postgres"
+		p.demote = append(p.demote, adminUser)
+	}
+	return admin, p, nil
+}
+
+// managedDbProvisioning prepares connection and provisioning plan for the database deployed by this operator
+func managedDbProvisioning(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) (dbConnection, dbProvisioning, error) {
+	admin, p, err := postgresAdminConnection(r, cr, horreumPostgres(cr))
+	if err != nil {
+		return dbConnection{}, dbProvisioning{}, err
+	}
+	if cr.Spec.Database.Host == "" {
+		adminSecret, err := readSecret(r, cr.Namespace, dbAdminSecret(cr))
+		if err != nil {
+			return dbConnection{}, dbProvisioning{}, err
+		}
+		appSecret, err := readSecret(r, cr.Namespace, appUserSecret(cr))
+		if err != nil {
+			return dbConnection{}, dbProvisioning{}, err
+		}
+		appUser := string(appSecret.Data[corev1.BasicAuthUsernameKey])
+		p.roles = append(p.roles, dbRole{name: appUser, password: string(appSecret.Data[corev1.BasicAuthPasswordKey])})
+		database := dbDatabase{
+			name:       withDefault(cr.Spec.Database.Name, "horreum"),
+			owner:      string(adminSecret.Data[corev1.BasicAuthUsernameKey]),
+			extensions: []string{"pgcrypto"},
+			users:      []string{appUser},
+		}
+		if hasReadReplicas(cr) {
+			readOnly, _, err := secretRole(r, cr, dbReadOnlySecret(cr))
+			if err != nil {
+				return dbConnection{}, dbProvisioning{}, err
+			}
+			readOnly.readOnly = true
+			replication, _, err := secretRole(r, cr, dbReplicationSecret(cr))
+			if err != nil {
+				return dbConnection{}, dbProvisioning{}, err
+			}
+			replication.replication = true
+			p.roles = append(p.roles, readOnly, replication)
+			database.users = append(database.users, readOnly.name)
+			database.readers = append(database.readers, readOnly.name)
+		}
+		p.databases = append(p.databases, database)
+	}
+	if cr.Spec.Keycloak.Database.Host == "" && cr.Spec.Keycloak.External.PublicUri == "" &&
+		keycloakDatabaseMode(cr) == hyperfoilv1alpha1.KeycloakDatabaseShared {
+		if err := addKeycloakDatabase(r, cr, &p); err != nil {
+			return dbConnection{}, dbProvisioning{}, err
+		}
+	}
+	return admin, p, nil
+}
+
+// keycloakDbProvisioning prepares connection and provisioning plan for the PostgreSQL dedicated to Keycloak
+func keycloakDbProvisioning(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) (dbConnection, dbProvisioning, error) {
+	admin, p, err := postgresAdminConnection(r, cr, keycloakPostgres(cr))
+	if err != nil {
+		return dbConnection{}, dbProvisioning{}, err
+	}
+	if err := addKeycloakDatabase(r, cr, &p); err != nil {
+		return dbConnection{}, dbProvisioning{}, err
+	}
+	return admin, p, nil
+}
+
+func addKeycloakDatabase(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, p *dbProvisioning) error {
+	keycloakSecret, err := readSecret(r, cr.Namespace, keycloakDbSecret(cr))
+	if err != nil {
+		return err
+	}
+	keycloakUser := string(keycloakSecret.Data[corev1.BasicAuthUsernameKey])
+	p.roles = append(p.roles, dbRole{name: keycloakUser, password: string(keycloakSecret.Data[corev1.BasicAuthPasswordKey])})
+	p.databases = append(p.databases, dbDatabase{
+		name:  withDefault(cr.Spec.Keycloak.Database.Name, "keycloak"),
+		owner: keycloakUser,
+	})
+	return nil
+}
+
+func provisionManagedDatabase(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) error {
+	admin, p, err := managedDbProvisioning(r, cr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Minute)
+	defer cancel()
+	return provisionDatabases(ctx, admin, p, logger)
+}
+
+func provisionKeycloakDatabase(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) error {
+	admin, p, err := keycloakDbProvisioning(r, cr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Minute)
+	defer cancel()
+	return provisionDatabases(ctx, admin, p, logger)
+}
+
+// externalDb is a database on a server not managed by this operator
+type externalDb struct {
+	spec     *hyperfoilv1alpha1.DatabaseSpec
+	database dbDatabase
+	role     dbRole
+}
+
+func dbConnectionFor(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, db *hyperfoilv1alpha1.DatabaseSpec, database string) (dbConnection, error) {
+	conn := dbConnection{
+		host:     withDefault(db.Host, dbDefaultHost(cr)),
+		port:     db.Port,
+		database: database,
+		sslMode:  dbSSLMode(db),
+	}
+	if conn.port == 0 {
+		conn.port = 5432
+	}
+	if db.CASecret != "" {
+		caSecret, err := readSecret(r, cr.Namespace, db.CASecret)
+		if err != nil {
+			return conn, err
+		}
+		conn.caCert = string(caSecret.Data["ca.crt"])
+	} else if dbSSLRootCert(db) == serviceCaPath {
+		ca, err := readServiceCa(r, cr)
+		if err != nil {
+			return conn, err
+		}
+		conn.caCert = ca
+	}
+	return conn, nil
+}
+
+func secretRole(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, name string) (dbRole, *corev1.Secret, error) {
+	secret, err := readSecret(r, cr.Namespace, name)
+	if err != nil {
+		return dbRole{}, nil, err
+	}
+	return dbRole{
+		name:     string(secret.Data[corev1.BasicAuthUsernameKey]),
+		password: string(secret.Data[corev1.BasicAuthPasswordKey]),
+	}, secret, nil
+}
+
+// provisionExternalDatabase creates missing roles, databases and extensions on external servers when
+// the user provided admin credentials; otherwise it only reports what is missing.
+func provisionExternalDatabase(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) ([]string, error) {
+	admin, adminSecret, err := secretRole(r, cr, dbAdminSecret(cr))
+	if err != nil {
+		return nil, err
+	}
+	app, _, err := secretRole(r, cr, appUserSecret(cr))
+	if err != nil {
+		return nil, err
+	}
+	dbs := []externalDb{
+		{
+			spec: &cr.Spec.Database,
+			database: dbDatabase{
+				name:       withDefault(cr.Spec.Database.Name, "horreum"),
+				owner:      admin.name,
+				extensions: []string{"pgcrypto"},
+				users:      []string{app.name},
+			},
+			role: app,
+		},
+	}
+	if cr.Spec.Keycloak.External.PublicUri == "" && keycloakDatabaseMode(cr) == hyperfoilv1alpha1.KeycloakDatabaseShared {
+		keycloak, _, err := secretRole(r, cr, keycloakDbSecret(cr))
+		if err != nil {
+			return nil, err
+		}
+		dbs = append(dbs, externalDb{
+			spec: &cr.Spec.Keycloak.Database,
+			database: dbDatabase{
+				name:  withDefault(cr.Spec.Keycloak.Database.Name, "keycloak"),
+				owner: keycloak.name,
+			},
+			role: keycloak,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Minute)
+	defer cancel()
+	// Secret generated by the operator cannot hold credentials to an external server; only the roles
+	// the operator would provision are checked as the generated admin role cannot exist there.
+	if metav1.IsControlledBy(adminSecret, cr) {
+		problems := []string{}
+		for _, db := range dbs {
+			conn, err := dbConnectionFor(r, cr, db.spec, db.database.name)
+			if err != nil {
+				return nil, err
+			}
+			conn.user = db.role.name
+			conn.password = db.role.password
+			problems = append(problems, verifyDatabase(ctx, conn, db.database.extensions)...)
+		}
+		if len(problems) > 0 {
+			problems = append(problems, "set spec.postgres.adminSecret to let the operator create missing objects")
+		}
+		return problems, nil
+	}
+
+	servers := map[string]*dbProvisioning{}
+	connections := map[string]dbConnection{}
+	order := []string{}
+	for _, db := range dbs {
+		conn, err := dbConnectionFor(r, cr, db.spec, "postgres")
+		if err != nil {
+			return nil, err
+		}
+		conn.user = admin.name
+		conn.password = admin.password
+		key := fmt.Sprintf("%s:%d", conn.host, conn.port)
+		p, ok := servers[key]
+		if !ok {
+			p = &dbProvisioning{}
+			servers[key] = p
+			connections[key] = conn
+			order = append(order, key)
+		}
+		p.roles = append(p.roles, db.role)
+		p.databases = append(p.databases, db.database)
+	}
+	for _, key := range order {
+		if err := provisionDatabases(ctx, connections[key], *servers[key], logger); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,239 @@
+package horreum
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	"github.com/lib/pq"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// Run against a local server, e.g.:
+//
+//	docker run --rm -d -p 5432:5432 -e POSTGRES_PASSWORD=secret postgres:14
+//	HORREUM_TEST_POSTGRES_HOST=localhost HORREUM_TEST_POSTGRES_PASSWORD=secret go test ./controllers -run Provision
+func testAdminConnection(t *testing.T) dbConnection {
+	host := os.Getenv("HORREUM_TEST_POSTGRES_HOST")
+	if host == "" {
+		t.Skip("HORREUM_TEST_POSTGRES_HOST is not set")
+	}
+	port := int64(5432)
+	if value := os.Getenv("HORREUM_TEST_POSTGRES_PORT"); value != "" {
+		var err error
+		if port, err = strconv.ParseInt(value, 10, 32); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dbConnection{
+		host:     host,
+		port:     int32(port),
+		database: "postgres",
+		user:     withDefault(os.Getenv("HORREUM_TEST_POSTGRES_USER"), "postgres"),
+		password: os.Getenv("HORREUM_TEST_POSTGRES_PASSWORD"),
+		sslMode:  os.Getenv("HORREUM_TEST_POSTGRES_SSLMODE"),
+	}
+}
+
+func TestProvisionDatabases(t *testing.T) {
+	admin := testAdminConnection(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	app := dbRole{name: "app_" + suffix, password: "app'pass\\word"}
+	keycloak := dbRole{name: "keycloak_" + suffix, password: "keycloak pass"}
+	replication := dbRole{name: "replication_" + suffix, password: "replication", replication: true}
+	p := dbProvisioning{
+		roles: []dbRole{app, keycloak, replication},
+		databases: []dbDatabase{
+			{name: "horreum_" + suffix, owner: admin.user, extensions: []string{"pgcrypto"}, users: []string{app.name}},
+			{name: "keycloak_" + suffix, owner: keycloak.name},
+		},
+	}
+	defer func() {
+		db, err := openDb(context.Background(), admin)
+		if err != nil {
+			t.Log(err)
+			return
+		}
+		defer db.Close()
+		for _, database := range p.databases {
+			_, _ = db.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(database.name))
+		}
+		for _, role := range p.roles {
+			_, _ = db.Exec("DROP ROLE IF EXISTS " + pq.QuoteIdentifier(role.name))
+		}
+	}()
+
+	verify := func() []string {
+		problems := []string{}
+		for _, check := range []struct {
+			role     dbRole
+			database dbDatabase
+		}{{app, p.databases[0]}, {keycloak, p.databases[1]}} {
+			conn := admin.withDatabase(check.database.name)
+			conn.user = check.role.name
+			conn.password = check.role.password
+			problems = append(problems, verifyDatabase(ctx, conn, check.database.extensions)...)
+		}
+		return problems
+	}
+
+	problems := verify()
+	if len(problems) != 2 {
+		t.Fatalf("expected missing roles to be reported, got %v", problems)
+	}
+	for _, problem := range problems {
+		if !strings.Contains(problem, "does not exist") && !strings.Contains(problem, "password authentication failed") {
+			t.Errorf("unexpected problem: %s", problem)
+		}
+	}
+
+	// Second invocation must not fail on existing objects
+	for i := 0; i < 2; i++ {
+		if err := provisionDatabases(ctx, admin, p, logr.Discard()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if problems := verify(); len(problems) != 0 {
+		t.Fatalf("unexpected problems after provisioning: %v", problems)
+	}
+	db, err := openDb(ctx, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if found, err := exists(ctx, db, "SELECT 1 FROM pg_roles WHERE rolname = $1 AND rolreplication AND NOT rolsuper", replication.name); err != nil || !found {
+		t.Errorf("replication role must not be a superuser: %v, %v", found, err)
+	}
+
+	wrong := admin.withDatabase(p.databases[0].name)
+	wrong.user = app.name
+	wrong.password = "wrong"
+	if problems := verifyDatabase(ctx, wrong, nil); len(problems) != 1 || !strings.Contains(problems[0], "password authentication failed") {
+		t.Errorf("expected authentication failure, got %v", problems)
+	}
+}
+
+// externalDbReconciler holds a Horreum using an external server with credentials generated by the operator
+func externalDbReconciler(t *testing.T, conn dbConnection, app dbRole, keycloak dbRole, suffix string) (*HorreumReconciler, *hyperfoilv1alpha1.Horreum) {
+	disabled := false
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test", UID: "1234"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			Postgres: hyperfoilv1alpha1.PostgresSpec{Enabled: &disabled},
+			Database: hyperfoilv1alpha1.DatabaseSpec{
+				Host: conn.host, Port: conn.port, Name: "horreum_" + suffix, SSLMode: conn.sslMode,
+			},
+			Keycloak: hyperfoilv1alpha1.KeycloakSpec{
+				Database: hyperfoilv1alpha1.DatabaseSpec{
+					Host: conn.host, Port: conn.port, Name: "keycloak_" + suffix, SSLMode: conn.sslMode,
+				},
+			},
+		},
+	}
+	r := fakeReconciler(t, cr)
+	secrets := map[string]dbRole{
+		// Role that does not exist on the server
+		dbAdminSecret(cr):    {name: "admin_" + suffix, password: "generated"},
+		appUserSecret(cr):    app,
+		keycloakDbSecret(cr): keycloak,
+	}
+	for name, role := range secrets {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: cr.Namespace},
+			Data: map[string][]byte{
+				corev1.BasicAuthUsernameKey: []byte(role.name),
+				corev1.BasicAuthPasswordKey: []byte(role.password),
+			},
+		}
+		if err := controllerutil.SetControllerReference(cr, secret, r.Scheme); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Create(context.TODO(), secret); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r, cr
+}
+
+func TestVerifyExternalDatabaseProblems(t *testing.T) {
+	// Port where nothing listens
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	conn := dbConnection{host: "127.0.0.1", port: int32(port), sslMode: "disable"}
+	r, cr := externalDbReconciler(t, conn, dbRole{name: "app", password: "secret"}, dbRole{name: "keycloak", password: "secret"}, "test")
+	problems, err := provisionExternalDatabase(r, cr, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 3 || !strings.Contains(problems[0], " as app") || !strings.Contains(problems[1], " as keycloak") ||
+		!strings.Contains(problems[2], "spec.postgres.adminSecret") {
+		t.Errorf("unexpected problems %v", problems)
+	}
+	for _, problem := range problems {
+		if strings.Contains(problem, "admin_test") {
+			t.Errorf("generated admin role must not be verified: %s", problem)
+		}
+	}
+}
+
+func TestVerifyExternalDatabase(t *testing.T) {
+	admin := testAdminConnection(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	app := dbRole{name: "app_" + suffix, password: "app password"}
+	keycloak := dbRole{name: "keycloak_" + suffix, password: "keycloak password"}
+	r, cr := externalDbReconciler(t, admin, app, keycloak, suffix)
+	p := dbProvisioning{
+		roles: []dbRole{app, keycloak},
+		databases: []dbDatabase{
+			{name: cr.Spec.Database.Name, owner: admin.user, extensions: []string{"pgcrypto"}, users: []string{app.name}},
+			{name: cr.Spec.Keycloak.Database.Name, owner: keycloak.name},
+		},
+	}
+	defer func() {
+		db, err := openDb(context.Background(), admin)
+		if err != nil {
+			t.Log(err)
+			return
+		}
+		defer db.Close()
+		for _, database := range p.databases {
+			_, _ = db.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(database.name))
+		}
+		for _, role := range p.roles {
+			_, _ = db.Exec("DROP ROLE IF EXISTS " + pq.QuoteIdentifier(role.name))
+		}
+	}()
+
+	if problems, err := provisionExternalDatabase(r, cr, logr.Discard()); err != nil {
+		t.Fatal(err)
+	} else if len(problems) != 3 {
+		t.Fatalf("expected missing roles to be reported, got %v", problems)
+	}
+	// The administrator creates the roles and databases from the generated secrets
+	if err := provisionDatabases(ctx, admin, p, logr.Discard()); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := provisionExternalDatabase(r, cr, logr.Discard()); err != nil || len(problems) != 0 {
+		t.Fatalf("unexpected problems after provisioning: %v, %v", problems, err)
+	}
+}
@@ -0,0 +1,122 @@
+package horreum
+
+import (
+	"errors"
+	"fmt"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Render returns the resources the operator would create for the Horreum resource, without contacting
+// the cluster. Secrets with credentials and certificates are not included as these are generated.
+// When keycloakPublicUrl or appPublicUrl is empty it is derived from the spec or status; tlsSecrets
+// hold certificates for routes, indexed by name.
+func Render(cr *hyperfoilv1alpha1.Horreum, p Platform, keycloakPublicUrl string, appPublicUrl string,
+	tlsSecrets map[string]*corev1.Secret) ([]client.Object, error) {
+	objects := []client.Object{}
+	if p.RoutesAvailable {
+		objects = append(objects, serviceCaConfigMap(cr))
+	}
+
+	useCSI := false
+	for _, c := range credentialSecrets(cr) {
+		switch c.spec.Source {
+		case hyperfoilv1alpha1.CredentialSourceExternalSecret:
+			es, err := externalSecret(cr, c)
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, es)
+		case hyperfoilv1alpha1.CredentialSourceCSI:
+			if c.spec.CSI == nil {
+				return nil, fmt.Errorf("spec.credentials.%s.csi must be set for source csi", c.credential)
+			}
+			useCSI = true
+		}
+	}
+	if useCSI {
+		objects = append(objects, secretsSyncPod(cr, p))
+	}
+	policies, _, err := networkPolicies(cr, p)
+	if err != nil {
+		return nil, err
+	}
+	for _, policy := range policies {
+		objects = append(objects, policy)
+	}
+
+	dbs := []postgresInstance{}
+	if cr.Spec.Postgres.Enabled == nil || *cr.Spec.Postgres.Enabled {
+		dbs = append(dbs, horreumPostgres(cr))
+	}
+	if isKeycloakDbDeployed(cr) {
+		dbs = append(dbs, keycloakPostgres(cr))
+	}
+	for _, db := range dbs {
+		if usesWalG(db.spec) && walGImage(p) == "" {
+			return nil, errors.New("backup or restore of PostgreSQL requires the WAL-G image")
+		}
+		objects = append(objects, postgresConfigMap(cr, db, p), postgresPod(cr, db, p), postgresService(cr, db))
+		if isBackupEnabled(db.spec) {
+			objects = append(objects, postgresBackupCronJob(cr, db, p))
+		}
+	}
+	if hasReadReplicas(cr) {
+		objects = append(objects, dbReplicaDeployment(cr, p), dbReadOnlyServiceObject(cr))
+	}
+
+	if cr.Spec.PgBouncer.Enabled {
+		// The configuration is kept in a secret together with the passwords
+		objects = append(objects, pgBouncerDeployment(cr, p, configHash(pgBouncerIni(cr))), pgBouncerService(cr))
+	}
+
+	if cr.Spec.Keycloak.External.PublicUri == "" {
+		objects = append(objects, keycloakService(cr, p))
+		if exposedByRoute(p, cr.Spec.Keycloak.ServiceType) {
+			keycloakRoute, err := keycloakRoute(cr, p, tlsSecrets[cr.Spec.Keycloak.Route.TLS])
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, keycloakRoute)
+		}
+	}
+	keycloakPublicUrl = withDefault(keycloakPublicUrl, withDefault(cr.Spec.Keycloak.External.PublicUri,
+		withDefault(routeHostUrl(cr.Spec.Keycloak.Route), cr.Status.KeycloakUrl)))
+	if keycloakPublicUrl == "" {
+		return nil, errors.New("cannot determine Keycloak public URL; set spec.keycloak.route.host or provide the URL, e.g. with --keycloak-url")
+	}
+	if cr.Spec.Keycloak.External.PublicUri == "" {
+		objects = append(objects, keycloakDiscoveryService(cr), keycloakDeployment(cr, p, keycloakPublicUrl))
+		if keycloakReplicas(cr) > 1 {
+			objects = append(objects, keycloakPodDisruptionBudget(cr))
+		}
+	}
+
+	objects = append(objects, appService(cr, p))
+	if exposedByRoute(p, cr.Spec.ServiceType) {
+		appRoute, err := appRoute(cr, p, tlsSecrets[cr.Spec.Route.TLS])
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, appRoute)
+	}
+	appPublicUrl = withDefault(appPublicUrl, withDefault(routeHostUrl(cr.Spec.Route), cr.Status.PublicUrl))
+	if appPublicUrl == "" {
+		return nil, errors.New("cannot determine Horreum public URL; set spec.route.host or provide the URL, e.g. with --app-url")
+	}
+	objects = append(objects, appPod(cr, p, keycloakPublicUrl, appPublicUrl), uploadConfig(cr))
+	return objects, nil
+}
+
+func exposedByRoute(p Platform, svcType corev1.ServiceType) bool {
+	return p.RoutesAvailable && !isNodePort(p, svcType) && serviceType(svcType, p) != corev1.ServiceTypeLoadBalancer
+}
+
+func routeHostUrl(route hyperfoilv1alpha1.RouteSpec) string {
+	if route.Host == "" {
+		return ""
+	}
+	return ifThenElse(route.Type == "http", "http://", "https://") + route.Host
+}
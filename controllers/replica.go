@@ -0,0 +1,401 @@
+package horreum
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// replicationHbaScript lets the replicas stream WAL from the primary, authenticating as the replication role
+const replicationHbaScript = `
+	if [ -f "$PGDATA/pg_hba.conf" ] && ! grep -q "^host replication all all" "$PGDATA/pg_hba.conf"; then
+		echo "host replication all all md5" >> "$PGDATA/pg_hba.conf"
+	fi
+`
+
+var replicaLagBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "horreum_postgres_replica_lag_bytes",
+	Help: "Amount of WAL generated by the primary and not replayed by the read replica yet",
+}, []string{"namespace", "horreum", "replica"})
+
+// Replicas of each instance that have the lag metric set, to remove it when they go away
+var (
+	laggingReplicasLock sync.Mutex
+	laggingReplicas     = map[types.NamespacedName][]string{}
+)
+
+// Lag of the replicas is sampled periodically, not only when something in the instance changes
+const replicaLagInterval = 30 * time.Second
+
+func init() {
+	metrics.Registry.MustRegister(replicaLagBytes)
+}
+
+// setReplicaLag replaces lag metrics of the instance; replicas missing in the status are removed
+func setReplicaLag(instance types.NamespacedName, replicas []hyperfoilv1alpha1.PostgresReplicaStatus) {
+	laggingReplicasLock.Lock()
+	defer laggingReplicasLock.Unlock()
+	for _, name := range laggingReplicas[instance] {
+		replicaLagBytes.DeleteLabelValues(instance.Namespace, instance.Name, name)
+	}
+	names := []string{}
+	for _, replica := range replicas {
+		if replica.State != "" {
+			replicaLagBytes.WithLabelValues(instance.Namespace, instance.Name, replica.Name).Set(float64(replica.LagBytes))
+			names = append(names, replica.Name)
+		}
+	}
+	if len(names) > 0 {
+		laggingReplicas[instance] = names
+	} else {
+		delete(laggingReplicas, instance)
+	}
+}
+
+func dbReplicaName(cr *hyperfoilv1alpha1.Horreum) string {
+	return cr.Name + "-db-replica"
+}
+
+// dbReadOnlyService load-balances connections over the replicas
+func dbReadOnlyService(cr *hyperfoilv1alpha1.Horreum) string {
+	return cr.Name + "-db-ro"
+}
+
+func dbReadOnlyCertsSecret(cr *hyperfoilv1alpha1.Horreum) string {
+	return cr.Name + "-db-ro-certs"
+}
+
+func dbReplicaLabels(cr *hyperfoilv1alpha1.Horreum) map[string]string {
+	return map[string]string{
+		"app":     cr.Name,
+		"service": "db-replica",
+	}
+}
+
+// dbReplicaDeployment runs hot standby servers on ephemeral storage. Each replica copies the data from the primary
+// when it starts and then follows the primary's WAL stream, so the data is lost only together with the pod.
+func dbReplicaDeployment(cr *hyperfoilv1alpha1.Horreum, p Platform) *appsv1.Deployment {
+	db := horreumPostgres(cr)
+	image := postgresImage(db.spec, p)
+	userId := postgresUserId(db.spec, image)
+	replicas := db.spec.ReadReplicas.Replicas
+	// pg_basebackup stores the connection in primary_conninfo, too
+	env := []corev1.EnvVar{
+		{
+			Name:  "PGHOST",
+			Value: db.host(cr),
+		},
+		{
+			Name:  "PGPORT",
+			Value: "5432",
+		},
+		secretEnv("PGUSER", dbReplicationSecret(cr), corev1.BasicAuthUsernameKey),
+		secretEnv("PGPASSWORD", dbReplicationSecret(cr), corev1.BasicAuthPasswordKey),
+		{
+			Name:  "PGSSLMODE",
+			Value: "verify-full",
+		},
+		{
+			Name:  "PGSSLROOTCERT",
+			Value: serviceCaPath,
+		},
+		{
+			Name: "POD_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+			},
+		},
+	}
+	volumes := []corev1.Volume{
+		{
+			Name: "db-volume",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		},
+		{
+			Name: "postgresql-start",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: db.configMap,
+					},
+				},
+			},
+		},
+		{
+			Name: "certs",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: dbReadOnlyCertsSecret(cr),
+					// PostgreSQL refuses to use private key readable by others
+					DefaultMode: &[]int32{0640}[0],
+				},
+			},
+		},
+		{
+			Name: "service-ca",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: serviceCaConfigMapName(cr),
+					},
+				},
+			},
+		},
+	}
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      "db-volume",
+			MountPath: dbDataPath,
+		},
+		{
+			Name:      "postgresql-start",
+			MountPath: dbConfigPath,
+		},
+		{
+			Name:      "certs",
+			MountPath: dbCertsPath,
+		},
+		{
+			Name:      "service-ca",
+			MountPath: serviceCaPath,
+			SubPath:   "service-ca.crt",
+		},
+	}
+	readOnlyRootFilesystem := isDockerDbImage(image)
+	if readOnlyRootFilesystem {
+		for _, dir := range []struct{ name, path string }{{"run", "/var/run/postgresql"}, {"tmp", "/tmp"}} {
+			volumes = append(volumes, corev1.Volume{
+				Name: dir.name,
+				VolumeSource: corev1.VolumeSource{
+					EmptyDir: &corev1.EmptyDirVolumeSource{},
+				},
+			})
+			volumeMounts = append(volumeMounts, corev1.VolumeMount{
+				Name:      dir.name,
+				MountPath: dir.path,
+			})
+		}
+	}
+	resources := db.spec.ReadReplicas.Resources
+	if len(resources.Limits) == 0 && len(resources.Requests) == 0 {
+		resources = db.spec.Resources
+	}
+	// The copy includes postgresql.conf of the primary; with the Red Hat image it includes configuration
+	// generated outside of the data directory, which the replica does not need. Cluster name identifies
+	// the replica in pg_stat_replication on the primary.
+	command := []string{"bash", "-c", `
+		set -e
+		export PGDATA=` + dbDataPath + `/pgdata
+		if [ ! -f "$PGDATA/PG_VERSION" ]; then
+			rm -rf "$PGDATA"
+			pg_basebackup --pgdata="$PGDATA" --wal-method=stream --write-recovery-conf --checkpoint=fast
+		fi
+		if ! grep -q "` + dbConfigPath + `/horreum.conf" "$PGDATA/postgresql.conf"; then
+			echo "include_if_exists = '` + dbConfigPath + `/horreum.conf'" >> "$PGDATA/postgresql.conf"
+		fi
+		touch /var/lib/pgsql/openshift-custom-postgresql.conf 2> /dev/null || true
+		exec postgres -c cluster_name="$POD_NAME" -c listen_addresses='*' -c hot_standby=on -c hot_standby_feedback=on
+	`}
+
+	podSecurityContext := restrictedPodSecurityContext()
+	podSecurityContext.FSGroup = &[]int64{userId}[0]
+	securityContext := restrictedSecurityContext(readOnlyRootFilesystem)
+	securityContext.RunAsUser = &[]int64{userId}[0]
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dbReplicaName(cr),
+			Namespace: cr.Namespace,
+			Labels:    dbReplicaLabels(cr),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: dbReplicaLabels(cr),
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: dbReplicaLabels(cr),
+					Annotations: map[string]string{
+						configHashAnnotation: configHash(postgresqlConf(db.spec)),
+					},
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets: cr.Spec.ImagePullSecrets,
+					SecurityContext:  podSecurityContext,
+					Containers: []corev1.Container{
+						{
+							Name:            "postgres",
+							Image:           image,
+							ImagePullPolicy: p.PullPolicy,
+							Command:         command,
+							Env:             env,
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "postgres",
+									ContainerPort: 5432,
+								},
+							},
+							ReadinessProbe: &corev1.Probe{
+								ProbeHandler: corev1.ProbeHandler{
+									Exec: &corev1.ExecAction{
+										Command: []string{"pg_isready", "-h", "127.0.0.1", "-p", "5432"},
+									},
+								},
+								PeriodSeconds: 5,
+							},
+							Resources:       resources,
+							SecurityContext: securityContext,
+							VolumeMounts:    volumeMounts,
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+}
+
+func dbReadOnlyServiceObject(cr *hyperfoilv1alpha1.Horreum) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dbReadOnlyService(cr),
+			Namespace: cr.Namespace,
+			Annotations: map[string]string{
+				"service.beta.openshift.io/serving-cert-secret-name": dbReadOnlyCertsSecret(cr),
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeClusterIP,
+			Ports: []corev1.ServicePort{
+				{
+					Name: "postgres",
+					Port: int32(5432),
+					TargetPort: intstr.IntOrString{
+						IntVal: 5432,
+					},
+				},
+			},
+			Selector: dbReplicaLabels(cr),
+		},
+	}
+}
+
+// ensureDbReplicas deploys read replicas when requested, or deletes them
+func ensureDbReplicas(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) error {
+	deployment := dbReplicaDeployment(cr, r.Platform)
+	service := dbReadOnlyServiceObject(cr)
+	if !hasReadReplicas(cr) {
+		if err := ensureDeleted(r, cr, deployment, &appsv1.Deployment{}); err != nil {
+			return err
+		}
+		return ensureDeleted(r, cr, service, &corev1.Service{})
+	}
+	if err := ensureDeployment(r, cr, logger, deployment); err != nil {
+		return err
+	}
+	return ensureSame(r, cr, logger, service, &corev1.Service{}, compareService, nocheck)
+}
+
+type replicationState struct {
+	state     string
+	lagBytes  int64
+	replayLag sql.NullFloat64
+}
+
+// readReplicationState queries the primary for the state of the connected standby servers, keyed by cluster name
+func readReplicationState(ctx context.Context, admin dbConnection) (map[string]replicationState, error) {
+	db, err := openDb(ctx, admin)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s:%d as %s: %w", admin.host, admin.port, admin.user, err)
+	}
+	defer db.Close()
+	rows, err := db.QueryContext(ctx, "SELECT application_name, state, "+
+		"COALESCE(pg_wal_lsn_diff(pg_current_wal_lsn(), replay_lsn), 0)::bigint, "+
+		"EXTRACT(EPOCH FROM replay_lag)::float8 FROM pg_stat_replication")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read replication state: %w", err)
+	}
+	defer rows.Close()
+	states := map[string]replicationState{}
+	for rows.Next() {
+		var name string
+		var state replicationState
+		if err := rows.Scan(&name, &state.state, &state.lagBytes, &state.replayLag); err != nil {
+			return nil, fmt.Errorf("cannot read replication state: %w", err)
+		}
+		states[name] = state
+	}
+	return states, rows.Err()
+}
+
+// replicaStatus matches the replica pods with the replication state reported by the primary
+func replicaStatus(pods []corev1.Pod, states map[string]replicationState) []hyperfoilv1alpha1.PostgresReplicaStatus {
+	statuses := []hyperfoilv1alpha1.PostgresReplicaStatus{}
+	for _, pod := range pods {
+		status := hyperfoilv1alpha1.PostgresReplicaStatus{Name: pod.Name}
+		if state, ok := states[pod.Name]; ok {
+			status.State = state.state
+			status.LagBytes = state.lagBytes
+			if state.replayLag.Valid {
+				status.ReplayLag = &metav1.Duration{Duration: time.Duration(state.replayLag.Float64 * float64(time.Second))}
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// updateReplicaStatus reports replication lag in the status and as a metric. Failures are only logged,
+// the replicas do not affect the rest of the instance; the metric is removed rather than left stale.
+func updateReplicaStatus(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) {
+	instance := types.NamespacedName{Name: cr.Name, Namespace: cr.Namespace}
+	var current []hyperfoilv1alpha1.PostgresReplicaStatus
+	if hasReadReplicas(cr) {
+		pods := &corev1.PodList{}
+		if err := r.List(context.TODO(), pods, client.InNamespace(cr.Namespace), client.MatchingLabels(dbReplicaLabels(cr))); err != nil {
+			logger.Error(err, "Cannot list read replicas")
+			setReplicaLag(instance, nil)
+			return
+		}
+		admin, _, err := postgresAdminConnection(r, cr, horreumPostgres(cr))
+		if err != nil {
+			logger.Error(err, "Cannot read replication state")
+			setReplicaLag(instance, nil)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+		defer cancel()
+		states, err := readReplicationState(ctx, admin)
+		if err != nil {
+			logger.Error(err, "Cannot read replication state")
+			setReplicaLag(instance, nil)
+			return
+		}
+		current = replicaStatus(pods.Items, states)
+	}
+	setReplicaLag(instance, current)
+	if cr.Status.Postgres == nil {
+		if len(current) == 0 {
+			return
+		}
+		cr.Status.Postgres = &hyperfoilv1alpha1.PostgresStatus{}
+	}
+	cr.Status.Postgres.ReadReplicas = current
+}
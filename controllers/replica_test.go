@@ -0,0 +1,126 @@
+package horreum
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestDbReplicas(t *testing.T) {
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			Postgres: hyperfoilv1alpha1.PostgresSpec{
+				Image: "docker.io/library/postgres:16.2",
+				Resources: corev1.ResourceRequirements{
+					Limits: corev1.ResourceList{corev1.ResourceMemory: apiresource.MustParse("1Gi")},
+				},
+			},
+		},
+	}
+	plain := postgresPod(cr, horreumPostgres(cr), Platform{})
+	if strings.Contains(plain.Spec.Containers[0].Command[2], "replication_hba.sh") {
+		t.Error("replication must not be configured without replicas")
+	}
+
+	cr.Spec.Postgres.ReadReplicas.Replicas = 2
+	db := horreumPostgres(cr)
+	if cm := postgresConfigMap(cr, db, Platform{}); cm.Data["replication_hba.sh"] == "" {
+		t.Error("replication entry in pg_hba.conf is missing")
+	}
+	pod := postgresPod(cr, db, Platform{})
+	if !strings.Contains(pod.Spec.Containers[0].Command[2], "source "+dbConfigPath+"/replication_hba.sh\n") {
+		t.Error("existing databases must get the replication entry on start")
+	}
+	if pod.Annotations[configHashAnnotation] == plain.Annotations[configHashAnnotation] {
+		t.Error("primary must restart to accept replication connections")
+	}
+
+	deployment := dbReplicaDeployment(cr, Platform{})
+	if *deployment.Spec.Replicas != 2 {
+		t.Errorf("unexpected replicas %d", *deployment.Spec.Replicas)
+	}
+	container := deployment.Spec.Template.Spec.Containers[0]
+	if envValue(container.Env, "PGHOST") != "horreum-db.test.svc" {
+		t.Errorf("unexpected host %s", envValue(container.Env, "PGHOST"))
+	}
+	if container.Resources.Limits.Memory().String() != "1Gi" {
+		t.Error("replicas must default to resources of the primary")
+	}
+	if np := dbNetworkPolicy(cr, Platform{}); !strings.Contains(np.Spec.Ingress[0].From[0].PodSelector.String(), "db-replica") {
+		t.Error("replicas must be allowed to connect to the primary")
+	}
+	secrets := credentialSecrets(cr)
+	if secrets[len(secrets)-3].name != "horreum-db-readonly" || secrets[len(secrets)-2].name != "horreum-db-replication" {
+		t.Errorf("read-only or replication secret is missing: %v", secrets)
+	}
+	for _, e := range container.Env {
+		if e.ValueFrom != nil && e.ValueFrom.SecretKeyRef != nil && e.ValueFrom.SecretKeyRef.Name != "horreum-db-replication" {
+			t.Errorf("replicas must connect only with the replication role: %s from %s", e.Name, e.ValueFrom.SecretKeyRef.Name)
+		}
+	}
+	if e := container.Env[2]; e.Name != "PGUSER" || e.ValueFrom.SecretKeyRef.Name != "horreum-db-replication" {
+		t.Errorf("unexpected user %v", e)
+	}
+
+	status := replicaStatus([]corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "horreum-db-replica-b"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "horreum-db-replica-a"}},
+	}, map[string]replicationState{
+		"horreum-db-replica-a": {state: "streaming", lagBytes: 1024, replayLag: sql.NullFloat64{Float64: 0.5, Valid: true}},
+		"pg_basebackup":        {state: "backup"},
+	})
+	if len(status) != 2 || status[0].Name != "horreum-db-replica-a" || status[0].LagBytes != 1024 ||
+		status[0].ReplayLag.Duration != 500*time.Millisecond {
+		t.Errorf("unexpected status %v", status)
+	}
+	if status[1].State != "" || status[1].ReplayLag != nil {
+		t.Errorf("replica that is not connected must have no state: %v", status[1])
+	}
+}
+
+func TestReplicaLagMetric(t *testing.T) {
+	other := types.NamespacedName{Name: "other", Namespace: "test"}
+	setReplicaLag(other, []hyperfoilv1alpha1.PostgresReplicaStatus{{Name: "other-db-replica-a", State: "streaming", LagBytes: 10}})
+	defer setReplicaLag(other, nil)
+
+	cr := &hyperfoilv1alpha1.Horreum{ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test"}}
+	instance := types.NamespacedName{Name: cr.Name, Namespace: cr.Namespace}
+	setReplicaLag(instance, []hyperfoilv1alpha1.PostgresReplicaStatus{
+		{Name: "horreum-db-replica-a", State: "streaming", LagBytes: 1024},
+		{Name: "horreum-db-replica-b"},
+	})
+	if count := testutil.CollectAndCount(replicaLagBytes); count != 2 {
+		t.Fatalf("replica without state must not be reported, got %d series", count)
+	}
+
+	// Replicas scaled to zero
+	r := fakeReconciler(t, cr)
+	updateReplicaStatus(r, cr, r.Log)
+	if count := testutil.CollectAndCount(replicaLagBytes); count != 1 {
+		t.Errorf("lag of removed replicas must be deleted, got %d series", count)
+	}
+
+	// Horreum deleted
+	setReplicaLag(instance, []hyperfoilv1alpha1.PostgresReplicaStatus{{Name: "horreum-db-replica-a", State: "streaming"}})
+	r = fakeReconciler(t)
+	if result, err := r.Reconcile(context.TODO(), ctrl.Request{NamespacedName: instance}); err != nil || result.RequeueAfter != 0 {
+		t.Fatalf("unexpected result %v, %v", result, err)
+	}
+	if count := testutil.CollectAndCount(replicaLagBytes); count != 1 {
+		t.Errorf("lag of deleted instance must be deleted, got %d series", count)
+	}
+	if testutil.ToFloat64(replicaLagBytes.WithLabelValues("test", "other", "other-db-replica-a")) != 10 {
+		t.Error("lag of other instances must be kept")
+	}
+}
@@ -0,0 +1,393 @@
+package horreum
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	"github.com/Hyperfoil/horreum-operator/pkg/keycloak"
+	logr "github.com/go-logr/logr"
+	"github.com/lib/pq"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Password that was generated but not applied everywhere yet is kept in the secret under this key
+// so that an interrupted rotation resumes with the same value.
+const stagedPasswordKey = "password.next"
+
+// rotatedCredential is a secret whose password is also set in the database or Keycloak
+type rotatedCredential struct {
+	secret *corev1.Secret
+	policy hyperfoilv1alpha1.PasswordPolicy
+	// apply sets the staged password; it is invoked again when the rotation is resumed
+	apply func(ctx context.Context, username, password string) error
+	// Additional random keys regenerated together with the password
+	keys []string
+	// applyKeys sets the staged keys, if there are any
+	applyKeys func(ctx context.Context, keys map[string]string) error
+}
+
+func rotationRequested(cr *hyperfoilv1alpha1.Horreum) bool {
+	if cr.Spec.RotateCredentials == nil {
+		return false
+	}
+	return cr.Status.CredentialsRotation == nil || !cr.Status.CredentialsRotation.Requested.Equal(cr.Spec.RotateCredentials)
+}
+
+func currentPassword(secret *corev1.Secret) string {
+	return string(secret.Data[corev1.BasicAuthPasswordKey])
+}
+
+func stagedPassword(secret *corev1.Secret) string {
+	return string(secret.Data[stagedPasswordKey])
+}
+
+// Other keys are staged the same way as the password
+func stagedKey(key string) string {
+	return key + ".next"
+}
+
+// openAdminDb connects as the admin, whose password might have been already changed in an interrupted rotation
+func openAdminDb(ctx context.Context, admin dbConnection, adminSecret *corev1.Secret) (*sql.DB, error) {
+	var lastErr error
+	for _, adminPassword := range []string{currentPassword(adminSecret), stagedPassword(adminSecret)} {
+		if adminPassword == "" {
+			continue
+		}
+		admin.password = adminPassword
+		db, err := openDb(ctx, admin)
+		if err == nil {
+			return db, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("cannot connect to %s:%d as %s: %w", admin.host, admin.port, admin.user, lastErr)
+}
+
+func alterRolePassword(ctx context.Context, admin dbConnection, adminSecret *corev1.Secret, role string, password string) error {
+	db, err := openAdminDb(ctx, admin, adminSecret)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, "ALTER ROLE "+pq.QuoteIdentifier(role)+" WITH PASSWORD "+pq.QuoteLiteral(password)); err != nil {
+		return fmt.Errorf("cannot change password of role %s: %w", role, err)
+	}
+	return nil
+}
+
+// updateDbSecret replaces the passphrase Horreum uses to sign the roles of the user; the table
+// does not exist until Horreum runs its migrations, and these insert the passphrase from the secret.
+func updateDbSecret(ctx context.Context, admin dbConnection, adminSecret *corev1.Secret, database string, passphrase string) error {
+	admin.database = database
+	db, err := openAdminDb(ctx, admin, adminSecret)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if found, err := exists(ctx, db, "SELECT 1 FROM pg_tables WHERE schemaname = 'public' AND tablename = 'dbsecret'"); err != nil {
+		return err
+	} else if !found {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE dbsecret SET passphrase = $1", passphrase); err != nil {
+		return fmt.Errorf("cannot update passphrase in database %s: %w", database, err)
+	}
+	return nil
+}
+
+func keycloakAdminClient(ctx context.Context, r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, adminSecret *corev1.Secret) (*keycloak.Client, error) {
+	var caCert []byte
+	if cr.Spec.Keycloak.External.PublicUri == "" {
+		ca, err := readServiceCa(r, cr)
+		if err != nil {
+			return nil, err
+		}
+		caCert = []byte(ca)
+	}
+	client, err := keycloak.NewClient(keycloakInternalURL(cr), caCert)
+	if err != nil {
+		return nil, err
+	}
+	username := string(adminSecret.Data[corev1.BasicAuthUsernameKey])
+	for _, password := range []string{currentPassword(adminSecret), stagedPassword(adminSecret)} {
+		if password == "" {
+			continue
+		}
+		if err = client.Login(ctx, "master", username, password); err == nil {
+			return client, nil
+		}
+	}
+	return nil, err
+}
+
+func resetKeycloakPassword(ctx context.Context, r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, adminSecret *corev1.Secret, realm, username, password string) error {
+	client, err := keycloakAdminClient(ctx, r, cr, adminSecret)
+	if err != nil {
+		return err
+	}
+	userID, err := client.FindUser(ctx, realm, username)
+	if err != nil {
+		return err
+	}
+	return client.ResetPassword(ctx, realm, userID, password)
+}
+
+// rotatedCredentials lists secrets created by the operator that can be rotated, in the order the
+// passwords should be changed: the admin credentials used to change the others go last.
+func rotatedCredentials(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) ([]rotatedCredential, error) {
+	dbAdmin, err := readSecret(r, cr.Namespace, dbAdminSecret(cr))
+	if err != nil {
+		return nil, err
+	}
+	keycloakAdmin, err := readSecret(r, cr.Namespace, keycloakAdminSecret(cr))
+	if err != nil {
+		return nil, err
+	}
+	managed := cr.Spec.Postgres.Enabled == nil || *cr.Spec.Postgres.Enabled
+	keycloakDeployed := cr.Spec.Keycloak.External.PublicUri == ""
+	// Admin connection to the server hosting given database, nil when the operator has no admin access
+	adminConnection := func(db *hyperfoilv1alpha1.DatabaseSpec) (*dbConnection, error) {
+		if managed && db.Host == "" {
+			conn, _, err := managedDbProvisioning(r, cr)
+			return &conn, err
+		} else if !managed && !metav1.IsControlledBy(dbAdmin, cr) {
+			conn, err := dbConnectionFor(r, cr, db, "postgres")
+			conn.user = string(dbAdmin.Data[corev1.BasicAuthUsernameKey])
+			return &conn, err
+		}
+		return nil, nil
+	}
+	roleCredential := func(secretName string, spec hyperfoilv1alpha1.CredentialSpec, admin *dbConnection, adminSecret *corev1.Secret) (*rotatedCredential, error) {
+		if admin == nil {
+			return nil, nil
+		}
+		secret, err := readSecret(r, cr.Namespace, secretName)
+		if err != nil || !metav1.IsControlledBy(secret, cr) {
+			return nil, err
+		}
+		return &rotatedCredential{
+			secret: secret,
+			policy: passwordPolicy(cr, spec),
+			apply: func(ctx context.Context, username, password string) error {
+				return alterRolePassword(ctx, *admin, adminSecret, username, password)
+			},
+		}, nil
+	}
+	// Credential of the admin on a server deployed by the operator
+	superuserCredential := func(adminSecret *corev1.Secret, spec hyperfoilv1alpha1.CredentialSpec, admin dbConnection) rotatedCredential {
+		return rotatedCredential{
+			secret: adminSecret,
+			policy: passwordPolicy(cr, spec),
+			apply: func(ctx context.Context, username, password string) error {
+				if err := alterRolePassword(ctx, admin, adminSecret, username, password); err != nil {
+					return err
+				}
+				if admin.user != username {
+					// Red Hat image sets the same password for the 'postgres' superuser
+					return alterRolePassword(ctx, admin, adminSecret, admin.user, password)
+				}
+				return nil
+			},
+		}
+	}
+
+	credentials := []rotatedCredential{}
+	if admin, err := adminConnection(&cr.Spec.Database); err != nil {
+		return nil, err
+	} else if c, err := roleCredential(appUserSecret(cr), cr.Spec.Credentials.App, admin, dbAdmin); err != nil {
+		return nil, err
+	} else if c != nil {
+		database := withDefault(cr.Spec.Database.Name, "horreum")
+		c.keys = []string{"dbsecret"}
+		c.applyKeys = func(ctx context.Context, keys map[string]string) error {
+			return updateDbSecret(ctx, *admin, dbAdmin, database, keys["dbsecret"])
+		}
+		credentials = append(credentials, *c)
+	}
+	if hasReadReplicas(cr) {
+		admin, err := adminConnection(&cr.Spec.Database)
+		if err != nil {
+			return nil, err
+		}
+		for _, role := range []struct {
+			secret string
+			spec   hyperfoilv1alpha1.CredentialSpec
+		}{
+			{dbReadOnlySecret(cr), cr.Spec.Credentials.DbReadOnly},
+			{dbReplicationSecret(cr), cr.Spec.Credentials.DbReplication},
+		} {
+			if c, err := roleCredential(role.secret, role.spec, admin, dbAdmin); err != nil {
+				return nil, err
+			} else if c != nil {
+				credentials = append(credentials, *c)
+			}
+		}
+	}
+	var keycloakDbAdmin *corev1.Secret
+	var keycloakDbConn dbConnection
+	if keycloakDeployed {
+		var admin *dbConnection
+		adminSecret := dbAdmin
+		switch keycloakDatabaseMode(cr) {
+		case hyperfoilv1alpha1.KeycloakDatabaseShared:
+			if admin, err = adminConnection(&cr.Spec.Keycloak.Database); err != nil {
+				return nil, err
+			}
+		case hyperfoilv1alpha1.KeycloakDatabaseDedicated:
+			if keycloakDbAdmin, err = readSecret(r, cr.Namespace, keycloakDbAdminSecret(cr)); err != nil {
+				return nil, err
+			}
+			if keycloakDbConn, _, err = keycloakDbProvisioning(r, cr); err != nil {
+				return nil, err
+			}
+			admin, adminSecret = &keycloakDbConn, keycloakDbAdmin
+		}
+		if c, err := roleCredential(keycloakDbSecret(cr), cr.Spec.Credentials.KeycloakDb, admin, adminSecret); err != nil {
+			return nil, err
+		} else if c != nil {
+			credentials = append(credentials, *c)
+		}
+	}
+	horreumAdmin, err := readSecret(r, cr.Namespace, horreumAdminSecret(cr))
+	if err != nil {
+		return nil, err
+	}
+	if metav1.IsControlledBy(horreumAdmin, cr) {
+		credentials = append(credentials, rotatedCredential{
+			secret: horreumAdmin,
+			policy: passwordPolicy(cr, cr.Spec.Credentials.HorreumAdmin),
+			apply: func(ctx context.Context, username, password string) error {
+				return resetKeycloakPassword(ctx, r, cr, keycloakAdmin, "horreum", username, password)
+			},
+		})
+	}
+	if keycloakDeployed && metav1.IsControlledBy(keycloakAdmin, cr) {
+		credentials = append(credentials, rotatedCredential{
+			secret: keycloakAdmin,
+			policy: passwordPolicy(cr, cr.Spec.Credentials.KeycloakAdmin),
+			apply: func(ctx context.Context, username, password string) error {
+				return resetKeycloakPassword(ctx, r, cr, keycloakAdmin, "master", username, password)
+			},
+		})
+	}
+	if managed && metav1.IsControlledBy(dbAdmin, cr) {
+		admin, err := adminConnection(&hyperfoilv1alpha1.DatabaseSpec{})
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, superuserCredential(dbAdmin, cr.Spec.Credentials.DbAdmin, *admin))
+	}
+	if keycloakDbAdmin != nil && metav1.IsControlledBy(keycloakDbAdmin, cr) {
+		credentials = append(credentials, superuserCredential(keycloakDbAdmin, cr.Spec.Credentials.KeycloakDbAdmin, keycloakDbConn))
+	}
+	return credentials, nil
+}
+
+// rotateCredentials stages new passwords in the secrets, applies them to PostgreSQL and Keycloak,
+// promotes them and restarts Horreum and Keycloak (one instance at a time) to pick them up. The database keeps running.
+// Returns false when the rotation has to wait for Keycloak.
+func rotateCredentials(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) (bool, error) {
+	appPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: cr.Name + "-app", Namespace: cr.Namespace}}
+	if cr.Spec.Keycloak.External.PublicUri == "" {
+		if ready, err := isDeploymentReady(r, cr.Name+"-keycloak", cr.Namespace); err != nil {
+			return false, err
+		} else if !ready {
+			logger.Info("Waiting for Keycloak before rotating credentials")
+			return false, nil
+		}
+	}
+	credentials, err := rotatedCredentials(r, cr)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), 2*time.Minute)
+	defer cancel()
+	rotated, err := rotatePasswords(ctx, r, logger, credentials)
+	if err != nil {
+		return false, err
+	}
+
+	// Pods read the credentials from environment on start; they will be recreated in next reconciliation
+	if err := ensureDeleted(r, cr, appPod, &corev1.Pod{}); err != nil {
+		return false, err
+	}
+	if cr.Spec.Keycloak.External.PublicUri == "" {
+		if err := restartDeployment(r, cr, cr.Name+"-keycloak"); err != nil {
+			return false, err
+		}
+	}
+	// Replicas stream from the primary as the replication role; new pods copy the data with the new password
+	if hasReadReplicas(cr) {
+		if err := restartDeployment(r, cr, dbReplicaName(cr)); err != nil {
+			return false, err
+		}
+	}
+	cr.Status.CredentialsRotation = &hyperfoilv1alpha1.CredentialsRotationStatus{
+		Requested: *cr.Spec.RotateCredentials,
+		Completed: metav1.Now(),
+		Secrets:   rotated,
+	}
+	recordEvent(r, cr, corev1.EventTypeNormal, "CredentialsRotated", fmt.Sprintf("Rotated passwords in secrets %v", rotated))
+	return true, nil
+}
+
+// rotatePasswords stages new passwords and keys, applies them and promotes them in the secrets
+func rotatePasswords(ctx context.Context, r *HorreumReconciler, logger logr.Logger, credentials []rotatedCredential) ([]string, error) {
+	for _, c := range credentials {
+		if stagedPassword(c.secret) != "" {
+			continue
+		}
+		password, err := generatePassword(c.policy)
+		if err != nil {
+			return nil, err
+		}
+		c.secret.Data[stagedPasswordKey] = []byte(password)
+		for _, key := range c.keys {
+			value, err := generateKey(dbSecretKeySize)
+			if err != nil {
+				return nil, err
+			}
+			c.secret.Data[stagedKey(key)] = []byte(value)
+		}
+		if err := r.Update(ctx, c.secret); err != nil {
+			return nil, fmt.Errorf("cannot stage new password in secret %s: %w", c.secret.Name, err)
+		}
+	}
+	for _, c := range credentials {
+		logger.Info("Rotating password in secret " + c.secret.Name)
+		if err := c.apply(ctx, string(c.secret.Data[corev1.BasicAuthUsernameKey]), stagedPassword(c.secret)); err != nil {
+			return nil, fmt.Errorf("cannot rotate password in secret %s: %w", c.secret.Name, err)
+		}
+		if c.applyKeys != nil {
+			keys := map[string]string{}
+			for _, key := range c.keys {
+				keys[key] = string(c.secret.Data[stagedKey(key)])
+			}
+			if err := c.applyKeys(ctx, keys); err != nil {
+				return nil, fmt.Errorf("cannot rotate keys in secret %s: %w", c.secret.Name, err)
+			}
+		}
+	}
+	rotated := []string{}
+	for _, c := range credentials {
+		c.secret.Data[corev1.BasicAuthPasswordKey] = c.secret.Data[stagedPasswordKey]
+		delete(c.secret.Data, stagedPasswordKey)
+		for _, key := range c.keys {
+			c.secret.Data[key] = c.secret.Data[stagedKey(key)]
+			delete(c.secret.Data, stagedKey(key))
+		}
+		if c.secret.Annotations == nil {
+			c.secret.Annotations = map[string]string{}
+		}
+		c.secret.Annotations[passwordGeneratorAnnotation] = passwordGenerator
+		if err := r.Update(ctx, c.secret); err != nil {
+			return nil, fmt.Errorf("cannot update secret %s: %w", c.secret.Name, err)
+		}
+		rotated = append(rotated, c.secret.Name)
+	}
+	return rotated, nil
+}
@@ -0,0 +1,177 @@
+package horreum
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+func TestRotationRequested(t *testing.T) {
+	cr := &hyperfoilv1alpha1.Horreum{}
+	if rotationRequested(cr) {
+		t.Error("rotation was not requested")
+	}
+	requested := metav1.NewTime(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	cr.Spec.RotateCredentials = &requested
+	if !rotationRequested(cr) {
+		t.Error("first request must rotate")
+	}
+	cr.Status.CredentialsRotation = &hyperfoilv1alpha1.CredentialsRotationStatus{Requested: requested}
+	if rotationRequested(cr) {
+		t.Error("completed request must not rotate again")
+	}
+	next := metav1.NewTime(requested.Add(time.Hour))
+	cr.Spec.RotateCredentials = &next
+	if !rotationRequested(cr) {
+		t.Error("changed timestamp must rotate")
+	}
+}
+
+func TestRotatePasswordsResumes(t *testing.T) {
+	cr := &hyperfoilv1alpha1.Horreum{ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test", UID: "1234"}}
+	r := fakeReconciler(t, cr)
+	secrets := []*corev1.Secret{}
+	for _, name := range []string{appUserSecret(cr), keycloakDbSecret(cr)} {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: cr.Namespace},
+			Data: map[string][]byte{
+				corev1.BasicAuthUsernameKey: []byte(name),
+				corev1.BasicAuthPasswordKey: []byte("old"),
+			},
+		}
+		if err := r.Create(context.TODO(), secret); err != nil {
+			t.Fatal(err)
+		}
+		secrets = append(secrets, secret)
+	}
+	applied := map[string]string{}
+	failing := keycloakDbSecret(cr)
+	credentials := func() []rotatedCredential {
+		list := []rotatedCredential{}
+		for _, s := range secrets {
+			stored := &corev1.Secret{}
+			if err := r.Get(context.TODO(), types.NamespacedName{Name: s.Name, Namespace: cr.Namespace}, stored); err != nil {
+				t.Fatal(err)
+			}
+			list = append(list, rotatedCredential{
+				secret: stored,
+				policy: passwordPolicy(cr, cr.Spec.Credentials.App),
+				apply: func(ctx context.Context, username, password string) error {
+					if username == failing {
+						return fmt.Errorf("database is down")
+					}
+					applied[username] = password
+					return nil
+				},
+			})
+		}
+		return list
+	}
+
+	// The new passwords are kept in the secrets when the rotation is interrupted
+	if _, err := rotatePasswords(context.TODO(), r, r.Log, credentials()); err == nil {
+		t.Fatal("failure to apply the password must be reported")
+	}
+	staged := map[string]string{}
+	for _, c := range credentials() {
+		if currentPassword(c.secret) != "old" || stagedPassword(c.secret) == "" {
+			t.Fatalf("%s: password must be staged, not promoted", c.secret.Name)
+		}
+		staged[c.secret.Name] = stagedPassword(c.secret)
+	}
+
+	failing = ""
+	rotated, err := rotatePasswords(context.TODO(), r, r.Log, credentials())
+	if err != nil || len(rotated) != 2 {
+		t.Fatalf("unexpected result %v, %v", rotated, err)
+	}
+	for _, c := range credentials() {
+		password := currentPassword(c.secret)
+		if password != staged[c.secret.Name] || applied[c.secret.Name] != password {
+			t.Errorf("%s: resumed rotation must apply and promote the staged password", c.secret.Name)
+		}
+		if stagedPassword(c.secret) != "" || c.secret.Annotations[passwordGeneratorAnnotation] != passwordGenerator {
+			t.Errorf("%s: unexpected secret after rotation: %v", c.secret.Name, c.secret.Annotations)
+		}
+	}
+}
+
+func TestRotateCredentialsWaitsForKeycloak(t *testing.T) {
+	requested := metav1.Now()
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test", UID: "1234"},
+		Spec:       hyperfoilv1alpha1.HorreumSpec{RotateCredentials: &requested},
+	}
+	r := fakeReconciler(t, cr)
+	if done, err := rotateCredentials(r, cr, r.Log); err != nil || done {
+		t.Errorf("rotation must wait for Keycloak: %v, %v", done, err)
+	}
+	if cr.Status.CredentialsRotation != nil {
+		t.Error("rotation must not be completed")
+	}
+}
+
+func TestRotateWeakDbSecret(t *testing.T) {
+	cr := &hyperfoilv1alpha1.Horreum{ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test", UID: "1234"}}
+	r := fakeReconciler(t, cr)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        appUserSecret(cr),
+			Namespace:   cr.Namespace,
+			Annotations: map[string]string{passwordGeneratorAnnotation: passwordGenerator},
+		},
+		Data: map[string][]byte{
+			corev1.BasicAuthUsernameKey: []byte("appuser"),
+			corev1.BasicAuthPasswordKey: []byte("0123456789abcdef0123456789abcdef"),
+			"dbsecret":                  []byte("secret"),
+		},
+	}
+	if err := controllerutil.SetControllerReference(cr, secret, r.Scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Create(context.TODO(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if weak, err := weakSecrets(r, cr); err != nil || len(weak) != 1 || weak[0] != secret.Name {
+		t.Fatalf("short dbsecret must be reported: %v, %v", weak, err)
+	}
+
+	var appliedPassword, appliedDbSecret string
+	credentials := []rotatedCredential{{
+		secret: secret,
+		policy: passwordPolicy(cr, cr.Spec.Credentials.App),
+		apply: func(ctx context.Context, username, password string) error {
+			appliedPassword = password
+			return nil
+		},
+		keys: []string{"dbsecret"},
+		applyKeys: func(ctx context.Context, keys map[string]string) error {
+			appliedDbSecret = keys["dbsecret"]
+			return nil
+		},
+	}}
+	if rotated, err := rotatePasswords(context.TODO(), r, r.Log, credentials); err != nil || len(rotated) != 1 {
+		t.Fatalf("unexpected result %v, %v", rotated, err)
+	}
+
+	stored := &corev1.Secret{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: secret.Name, Namespace: cr.Namespace}, stored); err != nil {
+		t.Fatal(err)
+	}
+	if currentPassword(stored) != appliedPassword || string(stored.Data["dbsecret"]) != appliedDbSecret {
+		t.Error("secret must contain the applied values")
+	}
+	if _, staged := stored.Data[stagedKey("dbsecret")]; staged || stagedPassword(stored) != "" {
+		t.Error("staged values must be removed")
+	}
+	if weak, err := weakSecrets(r, cr); err != nil || len(weak) != 0 {
+		t.Errorf("rotated secrets must not be weak: %v, %v", weak, err)
+	}
+}
@@ -0,0 +1,138 @@
+package horreum
+
+import (
+	"testing"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// checkRestricted verifies the pod against the 'restricted' Pod Security Standard (which includes 'baseline'),
+// see https://kubernetes.io/docs/concepts/security/pod-security-standards/
+func checkRestricted(t *testing.T, pod *corev1.Pod) {
+	t.Helper()
+	spec := pod.Spec
+	if spec.HostNetwork || spec.HostPID || spec.HostIPC {
+		t.Errorf("%s: host namespaces must not be shared", pod.Name)
+	}
+	for _, v := range spec.Volumes {
+		src := v.VolumeSource
+		if src.ConfigMap == nil && src.CSI == nil && src.DownwardAPI == nil && src.EmptyDir == nil &&
+			src.Ephemeral == nil && src.PersistentVolumeClaim == nil && src.Projected == nil && src.Secret == nil {
+			t.Errorf("%s: volume %s has disallowed type", pod.Name, v.Name)
+		}
+	}
+	podSc := spec.SecurityContext
+	if podSc == nil {
+		podSc = &corev1.PodSecurityContext{}
+	}
+	if podSc.RunAsUser != nil && *podSc.RunAsUser == 0 {
+		t.Errorf("%s: pod must not run as root", pod.Name)
+	}
+	if podSc.RunAsNonRoot != nil && !*podSc.RunAsNonRoot {
+		t.Errorf("%s: runAsNonRoot must not be false", pod.Name)
+	}
+	if len(podSc.Sysctls) > 0 {
+		t.Errorf("%s: sysctls are not allowed", pod.Name)
+	}
+	podSeccomp := podSc.SeccompProfile != nil && podSc.SeccompProfile.Type != corev1.SeccompProfileTypeUnconfined
+
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		sc := c.SecurityContext
+		if sc == nil {
+			t.Errorf("%s/%s: security context is missing", pod.Name, c.Name)
+			continue
+		}
+		if sc.Privileged != nil && *sc.Privileged {
+			t.Errorf("%s/%s: must not be privileged", pod.Name, c.Name)
+		}
+		if sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+			t.Errorf("%s/%s: allowPrivilegeEscalation must be false", pod.Name, c.Name)
+		}
+		if sc.ProcMount != nil && *sc.ProcMount != corev1.DefaultProcMount {
+			t.Errorf("%s/%s: procMount must be default", pod.Name, c.Name)
+		}
+		if sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+			t.Errorf("%s/%s: must not run as root", pod.Name, c.Name)
+		}
+		if sc.RunAsNonRoot != nil && !*sc.RunAsNonRoot {
+			t.Errorf("%s/%s: runAsNonRoot must not be false", pod.Name, c.Name)
+		} else if sc.RunAsNonRoot == nil && (podSc.RunAsNonRoot == nil || !*podSc.RunAsNonRoot) {
+			t.Errorf("%s/%s: runAsNonRoot must be true", pod.Name, c.Name)
+		}
+		if sc.SeccompProfile != nil {
+			if sc.SeccompProfile.Type == corev1.SeccompProfileTypeUnconfined {
+				t.Errorf("%s/%s: seccomp profile must not be unconfined", pod.Name, c.Name)
+			}
+		} else if !podSeccomp {
+			t.Errorf("%s/%s: seccomp profile must be set", pod.Name, c.Name)
+		}
+		dropsAll := false
+		if sc.Capabilities != nil {
+			for _, capability := range sc.Capabilities.Drop {
+				dropsAll = dropsAll || capability == "ALL"
+			}
+			for _, capability := range sc.Capabilities.Add {
+				if capability != "NET_BIND_SERVICE" {
+					t.Errorf("%s/%s: capability %s must not be added", pod.Name, c.Name, capability)
+				}
+			}
+		}
+		if !dropsAll {
+			t.Errorf("%s/%s: must drop ALL capabilities", pod.Name, c.Name)
+		}
+		for _, port := range c.Ports {
+			if port.HostPort != 0 {
+				t.Errorf("%s/%s: host ports are not allowed", pod.Name, c.Name)
+			}
+		}
+	}
+}
+
+func TestPodsAreRestricted(t *testing.T) {
+	enabled := true
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			Postgres: hyperfoilv1alpha1.PostgresSpec{
+				Enabled:               &enabled,
+				PersistentVolumeClaim: "horreum-db",
+				Backup: hyperfoilv1alpha1.PostgresBackupSpec{
+					Enabled: true,
+					Storage: hyperfoilv1alpha1.BackupStorageSpec{PersistentVolumeClaim: "horreum-backup"},
+				},
+				ReadReplicas: hyperfoilv1alpha1.PostgresReadReplicasSpec{Replicas: 2},
+			},
+			Credentials: hyperfoilv1alpha1.CredentialsSpec{
+				App: hyperfoilv1alpha1.CredentialSpec{
+					Source: hyperfoilv1alpha1.CredentialSourceCSI,
+					CSI:    &hyperfoilv1alpha1.CSISecretSpec{SecretProviderClass: "vault"},
+				},
+			},
+		},
+	}
+	for _, p := range []Platform{{RoutesAvailable: true, UseRedHatImages: true}, {}} {
+		checkRestricted(t, postgresPod(cr, horreumPostgres(cr), p))
+		checkRestricted(t, postgresPod(cr, keycloakPostgres(cr), p))
+		checkRestricted(t, appPod(cr, p, "https://keycloak.example.com", "https://horreum.example.com"))
+		keycloak := keycloakDeployment(cr, p, "https://keycloak.example.com")
+		checkRestricted(t, &corev1.Pod{ObjectMeta: keycloak.ObjectMeta, Spec: keycloak.Spec.Template.Spec})
+		checkRestricted(t, secretsSyncPod(cr, p))
+		pgBouncer := pgBouncerDeployment(cr, p, "")
+		checkRestricted(t, &corev1.Pod{ObjectMeta: pgBouncer.ObjectMeta, Spec: pgBouncer.Spec.Template.Spec})
+		backup := postgresBackupCronJob(cr, horreumPostgres(cr), p)
+		checkRestricted(t, &corev1.Pod{ObjectMeta: backup.ObjectMeta, Spec: backup.Spec.JobTemplate.Spec.Template.Spec})
+		replica := dbReplicaDeployment(cr, p)
+		checkRestricted(t, &corev1.Pod{ObjectMeta: replica.ObjectMeta, Spec: replica.Spec.Template.Spec})
+		clone := cloneJob(cr, cr, p)
+		checkRestricted(t, &corev1.Pod{ObjectMeta: clone.ObjectMeta, Spec: clone.Spec.Template.Spec})
+		cr.Status.Postgres = &hyperfoilv1alpha1.PostgresStatus{
+			Image:   postgresImage(&cr.Spec.Postgres, p),
+			Upgrade: &hyperfoilv1alpha1.PostgresUpgradeStatus{PersistentVolumeClaim: "horreum-db-pg16"},
+		}
+		upgrade := postgresUpgradeJob(cr, horreumPostgres(cr), p)
+		checkRestricted(t, &corev1.Pod{ObjectMeta: upgrade.ObjectMeta, Spec: upgrade.Spec.Template.Spec})
+	}
+}
@@ -0,0 +1,462 @@
+package horreum
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const dbUpgradeMountPath = "/upgrade"
+
+var postgresVersionPattern = regexp.MustCompile(`^(\d+)(\.\d+)?`)
+
+// postgresMajorVersion guesses the major version from the image, e.g. postgres:14.4 or rhel8/postgresql-12.
+// Returns empty string when the version cannot be determined, e.g. for digests or the 'latest' tag.
+func postgresMajorVersion(image string) string {
+	name := image
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	tag := ""
+	if i := strings.Index(name, ":"); i >= 0 {
+		tag = name[i+1:]
+		name = name[:i]
+	}
+	version := tag
+	if !isDockerDbImage(image) {
+		if i := strings.LastIndex(name, "-"); i >= 0 {
+			version = name[i+1:]
+		}
+	}
+	match := postgresVersionPattern.FindStringSubmatch(version)
+	if match == nil {
+		return ""
+	}
+	// Before PostgreSQL 10 the major version had two components
+	if major, _ := strconv.Atoi(match[1]); major < 10 {
+		return match[1] + match[2]
+	}
+	return match[1]
+}
+
+// postgresDataClaim is the claim holding the data directory; after an upgrade it differs from the one in spec
+func postgresDataClaim(spec *hyperfoilv1alpha1.PostgresSpec, status *hyperfoilv1alpha1.PostgresStatus) string {
+	if status != nil && status.PersistentVolumeClaim != "" &&
+		status.RequestedPersistentVolumeClaim == spec.PersistentVolumeClaim {
+		return status.PersistentVolumeClaim
+	}
+	return spec.PersistentVolumeClaim
+}
+
+func postgresUpgradeJobName(db postgresInstance) string {
+	return db.name + "-upgrade"
+}
+
+// postgresUpgradeClaim has the same class and size as the claim with the data of the previous version
+func postgresUpgradeClaim(cr *hyperfoilv1alpha1.Horreum, name string, source *corev1.PersistentVolumeClaim) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels: map[string]string{
+				"app": cr.Name,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: source.Spec.AccessModes,
+			Resources: corev1.ResourceRequirements{
+				Requests: source.Spec.Resources.Requests,
+			},
+			StorageClassName: source.Spec.StorageClassName,
+			VolumeMode:       source.Spec.VolumeMode,
+		},
+	}
+}
+
+// postgresUpgradeJob starts the previous version of the server on its data and dumps everything into the new
+// volume, where the new server finds it on its first start (see restoreUpgradeScript)
+func postgresUpgradeJob(cr *hyperfoilv1alpha1.Horreum, db postgresInstance, p Platform) *batchv1.Job {
+	status := *db.status
+	image := status.Image
+	userId := postgresUserId(db.spec, image)
+	env := []corev1.EnvVar{}
+	if isDockerDbImage(image) {
+		// Superuser of the community image is the admin; Red Hat image uses 'postgres'
+		env = append(env, secretEnv("PGUSER", db.adminSecret, corev1.BasicAuthUsernameKey))
+	}
+	podSecurityContext := restrictedPodSecurityContext()
+	podSecurityContext.FSGroup = &[]int64{userId}[0]
+	podSecurityContext.FSGroupChangePolicy = &[]corev1.PodFSGroupChangePolicy{corev1.FSGroupChangeOnRootMismatch}[0]
+	securityContext := restrictedSecurityContext(false)
+	securityContext.RunAsUser = &[]int64{userId}[0]
+	backoffLimit := int32(2)
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      postgresUpgradeJobName(db),
+			Namespace: cr.Namespace,
+			Labels: map[string]string{
+				"app":     cr.Name,
+				"service": db.component + "-upgrade",
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						"app":     cr.Name,
+						"service": db.component + "-upgrade",
+					},
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy:    corev1.RestartPolicyNever,
+					ImagePullSecrets: cr.Spec.ImagePullSecrets,
+					SecurityContext:  podSecurityContext,
+					Containers: []corev1.Container{
+						{
+							Name:            "dump",
+							Image:           image,
+							ImagePullPolicy: p.PullPolicy,
+							Env:             env,
+							// The server listens only on a socket in /tmp and does not need the certificates
+							Command: []string{"bash", "-c", `
+								set -e
+								for dir in ` + dbDataPath + `/pgdata ` + dbDataPath + `/userdata ` + dbDataPath + `; do
+									if [ -f "$dir/PG_VERSION" ]; then
+										export PGDATA="$dir"
+										break
+									fi
+								done
+								# Red Hat image includes configuration generated on start
+								touch /var/lib/pgsql/openshift-custom-postgresql.conf 2> /dev/null || true
+								pg_ctl start -w -t 600 -o "-c listen_addresses='' -c unix_socket_directories=/tmp -c ssl=off"
+								pg_dumpall -h /tmp --username "${PGUSER:-postgres}" --file ` + dbUpgradeMountPath + `/upgrade.sql.tmp
+								pg_ctl stop -w -m fast
+								mv ` + dbUpgradeMountPath + `/upgrade.sql.tmp ` + dbUpgradeMountPath + `/upgrade.sql
+							`},
+							SecurityContext: securityContext,
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "db-volume",
+									MountPath: dbDataPath,
+								},
+								{
+									Name:      "upgrade-volume",
+									MountPath: dbUpgradeMountPath,
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "db-volume",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: postgresDataClaim(db.spec, status),
+								},
+							},
+						},
+						{
+							Name: "upgrade-volume",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: status.Upgrade.PersistentVolumeClaim,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// upgradePostgres moves the data to a new volume when the major version of the image changes, keeping
+// the previous volume for rollback. Returns false while the database server must not run.
+func upgradePostgres(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, db postgresInstance, logger logr.Logger) (bool, error) {
+	status := *db.status
+	image := postgresImage(db.spec, r.Platform)
+	version := postgresMajorVersion(image)
+	// Without persistent volume there is nothing to migrate
+	if status == nil || status.Version == "" || db.spec.PersistentVolumeClaim == "" || version == "" {
+		return true, nil
+	}
+	if upgrade := status.Upgrade; upgrade != nil {
+		switch upgrade.Phase {
+		case hyperfoilv1alpha1.PostgresUpgradeDumping:
+			if version == upgrade.To {
+				return dumpPostgres(r, cr, db, logger)
+			}
+			// The upgrade was cancelled by changing the image
+			if err := cancelPostgresUpgrade(r, cr, db, logger, "cancelled"); err != nil {
+				return false, err
+			}
+			return upgradePostgres(r, cr, db, logger)
+		case hyperfoilv1alpha1.PostgresUpgradeRestoring:
+			if version == upgrade.To {
+				return checkPostgresRestore(r, cr, db)
+			}
+		case hyperfoilv1alpha1.PostgresUpgradeFailed:
+			if version == upgrade.To {
+				updateStatus(r, cr, "Error", db.title+" upgrade to version "+upgrade.To+" failed: "+upgrade.Message+
+					"; set "+db.specPath+".image back to version "+upgrade.From+" to roll back")
+				return false, nil
+			}
+			if status.Version == upgrade.From {
+				// Failed while dumping the data, the server keeps using the previous volume
+				if err := cancelPostgresUpgrade(r, cr, db, logger, "rolled back"); err != nil {
+					return false, err
+				}
+				return upgradePostgres(r, cr, db, logger)
+			}
+		}
+	}
+	if version == status.Version {
+		return true, nil
+	}
+	from, _ := strconv.ParseFloat(status.Version, 64)
+	to, _ := strconv.ParseFloat(version, 64)
+	if to < from {
+		if version == status.PreviousVersion && status.PreviousPersistentVolumeClaim != "" {
+			return true, rollbackPostgres(r, cr, db, logger, image)
+		}
+		updateStatus(r, cr, "Error", "Cannot downgrade "+db.title+" from version "+status.Version+" to "+version)
+		return false, nil
+	}
+	claim := fmt.Sprintf("%s-pg%s", db.spec.PersistentVolumeClaim, version)
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: claim, Namespace: cr.Namespace}, &corev1.PersistentVolumeClaim{}); err == nil {
+		updateStatus(r, cr, "Error", "Cannot upgrade "+db.title+" to version "+version+": claim "+claim+
+			" already exists, delete it to upgrade again")
+		return false, nil
+	} else if !errors.IsNotFound(err) {
+		return false, err
+	}
+	status.Upgrade = &hyperfoilv1alpha1.PostgresUpgradeStatus{
+		Phase:                 hyperfoilv1alpha1.PostgresUpgradeDumping,
+		From:                  status.Version,
+		To:                    version,
+		PersistentVolumeClaim: claim,
+		Message:               "Dumping data from version " + status.Version,
+		Started:               metav1.Now(),
+	}
+	recordEvent(r, cr, corev1.EventTypeNormal, "PostgresUpgradeStarted",
+		"Upgrading "+db.title+" from version "+status.Version+" to "+version+" into claim "+claim)
+	if err := r.Status().Update(context.TODO(), cr); err != nil {
+		return false, err
+	}
+	return dumpPostgres(r, cr, db, logger)
+}
+
+func dumpPostgres(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, db postgresInstance, logger logr.Logger) (bool, error) {
+	status := *db.status
+	upgrade := status.Upgrade
+	// The data must not change while being dumped
+	if err := ensureDeleted(r, cr, postgresPod(cr, db, r.Platform), &corev1.Pod{}); err != nil {
+		return false, err
+	}
+	dataClaim := postgresDataClaim(db.spec, status)
+	claim := &corev1.PersistentVolumeClaim{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: upgrade.PersistentVolumeClaim, Namespace: cr.Namespace}, claim); errors.IsNotFound(err) {
+		source := &corev1.PersistentVolumeClaim{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: dataClaim, Namespace: cr.Namespace}, source); err != nil {
+			return false, failPostgresUpgrade(r, cr, db, "Cannot read claim "+dataClaim+": "+err.Error())
+		}
+		// Owned by the Horreum resource only until the data are restored, see completePostgresUpgrade
+		claim = postgresUpgradeClaim(cr, upgrade.PersistentVolumeClaim, source)
+		if err := controllerutil.SetControllerReference(cr, claim, r.Scheme); err != nil {
+			return false, err
+		}
+		if err := r.Create(context.TODO(), claim); err != nil {
+			return false, err
+		}
+		recordEvent(r, cr, corev1.EventTypeNormal, "Created", "Created PersistentVolumeClaim "+upgrade.PersistentVolumeClaim)
+	} else if err != nil {
+		return false, err
+	}
+	job := postgresUpgradeJob(cr, db, r.Platform)
+	if err := ensureSame(r, cr, logger, job, &batchv1.Job{}, nocompare, nocheck); err != nil {
+		return false, err
+	}
+	found := &batchv1.Job{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, found); err != nil {
+		return false, err
+	}
+	for _, c := range found.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			// The job is kept to let the user inspect its logs
+			return false, failPostgresUpgrade(r, cr, db, "Dumping the data failed ("+c.Message+"), see logs of job "+found.Name)
+		}
+	}
+	if found.Status.Succeeded == 0 {
+		updateStatus(r, cr, "Pending", "Upgrading "+db.title+" from version "+upgrade.From+" to "+upgrade.To+": dumping data")
+		return false, nil
+	}
+	if err := deleteJob(r, cr, found); err != nil {
+		return false, err
+	}
+	// The new server loads the dump on first start; from now on the data live in the new volume
+	status.PreviousVersion = status.Version
+	status.PreviousPersistentVolumeClaim = dataClaim
+	status.Version = upgrade.To
+	status.Image = postgresImage(db.spec, r.Platform)
+	status.PersistentVolumeClaim = upgrade.PersistentVolumeClaim
+	status.RequestedPersistentVolumeClaim = db.spec.PersistentVolumeClaim
+	upgrade.Phase = hyperfoilv1alpha1.PostgresUpgradeRestoring
+	upgrade.Message = "Restoring data into version " + upgrade.To
+	setStatus(r, cr, "Pending", "Upgrading "+db.title+" from version "+upgrade.From+" to "+upgrade.To+": restoring data")
+	return true, r.Status().Update(context.TODO(), cr)
+}
+
+// checkPostgresRestore fails the upgrade when the new server cannot load the dump
+func checkPostgresRestore(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, db postgresInstance) (bool, error) {
+	status := *db.status
+	pod := &corev1.Pod{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: db.name, Namespace: cr.Namespace}, pod); errors.IsNotFound(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.RestartCount > 0 && cs.LastTerminationState.Terminated != nil && cs.LastTerminationState.Terminated.ExitCode != 0 {
+			return false, failPostgresUpgrade(r, cr, db, "Restoring the data failed, see logs of pod "+pod.Name+
+				" and upgrade.log in claim "+status.PersistentVolumeClaim)
+		}
+	}
+	setStatus(r, cr, "Pending", "Upgrading "+db.title+" from version "+status.Upgrade.From+
+		" to "+status.Upgrade.To+": restoring data")
+	return true, nil
+}
+
+// completePostgresUpgrade records version of the running server. Once the data are restored the claim
+// is released, so that it outlives the Horreum resource like the claim from spec.
+func completePostgresUpgrade(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, db postgresInstance) error {
+	image := postgresImage(db.spec, r.Platform)
+	if *db.status == nil {
+		*db.status = &hyperfoilv1alpha1.PostgresStatus{}
+	}
+	status := *db.status
+	if version := postgresMajorVersion(image); version != "" {
+		status.Version = version
+	}
+	status.Image = image
+	if upgrade := status.Upgrade; upgrade != nil && upgrade.Phase == hyperfoilv1alpha1.PostgresUpgradeRestoring {
+		if err := releaseClaim(r, cr, upgrade.PersistentVolumeClaim); err != nil {
+			return err
+		}
+		upgrade.Phase = hyperfoilv1alpha1.PostgresUpgradeSucceeded
+		upgrade.Message = "Data of version " + upgrade.From + " are kept in claim " + status.PreviousPersistentVolumeClaim
+		upgrade.Completed = &[]metav1.Time{metav1.Now()}[0]
+		recordEvent(r, cr, corev1.EventTypeNormal, "PostgresUpgraded", db.title+" was upgraded from version "+
+			upgrade.From+" to "+upgrade.To+"; "+upgrade.Message)
+	}
+	return nil
+}
+
+// releaseClaim removes the owner reference to the Horreum resource
+func releaseClaim(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, name string) error {
+	claim := &corev1.PersistentVolumeClaim{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, claim); errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	owners := []metav1.OwnerReference{}
+	for _, owner := range claim.OwnerReferences {
+		if owner.UID != cr.UID {
+			owners = append(owners, owner)
+		}
+	}
+	if len(owners) == len(claim.OwnerReferences) {
+		return nil
+	}
+	claim.OwnerReferences = owners
+	return r.Update(context.TODO(), claim)
+}
+
+func failPostgresUpgrade(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, db postgresInstance, message string) error {
+	upgrade := (*db.status).Upgrade
+	upgrade.Phase = hyperfoilv1alpha1.PostgresUpgradeFailed
+	upgrade.Message = message
+	upgrade.Completed = &[]metav1.Time{metav1.Now()}[0]
+	recordEvent(r, cr, corev1.EventTypeWarning, "PostgresUpgradeFailed", message)
+	setStatus(r, cr, "Error", db.title+" upgrade to version "+upgrade.To+" failed: "+message)
+	return r.Status().Update(context.TODO(), cr)
+}
+
+// cancelPostgresUpgrade removes the job and the claim that did not receive complete data
+func cancelPostgresUpgrade(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, db postgresInstance, logger logr.Logger, reason string) error {
+	status := *db.status
+	upgrade := status.Upgrade
+	job := &batchv1.Job{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: postgresUpgradeJobName(db), Namespace: cr.Namespace}, job); err == nil {
+		if err := deleteJob(r, cr, job); err != nil {
+			return err
+		}
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+	claim := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: upgrade.PersistentVolumeClaim, Namespace: cr.Namespace}}
+	if err := ensureDeleted(r, cr, claim, &corev1.PersistentVolumeClaim{}); err != nil {
+		return err
+	}
+	logger.Info(db.title + " upgrade to version " + upgrade.To + " was " + reason)
+	recordEvent(r, cr, corev1.EventTypeNormal, "PostgresUpgradeCancelled", db.title+" upgrade to version "+upgrade.To+" was "+reason)
+	status.Upgrade = nil
+	return r.Status().Update(context.TODO(), cr)
+}
+
+// rollbackPostgres switches back to the volume with data of the previous version; data of the newer version
+// are kept unless the upgrade did not complete
+func rollbackPostgres(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, db postgresInstance, logger logr.Logger, image string) error {
+	status := *db.status
+	current := postgresDataClaim(db.spec, status)
+	message := "Rolled back " + db.title + " from version " + status.Version + " to " + status.PreviousVersion +
+		" in claim " + status.PreviousPersistentVolumeClaim
+	if upgrade := status.Upgrade; upgrade != nil && upgrade.Phase != hyperfoilv1alpha1.PostgresUpgradeSucceeded {
+		claim := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: current, Namespace: cr.Namespace}}
+		if err := ensureDeleted(r, cr, claim, &corev1.PersistentVolumeClaim{}); err != nil {
+			return err
+		}
+		status.Upgrade = nil
+	} else {
+		message += "; data of version " + status.Version + " are kept in claim " + current
+	}
+	if status.PreviousPersistentVolumeClaim == db.spec.PersistentVolumeClaim {
+		status.PersistentVolumeClaim = ""
+		status.RequestedPersistentVolumeClaim = ""
+	} else {
+		status.PersistentVolumeClaim = status.PreviousPersistentVolumeClaim
+		status.RequestedPersistentVolumeClaim = db.spec.PersistentVolumeClaim
+	}
+	status.Version = status.PreviousVersion
+	status.Image = image
+	status.PreviousVersion = ""
+	status.PreviousPersistentVolumeClaim = ""
+	logger.Info(message)
+	recordEvent(r, cr, corev1.EventTypeNormal, "PostgresRolledBack", message)
+	return r.Status().Update(context.TODO(), cr)
+}
+
+// Jobs orphan their pods by default
+func deleteJob(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, job *batchv1.Job) error {
+	if err := r.Delete(context.TODO(), job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	recordEvent(r, cr, corev1.EventTypeNormal, "Deleted", "Deleted Job "+job.Name)
+	return nil
+}
@@ -0,0 +1,298 @@
+package horreum
+
+import (
+	"context"
+	"testing"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// upgradeReconciler holds a Horreum with data of PostgreSQL 14 in claim 'data', created by the user, and the running server
+func upgradeReconciler(t *testing.T, image string) (*HorreumReconciler, *hyperfoilv1alpha1.Horreum) {
+	cr := &hyperfoilv1alpha1.Horreum{
+		ObjectMeta: metav1.ObjectMeta{Name: "horreum", Namespace: "test", UID: "1234"},
+		Spec: hyperfoilv1alpha1.HorreumSpec{
+			Postgres: hyperfoilv1alpha1.PostgresSpec{Image: image, PersistentVolumeClaim: "data"},
+		},
+		Status: hyperfoilv1alpha1.HorreumStatus{
+			Postgres: &hyperfoilv1alpha1.PostgresStatus{Version: "14", Image: "docker.io/library/postgres:14.4"},
+		},
+	}
+	data := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: cr.Namespace},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: apiresource.MustParse("10Gi")},
+			},
+		},
+	}
+	r := fakeReconciler(t, cr, data)
+	pod := postgresPod(cr, horreumPostgres(cr), r.Platform)
+	if err := controllerutil.SetControllerReference(cr, pod, r.Scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Create(context.TODO(), pod); err != nil {
+		t.Fatal(err)
+	}
+	return r, cr
+}
+
+func getClaim(t *testing.T, r *HorreumReconciler, name string) *corev1.PersistentVolumeClaim {
+	claim := &corev1.PersistentVolumeClaim{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: "test"}, claim); errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return claim
+}
+
+func getUpgradeJob(t *testing.T, r *HorreumReconciler, db postgresInstance) *batchv1.Job {
+	job := &batchv1.Job{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: postgresUpgradeJobName(db), Namespace: "test"}, job); errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// startUpgrade runs the first step of the upgrade, which stops the server and starts the dump
+func startUpgrade(t *testing.T, r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) *batchv1.Job {
+	if proceed, err := upgradePostgres(r, cr, horreumPostgres(cr), r.Log); proceed || err != nil {
+		t.Fatalf("server must not run while dumping: %v, %v", proceed, err)
+	}
+	upgrade := cr.Status.Postgres.Upgrade
+	if upgrade == nil || upgrade.Phase != hyperfoilv1alpha1.PostgresUpgradeDumping || upgrade.PersistentVolumeClaim != "data-pg16" {
+		t.Fatalf("unexpected upgrade status %v", upgrade)
+	}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "horreum-db", Namespace: "test"}, &corev1.Pod{}); !errors.IsNotFound(err) {
+		t.Errorf("server must be stopped: %v", err)
+	}
+	if claim := getClaim(t, r, "data-pg16"); claim == nil || !metav1.IsControlledBy(claim, cr) {
+		t.Fatal("claim for the new version must be created and owned until the upgrade completes")
+	}
+	job := getUpgradeJob(t, r, horreumPostgres(cr))
+	if job == nil || job.Spec.Template.Spec.Containers[0].Image != "docker.io/library/postgres:14.4" {
+		t.Fatal("dump must run with the previous version")
+	}
+	return job
+}
+
+func TestPostgresUpgrade(t *testing.T) {
+	r, cr := upgradeReconciler(t, "docker.io/library/postgres:16.2")
+	job := startUpgrade(t, r, cr)
+
+	job.Status.Succeeded = 1
+	if err := r.Status().Update(context.TODO(), job); err != nil {
+		t.Fatal(err)
+	}
+	if proceed, err := upgradePostgres(r, cr, horreumPostgres(cr), r.Log); !proceed || err != nil {
+		t.Fatalf("new server must start after the dump: %v, %v", proceed, err)
+	}
+	status := cr.Status.Postgres
+	if status.Upgrade.Phase != hyperfoilv1alpha1.PostgresUpgradeRestoring || status.Version != "16" ||
+		status.PreviousVersion != "14" || status.PreviousPersistentVolumeClaim != "data" {
+		t.Errorf("unexpected status %v, upgrade %v", status, status.Upgrade)
+	}
+	if horreumPostgres(cr).claim != "data-pg16" {
+		t.Errorf("server must switch to the new claim, uses %s", horreumPostgres(cr).claim)
+	}
+	if getUpgradeJob(t, r, horreumPostgres(cr)) != nil {
+		t.Error("completed job must be deleted")
+	}
+
+	if err := completePostgresUpgrade(r, cr, horreumPostgres(cr)); err != nil {
+		t.Fatal(err)
+	}
+	if status.Upgrade.Phase != hyperfoilv1alpha1.PostgresUpgradeSucceeded || status.Upgrade.Completed == nil {
+		t.Errorf("unexpected upgrade status %v", status.Upgrade)
+	}
+	if claim := getClaim(t, r, "data-pg16"); claim == nil || len(claim.OwnerReferences) != 0 {
+		t.Error("upgraded data must outlive the Horreum resource")
+	}
+	if getClaim(t, r, "data") == nil {
+		t.Error("data of the previous version must be kept")
+	}
+}
+
+func TestPostgresUpgradeDumpFailure(t *testing.T) {
+	r, cr := upgradeReconciler(t, "docker.io/library/postgres:16.2")
+	job := startUpgrade(t, r, cr)
+
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Message: "BackoffLimitExceeded"}}
+	if err := r.Status().Update(context.TODO(), job); err != nil {
+		t.Fatal(err)
+	}
+	if proceed, err := upgradePostgres(r, cr, horreumPostgres(cr), r.Log); proceed || err != nil {
+		t.Fatalf("unexpected result %v, %v", proceed, err)
+	}
+	if cr.Status.Postgres.Upgrade.Phase != hyperfoilv1alpha1.PostgresUpgradeFailed || cr.Status.Postgres.Version != "14" {
+		t.Fatalf("unexpected status %v", cr.Status.Postgres.Upgrade)
+	}
+	// Server stays stopped until the user decides
+	if proceed, err := upgradePostgres(r, cr, horreumPostgres(cr), r.Log); proceed || err != nil || cr.Status.Status != "Error" {
+		t.Fatalf("failed upgrade must not proceed: %v, %v", proceed, err)
+	}
+	if getUpgradeJob(t, r, horreumPostgres(cr)) == nil {
+		t.Error("failed job must be kept for its logs")
+	}
+
+	cr.Spec.Postgres.Image = "docker.io/library/postgres:14.4"
+	if proceed, err := upgradePostgres(r, cr, horreumPostgres(cr), r.Log); !proceed || err != nil {
+		t.Fatalf("previous version must start again: %v, %v", proceed, err)
+	}
+	if cr.Status.Postgres.Upgrade != nil || horreumPostgres(cr).claim != "data" {
+		t.Errorf("server must use the original claim: %v", cr.Status.Postgres)
+	}
+	if getClaim(t, r, "data-pg16") != nil || getUpgradeJob(t, r, horreumPostgres(cr)) != nil {
+		t.Error("incomplete data and the job must be removed")
+	}
+	if getClaim(t, r, "data") == nil {
+		t.Error("original data must be kept")
+	}
+}
+
+func TestPostgresUpgradeCancel(t *testing.T) {
+	r, cr := upgradeReconciler(t, "docker.io/library/postgres:16.2")
+	startUpgrade(t, r, cr)
+
+	cr.Spec.Postgres.Image = "docker.io/library/postgres:14.4"
+	if proceed, err := upgradePostgres(r, cr, horreumPostgres(cr), r.Log); !proceed || err != nil {
+		t.Fatalf("previous version must start again: %v, %v", proceed, err)
+	}
+	if cr.Status.Postgres.Upgrade != nil || cr.Status.Postgres.Version != "14" || horreumPostgres(cr).claim != "data" {
+		t.Errorf("unexpected status %v", cr.Status.Postgres)
+	}
+	if getClaim(t, r, "data-pg16") != nil || getUpgradeJob(t, r, horreumPostgres(cr)) != nil {
+		t.Error("incomplete data and the job must be removed")
+	}
+	if getClaim(t, r, "data") == nil {
+		t.Error("original data must be kept")
+	}
+}
+
+func TestDeleteOnlyControlledClaims(t *testing.T) {
+	r, cr := upgradeReconciler(t, "docker.io/library/postgres:14.4")
+	claim := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: cr.Namespace}}
+	if err := ensureDeleted(r, cr, claim, &corev1.PersistentVolumeClaim{}); err != nil {
+		t.Fatal(err)
+	}
+	if getClaim(t, r, "data") == nil {
+		t.Error("claim created by the user must not be deleted")
+	}
+
+	// Rolling back an upgrade that was not completed by an older version of the operator
+	orphan := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data-pg16", Namespace: cr.Namespace}}
+	if err := r.Create(context.TODO(), orphan); err != nil {
+		t.Fatal(err)
+	}
+	status := cr.Status.Postgres
+	status.Version, status.PreviousVersion = "16", "14"
+	status.PersistentVolumeClaim, status.RequestedPersistentVolumeClaim, status.PreviousPersistentVolumeClaim = "data-pg16", "data", "data"
+	status.Upgrade = &hyperfoilv1alpha1.PostgresUpgradeStatus{Phase: hyperfoilv1alpha1.PostgresUpgradeFailed, From: "14", To: "16", PersistentVolumeClaim: "data-pg16"}
+	if proceed, err := upgradePostgres(r, cr, horreumPostgres(cr), r.Log); !proceed || err != nil {
+		t.Fatalf("unexpected result %v, %v", proceed, err)
+	}
+	if horreumPostgres(cr).claim != "data" || getClaim(t, r, "data-pg16") == nil {
+		t.Errorf("claim not controlled by the Horreum resource must be kept, using %s", horreumPostgres(cr).claim)
+	}
+}
+
+func TestKeycloakPostgresUpgrade(t *testing.T) {
+	r, cr := upgradeReconciler(t, "docker.io/library/postgres:14.4")
+	cr.Spec.Keycloak.DatabaseMode = hyperfoilv1alpha1.KeycloakDatabaseDedicated
+	cr.Spec.Keycloak.Postgres = hyperfoilv1alpha1.PostgresSpec{Image: "docker.io/library/postgres:16.2", PersistentVolumeClaim: "keycloak-data"}
+	cr.Status.KeycloakPostgres = &hyperfoilv1alpha1.PostgresStatus{Version: "14", Image: "docker.io/library/postgres:14.4"}
+	data := getClaim(t, r, "data")
+	keycloakData := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "keycloak-data", Namespace: cr.Namespace},
+		Spec:       data.Spec,
+	}
+	if err := r.Create(context.TODO(), keycloakData); err != nil {
+		t.Fatal(err)
+	}
+
+	// The database of Horreum is not affected
+	if proceed, err := upgradePostgres(r, cr, horreumPostgres(cr), r.Log); !proceed || err != nil {
+		t.Fatalf("unexpected result %v, %v", proceed, err)
+	}
+	db := keycloakPostgres(cr)
+	if proceed, err := upgradePostgres(r, cr, db, r.Log); proceed || err != nil {
+		t.Fatalf("server must not run while dumping: %v, %v", proceed, err)
+	}
+	if cr.Status.Postgres.Upgrade != nil {
+		t.Errorf("unexpected upgrade of Horreum database %v", cr.Status.Postgres.Upgrade)
+	}
+	upgrade := cr.Status.KeycloakPostgres.Upgrade
+	if upgrade == nil || upgrade.Phase != hyperfoilv1alpha1.PostgresUpgradeDumping || upgrade.PersistentVolumeClaim != "keycloak-data-pg16" {
+		t.Fatalf("unexpected upgrade status %v", upgrade)
+	}
+	if getClaim(t, r, "keycloak-data-pg16") == nil {
+		t.Fatal("claim for the new version must be created")
+	}
+	job := getUpgradeJob(t, r, db)
+	if job == nil || job.Name != "horreum-keycloak-db-upgrade" || job.Labels["service"] != "keycloak-db-upgrade" {
+		t.Fatalf("unexpected job %v", job)
+	}
+	spec := job.Spec.Template.Spec
+	if claim := spec.Volumes[0].PersistentVolumeClaim.ClaimName; claim != "keycloak-data" {
+		t.Errorf("dump must read the Keycloak data, reads %s", claim)
+	}
+	if env := spec.Containers[0].Env; len(env) != 1 || env[0].ValueFrom.SecretKeyRef.Name != "horreum-keycloak-db-admin" {
+		t.Errorf("dump must connect as the Keycloak database admin: %v", env)
+	}
+
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Message: "BackoffLimitExceeded"}}
+	if err := r.Status().Update(context.TODO(), job); err != nil {
+		t.Fatal(err)
+	}
+	if proceed, err := upgradePostgres(r, cr, db, r.Log); proceed || err != nil {
+		t.Fatalf("unexpected result %v, %v", proceed, err)
+	}
+	if proceed, err := upgradePostgres(r, cr, db, r.Log); proceed || err != nil ||
+		cr.Status.Reason != "Keycloak PostgreSQL upgrade to version 16 failed: Dumping the data failed (BackoffLimitExceeded), "+
+			"see logs of job horreum-keycloak-db-upgrade; set spec.keycloak.postgres.image back to version 14 to roll back" {
+		t.Fatalf("failed upgrade must not proceed: %v, %v, %s", proceed, err, cr.Status.Reason)
+	}
+
+	// Rolling back removes the failed job and the incomplete claim so that the upgrade can start again
+	cr.Spec.Keycloak.Postgres.Image = "docker.io/library/postgres:14.4"
+	if proceed, err := upgradePostgres(r, cr, db, r.Log); !proceed || err != nil {
+		t.Fatalf("previous version must start again: %v, %v", proceed, err)
+	}
+	cr.Spec.Keycloak.Postgres.Image = "docker.io/library/postgres:16.2"
+	if proceed, err := upgradePostgres(r, cr, db, r.Log); proceed || err != nil {
+		t.Fatalf("server must not run while dumping: %v, %v", proceed, err)
+	}
+	job = getUpgradeJob(t, r, db)
+	job.Status.Succeeded = 1
+	if err := r.Status().Update(context.TODO(), job); err != nil {
+		t.Fatal(err)
+	}
+	if proceed, err := upgradePostgres(r, cr, db, r.Log); !proceed || err != nil {
+		t.Fatalf("new server must start after the dump: %v, %v", proceed, err)
+	}
+	if claim := keycloakPostgres(cr).claim; claim != "keycloak-data-pg16" {
+		t.Errorf("server must switch to the new claim, uses %s", claim)
+	}
+	if err := completePostgresUpgrade(r, cr, db); err != nil {
+		t.Fatal(err)
+	}
+	status := cr.Status.KeycloakPostgres
+	if status.Version != "16" || status.Upgrade.Phase != hyperfoilv1alpha1.PostgresUpgradeSucceeded ||
+		status.PreviousPersistentVolumeClaim != "keycloak-data" {
+		t.Errorf("unexpected status %v, upgrade %v", status, status.Upgrade)
+	}
+	if cr.Status.Postgres.Version != "14" || horreumPostgres(cr).claim != "data" {
+		t.Errorf("Horreum database must stay intact: %v", cr.Status.Postgres)
+	}
+}
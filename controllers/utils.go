@@ -2,11 +2,14 @@ package horreum
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"log"
-	"math/rand"
+	"math/big"
 	"strconv"
-	"time"
+	"strings"
 
 	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
 	routev1 "github.com/openshift/api/route/v1"
@@ -37,29 +40,74 @@ func withDefaultInt(custom int32, def int32) string {
 	return strconv.Itoa(int(custom))
 }
 
-func newSecret(cr *hyperfoilv1alpha1.Horreum, name string) *corev1.Secret {
+func newSecret(cr *hyperfoilv1alpha1.Horreum, name string, policy hyperfoilv1alpha1.PasswordPolicy) (*corev1.Secret, error) {
+	password, err := generatePassword(policy)
+	if err != nil {
+		return nil, err
+	}
 	return &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: cr.Namespace,
+			Annotations: map[string]string{
+				passwordGeneratorAnnotation: passwordGenerator,
+			},
 		},
 		Type: corev1.SecretTypeBasicAuth,
 		StringData: map[string]string{
 			corev1.BasicAuthUsernameKey: name,
-			corev1.BasicAuthPasswordKey: generatePassword(),
+			corev1.BasicAuthPasswordKey: password,
 		},
+	}, nil
+}
+
+// Only symbols that need no escaping in shell scripts, URLs and connection strings
+var characterClasses = map[hyperfoilv1alpha1.CharacterClass]string{
+	hyperfoilv1alpha1.CharacterClassLowercase: "abcdefghijklmnopqrstuvwxyz",
+	hyperfoilv1alpha1.CharacterClassUppercase: "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	hyperfoilv1alpha1.CharacterClassDigits:    "0123456789",
+	hyperfoilv1alpha1.CharacterClassSymbols:   "-_.!@",
+}
+
+func generatePassword(policy hyperfoilv1alpha1.PasswordPolicy) (string, error) {
+	chars := ""
+	for _, class := range policy.CharacterClasses {
+		set, ok := characterClasses[class]
+		if !ok {
+			return "", errors.New("unknown character class " + string(class))
+		}
+		chars += set
+	}
+	if chars == "" || int(policy.Length) < len(policy.CharacterClasses) {
+		return "", fmt.Errorf("cannot generate password of length %d from %v", policy.Length, policy.CharacterClasses)
+	}
+	buf := make([]byte, policy.Length)
+	for {
+		for i := range buf {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+			if err != nil {
+				return "", err
+			}
+			buf[i] = chars[n.Int64()]
+		}
+		// Rejecting passwords that miss a class keeps the distribution uniform
+		complete := true
+		for _, class := range policy.CharacterClasses {
+			complete = complete && strings.ContainsAny(string(buf), characterClasses[class])
+		}
+		if complete {
+			return string(buf), nil
+		}
 	}
 }
 
-func generatePassword() string {
-	rand.Seed(time.Now().UnixNano())
-	chars := []rune("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789")
-	length := 16
-	buf := make([]rune, length)
-	for i := range buf {
-		buf[i] = chars[rand.Intn(len(chars))]
+// generateKey returns base64-encoded random key of given size in bytes
+func generateKey(size int) (string, error) {
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
 	}
-	return string(buf)
+	return base64.RawURLEncoding.EncodeToString(key), nil
 }
 
 func secretEnv(name string, secret string, key string) corev1.EnvVar {
@@ -77,8 +125,65 @@ func secretEnv(name string, secret string, key string) corev1.EnvVar {
 	}
 }
 
-func tls(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, route hyperfoilv1alpha1.RouteSpec) (*routev1.TLSConfig, error) {
-	switch cr.Spec.Route.Type {
+// restrictedPodSecurityContext satisfies the pod-level requirements of the 'restricted' Pod Security Standard
+func restrictedPodSecurityContext() *corev1.PodSecurityContext {
+	return &corev1.PodSecurityContext{
+		RunAsNonRoot: &[]bool{true}[0],
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+}
+
+// restrictedSecurityContext satisfies the container-level requirements of the 'restricted' Pod Security Standard.
+// Read-only root filesystem is not required by the standard; images that write outside of mounted volumes can't use it.
+func restrictedSecurityContext(readOnlyRootFilesystem bool) *corev1.SecurityContext {
+	return &corev1.SecurityContext{
+		AllowPrivilegeEscalation: &[]bool{false}[0],
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+		ReadOnlyRootFilesystem: &readOnlyRootFilesystem,
+	}
+}
+
+// dbCAVolume returns volume and mount with the CA certificate of an external database, if configured
+func dbCAVolume(db *hyperfoilv1alpha1.DatabaseSpec) ([]corev1.Volume, []corev1.VolumeMount) {
+	if db.CASecret == "" {
+		return nil, nil
+	}
+	return []corev1.Volume{
+		{
+			Name: "db-ca",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: db.CASecret,
+				},
+			},
+		},
+	}, []corev1.VolumeMount{
+		{
+			Name:      "db-ca",
+			MountPath: dbCAMountPath,
+		},
+	}
+}
+
+// routeTLSSecret fetches the secret with certificates for edge and reencrypt routes
+func routeTLSSecret(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, route hyperfoilv1alpha1.RouteSpec) (*corev1.Secret, error) {
+	if !r.RoutesAvailable || route.TLS == "" || route.Type == "http" || route.Type == "passthrough" {
+		return nil, nil
+	}
+	tlsSecret := &corev1.Secret{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: route.TLS, Namespace: cr.Namespace}, tlsSecret); err != nil {
+		updateStatus(r, cr, "Error", "Cannot find secret "+route.TLS)
+		return nil, err
+	}
+	return tlsSecret, nil
+}
+
+func tls(route hyperfoilv1alpha1.RouteSpec, tlsSecret *corev1.Secret) (*routev1.TLSConfig, error) {
+	switch route.Type {
 	case "http":
 		return nil, nil
 	// passthrough route must not set certs
@@ -88,26 +193,25 @@ func tls(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, route hyperfoilv1a
 			InsecureEdgeTerminationPolicy: routev1.InsecureEdgeTerminationPolicyRedirect,
 		}, nil
 	}
-	tlsSecret := corev1.Secret{}
-	if cr.Spec.Route.TLS != "" {
-		if error := r.Get(context.TODO(), types.NamespacedName{Name: cr.Spec.Route.TLS, Namespace: cr.Namespace}, &tlsSecret); error != nil {
-			updateStatus(r, cr, "Error", "Cannot find secret "+route.TLS)
-			return nil, error
+	if tlsSecret == nil {
+		if route.TLS != "" {
+			return nil, errors.New("Secret " + route.TLS + " was not provided")
 		}
+		tlsSecret = &corev1.Secret{}
 	}
 	cacert := ""
 	if bytes, ok := tlsSecret.Data["ca.crt"]; ok {
 		cacert = string(bytes)
 	}
 	var termination routev1.TLSTerminationType
-	switch cr.Spec.Route.Type {
+	switch route.Type {
 	case "edge":
 		termination = routev1.TLSTerminationEdge
 	case "reencrypt", "":
 		termination = routev1.TLSTerminationReencrypt
 	default:
-		log.Println("Invalid route type: " + cr.Spec.Route.Type)
-		return nil, errors.New("Invalid route type: " + cr.Spec.Route.Type)
+		log.Println("Invalid route type: " + route.Type)
+		return nil, errors.New("Invalid route type: " + route.Type)
 	}
 	return &routev1.TLSConfig{
 		Termination:                   termination,
@@ -118,15 +222,15 @@ func tls(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, route hyperfoilv1a
 	}, nil
 }
 
-func route(route hyperfoilv1alpha1.RouteSpec, suffix string, cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) (*routev1.Route, error) {
-	if !r.RoutesAvailable {
+func route(route hyperfoilv1alpha1.RouteSpec, suffix string, cr *hyperfoilv1alpha1.Horreum, p Platform, tlsSecret *corev1.Secret) (*routev1.Route, error) {
+	if !p.RoutesAvailable {
 		return nil, nil
 	}
 	subdomain := ""
 	if route.Host == "" {
 		subdomain = cr.Name + suffix
 	}
-	tls, err := tls(r, cr, route)
+	tls, err := tls(route, tlsSecret)
 	if err != nil {
 		return nil, err
 	}
@@ -175,10 +279,12 @@ func servicePort(route hyperfoilv1alpha1.RouteSpec, httpPort int32, httpsPort in
 	}
 }
 
-func serviceType(svcType corev1.ServiceType, r *HorreumReconciler) corev1.ServiceType {
+func serviceType(svcType corev1.ServiceType, p Platform) corev1.ServiceType {
 	if svcType != "" {
 		return svcType
-	} else if r.RoutesAvailable {
+	} else if p.ServiceType != "" {
+		return p.ServiceType
+	} else if p.RoutesAvailable {
 		return corev1.ServiceTypeClusterIP
 	} else {
 		return corev1.ServiceTypeNodePort
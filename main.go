@@ -18,7 +18,9 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"strings"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -29,10 +31,12 @@ import (
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	hyperfoiliov1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	hyperfoiliov1beta1 "github.com/Hyperfoil/horreum-operator/api/v1beta1"
 	horreum "github.com/Hyperfoil/horreum-operator/controllers"
 	routev1 "github.com/openshift/api/route/v1"
 	//+kubebuilder:scaffold:imports
@@ -47,19 +51,33 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(hyperfoiliov1alpha1.AddToScheme(scheme))
+	utilruntime.Must(hyperfoiliov1beta1.AddToScheme(scheme))
 	utilruntime.Must(routev1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		if err := render(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var watchNamespaces string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", os.Getenv("WATCH_NAMESPACE"),
+		"Comma-separated list of namespaces the operator watches. Empty value means all namespaces. "+
+			"Defaults to the value of WATCH_NAMESPACE environment variable.")
+	platformFlags := bindPlatformFlags(flag.CommandLine)
 	opts := zap.Options{
 		Development: true,
 	}
@@ -68,14 +86,26 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	options := ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "ac631cda.hyperfoil.io",
-	})
+	}
+	namespaces := parseNamespaces(watchNamespaces)
+	if len(namespaces) == 1 {
+		setupLog.Info("Watching single namespace", "namespace", namespaces[0])
+		options.Namespace = namespaces[0]
+	} else if len(namespaces) > 1 {
+		setupLog.Info("Watching multiple namespaces", "namespaces", namespaces)
+		options.NewCache = cache.MultiNamespacedCacheBuilder(namespaces)
+	} else {
+		setupLog.Info("Watching all namespaces")
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
@@ -105,16 +135,31 @@ func main() {
 		setupLog.Error(err, "Cannot retrieve kubeconfig")
 	}
 
+	platform, err := platformFlags.platform(routesAvailable)
+	if err != nil {
+		setupLog.Error(err, "invalid operator configuration")
+		os.Exit(1)
+	}
+	// Set through downward API in the operator deployment
+	platform.OperatorNamespace = os.Getenv("POD_NAMESPACE")
+
 	if err = (&horreum.HorreumReconciler{
-		Client:          mgr.GetClient(),
-		Scheme:          mgr.GetScheme(),
-		Log:             ctrl.Log.WithName("controllers").WithName("Horreum"),
-		RoutesAvailable: routesAvailable,
-		UseRedHatImages: routesAvailable,
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Log:      ctrl.Log.WithName("controllers").WithName("Horreum"),
+		Recorder: mgr.GetEventRecorderFor("horreum-controller"),
+		Platform: platform,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Horreum")
 		os.Exit(1)
 	}
+	// Conversion between v1alpha1 and v1beta1; disable when running locally without certificates
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = ctrl.NewWebhookManagedBy(mgr).For(&hyperfoiliov1alpha1.Horreum{}).Complete(); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Horreum")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -132,3 +177,14 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// parseNamespaces splits the comma-separated list, ignoring whitespace and empty entries
+func parseNamespaces(value string) []string {
+	namespaces := []string{}
+	for _, ns := range strings.Split(value, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces
+}
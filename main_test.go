@@ -0,0 +1,20 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNamespaces(t *testing.T) {
+	for value, expected := range map[string][]string{
+		"":                      {},
+		" , ":                   {},
+		"horreum":               {"horreum"},
+		"horreum,perf":          {"horreum", "perf"},
+		" horreum , perf ,,ci ": {"horreum", "perf", "ci"},
+	} {
+		if actual := parseNamespaces(value); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("parseNamespaces(%q): expected %v, got %v", value, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package keycloak implements the small subset of Keycloak admin REST API the operator needs.
+package keycloak
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client talks to a Keycloak instance; call Login before any other method.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	token      string
+}
+
+// ErrExists is wrapped by errors of requests creating an object that already exists
+var ErrExists = errors.New("already exists")
+
+// User is a Keycloak user representation, reduced to fields we use
+type User struct {
+	ID          string       `json:"id,omitempty"`
+	Username    string       `json:"username"`
+	Email       string       `json:"email,omitempty"`
+	Enabled     bool         `json:"enabled"`
+	Credentials []Credential `json:"credentials,omitempty"`
+}
+
+// Credential is a password set when the user is created
+type Credential struct {
+	Type      string `json:"type"`
+	Value     string `json:"value"`
+	Temporary bool   `json:"temporary"`
+}
+
+// Role is a realm role representation
+type Role struct {
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// NewClient creates a client for Keycloak at baseURL (without the realm path). When caCert
+// is empty the system trust store is used to verify the server.
+func NewClient(baseURL string, caCert []byte) (*Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(caCert) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("cannot parse CA certificate")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   30 * time.Second,
+		},
+	}, nil
+}
+
+// Login obtains an access token for the user in given realm using the admin-cli client.
+func (c *Client) Login(ctx context.Context, realm, username, password string) error {
+	form := url.Values{
+		"grant_type": {"password"},
+		"client_id":  {"admin-cli"},
+		"username":   {username},
+		"password":   {password},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		c.baseURL+"/realms/"+url.PathEscape(realm)+"/protocol/openid-connect/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := c.do(req, &token); err != nil {
+		return fmt.Errorf("cannot log in to realm %s as %s: %w", realm, username, err)
+	}
+	c.token = token.AccessToken
+	return nil
+}
+
+// FindUser returns the ID of user with exactly matching username.
+func (c *Client) FindUser(ctx context.Context, realm, username string) (string, error) {
+	var users []User
+	path := "/admin/realms/" + url.PathEscape(realm) + "/users?exact=true&username=" + url.QueryEscape(username)
+	if err := c.call(ctx, http.MethodGet, path, nil, &users); err != nil {
+		return "", err
+	}
+	for _, user := range users {
+		if user.Username == username {
+			return user.ID, nil
+		}
+	}
+	return "", fmt.Errorf("user %s not found in realm %s", username, realm)
+}
+
+// ResetPassword sets permanent password for the user.
+func (c *Client) ResetPassword(ctx context.Context, realm, userID, password string) error {
+	credential := map[string]interface{}{
+		"type":      "password",
+		"value":     password,
+		"temporary": false,
+	}
+	return c.call(ctx, http.MethodPut, "/admin/realms/"+url.PathEscape(realm)+"/users/"+url.PathEscape(userID)+"/reset-password", credential, nil)
+}
+
+// CreateRole creates a realm role; the error wraps ErrExists when the role is already present.
+func (c *Client) CreateRole(ctx context.Context, realm string, role Role) error {
+	return c.call(ctx, http.MethodPost, "/admin/realms/"+url.PathEscape(realm)+"/roles", role, nil)
+}
+
+// GetRole fetches realm role by its name.
+func (c *Client) GetRole(ctx context.Context, realm, name string) (Role, error) {
+	var role Role
+	err := c.call(ctx, http.MethodGet, "/admin/realms/"+url.PathEscape(realm)+"/roles/"+url.PathEscape(name), nil, &role)
+	return role, err
+}
+
+// CreateUser creates the user and returns its ID; the error wraps ErrExists when the username is taken.
+func (c *Client) CreateUser(ctx context.Context, realm string, user User) (string, error) {
+	if err := c.call(ctx, http.MethodPost, "/admin/realms/"+url.PathEscape(realm)+"/users", user, nil); err != nil {
+		return "", err
+	}
+	return c.FindUser(ctx, realm, user.Username)
+}
+
+// AddRealmRoles assigns realm roles to the user.
+func (c *Client) AddRealmRoles(ctx context.Context, realm, userID string, roles []Role) error {
+	return c.call(ctx, http.MethodPost, "/admin/realms/"+url.PathEscape(realm)+"/users/"+url.PathEscape(userID)+"/role-mappings/realm", roles, nil)
+}
+
+func (c *Client) call(ctx context.Context, method, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	return c.do(req, out)
+}
+
+func (c *Client) do(req *http.Request, out interface{}) error {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusConflict {
+			return fmt.Errorf("%s %s: %w", req.Method, req.URL.Path, ErrExists)
+		}
+		return fmt.Errorf("%s %s returned %s: %s", req.Method, req.URL.Path, resp.Status, string(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+
+	horreum "github.com/Hyperfoil/horreum-operator/controllers"
+)
+
+// platformFlags hold operator-wide defaults for the resources created for Horreum instances
+type platformFlags struct {
+	images         horreum.Images
+	pullPolicy     string
+	registryMirror string
+	serviceType    string
+	redHatImages   string
+}
+
+func bindPlatformFlags(fs *flag.FlagSet) *platformFlags {
+	f := &platformFlags{}
+	// OLM pins images by digest through RELATED_IMAGE_* variables on the operator deployment
+	fs.StringVar(&f.images.App, "app-image", envOrDefault("RELATED_IMAGE_HORREUM", horreum.DefaultAppImage),
+		"Default Horreum image; defaults to RELATED_IMAGE_HORREUM environment variable.")
+	fs.StringVar(&f.images.Keycloak, "keycloak-image", envOrDefault("RELATED_IMAGE_KEYCLOAK", horreum.DefaultKeycloakImage),
+		"Default Keycloak image; defaults to RELATED_IMAGE_KEYCLOAK environment variable.")
+	fs.StringVar(&f.images.Postgres, "postgres-image", envOrDefault("RELATED_IMAGE_POSTGRES", horreum.DefaultPostgresImage),
+		"Default community PostgreSQL image; defaults to RELATED_IMAGE_POSTGRES environment variable.")
+	fs.StringVar(&f.images.PostgresRedHat, "postgres-redhat-image", envOrDefault("RELATED_IMAGE_POSTGRES_REDHAT", horreum.DefaultPostgresRedHatImage),
+		"Default Red Hat PostgreSQL image; defaults to RELATED_IMAGE_POSTGRES_REDHAT environment variable.")
+	fs.StringVar(&f.images.SecretsSync, "secrets-sync-image", envOrDefault("RELATED_IMAGE_SECRETS_SYNC", horreum.DefaultSecretsSyncImage),
+		"Image of the pod mounting Secrets Store CSI volumes; defaults to RELATED_IMAGE_SECRETS_SYNC environment variable.")
+	fs.StringVar(&f.images.PgBouncer, "pgbouncer-image", envOrDefault("RELATED_IMAGE_PGBOUNCER", horreum.DefaultPgBouncerImage),
+		"Default PgBouncer image; defaults to RELATED_IMAGE_PGBOUNCER environment variable.")
+	fs.StringVar(&f.images.WalG, "wal-g-image", envOrDefault("RELATED_IMAGE_WAL_G", ""),
+		"Image with WAL-G used for PostgreSQL backups, required when backups are enabled; defaults to RELATED_IMAGE_WAL_G environment variable.")
+	fs.StringVar(&f.pullPolicy, "image-pull-policy", "",
+		"Pull policy of the containers: Always, IfNotPresent or Never. Kubernetes chooses the policy by default.")
+	fs.StringVar(&f.registryMirror, "registry-mirror", "",
+		"Registry (with optional path prefix) that replaces the registry of default images, e.g. mirror.example.com:5000.")
+	fs.StringVar(&f.serviceType, "service-type", "",
+		"Default type of services: ClusterIP, NodePort or LoadBalancer. Defaults to ClusterIP on OpenShift and NodePort otherwise.")
+	fs.StringVar(&f.redHatImages, "redhat-images", "auto",
+		"Use the Red Hat PostgreSQL image: true, false or auto (when running on OpenShift).")
+	return f
+}
+
+func envOrDefault(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+func (f *platformFlags) platform(routesAvailable bool) (horreum.Platform, error) {
+	p := horreum.Platform{
+		RoutesAvailable: routesAvailable,
+		Images:          f.images,
+		PullPolicy:      corev1.PullPolicy(f.pullPolicy),
+		RegistryMirror:  f.registryMirror,
+		ServiceType:     corev1.ServiceType(f.serviceType),
+	}
+	switch p.PullPolicy {
+	case "", corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		return p, fmt.Errorf("invalid image pull policy %s", f.pullPolicy)
+	}
+	switch p.ServiceType {
+	case "", corev1.ServiceTypeClusterIP, corev1.ServiceTypeNodePort, corev1.ServiceTypeLoadBalancer:
+	default:
+		return p, fmt.Errorf("invalid service type %s", f.serviceType)
+	}
+	if f.redHatImages == "auto" {
+		p.UseRedHatImages = routesAvailable
+	} else if use, err := strconv.ParseBool(f.redHatImages); err != nil {
+		return p, fmt.Errorf("invalid value of --redhat-images: %s", f.redHatImages)
+	} else {
+		p.UseRedHatImages = use
+	}
+	return p, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestPlatformFlags(t *testing.T) {
+	for _, tc := range []struct {
+		args            []string
+		routesAvailable bool
+		valid           bool
+		redHatImages    bool
+		serviceType     corev1.ServiceType
+	}{
+		{args: nil, valid: true},
+		{args: nil, routesAvailable: true, valid: true, redHatImages: true},
+		{args: []string{"--redhat-images=false"}, routesAvailable: true, valid: true},
+		{args: []string{"--redhat-images=true"}, valid: true, redHatImages: true},
+		{args: []string{"--redhat-images=sometimes"}},
+		{args: []string{"--image-pull-policy=IfNotPresent", "--service-type=LoadBalancer"}, valid: true, serviceType: corev1.ServiceTypeLoadBalancer},
+		{args: []string{"--image-pull-policy=ifnotpresent"}},
+		{args: []string{"--service-type=ExternalName"}},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		f := bindPlatformFlags(fs)
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatal(err)
+		}
+		p, err := f.platform(tc.routesAvailable)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("%v must be rejected", tc.args)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%v: %s", tc.args, err)
+			continue
+		}
+		if p.UseRedHatImages != tc.redHatImages {
+			t.Errorf("%v with routes %v: expected Red Hat images %v", tc.args, tc.routesAvailable, tc.redHatImages)
+		}
+		if p.ServiceType != tc.serviceType {
+			t.Errorf("%v: unexpected service type %s", tc.args, p.ServiceType)
+		}
+	}
+}
+
+func TestPlatformFlagsImages(t *testing.T) {
+	t.Setenv("RELATED_IMAGE_WAL_G", "")
+	t.Setenv("RELATED_IMAGE_POSTGRES", "registry.example.com:5000/library/postgres@sha256:0123456789abcdef")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := bindPlatformFlags(fs)
+	if err := fs.Parse([]string{"--registry-mirror=mirror.example.com:5000", "--app-image=horreum:dev"}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := f.platform(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Images.Postgres != "registry.example.com:5000/library/postgres@sha256:0123456789abcdef" {
+		t.Errorf("image must be taken from the environment: %s", p.Images.Postgres)
+	}
+	if p.Images.App != "horreum:dev" || p.RegistryMirror != "mirror.example.com:5000" {
+		t.Errorf("flags must override the defaults: %+v", p)
+	}
+	if p.Images.WalG != "" {
+		t.Errorf("WAL-G image has no default: %s", p.Images.WalG)
+	}
+}
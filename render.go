@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/yaml"
+
+	hyperfoiliov1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	hyperfoiliov1beta1 "github.com/Hyperfoil/horreum-operator/api/v1beta1"
+	horreum "github.com/Hyperfoil/horreum-operator/controllers"
+)
+
+// render prints manifests the operator would create for a Horreum resource, without a cluster
+func render(args []string) error {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	file := flags.String("f", "", "File with the Horreum resource and optionally Secrets with route certificates; '-' reads standard input.")
+	routes := flags.Bool("openshift", false, "Render for OpenShift: expose services through Routes and use the service CA.")
+	keycloakUrl := flags.String("keycloak-url", "", "Public URL of Keycloak; defaults to the external URI, route host or status of the resource.")
+	appUrl := flags.String("app-url", "", "Public URL of Horreum; defaults to the route host or status of the resource.")
+	operatorNamespace := flags.String("operator-namespace", "", "Namespace of the operator, used in network policies.")
+	platformFlags := bindPlatformFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s render -f horreum.yaml [--keycloak-url URL] [--app-url URL] [flags]\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "The URLs are required when the resource does not set route hosts, e.g. with NodePort services,")
+		fmt.Fprintln(flags.Output(), "as the node port or route host is assigned only when the services or routes are created.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *file == "" {
+		flags.Usage()
+		return errors.New("missing -f")
+	}
+	platform, err := platformFlags.platform(*routes)
+	if err != nil {
+		return err
+	}
+	platform.OperatorNamespace = *operatorNamespace
+
+	var in io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	cr, tlsSecrets, err := readRenderInput(in)
+	if err != nil {
+		return err
+	}
+	if cr.Namespace == "" {
+		cr.Namespace = "default"
+	}
+	objects, err := horreum.Render(cr, platform, *keycloakUrl, *appUrl, tlsSecrets)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if obj.GetObjectKind().GroupVersionKind().Empty() {
+			gvk, err := apiutil.GVKForObject(obj, scheme)
+			if err != nil {
+				return err
+			}
+			obj.GetObjectKind().SetGroupVersionKind(gvk)
+		}
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("---\n%s", data)
+	}
+	return nil
+}
+
+func readRenderInput(in io.Reader) (*hyperfoiliov1alpha1.Horreum, map[string]*corev1.Secret, error) {
+	var cr *hyperfoiliov1alpha1.Horreum
+	secrets := map[string]*corev1.Secret{}
+	decoder := utilyaml.NewYAMLOrJSONDecoder(in, 4096)
+	for {
+		doc := &unstructured.Unstructured{}
+		if err := decoder.Decode(&doc.Object); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if len(doc.Object) == 0 {
+			continue
+		}
+		switch doc.GetObjectKind().GroupVersionKind() {
+		case hyperfoiliov1alpha1.GroupVersion.WithKind("Horreum"):
+			if cr != nil {
+				return nil, nil, errors.New("input contains more than one Horreum resource")
+			}
+			cr = &hyperfoiliov1alpha1.Horreum{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(doc.Object, cr); err != nil {
+				return nil, nil, err
+			}
+		case hyperfoiliov1beta1.GroupVersion.WithKind("Horreum"):
+			if cr != nil {
+				return nil, nil, errors.New("input contains more than one Horreum resource")
+			}
+			spoke := &hyperfoiliov1beta1.Horreum{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(doc.Object, spoke); err != nil {
+				return nil, nil, err
+			}
+			cr = &hyperfoiliov1alpha1.Horreum{}
+			if err := spoke.ConvertTo(cr); err != nil {
+				return nil, nil, err
+			}
+		case corev1.SchemeGroupVersion.WithKind("Secret"):
+			secret := &corev1.Secret{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(doc.Object, secret); err != nil {
+				return nil, nil, err
+			}
+			// API server would merge stringData into data
+			if secret.Data == nil {
+				secret.Data = map[string][]byte{}
+			}
+			for k, v := range secret.StringData {
+				secret.Data[k] = []byte(v)
+			}
+			secrets[secret.Name] = secret
+		default:
+			return nil, nil, fmt.Errorf("unexpected %s %s in input", doc.GetKind(), doc.GetName())
+		}
+	}
+	if cr == nil {
+		return nil, nil, errors.New("input does not contain a Horreum resource")
+	}
+	return cr, secrets, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"testing"
+
+	horreum "github.com/Hyperfoil/horreum-operator/controllers"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+func TestRenderSamples(t *testing.T) {
+	for _, tc := range []struct {
+		file      string
+		openshift bool
+		kinds     string
+	}{
+		{
+			file:  "config/samples/_v1alpha1_horreum.yaml",
+			kinds: "ConfigMap Pod Service Service Service Deployment Service Pod ConfigMap",
+		},
+		{
+			file:      "config/samples/_v1alpha1_horreum.yaml",
+			openshift: true,
+			kinds:     "ConfigMap ConfigMap Pod Service Service Route Service Deployment Service Route Pod ConfigMap",
+		},
+		{
+			file:  "config/samples/_v1beta1_horreum.yaml",
+			kinds: "ConfigMap Pod Service Service Service Deployment Service Pod ConfigMap",
+		},
+		{
+			file:      "config/samples/_v1beta1_horreum.yaml",
+			openshift: true,
+			kinds:     "ConfigMap ConfigMap Pod Service Service Service Deployment Service Pod ConfigMap",
+		},
+	} {
+		f, err := os.Open(tc.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cr, tlsSecrets, err := readRenderInput(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", tc.file, err)
+		}
+		cr.Namespace = "default"
+		platform, err := bindPlatformFlags(flag.NewFlagSet("test", flag.ContinueOnError)).platform(tc.openshift)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Node ports and route hosts are assigned by the cluster
+		if _, err := horreum.Render(cr.DeepCopy(), platform, "", "", tlsSecrets); err == nil ||
+			!strings.Contains(err.Error(), "--keycloak-url") {
+			t.Errorf("%s with OpenShift %v: expected error asking for Keycloak URL, got %v", tc.file, tc.openshift, err)
+		}
+		objects, err := horreum.Render(cr, platform, "https://127.0.0.1:30443", "https://127.0.0.1:30080", tlsSecrets)
+		if err != nil {
+			t.Errorf("%s with OpenShift %v: %s", tc.file, tc.openshift, err)
+			continue
+		}
+		kinds := []string{}
+		for _, obj := range objects {
+			gvk, err := apiutil.GVKForObject(obj, scheme)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kinds = append(kinds, gvk.Kind)
+		}
+		if strings.Join(kinds, " ") != tc.kinds {
+			t.Errorf("%s with OpenShift %v: unexpected kinds %s", tc.file, tc.openshift, strings.Join(kinds, " "))
+		}
+	}
+}